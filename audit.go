@@ -0,0 +1,254 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os/user"
+	"strconv"
+	"time"
+)
+
+// Audit actions.
+const (
+	AuditCreate = "create"
+	AuditUpdate = "update"
+	AuditDelete = "delete"
+)
+
+// AuditEntry records who changed a book, from where and how.
+type AuditEntry struct {
+	ID        uint            `gorm:"column:id;primary_key" json:"id"`
+	Time      time.Time       `gorm:"column:time" json:"time"`
+	Actor     string          `gorm:"column:actor" json:"actor"`
+	IP        string          `gorm:"column:ip" json:"ip"`
+	RequestID string          `gorm:"column:request_id" json:"request_id"`
+	Action    string          `gorm:"column:action" json:"action"`
+	BookID    uint            `gorm:"column:book_id" json:"book_id"`
+	Before    json.RawMessage `gorm:"column:before_json" json:"before,omitempty"`
+	After     json.RawMessage `gorm:"column:after_json" json:"after,omitempty"`
+}
+
+// TableName tells gorm where audit entries live.
+func (AuditEntry) TableName() string {
+	return "audit_log"
+}
+
+// AuditFilter selects audit entries. Zero fields match everything.
+type AuditFilter struct {
+	Actor  string
+	Action string
+	BookID uint
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+}
+
+// match reports whether e is selected by f, ignoring f.Limit.
+func (f AuditFilter) match(e *AuditEntry) bool {
+	return (f.Actor == "" || e.Actor == f.Actor) &&
+		(f.Action == "" || e.Action == f.Action) &&
+		(f.BookID == 0 || e.BookID == f.BookID) &&
+		(f.Since.IsZero() || !e.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || e.Time.Before(f.Until))
+}
+
+// AuditLog is an append-only record of catalog mutations.
+type AuditLog interface {
+	// AppendAudit adds an entry, assigning it a new ID.
+	AppendAudit(e *AuditEntry) error
+
+	// ListAudit returns the entries selected by f, newest first.
+	ListAudit(f AuditFilter) ([]*AuditEntry, error)
+}
+
+// audit records that the user behind r applied action to a book. before and
+// after are snapshots of the book, either may be nil. The change is saved
+// by then, so a failure to record it does not fail the request: it is
+// logged, together with the entry, to be added to the audit log by hand.
+func (b *Bookshelf) audit(r *http.Request, action string, bookID uint, before, after *Book) {
+	e := &AuditEntry{
+		Actor:     actorOf(r),
+		IP:        b.clientIP(r),
+		RequestID: requestID(r),
+		Action:    action,
+		BookID:    bookID,
+	}
+	if err := b.appendAudit(e, before, after); err != nil {
+		entry, _ := json.Marshal(e)
+		fmt.Fprintf(b.logWriter, "AUDIT LOG WRITE FAILED, %s of book %d is not recorded: %v; entry: %s\n", action, bookID, err, entry)
+	}
+}
+
+// auditCLI records a change made through a subcommand, see cli.go.
+func (b *Bookshelf) auditCLI(action string, bookID uint, before, after *Book) error {
+	return b.appendAudit(&AuditEntry{
+		Actor:  cliActor(),
+		Action: action,
+		BookID: bookID,
+	}, before, after)
+}
+
+// cliActor names the user running a subcommand.
+func cliActor() string {
+	if u, err := user.Current(); err == nil {
+		return "cli:" + u.Username
+	}
+	return "cli"
+}
+
+func (b *Bookshelf) appendAudit(e *AuditEntry, before, after *Book) error {
+	if b.Audit == nil {
+		return nil
+	}
+	e.Time = time.Now().UTC()
+	var err error
+	if e.Before, err = snapshot(before); err != nil {
+		return err
+	}
+	if e.After, err = snapshot(after); err != nil {
+		return err
+	}
+	if err := b.Audit.AppendAudit(e); err != nil {
+		return fmt.Errorf("could not write audit log: %v", err)
+	}
+	return nil
+}
+
+// actorOf names the user behind r for the audit log.
+func actorOf(r *http.Request) string {
+	u := currentUser(r)
+	if u == nil {
+		return "anonymous"
+	}
+	if u.Email != "" {
+		return u.Email
+	}
+	return u.Issuer + "#" + u.Subject
+}
+
+func snapshot(book *Book) (json.RawMessage, error) {
+	if book == nil {
+		return nil, nil
+	}
+	return json.Marshal(book)
+}
+
+// auditFilterFromForm reads the filter of the audit page from r.
+func auditFilterFromForm(r *http.Request) (AuditFilter, error) {
+	f := AuditFilter{
+		Actor:  r.FormValue("actor"),
+		Action: r.FormValue("action"),
+		Limit:  500,
+	}
+	if s := r.FormValue("book"); s != "" {
+		id, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return f, fmt.Errorf("bad book ID %q", s)
+		}
+		f.BookID = uint(id)
+	}
+	if s := r.FormValue("since"); s != "" {
+		t, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			return f, fmt.Errorf("bad date %q, want YYYY-MM-DD", s)
+		}
+		f.Since = t
+	}
+	if s := r.FormValue("until"); s != "" {
+		t, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			return f, fmt.Errorf("bad date %q, want YYYY-MM-DD", s)
+		}
+		// Include the whole day.
+		f.Until = t.AddDate(0, 0, 1)
+	}
+	if s := r.FormValue("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return f, fmt.Errorf("bad limit %q", s)
+		}
+		f.Limit = n
+	}
+	return f, nil
+}
+
+// auditHandler displays the audit log.
+func (b *Bookshelf) auditHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if b.Audit == nil {
+		return b.appErrorf(r, errNoAuditLog, "%v", errNoAuditLog)
+	}
+	f, err := auditFilterFromForm(r)
+	if err != nil {
+		return b.appErrorf(r, err, "%v", err)
+	}
+	entries, err := b.Audit.ListAudit(f)
+	if err != nil {
+		return b.appErrorf(r, err, "could not list audit log: %v", err)
+	}
+
+	// Keep the filter, minus the limit, for the export link.
+	q := url.Values{}
+	for _, k := range []string{"actor", "action", "book", "since", "until"} {
+		if v := r.FormValue(k); v != "" {
+			q.Set(k, v)
+		}
+	}
+	return auditTmpl.Execute(b, w, r, struct {
+		Entries []*AuditEntry
+		Query   url.Values
+		Export  string
+	}{
+		Entries: entries,
+		Query:   q,
+		Export:  "/admin/audit.jsonl?" + q.Encode(),
+	})
+}
+
+// auditExportHandler writes the audit log as JSON Lines.
+func (b *Bookshelf) auditExportHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if b.Audit == nil {
+		return b.appErrorf(r, errNoAuditLog, "%v", errNoAuditLog)
+	}
+	f, err := auditFilterFromForm(r)
+	if err != nil {
+		return b.appErrorf(r, err, "%v", err)
+	}
+	if r.FormValue("limit") == "" {
+		f.Limit = 0
+	}
+	entries, err := b.Audit.ListAudit(f)
+	if err != nil {
+		return b.appErrorf(r, err, "could not list audit log: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf(`attachment; filename="audit-%s.jsonl"`, time.Now().UTC().Format("20060102-150405")))
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			// Headers are gone already, all we can do is log.
+			fmt.Fprintf(b.logWriter, "audit export: %v\n", err)
+			return nil
+		}
+	}
+	return nil
+}
+
+var errNoAuditLog = errors.New("the configured database does not keep an audit log")
@@ -0,0 +1,270 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Role is the access level granted to a signed-in user.
+type Role string
+
+// Roles, from the least to the most privileged.
+const (
+	RoleViewer Role = "viewer"
+	RoleStaff  Role = "staff"
+	RoleAdmin  Role = "admin"
+)
+
+var roleRank = map[Role]int{
+	RoleViewer: 1,
+	RoleStaff:  2,
+	RoleAdmin:  3,
+}
+
+// parseRole converts s to a known Role.
+func parseRole(s string) (Role, error) {
+	r := Role(strings.ToLower(strings.TrimSpace(s)))
+	if _, ok := roleRank[r]; !ok {
+		return "", fmt.Errorf("unknown role %q", s)
+	}
+	return r, nil
+}
+
+// AtLeast reports whether r grants at least the privileges of min.
+func (r Role) AtLeast(min Role) bool {
+	return roleRank[r] >= roleRank[min]
+}
+
+// User holds a person who signed in to the bookshelf.
+type User struct {
+	ID          uint      `gorm:"column:id;primary_key"`
+	Issuer      string    `gorm:"column:issuer"`
+	Subject     string    `gorm:"column:subject"`
+	Email       string    `gorm:"column:email"`
+	Name        string    `gorm:"column:name"`
+	Role        Role      `gorm:"column:role"`
+	CreatedAt   time.Time `gorm:"column:created_at"`
+	LastLoginAt time.Time `gorm:"column:last_login_at"`
+}
+
+// DisplayName returns a human readable name for the user.
+func (u *User) DisplayName() string {
+	if u.Name != "" {
+		return u.Name
+	}
+	if u.Email != "" {
+		return u.Email
+	}
+	return u.Subject
+}
+
+// IsAdmin reports whether the user may manage the bookshelf.
+func (u *User) IsAdmin() bool {
+	return u.Role.AtLeast(RoleAdmin)
+}
+
+// UserDatabase provides thread-safe access to a database of users.
+type UserDatabase interface {
+	// GetUser retrieves a user by its ID.
+	GetUser(id uint) (*User, error)
+
+	// FindUser retrieves a user by its issuer and subject.
+	FindUser(issuer, subject string) (*User, error)
+
+	// UpsertUser saves a given user, matching an existing entry by its
+	// issuer and subject, and returns the ID of the stored user.
+	UpsertUser(u *User) (id uint, err error)
+
+	// ListUsers returns a list of users, ordered by ID.
+	ListUsers() ([]*User, error)
+}
+
+var errNoUsers = errors.New("the database does not store users")
+
+const (
+	sessionCookieName = "bookshelf_session"
+	sessionTTL        = 12 * time.Hour
+)
+
+// sessionCodec signs and verifies the values stored in cookies, so that
+// sessions survive restarts and work across replicas sharing the secret.
+type sessionCodec struct {
+	secret []byte
+}
+
+// newSessionCodec creates a sessionCodec. A random secret is generated when
+// secret is empty, which invalidates sessions on every restart.
+func newSessionCodec(secret string) (*sessionCodec, error) {
+	if secret != "" {
+		return &sessionCodec{secret: []byte(secret)}, nil
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("session: could not generate secret: %v", err)
+	}
+	return &sessionCodec{secret: key}, nil
+}
+
+func (c *sessionCodec) mac(payload string) string {
+	m := hmac.New(sha256.New, c.secret)
+	m.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+// encode serializes v and appends a signature.
+func (c *sessionCodec) encode(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + c.mac(payload), nil
+}
+
+// decode verifies the signature of s and deserializes it into v.
+func (c *sessionCodec) decode(s string, v interface{}) error {
+	i := strings.LastIndex(s, ".")
+	if i < 0 {
+		return errors.New("session: malformed value")
+	}
+	payload, sig := s[:i], s[i+1:]
+	if !hmac.Equal([]byte(sig), []byte(c.mac(payload))) {
+		return errors.New("session: bad signature")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return fmt.Errorf("session: %v", err)
+	}
+	return json.Unmarshal(b, v)
+}
+
+// session is the signed content of the session cookie.
+type session struct {
+	UserID  uint  `json:"uid"`
+	Expires int64 `json:"exp"`
+}
+
+type userContextKey struct{}
+
+// setSession starts a session for u.
+func (b *Bookshelf) setSession(w http.ResponseWriter, r *http.Request, u *User) error {
+	expires := time.Now().Add(sessionTTL)
+	v, err := b.sessions.encode(session{UserID: u.ID, Expires: expires.Unix()})
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    v,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// clearSession ends the current session.
+func (b *Bookshelf) clearSession(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+}
+
+// userFromSession loads the user of the session cookie, if any.
+func (b *Bookshelf) userFromSession(r *http.Request) *User {
+	if b.sessions == nil || b.Users == nil {
+		return nil
+	}
+	c, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return nil
+	}
+	var s session
+	if err := b.sessions.decode(c.Value, &s); err != nil {
+		return nil
+	}
+	if time.Now().Unix() > s.Expires {
+		return nil
+	}
+	u, err := b.Users.GetUser(s.UserID)
+	if err != nil {
+		return nil
+	}
+	return u
+}
+
+// withUser attaches the signed-in user, if any, to the request context.
+func (b *Bookshelf) withUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u := b.userFromSession(r); u != nil {
+			r = r.WithContext(context.WithValue(r.Context(), userContextKey{}, u))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// currentUser returns the signed-in user of r, or nil.
+func currentUser(r *http.Request) *User {
+	u, _ := r.Context().Value(userContextKey{}).(*User)
+	return u
+}
+
+// authEnabled reports whether sign-in is configured. Without an identity
+// provider the bookshelf stays open to everyone, as it always has been.
+func (b *Bookshelf) authEnabled() bool {
+	return b.oidc != nil
+}
+
+// requireRole only lets users holding at least role reach next.
+// Anonymous users are sent to the login page.
+func (b *Bookshelf) requireRole(role Role, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !b.authEnabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		u := currentUser(r)
+		if u == nil {
+			if r.Method == http.MethodGet {
+				http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+				return
+			}
+			http.Error(w, "login required", http.StatusUnauthorized)
+			return
+		}
+		if !u.Role.AtLeast(role) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,341 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Roles of the people credited for a book.
+const (
+	creditAuthor      = "author"
+	creditEditor      = "editor"
+	creditTranslator  = "translator"
+	creditIllustrator = "illustrator"
+)
+
+// creditRoles are the roles offered by the edit form, in its order.
+var creditRoles = []string{creditAuthor, creditEditor, creditTranslator, creditIllustrator}
+
+// maxAuthorName is the size of the name column.
+const maxAuthorName = 255
+
+// Author is a person credited for books.
+type Author struct {
+	ID   uint   `gorm:"column:id;primary_key" json:"id"`
+	Name string `gorm:"column:name" json:"name"`
+}
+
+// TableName tells gorm where authors live.
+func (Author) TableName() string {
+	return "authors"
+}
+
+// Credit names an author of a book and what they did for it.
+type Credit struct {
+	AuthorID uint   `json:"author_id,omitempty"`
+	Name     string `json:"name"`
+	Role     string `json:"role"`
+}
+
+// bookAuthor links a book to an author, see Credit.
+type bookAuthor struct {
+	BookID   uint   `gorm:"column:book_id;primary_key"`
+	AuthorID uint   `gorm:"column:author_id;primary_key"`
+	Role     string `gorm:"column:role;primary_key"`
+	Position int    `gorm:"column:position"`
+}
+
+// TableName tells gorm where credits live.
+func (bookAuthor) TableName() string {
+	return "book_authors"
+}
+
+// Work is a book an author is credited for.
+type Work struct {
+	Book *Book
+	Role string
+}
+
+// AuthorDatabase provides thread-safe access to authors and the credits
+// linking them to books.
+type AuthorDatabase interface {
+	// GetAuthor retrieves an author by its ID.
+	GetAuthor(id uint) (*Author, error)
+
+	// SearchAuthors returns the authors whose names contain q, ignoring
+	// case, ordered by name. limit caps the number of authors unless 0.
+	SearchAuthors(q string, limit int) ([]*Author, error)
+
+	// SetCredits replaces the credits of a book. Authors are matched by
+	// name, ignoring case, and added when not known yet. The AuthorID and
+	// Name of credits are set to those of the matched authors.
+	SetCredits(bookID uint, credits []Credit) error
+
+	// Credits returns the credits of a book, in their order.
+	Credits(bookID uint) ([]Credit, error)
+
+	// Works returns the books an author is credited for, ordered by title.
+	Works(authorID uint) ([]Work, error)
+
+	// RenameAuthor changes the name of an author.
+	RenameAuthor(id uint, name string) error
+
+	// MergeAuthors moves the credits of author from to author into and
+	// removes from, for names which turned out to be variants.
+	MergeAuthors(from, into uint) error
+}
+
+var errNoAuthors = errors.New("the configured database does not keep authors")
+
+// errBadCredit is wrapped by the errors of normalizeCredits.
+var errBadCredit = errors.New("bad author")
+
+// normalizeCredits trims names, drops empty ones and duplicates and checks
+// the roles, which default to creditAuthor.
+func normalizeCredits(credits []Credit) ([]Credit, error) {
+	var out []Credit
+	seen := make(map[string]bool)
+	for _, c := range credits {
+		c.Name = strings.Join(strings.Fields(c.Name), " ")
+		if c.Name == "" {
+			continue
+		}
+		if len(c.Name) > maxAuthorName {
+			return nil, fmt.Errorf("%w: name longer than %d bytes", errBadCredit, maxAuthorName)
+		}
+		if c.Role == "" {
+			c.Role = creditAuthor
+		}
+		if !validCreditRole(c.Role) {
+			return nil, fmt.Errorf("%w: unknown role %q", errBadCredit, c.Role)
+		}
+		key := strings.ToLower(c.Name) + "\x00" + c.Role
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+func validCreditRole(role string) bool {
+	for _, r := range creditRoles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// creditLine formats credits for Book.Author, e.g.
+// "Frank Herbert, Brian Herbert (editor)".
+func creditLine(credits []Credit) string {
+	var parts []string
+	for _, c := range credits {
+		if c.Role == creditAuthor {
+			parts = append(parts, c.Name)
+		}
+	}
+	for _, c := range credits {
+		if c.Role != creditAuthor {
+			parts = append(parts, fmt.Sprintf("%s (%s)", c.Name, c.Role))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// creditsFromForm reads the authorName and authorRole fields of the edit
+// form, which come in pairs. Clients sending the single author field of
+// earlier versions credit it as one author.
+func creditsFromForm(r *http.Request) ([]Credit, error) {
+	names, roles := r.Form["authorName"], r.Form["authorRole"]
+	if len(names) == 0 {
+		return normalizeCredits([]Credit{{Name: r.FormValue("author")}})
+	}
+	if len(roles) != 0 && len(roles) != len(names) {
+		return nil, fmt.Errorf("%w: got %d names and %d roles", errBadCredit, len(names), len(roles))
+	}
+	credits := make([]Credit, len(names))
+	for i, name := range names {
+		credits[i].Name = name
+		if len(roles) != 0 {
+			credits[i].Role = roles[i]
+		}
+	}
+	return normalizeCredits(credits)
+}
+
+// prepareCredits normalizes the credits of a book read from a file, which
+// may only have Author set when written by earlier versions, and formats
+// Author from them.
+func prepareCredits(book *Book) error {
+	credits := book.Credits
+	if len(credits) == 0 {
+		credits = []Credit{{Name: book.Author}}
+	}
+	credits, err := normalizeCredits(credits)
+	if err != nil {
+		return err
+	}
+	book.Credits = credits
+	book.Author = creditLine(credits)
+	return nil
+}
+
+// saveCredits stores the credits of book, which must have an ID. It is a
+// no-op when the database does not keep authors.
+func (b *Bookshelf) saveCredits(book *Book) error {
+	if b.Authors == nil {
+		return nil
+	}
+	defer invalidateCache(b.DB, book.ID)
+	if err := b.Authors.SetCredits(book.ID, book.Credits); err != nil {
+		return fmt.Errorf("could not save authors: %v", err)
+	}
+	return nil
+}
+
+// loadCredits sets the credits of books from the database.
+func (b *Bookshelf) loadCredits(books ...*Book) error {
+	if b.Authors == nil {
+		return nil
+	}
+	for _, book := range books {
+		credits, err := b.Authors.Credits(book.ID)
+		if err != nil {
+			return fmt.Errorf("could not load authors: %v", err)
+		}
+		book.Credits = credits
+	}
+	return nil
+}
+
+// refreshCreditLines rewrites Book.Author for the books of an author after
+// the author was renamed or merged, calling audit for each changed book.
+// Changes go through b.DB, so that caches see them.
+func (b *Bookshelf) refreshCreditLines(authorID uint, audit func(id uint, before, after *Book) error) error {
+	works, err := b.Authors.Works(authorID)
+	if err != nil {
+		return err
+	}
+	done := make(map[uint]bool)
+	for _, w := range works {
+		if done[w.Book.ID] {
+			continue
+		}
+		done[w.Book.ID] = true
+		book, err := b.DB.GetBook(w.Book.ID)
+		if err != nil {
+			return err
+		}
+		before := *book
+		if err := b.loadCredits(book); err != nil {
+			return err
+		}
+		if line := creditLine(book.Credits); line != before.Author {
+			book.Author = line
+			if err := b.DB.UpdateBook(book); err != nil {
+				return err
+			}
+			if err := audit(book.ID, &before, book); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// authorFromRequest retrieves the author with the ID in the URL's path.
+func (b *Bookshelf) authorFromRequest(r *http.Request) (*Author, error) {
+	if b.Authors == nil {
+		return nil, errNoAuthors
+	}
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil || id == 0 {
+		return nil, fmt.Errorf("bad author ID %q", mux.Vars(r)["id"])
+	}
+	return b.Authors.GetAuthor(uint(id))
+}
+
+// authorsHandler lists all authors.
+func (b *Bookshelf) authorsHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if b.Authors == nil {
+		return b.appErrorf(r, errNoAuthors, "%v", errNoAuthors)
+	}
+	authors, err := b.Authors.SearchAuthors(r.FormValue("q"), 0)
+	if err != nil {
+		return b.appErrorf(r, err, "could not list authors: %v", err)
+	}
+	return authorsTmpl.Execute(b, w, r, struct {
+		Authors []*Author
+		Query   string
+	}{authors, r.FormValue("q")})
+}
+
+// authorHandler shows an author and the books they are credited for.
+func (b *Bookshelf) authorHandler(w http.ResponseWriter, r *http.Request) *appError {
+	a, err := b.authorFromRequest(r)
+	if err != nil {
+		e := b.appErrorf(r, err, "%v", err)
+		if errors.Is(err, errNotFound) {
+			e.code = http.StatusNotFound
+		}
+		return e
+	}
+	works, err := b.Authors.Works(a.ID)
+	if err != nil {
+		return b.appErrorf(r, err, "could not list books: %v", err)
+	}
+	type workView struct {
+		bookView
+		Role string
+	}
+	views := make([]workView, len(works))
+	for i, w := range works {
+		views[i] = workView{b.viewOf(w.Book), w.Role}
+	}
+	return authorTmpl.Execute(b, w, r, struct {
+		Author *Author
+		Works  []workView
+	}{a, views})
+}
+
+// maxAuthorSuggestions bounds the answers of authorSuggestHandler.
+const maxAuthorSuggestions = 10
+
+// authorSuggestHandler answers the autocompletion of the author picker of
+// the edit form with the authors whose names contain q, as JSON.
+func (b *Bookshelf) authorSuggestHandler(w http.ResponseWriter, r *http.Request) *appError {
+	authors := []*Author{}
+	if q := strings.TrimSpace(r.FormValue("q")); q != "" && b.Authors != nil {
+		var err error
+		if authors, err = b.Authors.SearchAuthors(q, maxAuthorSuggestions); err != nil {
+			return b.appErrorf(r, err, "could not search authors: %v", err)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(authors); err != nil {
+		return b.appErrorf(r, err, "could not write authors: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeCredits(t *testing.T) {
+	got, err := normalizeCredits([]Credit{
+		{Name: "  Frank   Herbert "},
+		{Name: ""},
+		{Name: "frank herbert", Role: creditAuthor},
+		{Name: "Frank Herbert", Role: creditEditor},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Credit{{Name: "Frank Herbert", Role: creditAuthor}, {Name: "Frank Herbert", Role: creditEditor}}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if line := creditLine(got); line != "Frank Herbert, Frank Herbert (editor)" {
+		t.Errorf("creditLine: got %q", line)
+	}
+	for _, c := range []Credit{{Name: "X", Role: "ghostwriter"}, {Name: strings.Repeat("x", maxAuthorName+1)}} {
+		if _, err := normalizeCredits([]Credit{c}); !errors.Is(err, errBadCredit) {
+			t.Errorf("normalizeCredits(%+v): got %v, want errBadCredit", c, err)
+		}
+	}
+}
+
+func TestBookAuthors(t *testing.T) {
+	bs, srv := newTestBookshelf(t)
+
+	get := func(path string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	post := func(form url.Values) int {
+		t.Helper()
+		resp, err := http.PostForm(srv.URL+"/books", form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	code := post(url.Values{
+		"title":      {"Good Omens"},
+		"authorName": {"Terry Pratchett", "Neil Gaiman", ""},
+		"authorRole": {creditAuthor, creditAuthor, creditAuthor},
+	})
+	if code != http.StatusOK {
+		t.Fatalf("adding a book: got status %d", code)
+	}
+	// The single author field of earlier clients still works.
+	if code := post(url.Values{"title": {"Mort"}, "author": {"terry pratchett"}}); code != http.StatusOK {
+		t.Fatalf("adding a book with author: got status %d", code)
+	}
+	for _, form := range []url.Values{
+		{"title": {"Bad"}, "authorName": {"X"}, "authorRole": {"ghostwriter"}},
+		{"title": {"Bad"}, "authorName": {"X", "Y"}, "authorRole": {creditAuthor}},
+	} {
+		if code := post(form); code != http.StatusBadRequest {
+			t.Errorf("%v: got status %d, want 400", form, code)
+		}
+	}
+
+	books, _ := bs.DB.ListBooks()
+	if len(books) != 2 || books[0].Title != "Good Omens" || books[0].Author != "Terry Pratchett, Neil Gaiman" {
+		t.Fatalf("got books %+v", books)
+	}
+	authors, _ := bs.Authors.SearchAuthors("", 0)
+	if len(authors) != 2 {
+		t.Fatalf("got authors %+v, want Neil Gaiman and Terry Pratchett", authors)
+	}
+	gaiman, pratchett := authors[0], authors[1]
+
+	_, body := get(fmt.Sprintf("/books/%d", books[0].ID))
+	for _, a := range authors {
+		if want := fmt.Sprintf(`<a href="/authors/%d">%s</a>`, a.ID, a.Name); !strings.Contains(body, want) {
+			t.Errorf("detail page: want a link %s", want)
+		}
+	}
+	_, body = get(fmt.Sprintf("/books/%d/edit", books[0].ID))
+	if n := strings.Count(body, `name="authorName"`); n != 2+blankCreditRows {
+		t.Errorf("edit form: got %d author rows, want %d", n, 2+blankCreditRows)
+	}
+
+	code, body = get(fmt.Sprintf("/authors/%d", pratchett.ID))
+	if code != http.StatusOK || !strings.Contains(body, ">Good Omens</a>") || !strings.Contains(body, ">Mort</a>") {
+		t.Errorf("author page: got %d\n%s", code, body)
+	}
+	if code, _ := get("/authors/999"); code != http.StatusNotFound {
+		t.Errorf("unknown author: got status %d, want 404", code)
+	}
+	if _, body := get("/authors?q=gai"); !strings.Contains(body, gaiman.Name) || strings.Contains(body, pratchett.Name) {
+		t.Errorf("authors page searching gai:\n%s", body)
+	}
+
+	_, body = get("/authors.json?q=TERRY")
+	var suggested []*Author
+	if err := json.Unmarshal([]byte(body), &suggested); err != nil || len(suggested) != 1 || suggested[0].ID != pratchett.ID {
+		t.Errorf("suggestions: got %s, %v", body, err)
+	}
+	if _, body := get("/authors.json"); strings.TrimSpace(body) != "[]" {
+		t.Errorf("suggestions without q: got %s, want []", body)
+	}
+}
+
+func TestCLIAuthors(t *testing.T) {
+	c := newCLI(t)
+	c.mustRun("books", "add", "-title", "Dune", "-author", "Frank Herbert")
+	c.mustRun("books", "add", "-title", "Chapterhouse", "-author", "F. Herbert", "-editor", "Brian Herbert")
+
+	var a Author
+	out := c.mustRun("authors", "list", "-q", "f. herbert")
+	if err := json.Unmarshal([]byte(out), &a); err != nil || a.Name != "F. Herbert" {
+		t.Fatalf("authors list: got %q, %v", out, err)
+	}
+	var into Author
+	out = c.mustRun("authors", "list", "-q", "frank")
+	if err := json.Unmarshal([]byte(out), &into); err != nil {
+		t.Fatal(err)
+	}
+
+	c.mustRun("authors", "merge", fmt.Sprint(a.ID), fmt.Sprint(into.ID))
+	book, err := c.bs.DB.GetBook(2)
+	if err != nil || book.Author != "Frank Herbert, Brian Herbert (editor)" {
+		t.Errorf("after merge: got %+v, %v", book, err)
+	}
+	c.mustRun("authors", "rename", fmt.Sprint(into.ID), "Frank Patrick Herbert")
+	if book, _ := c.bs.DB.GetBook(1); book.Author != "Frank Patrick Herbert" {
+		t.Errorf("after rename: got author %q", book.Author)
+	}
+	entries, _ := c.bs.Audit.ListAudit(AuditFilter{Action: AuditUpdate})
+	if len(entries) != 3 {
+		t.Errorf("got %d audited updates, want 3", len(entries))
+	}
+
+	for _, tc := range []struct {
+		args []string
+		want int
+	}{
+		{[]string{"authors", "merge", fmt.Sprint(a.ID), fmt.Sprint(into.ID)}, exitNotFound},
+		{[]string{"authors", "rename", fmt.Sprint(into.ID), " "}, exitUsage},
+		{[]string{"authors", "rename", "x", "Name"}, exitUsage},
+		{[]string{"authors", "merge", "1"}, exitUsage},
+	} {
+		if code, _, _ := c.run(tc.args...); code != tc.want {
+			t.Errorf("%q: got exit code %d, want %d", tc.args, code, tc.want)
+		}
+	}
+}
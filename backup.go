@@ -0,0 +1,952 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A backup is a gzipped tar archive holding
+//
+//	books.jsonl        the books, one JSON object per line
+//	copies.jsonl       the copies of the books
+//	users.jsonl        the users
+//	loans.jsonl        the loans of the copies, oldest first
+//	holds.jsonl        the waiting and ready holds, oldest first
+//	optouts.jsonl      the IDs of the users declining reminder emails
+//	reviews.jsonl      the reviews of the books, oldest first
+//	audit.jsonl        the audit log, oldest first
+//	collections.jsonl  the collections with the IDs of their books
+//	images/NAME        the covers kept in the image store
+//	manifest.json      the size and SHA-256 of each of the above
+//
+// The manifest comes last, since the checksums are only known once the
+// files have been written. Resized covers are not included: restoring
+// generates them again.
+
+const backupFormat = 1
+
+const (
+	backupBooks        = "books.jsonl"
+	backupUsers        = "users.jsonl"
+	backupAudit        = "audit.jsonl"
+	backupCollections  = "collections.jsonl"
+	backupCopies       = "copies.jsonl"
+	backupLoans        = "loans.jsonl"
+	backupHolds        = "holds.jsonl"
+	backupOptOuts      = "optouts.jsonl"
+	backupReviews      = "reviews.jsonl"
+	backupManifestFile = "manifest.json"
+	backupImages       = "images/"
+)
+
+// backupManifest describes the content of a backup.
+type backupManifest struct {
+	Format  int       `json:"format"`
+	Created time.Time `json:"created"`
+
+	Books int `json:"books"`
+	Users int `json:"users"`
+	Audit int `json:"audit"`
+	// Collections is missing from backups of earlier versions.
+	Collections int `json:"collections,omitempty"`
+	Copies      int `json:"copies,omitempty"`
+	Loans       int `json:"loans,omitempty"`
+	Holds       int `json:"holds,omitempty"`
+	OptOuts     int `json:"opt_outs,omitempty"`
+	Reviews     int `json:"reviews,omitempty"`
+	// Images maps from the cover URLs of the books to the names of their
+	// files below images/.
+	Images map[string]string `json:"images"`
+	// Missing are covers which were deleted while the backup was taken.
+	Missing []string `json:"missing,omitempty"`
+
+	Files []backupFile `json:"files"`
+}
+
+// backupFile is the checksum of a file of a backup.
+type backupFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// backupWriter writes the files of a backup, recording their checksums.
+type backupWriter struct {
+	tw       *tar.Writer
+	modified time.Time
+	files    []backupFile
+}
+
+func (w *backupWriter) add(name string, data []byte) error {
+	err := w.tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: w.modified,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := w.tw.Write(data); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	w.files = append(w.files, backupFile{Path: name, Size: int64(len(data)), SHA256: hex.EncodeToString(sum[:])})
+	return nil
+}
+
+// jsonLines encodes each element of the slice v on a line of its own.
+func jsonLines(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var elems []json.RawMessage
+	if err := json.Unmarshal(raw, &elems); err != nil {
+		return nil, err
+	}
+	for _, e := range elems {
+		if err := enc.Encode(e); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// holdWrites keeps requests changing the catalog from running while a
+// backup takes its snapshot.
+func (b *Bookshelf) holdWrites(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			b.writes.RLock()
+			defer b.writes.RUnlock()
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// holdingWrites runs f, which changes the database, keeping a backup from
+// taking its snapshot meanwhile. It is for the writers which are not
+// requests, and should not take longer than a request does.
+func (b *Bookshelf) holdingWrites(f func() error) error {
+	b.writes.RLock()
+	defer b.writes.RUnlock()
+	return f()
+}
+
+// backupCollection is a line of collections.jsonl.
+type backupCollection struct {
+	*Collection
+	BookIDs []uint `json:"book_ids"`
+}
+
+// backupSnapshot holds the database part of a backup.
+type backupSnapshot struct {
+	books       []*Book
+	users       []*User
+	audit       []*AuditEntry
+	collections []backupCollection
+	copies      []*Copy
+	loans       []*Loan
+	holds       []*Hold
+	optOuts     []uint
+	reviews     []*Review
+}
+
+// snapshotDatabase is implemented by databases which can be read as of a
+// single moment while others keep writing to them, including other
+// processes which b.writes does not hold off.
+type snapshotDatabase interface {
+	// ReadSnapshot calls read with a view of the database which does not
+	// see the changes committed after its first read.
+	ReadSnapshot(ctx context.Context, read func(BookDatabase) error) error
+}
+
+// snapshot reads the database as of a single moment. It reads past the
+// cache, which may hold books older than the rest of the snapshot.
+// Databases which cannot take a snapshot of their own are only changed by
+// this process, so its writers are held off instead.
+func (b *Bookshelf) snapshot(ctx context.Context) (*backupSnapshot, error) {
+	var s *backupSnapshot
+	read := func(db BookDatabase) error {
+		view := &Bookshelf{logWriter: b.logWriter}
+		view.useDatabase(db)
+		var err error
+		s, err = view.readSnapshot()
+		return err
+	}
+
+	db := uncachedDB(b.DB)
+	if sdb, ok := db.(snapshotDatabase); ok {
+		if err := sdb.ReadSnapshot(ctx, read); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	b.writes.Lock()
+	defer b.writes.Unlock()
+	if err := read(db); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// readSnapshot reads everything a backup holds from the database.
+func (b *Bookshelf) readSnapshot() (*backupSnapshot, error) {
+	s := &backupSnapshot{}
+	var err error
+	if s.books, err = b.DB.ListBooks(); err != nil {
+		return nil, err
+	}
+	sort.Slice(s.books, func(i, j int) bool {
+		return s.books[i].ID < s.books[j].ID
+	})
+	if err := b.loadCredits(s.books...); err != nil {
+		return nil, err
+	}
+	if err := b.loadSeries(s.books...); err != nil {
+		return nil, err
+	}
+	if b.Copies != nil {
+		if s.copies, err = b.Copies.AllCopies(); err != nil {
+			return nil, err
+		}
+	}
+	if b.Loans != nil {
+		if s.loans, err = b.Loans.ListLoans(LoanFilter{}); err != nil {
+			return nil, err
+		}
+		// Oldest first, the order they are checked out in when restoring.
+		for i, j := 0, len(s.loans)-1; i < j; i, j = i+1, j-1 {
+			s.loans[i], s.loans[j] = s.loans[j], s.loans[i]
+		}
+	}
+	if b.Holds != nil {
+		if s.holds, err = b.Holds.ListHolds(HoldFilter{}); err != nil {
+			return nil, err
+		}
+	}
+	if b.Reminders != nil {
+		if s.optOuts, err = b.Reminders.ListOptOuts(); err != nil {
+			return nil, err
+		}
+	}
+	if b.Reviews != nil {
+		if s.reviews, err = b.Reviews.ListReviews(ReviewFilter{}); err != nil {
+			return nil, err
+		}
+		// Oldest first, the order they are written in when restoring.
+		for i, j := 0, len(s.reviews)-1; i < j; i, j = i+1, j-1 {
+			s.reviews[i], s.reviews[j] = s.reviews[j], s.reviews[i]
+		}
+	}
+	if b.Users != nil {
+		if s.users, err = b.Users.ListUsers(); err != nil {
+			return nil, err
+		}
+	}
+	if b.Collections != nil {
+		// Collections are listed per owner, which are the users and 0.
+		owners := []uint{0}
+		for _, u := range s.users {
+			owners = append(owners, u.ID)
+		}
+		for _, owner := range owners {
+			collections, err := b.Collections.ListCollections(owner)
+			if err != nil {
+				return nil, err
+			}
+			for _, c := range collections {
+				books, err := b.Collections.CollectionBooks(c.ID)
+				if err != nil {
+					return nil, err
+				}
+				bc := backupCollection{Collection: c, BookIDs: make([]uint, len(books))}
+				for i, book := range books {
+					bc.BookIDs[i] = book.ID
+				}
+				s.collections = append(s.collections, bc)
+			}
+		}
+	}
+	if b.Audit != nil {
+		if s.audit, err = b.Audit.ListAudit(AuditFilter{}); err != nil {
+			return nil, err
+		}
+		// Oldest first, the order they are appended in when restoring.
+		for i, j := 0, len(s.audit)-1; i < j; i, j = i+1, j-1 {
+			s.audit[i], s.audit[j] = s.audit[j], s.audit[i]
+		}
+	}
+	return s, nil
+}
+
+// writeBackup writes a backup of the bookshelf to w. The database is read
+// at once, covers are fetched afterwards: they are never changed once
+// stored, but may be deleted meanwhile, which the manifest records.
+func (b *Bookshelf) writeBackup(ctx context.Context, w io.Writer) (*backupManifest, error) {
+	snap, err := b.snapshot(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("backup: %v", err)
+	}
+	m := &backupManifest{
+		Format:  backupFormat,
+		Created: time.Now().UTC(),
+		Books:   len(snap.books),
+		Users:   len(snap.users),
+		Audit:   len(snap.audit),
+		Images:  make(map[string]string),
+
+		Collections: len(snap.collections),
+		Copies:      len(snap.copies),
+		Loans:       len(snap.loans),
+		Holds:       len(snap.holds),
+		OptOuts:     len(snap.optOuts),
+		Reviews:     len(snap.reviews),
+	}
+
+	gz := gzip.NewWriter(w)
+	bw := &backupWriter{tw: tar.NewWriter(gz), modified: m.Created}
+	for _, f := range []struct {
+		name string
+		v    interface{}
+	}{
+		{backupBooks, snap.books},
+		{backupCopies, snap.copies},
+		{backupUsers, snap.users},
+		{backupLoans, snap.loans},
+		{backupHolds, snap.holds},
+		{backupOptOuts, snap.optOuts},
+		{backupReviews, snap.reviews},
+		{backupAudit, snap.audit},
+		{backupCollections, snap.collections},
+	} {
+		data, err := jsonLines(f.v)
+		if err != nil {
+			return nil, fmt.Errorf("backup: %s: %v", f.name, err)
+		}
+		if err := bw.add(f.name, data); err != nil {
+			return nil, fmt.Errorf("backup: %v", err)
+		}
+	}
+
+	if b.Images != nil {
+		written := make(map[string]bool)
+		for _, book := range snap.books {
+			name, ok := b.Images.Name(book.ImageURL)
+			if !ok || written[name] {
+				continue
+			}
+			data, err := b.Images.Get(ctx, name)
+			if errors.Is(err, errImageNotFound) {
+				m.Missing = append(m.Missing, book.ImageURL)
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("backup: cover of book %d: %v", book.ID, err)
+			}
+			if err := bw.add(backupImages+name, data); err != nil {
+				return nil, fmt.Errorf("backup: %v", err)
+			}
+			written[name] = true
+			m.Images[book.ImageURL] = name
+		}
+	}
+
+	m.Files = bw.files
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := bw.add(backupManifestFile, manifest); err != nil {
+		return nil, fmt.Errorf("backup: %v", err)
+	}
+	if err := bw.tw.Close(); err != nil {
+		return nil, fmt.Errorf("backup: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		return nil, fmt.Errorf("backup: %v", err)
+	}
+	return m, nil
+}
+
+// backupHandler streams a backup to an admin.
+func (b *Bookshelf) backupHandler(w http.ResponseWriter, r *http.Request) *appError {
+	name := fmt.Sprintf("bookshelf-%s.tar.gz", time.Now().UTC().Format("20060102-150405"))
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	if _, err := b.writeBackup(r.Context(), w); err != nil {
+		// Part of the archive may be sent already, so the status cannot
+		// be changed anymore; the archive is truncated instead.
+		fmt.Fprintf(b.logWriter, "backup: %v\n", err)
+	}
+	return nil
+}
+
+// openBackup is a backup unpacked to a directory and verified.
+type openBackup struct {
+	dir      string
+	manifest backupManifest
+}
+
+// maxBackupFile bounds the files of a backup to restore.
+const maxBackupFile = 1 << 30
+
+// unpackBackup extracts the backup read from r to a temporary directory and
+// checks it against its manifest. Close removes the directory.
+func unpackBackup(r io.Reader) (*openBackup, error) {
+	dir, err := ioutil.TempDir("", "bookshelf-restore")
+	if err != nil {
+		return nil, err
+	}
+	ob := &openBackup{dir: dir}
+	if err := ob.unpack(r); err != nil {
+		ob.Close()
+		return nil, fmt.Errorf("restore: %v", err)
+	}
+	return ob, nil
+}
+
+func (ob *openBackup) unpack(r io.Reader) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	sums := make(map[string]backupFile)
+	var manifest []byte
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return fmt.Errorf("unexpected entry %q", hdr.Name)
+		}
+		if hdr.Name == backupManifestFile {
+			if manifest, err = ioutil.ReadAll(io.LimitReader(tr, maxBackupFile)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := checkBackupPath(hdr.Name); err != nil {
+			return err
+		}
+		if _, ok := sums[hdr.Name]; ok {
+			return fmt.Errorf("duplicate entry %q", hdr.Name)
+		}
+		f, err := ob.create(hdr.Name)
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		n, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(tr, maxBackupFile+1))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		if n > maxBackupFile {
+			return fmt.Errorf("%s is too large", hdr.Name)
+		}
+		sums[hdr.Name] = backupFile{Path: hdr.Name, Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}
+	}
+
+	if manifest == nil {
+		return errors.New("no manifest, the archive is not a backup or truncated")
+	}
+	if err := json.Unmarshal(manifest, &ob.manifest); err != nil {
+		return fmt.Errorf("bad manifest: %v", err)
+	}
+	if ob.manifest.Format != backupFormat {
+		return fmt.Errorf("unsupported backup format %d", ob.manifest.Format)
+	}
+	for _, want := range ob.manifest.Files {
+		got, ok := sums[want.Path]
+		if !ok {
+			return fmt.Errorf("%s is missing", want.Path)
+		}
+		if got != want {
+			return fmt.Errorf("%s does not match its checksum", want.Path)
+		}
+		delete(sums, want.Path)
+	}
+	for name := range sums {
+		return fmt.Errorf("%s is not in the manifest", name)
+	}
+	for _, name := range ob.manifest.Images {
+		if err := checkBackupPath(backupImages + name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkBackupPath rejects names which could escape the directory of the
+// unpacked backup, and anything not belonging in a backup.
+func checkBackupPath(name string) error {
+	switch name {
+	case backupBooks, backupCopies, backupUsers, backupLoans, backupHolds, backupOptOuts, backupReviews, backupAudit, backupCollections:
+		return nil
+	}
+	base := strings.TrimPrefix(name, backupImages)
+	if base == name || base == "" || path.Base(base) != base || base == "." || base == ".." {
+		return fmt.Errorf("unexpected entry %q", name)
+	}
+	return nil
+}
+
+func (ob *openBackup) create(name string) (*os.File, error) {
+	p := filepath.Join(ob.dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+}
+
+func (ob *openBackup) read(name string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(ob.dir, filepath.FromSlash(name)))
+}
+
+// Close removes the unpacked files.
+func (ob *openBackup) Close() error {
+	return os.RemoveAll(ob.dir)
+}
+
+// readLines calls decode for each line of the JSON Lines file name of the
+// backup.
+func (ob *openBackup) readLines(name string, decode func(json.RawMessage) error) error {
+	data, err := ob.read(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		if err := decode(line); err != nil {
+			return fmt.Errorf("%s line %d: %v", name, i+1, err)
+		}
+	}
+	return nil
+}
+
+// restoreReport counts what a restore loaded.
+type restoreReport struct {
+	Books  int `json:"books"`
+	Users  int `json:"users"`
+	Audit  int `json:"audit"`
+	Images int `json:"images"`
+
+	Collections int `json:"collections"`
+	Copies      int `json:"copies"`
+	Loans       int `json:"loans"`
+	Holds       int `json:"holds"`
+	OptOuts     int `json:"opt_outs"`
+	Reviews     int `json:"reviews"`
+}
+
+// restore loads the verified backup ob into the bookshelf. Books, copies and
+// users get new IDs, which the audit log, loans, holds, reviews and
+// collections are rewritten for. Unless merge is set, the bookshelf must not
+// hold any books yet.
+func (b *Bookshelf) restore(ctx context.Context, ob *openBackup, merge bool) (*restoreReport, error) {
+	if !merge {
+		books, err := b.DB.ListBooks()
+		if err != nil {
+			return nil, err
+		}
+		if len(books) > 0 {
+			return nil, fmt.Errorf("restore: the database holds %d books already", len(books))
+		}
+	}
+	if len(ob.manifest.Images) > 0 && b.Images == nil {
+		return nil, fmt.Errorf("restore: %v", errNoImageStore)
+	}
+
+	report := &restoreReport{}
+	// Covers first, so that no book refers to a missing one.
+	urls := make(map[string]string)
+	for oldURL, name := range ob.manifest.Images {
+		data, err := ob.read(backupImages + name)
+		if err != nil {
+			return report, err
+		}
+		u, err := b.storeCover(ctx, bytes.NewReader(data))
+		if err != nil {
+			return report, fmt.Errorf("restore: cover %s: %v", name, err)
+		}
+		urls[oldURL] = u
+		report.Images++
+	}
+
+	ids := make(map[uint]uint)
+	err := ob.readLines(backupBooks, func(line json.RawMessage) error {
+		book := &Book{}
+		if err := json.Unmarshal(line, book); err != nil {
+			return err
+		}
+		oldID := book.ID
+		book.ID = 0
+		if u, ok := urls[book.ImageURL]; ok {
+			book.ImageURL = u
+		}
+		if err := prepareCredits(book); err != nil {
+			return err
+		}
+		if err := b.prepareLabels(book); err != nil {
+			return err
+		}
+		var err error
+		if book.Series, err = normalizeSeries(book.Series); err != nil {
+			return err
+		}
+		id, err := b.DB.AddBook(book)
+		if err != nil {
+			return err
+		}
+		book.ID = id
+		if err := b.saveCredits(book); err != nil {
+			return err
+		}
+		if err := b.saveSeries(book); err != nil {
+			return err
+		}
+		ids[oldID] = id
+		report.Books++
+		return nil
+	})
+	if err != nil {
+		return report, fmt.Errorf("restore: %v", err)
+	}
+
+	copyIDs := make(map[uint]uint)
+	// lost copies are added as good ones until their loans are restored.
+	var lost []*Copy
+	if b.Copies != nil {
+		err := ob.readLines(backupCopies, func(line json.RawMessage) error {
+			c := &Copy{}
+			if err := json.Unmarshal(line, c); err != nil {
+				return err
+			}
+			id, ok := ids[c.BookID]
+			if !ok {
+				return fmt.Errorf("copy %q of unknown book %d", c.Barcode, c.BookID)
+			}
+			oldID := c.ID
+			c.ID, c.BookID = 0, id
+			if err := normalizeCopy(c); err != nil {
+				return err
+			}
+			// Merging a backup into the bookshelf it was taken from
+			// finds its copies there already.
+			if _, err := b.Copies.FindCopy(c.Barcode); err == nil && merge {
+				return nil
+			}
+			condition := c.Condition
+			if !lendable(condition) {
+				c.Condition = conditionGood
+			}
+			if _, err := b.Copies.AddCopy(c); err != nil {
+				return err
+			}
+			if condition != c.Condition {
+				c.Condition = condition
+				lost = append(lost, c)
+			}
+			copyIDs[oldID] = c.ID
+			report.Copies++
+			return nil
+		})
+		if err != nil {
+			return report, fmt.Errorf("restore: %v", err)
+		}
+	}
+
+	owners := make(map[uint]uint)
+	if b.Users != nil {
+		err := ob.readLines(backupUsers, func(line json.RawMessage) error {
+			u := &User{}
+			if err := json.Unmarshal(line, u); err != nil {
+				return err
+			}
+			oldID := u.ID
+			u.ID = 0
+			id, err := b.Users.UpsertUser(u)
+			if err != nil {
+				return err
+			}
+			owners[oldID] = id
+			report.Users++
+			return nil
+		})
+		if err != nil {
+			return report, fmt.Errorf("restore: %v", err)
+		}
+	}
+
+	if b.Loans != nil {
+		err := ob.readLines(backupLoans, func(line json.RawMessage) error {
+			l := &Loan{}
+			if err := json.Unmarshal(line, l); err != nil {
+				return err
+			}
+			id, ok := copyIDs[l.CopyID]
+			if !ok && !merge {
+				// The copy was deleted, the loan is kept for its
+				// history. IDs of deleted copies and books would
+				// name others once restored, so they are dropped.
+				if l.Active() {
+					return fmt.Errorf("active loan %d of unknown copy %d", l.ID, l.CopyID)
+				}
+				if uid, ok := owners[l.UserID]; ok {
+					l.UserID = uid
+				}
+				l.ID, l.CopyID, l.BookID = 0, 0, ids[l.BookID]
+				if _, err := b.Loans.AddLoanRecord(l); err != nil {
+					return err
+				}
+				report.Loans++
+				return nil
+			}
+			// The loans of copies found when merging are there already.
+			if !ok {
+				return nil
+			}
+			if uid, ok := owners[l.UserID]; ok {
+				l.UserID = uid
+			}
+			l.ID, l.CopyID = 0, id
+			returned := l.Returned
+			l.Returned = nil
+			if _, err := b.Loans.CheckOut(l); err != nil {
+				return err
+			}
+			if returned != nil {
+				if _, err := b.Loans.CheckIn(l.CopyID, *returned); err != nil {
+					return err
+				}
+			}
+			report.Loans++
+			return nil
+		})
+		if err != nil {
+			return report, fmt.Errorf("restore: %v", err)
+		}
+	}
+	for _, c := range lost {
+		if err := b.Copies.UpdateCopy(c); err != nil {
+			return report, fmt.Errorf("restore: %v", err)
+		}
+	}
+
+	// Holds are placed again in their order, so free copies are kept for
+	// them as when placing them.
+	if b.Holds != nil {
+		err := ob.readLines(backupHolds, func(line json.RawMessage) error {
+			h := &Hold{}
+			if err := json.Unmarshal(line, h); err != nil {
+				return err
+			}
+			id, ok := ids[h.BookID]
+			if uid, ok := owners[h.UserID]; ok {
+				h.UserID = uid
+			}
+			if !h.Active() {
+				// Closed holds are kept for their history, also
+				// those of deleted books, whose IDs would name
+				// others once restored. When merging, those are
+				// there already.
+				if !ok && merge {
+					return nil
+				}
+				h.ID, h.BookID, h.CopyID = 0, id, copyIDs[h.CopyID]
+				if _, err := b.Holds.AddHoldRecord(h); err != nil {
+					return err
+				}
+				report.Holds++
+				return nil
+			}
+			if !ok {
+				return fmt.Errorf("hold %d on unknown book %d", h.ID, h.BookID)
+			}
+			placed := &Hold{BookID: id, UserID: h.UserID, Placed: h.Placed}
+			if _, err := b.Holds.PlaceHold(placed); err != nil {
+				// Merged books keep their copies where they are.
+				if merge && errors.Is(err, errBadHold) {
+					return nil
+				}
+				return err
+			}
+			report.Holds++
+			return nil
+		})
+		if err != nil {
+			return report, fmt.Errorf("restore: %v", err)
+		}
+	}
+
+	if b.Reminders != nil {
+		err := ob.readLines(backupOptOuts, func(line json.RawMessage) error {
+			var id uint
+			if err := json.Unmarshal(line, &id); err != nil {
+				return err
+			}
+			if uid, ok := owners[id]; ok {
+				id = uid
+			}
+			if err := b.Reminders.SetOptOut(id, true); err != nil {
+				return err
+			}
+			report.OptOuts++
+			return nil
+		})
+		if err != nil {
+			return report, fmt.Errorf("restore: %v", err)
+		}
+	}
+
+	if b.Reviews != nil {
+		err := ob.readLines(backupReviews, func(line json.RawMessage) error {
+			r := &Review{}
+			if err := json.Unmarshal(line, r); err != nil {
+				return err
+			}
+			id, ok := ids[r.BookID]
+			if !ok {
+				return fmt.Errorf("review %d of unknown book %d", r.ID, r.BookID)
+			}
+			if uid, ok := owners[r.UserID]; ok {
+				r.UserID = uid
+			}
+			r.ID, r.BookID = 0, id
+			if _, err := b.Reviews.SaveReview(r); err != nil {
+				return err
+			}
+			report.Reviews++
+			return nil
+		})
+		if err != nil {
+			return report, fmt.Errorf("restore: %v", err)
+		}
+	}
+
+	if b.Collections != nil {
+		err := ob.readLines(backupCollections, func(line json.RawMessage) error {
+			bc := &backupCollection{}
+			if err := json.Unmarshal(line, bc); err != nil {
+				return err
+			}
+			if bc.Collection == nil {
+				return errors.New("missing collection")
+			}
+			if err := b.restoreCollection(bc, ids, owners); err != nil {
+				return err
+			}
+			report.Collections++
+			return nil
+		})
+		if err != nil {
+			return report, fmt.Errorf("restore: %v", err)
+		}
+	}
+
+	if b.Audit != nil {
+		err := ob.readLines(backupAudit, func(line json.RawMessage) error {
+			e := &AuditEntry{}
+			if err := json.Unmarshal(line, e); err != nil {
+				return err
+			}
+			e.ID = 0
+			if id, ok := ids[e.BookID]; ok {
+				e.BookID = id
+			}
+			if err := b.Audit.AppendAudit(e); err != nil {
+				return err
+			}
+			report.Audit++
+			return nil
+		})
+		if err != nil {
+			return report, fmt.Errorf("restore: %v", err)
+		}
+	}
+	return report, nil
+}
+
+// restoreCollection adds a collection of a backup, or the books of it to
+// the collection of the same owner and name when merging. ids and owners
+// map from the IDs of the backup to the restored ones.
+func (b *Bookshelf) restoreCollection(bc *backupCollection, ids, owners map[uint]uint) error {
+	c := bc.Collection
+	var err error
+	if c.Name, err = normalizeCollectionName(c.Name); err != nil {
+		return err
+	}
+	if id, ok := owners[c.OwnerID]; ok {
+		c.OwnerID = id
+	}
+	existing, err := b.Collections.ListCollections(c.OwnerID)
+	if err != nil {
+		return err
+	}
+	c.ID = 0
+	for _, e := range existing {
+		if strings.EqualFold(e.Name, c.Name) {
+			c.ID = e.ID
+		}
+	}
+	if c.ID == 0 {
+		if c.ID, err = b.Collections.AddCollection(c); err != nil {
+			return err
+		}
+	}
+	for _, oldID := range bc.BookIDs {
+		id, ok := ids[oldID]
+		if !ok {
+			return fmt.Errorf("collection %q: unknown book %d", c.Name, oldID)
+		}
+		if err := b.Collections.AddToCollection(c.ID, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
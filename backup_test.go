@@ -0,0 +1,448 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newBackupSource returns a bookshelf with a book with a cover, one without,
+// a copy of each, a user with a collection holding both who borrowed the
+// copy of the first, holds the second, reviewed the first and declines
+// reminders, and the audit entries of adding the books.
+func newBackupSource(t *testing.T) *Bookshelf {
+	t.Helper()
+	bs, srv := newTestBookshelf(t)
+	for _, b := range []struct {
+		title string
+		cover []byte
+	}{
+		{"with cover", encodePNG(t, 300, 200)},
+		{"without cover", nil},
+	} {
+		resp := postBook(t, srv.URL, b.title, "cover.png", b.cover)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: got status %d, want 200", b.title, resp.StatusCode)
+		}
+	}
+	uid, err := bs.Users.UpsertUser(&User{Issuer: "https://issuer", Subject: "alice", Role: RoleAdmin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.Reminders.SetOptOut(uid, true); err != nil {
+		t.Fatal(err)
+	}
+	cid, err := bs.Collections.AddCollection(&Collection{OwnerID: uid, Name: "Favorites"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	books, err := bs.DB.ListBooks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range books {
+		if err := bs.Collections.AddToCollection(cid, b.ID); err != nil {
+			t.Fatal(err)
+		}
+		copyID, err := bs.Copies.AddCopy(&Copy{BookID: b.ID, Barcode: barcodeOf(b), Condition: conditionGood})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.Title == "with cover" {
+			now := time.Now().UTC()
+			if _, err := bs.Reviews.SaveReview(&Review{BookID: b.ID, UserID: uid, Rating: 4, Body: "Nice cover.", Created: now, Updated: now}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := bs.Loans.CheckOut(&Loan{CopyID: copyID, UserID: uid, CheckedOut: now, Due: now.Add(loanPeriod)}); err != nil {
+				t.Fatal(err)
+			}
+		} else if _, err := bs.Holds.PlaceHold(&Hold{BookID: b.ID, UserID: uid, Placed: time.Now().UTC()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return bs
+}
+
+// barcodeOf makes up the barcode of the copy of a book of newBackupSource.
+func barcodeOf(b *Book) string {
+	return strings.ReplaceAll(b.Title, " ", "-")
+}
+
+func TestBackupRestore(t *testing.T) {
+	ctx := context.Background()
+	src := newBackupSource(t)
+
+	var archive bytes.Buffer
+	m, err := src.writeBackup(ctx, &archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Books != 2 || m.Users != 1 || m.Audit != 2 || m.Collections != 1 || m.Copies != 2 || m.Loans != 1 || m.Holds != 1 || m.OptOuts != 1 || m.Reviews != 1 || len(m.Images) != 1 {
+		t.Errorf("got manifest %+v, want 2 books, 1 user, 2 audit entries, 1 collection, 2 copies, 1 loan, 1 hold, 1 opt-out, 1 review and 1 image", m)
+	}
+
+	dst, _ := newTestBookshelf(t)
+	ob, err := unpackBackup(&archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ob.Close()
+	report, err := dst.restore(ctx, ob, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *report != (restoreReport{Books: 2, Users: 1, Audit: 2, Images: 1, Collections: 1, Copies: 2, Loans: 1, Holds: 1, OptOuts: 1, Reviews: 1}) {
+		t.Errorf("got report %+v", report)
+	}
+
+	books, err := dst.DB.ListBooks()
+	if err != nil || len(books) != 2 {
+		t.Fatalf("ListBooks: got %d books, %v", len(books), err)
+	}
+	for _, book := range books {
+		copies, err := dst.Copies.ListCopies(book.ID)
+		if err != nil || len(copies) != 1 || copies[0].Barcode != barcodeOf(book) {
+			t.Errorf("ListCopies of %s: got %+v, %v", book.Title, copies, err)
+		}
+		if book.Title != "with cover" {
+			continue
+		}
+		name, ok := dst.Images.Name(book.ImageURL)
+		if !ok {
+			t.Fatalf("cover %q is not in the image store", book.ImageURL)
+		}
+		if _, err := dst.Images.Stat(ctx, name); err != nil {
+			t.Errorf("cover was not restored: %v", err)
+		}
+		if objects, _ := dst.Images.List(ctx); len(objects) != 1+len(defaultImageSizes) {
+			t.Errorf("got %d objects, want the cover and its variants", len(objects))
+		}
+	}
+
+	users, err := dst.Users.ListUsers()
+	if err != nil || len(users) != 1 || users[0].Subject != "alice" || users[0].Role != RoleAdmin {
+		t.Errorf("ListUsers: got %+v, %v", users, err)
+	}
+	if len(users) == 1 {
+		loans, err := dst.Loans.ListLoans(LoanFilter{UserID: users[0].ID, Active: true})
+		if err != nil || len(loans) != 1 {
+			t.Errorf("ListLoans: got %+v, %v", loans, err)
+		} else if c, _ := dst.Copies.GetCopy(loans[0].CopyID); c == nil || c.Barcode != "with-cover" {
+			t.Errorf("restored loan of copy %+v, want with-cover", c)
+		}
+		reviews, err := dst.Reviews.ListReviews(ReviewFilter{UserID: users[0].ID})
+		if err != nil || len(reviews) != 1 || reviews[0].Body != "Nice cover." {
+			t.Errorf("ListReviews: got %+v, %v", reviews, err)
+		} else if b, _ := dst.DB.GetBook(reviews[0].BookID); b == nil || b.Title != "with cover" {
+			t.Errorf("restored review of book %+v, want with cover", b)
+		}
+		if out, err := dst.Reminders.OptedOut(users[0].ID); err != nil || !out {
+			t.Errorf("OptedOut: got %v, %v, want the opt-out restored", out, err)
+		}
+		holds, err := dst.Holds.ListHolds(HoldFilter{UserID: users[0].ID, Active: true})
+		if err != nil || len(holds) != 1 || !holds[0].Ready() {
+			t.Errorf("ListHolds: got %+v, %v", holds, err)
+		} else if c, _ := dst.Copies.GetCopy(holds[0].CopyID); c == nil || c.Barcode != "without-cover" {
+			t.Errorf("restored hold keeps copy %+v, want without-cover", c)
+		}
+		collections, err := dst.Collections.ListCollections(users[0].ID)
+		if err != nil || len(collections) != 1 || collections[0].Name != "Favorites" {
+			t.Fatalf("ListCollections: got %+v, %v", collections, err)
+		}
+		restored, err := dst.Collections.CollectionBooks(collections[0].ID)
+		if err != nil || len(restored) != 2 {
+			t.Errorf("CollectionBooks: got %d books, %v", len(restored), err)
+		}
+	}
+	entries, err := dst.Audit.ListAudit(AuditFilter{})
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("ListAudit: got %+v, %v", entries, err)
+	}
+	ids := map[uint]bool{books[0].ID: true, books[1].ID: true}
+	for _, e := range entries {
+		if !ids[e.BookID] {
+			t.Errorf("audit entry %+v refers to a book not restored", e)
+		}
+	}
+
+	// Restoring again needs -merge.
+	if _, err := dst.restore(ctx, ob, false); err == nil {
+		t.Error("restore into a non-empty database succeeded")
+	}
+	if _, err := dst.restore(ctx, ob, true); err != nil {
+		t.Errorf("restore with merge: %v", err)
+	}
+	if books, _ := dst.DB.ListBooks(); len(books) != 4 {
+		t.Errorf("after merge: got %d books, want 4", len(books))
+	}
+}
+
+// rewriteBackup copies the backup archive, passing the content of each
+// file through edit.
+func rewriteBackup(t *testing.T, archive []byte, edit func(name string, data []byte) []byte) []byte {
+	t.Helper()
+	gr, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gr)
+	var out bytes.Buffer
+	gw := gzip.NewWriter(&out)
+	tw := tar.NewWriter(gw)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = edit(hdr.Name, data)
+		if data == nil {
+			continue
+		}
+		hdr.Size = int64(len(data))
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(data)
+	}
+	tw.Close()
+	gw.Close()
+	return out.Bytes()
+}
+
+// restoreInto restores a backup of src into a new bookshelf.
+func restoreInto(t *testing.T, src *Bookshelf) (*Bookshelf, *restoreReport) {
+	t.Helper()
+	ctx := context.Background()
+	var archive bytes.Buffer
+	if _, err := src.writeBackup(ctx, &archive); err != nil {
+		t.Fatal(err)
+	}
+	ob, err := unpackBackup(&archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ob.Close()
+	dst, _ := newTestBookshelf(t)
+	report, err := dst.restore(ctx, ob, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dst, report
+}
+
+func TestBackupKeepsHistory(t *testing.T) {
+	src, _ := newTestBookshelf(t)
+	bookID, err := src.DB.AddBook(&Book{Title: "withdrawn"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyID, err := src.Copies.AddCopy(&Copy{BookID: bookID, Barcode: "0001", Condition: conditionGood})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid, err := src.Users.UpsertUser(&User{Issuer: "https://issuer", Subject: "alice", Role: RoleViewer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	if _, err := src.Loans.CheckOut(&Loan{CopyID: copyID, UserID: uid, CheckedOut: now, Due: now.Add(loanPeriod)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.Loans.CheckIn(copyID, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	hold := &Hold{BookID: bookID, UserID: uid, Placed: now}
+	if _, err := src.Holds.PlaceHold(hold); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Holds.CancelHold(hold.ID, now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.DB.DeleteBook(bookID); err != nil {
+		t.Fatal(err)
+	}
+
+	dst, report := restoreInto(t, src)
+	if report.Loans != 1 || report.Holds != 1 {
+		t.Errorf("got report %+v, want the loan and the hold restored", report)
+	}
+	loans, err := dst.Loans.ListLoans(LoanFilter{})
+	if err != nil || len(loans) != 1 {
+		t.Fatalf("ListLoans: got %+v, %v", loans, err)
+	}
+	if l := loans[0]; l.CopyID != 0 || l.BookID != 0 || l.Returned == nil || !l.CheckedOut.Equal(now) {
+		t.Errorf("got loan %+v, want the returned loan of a deleted copy", l)
+	}
+	holds, err := dst.Holds.ListHolds(HoldFilter{})
+	if err != nil || len(holds) != 1 {
+		t.Fatalf("ListHolds: got %+v, %v", holds, err)
+	}
+	if h := holds[0]; h.BookID != 0 || h.Status != holdCancelled || h.Closed == nil {
+		t.Errorf("got hold %+v, want the cancelled hold of a deleted book", h)
+	}
+}
+
+func TestSnapshotReadsPastCache(t *testing.T) {
+	bs, _ := newTestBookshelf(t)
+	db := bs.DB
+	if _, err := db.AddBook(&Book{Title: "cached"}); err != nil {
+		t.Fatal(err)
+	}
+	bs.DB = newCachedDB(db, 10, time.Hour)
+	if _, err := bs.DB.ListBooks(); err != nil {
+		t.Fatal(err)
+	}
+	// Written by another process, which does not invalidate this cache.
+	if _, err := db.AddBook(&Book{Title: "uncached"}); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := bs.snapshot(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snap.books) != 2 {
+		t.Errorf("got %d books in the snapshot, want 2", len(snap.books))
+	}
+}
+
+func TestUnpackBackupRejectsDamage(t *testing.T) {
+	src := newBackupSource(t)
+	var archive bytes.Buffer
+	if _, err := src.writeBackup(context.Background(), &archive); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		edit func(name string, data []byte) []byte
+		want string
+	}{
+		{
+			name: "changed",
+			edit: func(name string, data []byte) []byte {
+				if name == backupBooks {
+					return bytes.Replace(data, []byte("without cover"), []byte("with a changed title"), 1)
+				}
+				return data
+			},
+			want: "checksum",
+		},
+		{
+			name: "missing",
+			edit: func(name string, data []byte) []byte {
+				if strings.HasPrefix(name, backupImages) {
+					return nil
+				}
+				return data
+			},
+			want: "missing",
+		},
+		{
+			name: "no manifest",
+			edit: func(name string, data []byte) []byte {
+				if name == backupManifestFile {
+					return nil
+				}
+				return data
+			},
+			want: "no manifest",
+		},
+	} {
+		data := rewriteBackup(t, archive.Bytes(), tc.edit)
+		_, err := unpackBackup(bytes.NewReader(data))
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: got %v, want an error containing %q", tc.name, err, tc.want)
+		}
+	}
+
+	// Truncated archives are refused as well.
+	if _, err := unpackBackup(bytes.NewReader(archive.Bytes()[:archive.Len()/2])); err == nil {
+		t.Error("truncated: unpacked successfully")
+	}
+}
+
+func TestCheckBackupPath(t *testing.T) {
+	for name, ok := range map[string]bool{
+		backupBooks:            true,
+		"images/0123.png":      true,
+		"images/":              false,
+		"images/../books.json": false,
+		"images/a/b.png":       false,
+		"../books.jsonl":       false,
+		"/etc/passwd":          false,
+		"other.txt":            false,
+	} {
+		if err := checkBackupPath(name); (err == nil) != ok {
+			t.Errorf("checkBackupPath(%q): got %v", name, err)
+		}
+	}
+}
+
+func TestBackupHandler(t *testing.T) {
+	bs, srv := newTestBookshelf(t)
+	resp := postBook(t, srv.URL, "Dune", "", nil)
+	resp.Body.Close()
+
+	resp, err := http.Get(srv.URL + "/admin/backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Type"); got != "application/gzip" {
+		t.Errorf("got Content-Type %q, want application/gzip", got)
+	}
+	ob, err := unpackBackup(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ob.Close()
+	if ob.manifest.Books != 1 {
+		t.Errorf("got %d books in the backup, want 1", ob.manifest.Books)
+	}
+
+	// The archive restores through the command line as well.
+	c := newCLI(t)
+	var archive bytes.Buffer
+	if _, err := bs.writeBackup(context.Background(), &archive); err != nil {
+		t.Fatal(err)
+	}
+	path := t.TempDir() + "/backup.tar.gz"
+	if err := ioutil.WriteFile(path, archive.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if out := c.mustRun("restore", path); !strings.Contains(out, `"books":1`) {
+		t.Errorf("restore: got %q", out)
+	}
+	if code, _, _ := c.run("restore", path); code != exitError {
+		t.Errorf("restore into a non-empty database: got exit code %d", code)
+	}
+}
@@ -30,23 +30,45 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"cloud.google.com/go/errorreporting"
-	"cloud.google.com/go/storage"
 )
 
 // Book holds metadata about a book.
 type Book struct {
-	ID            uint   `gorm:"column:id;primary_key"`
-	Title         string `gorm:"column:title"`
-	Author        string `gorm:"column:author"`
-	PublishedDate string `gorm:"column:published_at"`
-	ImageURL      string `gorm:"column:image_url"`
-	Description   string `gorm:"column:description"`
+	ID     uint   `gorm:"column:id;primary_key"`
+	Title  string `gorm:"column:title"`
+	Author string `gorm:"column:author"`
+	// PublishedDate is stored in the published_year, published_month and
+	// published_day columns, see date.go.
+	PublishedDate PartialDate `gorm:"embedded;embedded_prefix:published_"`
+	ImageURL      string      `gorm:"column:image_url"`
+	Description   string      `gorm:"column:description"`
+
+	// Credits are kept by an AuthorDatabase, see authors.go. Author holds
+	// them formatted by creditLine.
+	Credits []Credit `gorm:"-" json:",omitempty"`
+
+	// Genres are taken from the vocabulary of the BookDatabase; Tags are
+	// free-form. Both are stored with the book, see labels.go.
+	Genres []string `gorm:"-" json:",omitempty"`
+	Tags   []string `gorm:"-" json:",omitempty"`
+
+	// Series is kept by a SeriesDatabase, see series.go.
+	Series *SeriesEntry `gorm:"-" json:",omitempty"`
 }
 
+// errNotFound is wrapped by the errors of databases for missing entries.
+var errNotFound = errors.New("not found")
+
 // BookDatabase provides thread-safe access to a database of books.
 type BookDatabase interface {
 	// ListBooks returns a list of books, ordered by title.
@@ -63,14 +85,171 @@ type BookDatabase interface {
 
 	// UpdateBook updates the entry for a given book.
 	UpdateBook(b *Book) error
+
+	// QueryBooks returns the books selected by q, in its order.
+	QueryBooks(q BookQuery) ([]*Book, error)
+
+	// Facets counts the genres, tags, authors and decades of the books
+	// selected by q.
+	Facets(q BookQuery) (*Facets, error)
+
+	// ListGenres returns the genre vocabulary, in its order.
+	ListGenres() ([]string, error)
+
+	// AddGenre adds a genre to the end of the vocabulary.
+	AddGenre(name string) error
+}
+
+// Orders of BookQuery.
+const (
+	sortTitle         = "title"      // by title, the default.
+	sortPublished     = "published"  // oldest first.
+	sortPublishedDesc = "-published" // newest first.
+	sortRating        = "-rating"    // best rated first, see reviews.go.
+)
+
+// BookQuery selects and orders books.
+type BookQuery struct {
+	// PublishedFrom and PublishedTo bound the year of publication,
+	// inclusively, when not 0. Books of unknown date are left out then.
+	PublishedFrom int
+	PublishedTo   int
+	// Genre, Tag and AuthorID select the books with that genre, tag or
+	// credited author when set.
+	Genre    string
+	Tag      string
+	AuthorID uint
+	// Sort is sortTitle, sortPublished, sortPublishedDesc or sortRating.
+	// Books of unknown date come last when sorting by date, books without
+	// ratings when sorting by rating.
+	Sort string
+}
+
+// validate checks the query is one QueryBooks understands.
+func (q BookQuery) validate() error {
+	switch q.Sort {
+	case "", sortTitle, sortPublished, sortPublishedDesc, sortRating:
+	default:
+		return fmt.Errorf("unknown sort order %q", q.Sort)
+	}
+	if q.PublishedFrom != 0 && q.PublishedTo != 0 && q.PublishedFrom > q.PublishedTo {
+		return fmt.Errorf("published from %d after %d", q.PublishedFrom, q.PublishedTo)
+	}
+	return nil
+}
+
+// match reports whether book is selected by q, leaving AuthorID to the
+// database.
+func (q BookQuery) match(book *Book) bool {
+	year := book.PublishedDate.Year
+	if q.PublishedFrom != 0 && (year == 0 || year < q.PublishedFrom) {
+		return false
+	}
+	if q.PublishedTo != 0 && (year == 0 || year > q.PublishedTo) {
+		return false
+	}
+	if q.Genre != "" && !containsFold(book.Genres, q.Genre) {
+		return false
+	}
+	if q.Tag != "" && !containsFold(book.Tags, q.Tag) {
+		return false
+	}
+	return true
+}
+
+func containsFold(values []string, s string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// sortBooks orders books as q asks for, breaking ties by title and ID.
+func (q BookQuery) sortBooks(books []*Book) {
+	sort.Slice(books, func(i, j int) bool {
+		a, b := books[i], books[j]
+		if q.Sort == sortPublished || q.Sort == sortPublishedDesc {
+			if a.PublishedDate.IsZero() != b.PublishedDate.IsZero() {
+				return b.PublishedDate.IsZero()
+			}
+			c := a.PublishedDate.Compare(b.PublishedDate)
+			if q.Sort == sortPublishedDesc {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		if a.Title != b.Title {
+			return a.Title < b.Title
+		}
+		return a.ID < b.ID
+	})
 }
 
 // Bookshelf holds a BookDatabase and storage info.
 type Bookshelf struct {
 	DB BookDatabase
 
-	StorageBucket     *storage.BucketHandle
-	StorageBucketName string
+	// Users is nil unless DB also stores users.
+	Users UserDatabase
+	// Audit is nil unless DB also keeps an audit log.
+	Audit AuditLog
+	// Authors is nil unless DB also keeps authors.
+	Authors AuthorDatabase
+	// Series is nil unless DB also keeps series.
+	Series SeriesDatabase
+	// Collections is nil unless DB also keeps collections.
+	Collections CollectionDatabase
+	// Copies is nil unless DB also keeps copies.
+	Copies CopyDatabase
+	// Loans is nil unless DB also keeps loans.
+	Loans LoanDatabase
+	// Holds is nil unless DB also keeps holds.
+	Holds HoldDatabase
+	// Reminders is nil unless DB also keeps reminders.
+	Reminders ReminderDatabase
+	// Reviews is nil unless DB also keeps reviews.
+	Reviews ReviewDatabase
+
+	// Images stores cover images, see imagestore.go.
+	Images ImageStore
+
+	// imageLimits bounds uploaded cover images.
+	imageLimits ImageLimits
+	// imageSizes are the widths covers are resized to.
+	imageSizes []imageSize
+	// fetcher downloads covers imported from a URL, see remotecover.go.
+	fetcher *coverFetcher
+
+	// mailer sends reminders of loans when set, see reminders.go.
+	mailer mailer
+	// publicURL is where the links in emails lead.
+	publicURL string
+	// reminderLead is how long before the due date borrowers are reminded.
+	reminderLead time.Duration
+
+	// oidc is set when sign-in through an identity provider is enabled.
+	oidc *oidcProvider
+	// sessions signs session cookies.
+	sessions *sessionCodec
+
+	// trustProxy makes clientIP honor X-Forwarded-For.
+	trustProxy bool
+
+	// limiters maps from route group to its rate limit, see ratelimit.go.
+	limiters map[string]*rateLimiter
+	// maxRequestBytes caps the size of request bodies.
+	maxRequestBytes int64
+
+	// writes is held for reading by requests changing the catalog, and
+	// for writing while a backup takes its snapshot, see backup.go.
+	writes sync.RWMutex
+
+	// templateDir overrides the embedded templates when set, see template.go.
+	templateDir string
 
 	// logWriter is used for request logging and can be overridden for tests.
 	//
@@ -84,9 +263,55 @@ type Bookshelf struct {
 
 // NewBookshelf creates a new Bookshelf.
 func NewBookshelf(db BookDatabase) (*Bookshelf, error) {
+	sessions, err := newSessionCodec(os.Getenv("SESSION_SECRET"))
+	if err != nil {
+		return nil, err
+	}
 	b := &Bookshelf{
-		logWriter: os.Stderr,
-		DB:        db,
+		logWriter:       os.Stderr,
+		sessions:        sessions,
+		maxRequestBytes: defaultMaxRequestBytes,
+		imageLimits:     defaultImageLimits,
+		imageSizes:      defaultImageSizes,
+		fetcher:         newCoverFetcher(defaultCoverFetchTimeout, false),
+		reminderLead:    defaultReminderLead,
 	}
+	b.useDatabase(db)
 	return b, nil
 }
+
+// useDatabase sets the database of the bookshelf, and the optional
+// interfaces it implements.
+func (b *Bookshelf) useDatabase(db BookDatabase) {
+	b.DB = db
+	if users, ok := db.(UserDatabase); ok {
+		b.Users = users
+	}
+	if audit, ok := db.(AuditLog); ok {
+		b.Audit = audit
+	}
+	if authors, ok := db.(AuthorDatabase); ok {
+		b.Authors = authors
+	}
+	if series, ok := db.(SeriesDatabase); ok {
+		b.Series = series
+	}
+	if collections, ok := db.(CollectionDatabase); ok {
+		b.Collections = collections
+	}
+	if copies, ok := db.(CopyDatabase); ok {
+		b.Copies = copies
+	}
+	if loans, ok := db.(LoanDatabase); ok {
+		b.Loans = loans
+	}
+	if holds, ok := db.(HoldDatabase); ok {
+		b.Holds = holds
+	}
+	if reminders, ok := db.(ReminderDatabase); ok {
+		b.Reminders = reminders
+	}
+	if reviews, ok := db.(ReviewDatabase); ok {
+		b.Reviews = reviews
+	}
+}
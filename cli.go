@@ -0,0 +1,1410 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Exit codes of subcommands.
+const (
+	exitOK       = 0
+	exitError    = 1
+	exitUsage    = 2
+	exitNotFound = 3
+)
+
+// command is a subcommand of the bookshelf binary. Commands print results
+// as JSON to stdout, one value per line, and diagnostics to stderr.
+type command struct {
+	name  string
+	usage string
+	run   func(ctx context.Context, b *Bookshelf, args []string, stdout io.Writer) error
+	// sub are the subcommands of a group such as "books".
+	sub []command
+	// offline commands run without a database, b is nil.
+	offline bool
+}
+
+var commands = []command{
+	{
+		name:  "serve",
+		usage: "run the web server [-port 8080]",
+		run:   runServe,
+	},
+	{
+		name:  "books",
+		usage: "manage books",
+		sub: []command{
+			{name: "list", usage: "print books [-sort title|published|-published] [-from YEAR] [-to YEAR] [-genre G] [-tag T] [-author ID]", run: runBooksList},
+			{name: "facets", usage: "print the genres, tags, authors and decades of books, with the filters of list", run: runBooksFacets},
+			{name: "get", usage: "print a book: get ID", run: runBooksGet},
+			{name: "add", usage: "add a book [-title T] [-author A]... [-editor|-translator|-illustrator N]... [-published D] [-genre G]... [-tag T]... [-series S [-series-number N]] [-description D] [-image-url U]", run: runBooksAdd},
+			{name: "delete", usage: "delete books: delete ID...", run: runBooksDelete},
+		},
+	},
+	{
+		name:  "import",
+		usage: "add the books of a JSON Lines file, as written by export [FILE|-]",
+		run:   runImport,
+	},
+	{
+		name:  "export",
+		usage: "print all books as JSON Lines",
+		run:   runExport,
+	},
+	{
+		name:  "backup",
+		usage: "write a backup of books, users, audit log and covers [-out FILE]",
+		run:   runBackup,
+	},
+	{
+		name:  "restore",
+		usage: "load a backup into an empty database [-merge] FILE",
+		run:   runRestore,
+	},
+	{
+		name:  "users",
+		usage: "manage users",
+		sub: []command{
+			{name: "list", usage: "print all users", run: runUsersList},
+			{name: "create", usage: "create or update a user: -subject S [-issuer I] [-email E] [-name N] [-role viewer|staff|admin]", run: runUsersCreate},
+		},
+	},
+	{
+		name:  "genres",
+		usage: "manage the genre vocabulary",
+		sub: []command{
+			{name: "list", usage: "print the genres", run: runGenresList},
+			{name: "add", usage: "add a genre: add NAME", run: runGenresAdd},
+		},
+	},
+	{
+		name:  "series",
+		usage: "manage series",
+		sub: []command{
+			{name: "list", usage: "print all series", run: runSeriesList},
+			{name: "get", usage: "print the books of a series in reading order: get ID", run: runSeriesGet},
+			{name: "rename", usage: "change the name of a series: rename ID NAME", run: runSeriesRename},
+			{name: "convert-titles", usage: "move series written in titles, e.g. \"Dust (Silo, #3)\", into series [-dry-run]", run: runSeriesConvertTitles},
+		},
+	},
+	{
+		name:  "copies",
+		usage: "manage the physical copies of books",
+		sub: []command{
+			{name: "list", usage: "print the copies of a book: list BOOK", run: runCopiesList},
+			{name: "add", usage: "add a copy of a book: add -barcode CODE [-location L] [-condition C] [-acquired DATE] [-price 12.50] BOOK", run: runCopiesAdd},
+			{name: "delete", usage: "delete copies: delete ID...", run: runCopiesDelete},
+		},
+	},
+	{
+		name:  "loans",
+		usage: "lend copies of books",
+		sub: []command{
+			{name: "list", usage: "print loans, newest first [-book ID] [-user ID] [-active]", run: runLoansList},
+			{name: "checkout", usage: "lend a copy to a user: checkout -user ID [-due 2006-01-02] BARCODE", run: runLoansCheckOut},
+			{name: "checkin", usage: "end the loan of a copy: checkin BARCODE", run: runLoansCheckIn},
+		},
+	},
+	{
+		name:  "holds",
+		usage: "queue users for books which are out",
+		sub: []command{
+			{name: "list", usage: "print holds, oldest first [-book ID] [-user ID] [-active]", run: runHoldsList},
+			{name: "place", usage: "queue a user for a book: place -user ID BOOK", run: runHoldsPlace},
+			{name: "cancel", usage: "cancel holds: cancel ID...", run: runHoldsCancel},
+			{name: "expire", usage: "close the holds not picked up in time", run: runHoldsExpire},
+		},
+	},
+	{
+		name:  "reminders",
+		usage: "email borrowers about loans due soon or overdue",
+		sub: []command{
+			{name: "send", usage: "queue the reminders due and send the pending ones through SMTP_ADDR", run: runRemindersSend},
+			{name: "log", usage: "print the delivery log, newest first [-user ID] [-status S] [-limit N]", run: runRemindersLog},
+			{name: "opt-out", usage: "stop reminding a user: opt-out [-undo] USER", run: runRemindersOptOut},
+		},
+	},
+	{
+		name:  "reviews",
+		usage: "moderate the reviews of books",
+		sub: []command{
+			{name: "list", usage: "print reviews, newest first [-book ID] [-user ID] [-limit N]", run: runReviewsList},
+			{name: "hide", usage: "take reviews down from the site: hide [-undo] ID...", run: runReviewsHide},
+			{name: "delete", usage: "delete reviews: delete ID...", run: runReviewsDelete},
+		},
+	},
+	{
+		name:  "authors",
+		usage: "manage authors",
+		sub: []command{
+			{name: "list", usage: "print authors [-q NAME]", run: runAuthorsList},
+			{name: "rename", usage: "change the name of an author: rename ID NAME", run: runAuthorsRename},
+			{name: "merge", usage: "credit the books of an author to another and remove it: merge FROM INTO", run: runAuthorsMerge},
+		},
+	},
+	{
+		name:  "reindex",
+		usage: "rebuild the data derived from books, such as resized covers",
+		run:   runReindex,
+	},
+	{
+		name:  "thumbnails",
+		usage: "generate the resized variants of every stored cover",
+		run:   runThumbnails,
+	},
+	{
+		name:  "gc-images",
+		usage: "delete stored images no book refers to [-dry-run] [-grace 24h]",
+		run:   runImageGC,
+	},
+	{
+		name:  "migrate",
+		usage: "migrate the database schema: up, down [N], goto V, force V or status",
+		run:   runMigrate,
+	},
+	{
+		name:  "convert-dates",
+		usage: "parse the free-text publication dates left by migration 4 and report the others [-dry-run]",
+		run:   runConvertDates,
+	},
+	{
+		name:    "dump-migrations",
+		usage:   "write the built-in SQL migrations to a directory [-out migrations]",
+		run:     runDumpMigrations,
+		offline: true,
+	},
+}
+
+// usageError is returned for bad command lines.
+type usageError struct {
+	msg string
+}
+
+func (e *usageError) Error() string { return e.msg }
+
+func usagef(format string, v ...interface{}) error {
+	return &usageError{msg: fmt.Sprintf(format, v...)}
+}
+
+// runCommand runs the subcommand named by args and returns the exit code.
+// newBookshelf is only called for commands which need the database.
+func runCommand(ctx context.Context, newBookshelf func(context.Context) (*Bookshelf, error), args []string, stdout, stderr io.Writer) int {
+	cmds, path := commands, "bookshelf"
+	for {
+		if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "-help" {
+			printUsage(stderr, path, cmds)
+			return exitUsage
+		}
+		c, ok := findCommand(cmds, args[0])
+		if !ok {
+			fmt.Fprintf(stderr, "%s: unknown command %q\n\n", path, args[0])
+			printUsage(stderr, path, cmds)
+			return exitUsage
+		}
+		path += " " + c.name
+		args = args[1:]
+		if c.sub != nil {
+			cmds = c.sub
+			continue
+		}
+
+		var b *Bookshelf
+		if !c.offline {
+			var err error
+			if b, err = newBookshelf(ctx); err != nil {
+				fmt.Fprintf(stderr, "%s: %v\n", path, err)
+				return exitError
+			}
+		}
+		err := c.run(ctx, b, args, stdout)
+		var usage *usageError
+		switch {
+		case err == nil:
+			return exitOK
+		case errors.Is(err, flag.ErrHelp):
+			return exitUsage
+		case errors.As(err, &usage):
+			fmt.Fprintf(stderr, "%s: %v\nusage: %s %s\n", path, err, path, c.usage)
+			return exitUsage
+		case errors.Is(err, errNotFound):
+			fmt.Fprintf(stderr, "%s: %v\n", path, err)
+			return exitNotFound
+		}
+		fmt.Fprintf(stderr, "%s: %v\n", path, err)
+		return exitError
+	}
+}
+
+func findCommand(cmds []command, name string) (command, bool) {
+	for _, c := range cmds {
+		if c.name == name {
+			return c, true
+		}
+	}
+	return command{}, false
+}
+
+func printUsage(w io.Writer, path string, cmds []command) {
+	fmt.Fprintf(w, "usage: %s <command> [arguments]\n\nCommands:\n", path)
+	for _, c := range cmds {
+		fmt.Fprintf(w, "  %-16s %s\n", c.name, c.usage)
+	}
+}
+
+// parseFlags parses the flags of a command. Flag errors are usage errors.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	fs.SetOutput(ioutil.Discard)
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return usagef("flags:%s", flagDefaults(fs))
+		}
+		return usagef("%v", err)
+	}
+	return nil
+}
+
+func flagDefaults(fs *flag.FlagSet) string {
+	var b strings.Builder
+	fs.VisitAll(func(f *flag.Flag) {
+		fmt.Fprintf(&b, "\n  -%s\t%s", f.Name, f.Usage)
+	})
+	return b.String()
+}
+
+func parseID(s string) (uint, error) {
+	id, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || id == 0 {
+		return 0, usagef("bad ID %q", s)
+	}
+	return uint(id), nil
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+func runServe(ctx context.Context, b *Bookshelf, args []string, stdout io.Writer) error {
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	fs.StringVar(&port, "port", port, "port to listen on")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	return b.serve(ctx, port)
+}
+
+// parseBookQuery parses the filters of books list and books facets.
+func parseBookQuery(name string, args []string) (BookQuery, error) {
+	var q BookQuery
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&q.Sort, "sort", sortTitle, "order: title, published, -published or -rating")
+	fs.IntVar(&q.PublishedFrom, "from", 0, "first year of publication")
+	fs.IntVar(&q.PublishedTo, "to", 0, "last year of publication")
+	fs.StringVar(&q.Genre, "genre", "", "only books of this genre")
+	fs.StringVar(&q.Tag, "tag", "", "only books with this tag")
+	fs.UintVar(&q.AuthorID, "author", 0, "only books crediting the author with this ID")
+	if err := parseFlags(fs, args); err != nil {
+		return q, err
+	}
+	if fs.NArg() != 0 {
+		return q, usagef("unexpected arguments %q", fs.Args())
+	}
+	if err := q.validate(); err != nil {
+		return q, usagef("%v", err)
+	}
+	return q, nil
+}
+
+func runBooksList(ctx context.Context, b *Bookshelf, args []string, stdout io.Writer) error {
+	q, err := parseBookQuery("books list", args)
+	if err != nil {
+		return err
+	}
+	books, err := b.DB.QueryBooks(q)
+	if err != nil {
+		return err
+	}
+	for _, book := range books {
+		if err := writeJSON(stdout, book); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runBooksFacets(ctx context.Context, b *Bookshelf, args []string, stdout io.Writer) error {
+	q, err := parseBookQuery("books facets", args)
+	if err != nil {
+		return err
+	}
+	facets, err := b.DB.Facets(q)
+	if err != nil {
+		return err
+	}
+	return writeJSON(stdout, facets)
+}
+
+// stringsFlag collects the values of a flag which may be repeated.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *stringsFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+// creditFlag adds a credit in role for each use of the flag.
+type creditFlag struct {
+	role    string
+	credits *[]Credit
+}
+
+func (f *creditFlag) String() string { return "" }
+
+func (f *creditFlag) Set(name string) error {
+	*f.credits = append(*f.credits, Credit{Name: name, Role: f.role})
+	return nil
+}
+
+func runBooksGet(ctx context.Context, b *Bookshelf, args []string, stdout io.Writer) error {
+	if len(args) != 1 {
+		return usagef("want exactly one ID")
+	}
+	id, err := parseID(args[0])
+	if err != nil {
+		return err
+	}
+	book, err := b.DB.GetBook(id)
+	if err != nil {
+		return err
+	}
+	if err := b.loadCredits(book); err != nil {
+		return err
+	}
+	if err := b.loadSeries(book); err != nil {
+		return err
+	}
+	return writeJSON(stdout, book)
+}
+
+func runBooksAdd(ctx context.Context, b *Bookshelf, args []string, stdout io.Writer) error {
+	book := &Book{}
+	fs := flag.NewFlagSet("books add", flag.ContinueOnError)
+	fs.StringVar(&book.Title, "title", "", "title of the book")
+	for _, role := range creditRoles {
+		fs.Var(&creditFlag{role: role, credits: &book.Credits}, role, role+" of the book, may be repeated")
+	}
+	fs.Var(&book.PublishedDate, "published", "publication date, e.g. 1965 or 1965-03-01")
+	fs.Var((*stringsFlag)(&book.Genres), "genre", "genre of the book, may be repeated")
+	fs.Var((*stringsFlag)(&book.Tags), "tag", "tag of the book, may be repeated")
+	series := &SeriesEntry{}
+	fs.StringVar(&series.Name, "series", "", "series of the book")
+	fs.Float64Var(&series.Number, "series-number", 0, "number of the book in its series, e.g. 3 or 2.5")
+	fs.StringVar(&book.Description, "description", "", "description of the book")
+	fs.StringVar(&book.ImageURL, "image-url", "", "URL of the cover")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if book.Title == "" {
+		return usagef("-title is required")
+	}
+	if err := prepareCredits(book); err != nil {
+		return usagef("%v", err)
+	}
+	if err := b.prepareLabels(book); err != nil {
+		return usagef("%v", err)
+	}
+	entry, err := normalizeSeries(series)
+	if err != nil {
+		return usagef("%v", err)
+	}
+	book.Series = entry
+	id, err := b.DB.AddBook(book)
+	if err != nil {
+		return err
+	}
+	book.ID = id
+	if err := b.saveCredits(book); err != nil {
+		return err
+	}
+	if err := b.saveSeries(book); err != nil {
+		return err
+	}
+	if err := b.auditCLI(AuditCreate, id, nil, book); err != nil {
+		return err
+	}
+	return writeJSON(stdout, struct {
+		ID uint `json:"id"`
+	}{id})
+}
+
+func runBooksDelete(ctx context.Context, b *Bookshelf, args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return usagef("want at least one ID")
+	}
+	var ids []uint
+	for _, a := range args {
+		id, err := parseID(a)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+	for _, id := range ids {
+		book, err := b.DB.GetBook(id)
+		if err != nil {
+			return err
+		}
+		before := *book
+		if err := b.DB.DeleteBook(id); err != nil {
+			return err
+		}
+		if err := b.auditCLI(AuditDelete, id, &before, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxImportLine bounds the size of a book in an import file.
+const maxImportLine = 1 << 20
+
+func runImport(ctx context.Context, b *Bookshelf, args []string, stdout io.Writer) error {
+	if len(args) > 1 {
+		return usagef("want at most one file")
+	}
+	var in io.Reader = os.Stdin
+	if len(args) == 1 && args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	// All lines are parsed before anything is added, so that a broken
+	// file does not leave a partial import behind.
+	var books []*Book
+	s := bufio.NewScanner(in)
+	s.Buffer(make([]byte, 64*1024), maxImportLine)
+	for line := 1; s.Scan(); line++ {
+		if strings.TrimSpace(s.Text()) == "" {
+			continue
+		}
+		book := &Book{}
+		if err := json.Unmarshal(s.Bytes(), book); err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		if book.Title == "" {
+			return fmt.Errorf("line %d: book without title", line)
+		}
+		if err := prepareCredits(book); err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		if err := b.prepareLabels(book); err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		var err error
+		if book.Series, err = normalizeSeries(book.Series); err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		book.ID = 0
+		books = append(books, book)
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+
+	for _, book := range books {
+		id, err := b.DB.AddBook(book)
+		if err != nil {
+			return err
+		}
+		book.ID = id
+		if err := b.saveCredits(book); err != nil {
+			return err
+		}
+		if err := b.saveSeries(book); err != nil {
+			return err
+		}
+		if err := b.auditCLI(AuditCreate, id, nil, book); err != nil {
+			return err
+		}
+	}
+	return writeJSON(stdout, struct {
+		Imported int `json:"imported"`
+	}{len(books)})
+}
+
+func runExport(ctx context.Context, b *Bookshelf, args []string, stdout io.Writer) error {
+	if len(args) != 0 {
+		return usagef("unexpected arguments %q", args)
+	}
+	books, err := b.DB.ListBooks()
+	if err != nil {
+		return err
+	}
+	sort.Slice(books, func(i, j int) bool {
+		return books[i].ID < books[j].ID
+	})
+	if err := b.loadCredits(books...); err != nil {
+		return err
+	}
+	if err := b.loadSeries(books...); err != nil {
+		return err
+	}
+	for _, book := range books {
+		if err := writeJSON(stdout, book); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runUsersList(ctx context.Context, b *Bookshelf, args []string, stdout io.Writer) error {
+	if b.Users == nil {
+		return errNoUsers
+	}
+	users, err := b.Users.ListUsers()
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		if err := writeJSON(stdout, u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runUsersCreate(ctx context.Context, b *Bookshelf, args []string, stdout io.Writer) error {
+	if b.Users == nil {
+		return errNoUsers
+	}
+	u := &User{}
+	var role string
+	fs := flag.NewFlagSet("users create", flag.ContinueOnError)
+	fs.StringVar(&u.Issuer, "issuer", os.Getenv("OIDC_ISSUER_URL"), "issuer of the identity provider")
+	fs.StringVar(&u.Subject, "subject", "", "subject of the user at the identity provider")
+	fs.StringVar(&u.Email, "email", "", "email address")
+	fs.StringVar(&u.Name, "name", "", "display name")
+	fs.StringVar(&role, "role", string(RoleViewer), "viewer, staff or admin")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if u.Subject == "" {
+		return usagef("-subject is required")
+	}
+	var err error
+	if u.Role, err = parseRole(role); err != nil {
+		return usagef("%v", err)
+	}
+	// Keep what logging in recorded.
+	if old, err := b.Users.FindUser(u.Issuer, u.Subject); err == nil {
+		u.LastLoginAt = old.LastLoginAt
+		if u.Email == "" {
+			u.Email = old.Email
+		}
+		if u.Name == "" {
+			u.Name = old.Name
+		}
+	} else if !errors.Is(err, errNotFound) {
+		return err
+	}
+	if u.ID, err = b.Users.UpsertUser(u); err != nil {
+		return err
+	}
+	return writeJSON(stdout, u)
+}
+
+func runGenresList(ctx context.Context, b *Bookshelf, args []string, stdout io.Writer) error {
+	if len(args) != 0 {
+		return usagef("unexpected arguments %q", args)
+	}
+	genres, err := b.DB.ListGenres()
+	if err != nil {
+		return err
+	}
+	for _, g := range genres {
+		if err := writeJSON(stdout, g); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runGenresAdd(ctx context.Context, b *Bookshelf, args []string, stdout io.Writer) error {
+	if len(args) != 1 {
+		return usagef("want a name")
+	}
+	name := normalizeLabel(args[0])
+	if name == "" || len(name) > maxLabel {
+		return usagef("bad name %q", args[0])
+	}
+	return b.DB.AddGenre(name)
+}
+
+func runSeriesList(ctx context.Context, b *Bookshelf, args []string, stdout io.Writer) error {
+	if b.Series == nil {
+		return errNoSeries
+	}
+	if len(args) != 0 {
+		return usagef("unexpected arguments %q", args)
+	}
+	series, err := b.Series.ListSeries()
+	if err != nil {
+		return err
+	}
+	for _, s := range series {
+		if err := writeJSON(stdout, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runSeriesGet(ctx context.Context, b *Bookshelf, args []string, stdout io.Writer) error {
+	if b.Series == nil {
+		return errNoSeries
+	}
+	if len(args) != 1 {
+		return usagef("want exactly one ID")
+	}
+	id, err := parseID(args[0])
+	if err != nil {
+		return err
+	}
+	volumes, err := b.Series.Volumes(id)
+	if err != nil {
+		return err
+	}
+	for _, v := range volumes {
+		err := writeJSON(stdout, struct {
+			Number float64 `json:"number,omitempty"`
+			ID     uint    `json:"id"`
+			Title  string  `json:"title"`
+		}{v.Number, v.Book.ID, v.Book.Title})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runSeriesRename(ctx context.Context, b *Bookshelf, args []string, stdout io.Writer) error {
+	if b.Series == nil {
+		return errNoSeries
+	}
+	if len(args) != 2 {
+		return usagef("want an ID and a name")
+	}
+	id, err := parseID(args[0])
+	if err != nil {
+		return err
+	}
+	e, err := normalizeSeries(&SeriesEntry{Name: args[1]})
+	if err != nil || e == nil {
+		return usagef("bad name %q", args[1])
+	}
+	return b.Series.RenameSeries(id, e.Name)
+}
+
+func runSeriesConvertTitles(ctx context.Context, b *Bookshelf, args []string, stdout io.Writer) error {
+	if b.Series == nil {
+		return errNoSeries
+	}
+	fs := flag.NewFlagSet("series convert-titles", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "only report what would be converted")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return usagef("unexpected arguments %q", fs.Args())
+	}
+	report, err := b.convertSeriesTitles(*dryRun)
+	if report != nil {
+		if err := writeJSON(stdout, report); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func runCopiesList(ctx context.Context, b *Bookshelf, args []string, stdout io.Writer) error {
+	if b.Copies == nil {
+		return errNoCopies
+	}
+	if len(args) != 1 {
+		return usagef("want exactly one book ID")
+	}
+	id, err := parseID(args[0])
+	if err != nil {
+		return err
+	}
+	if _, err := b.DB.GetBook(id); err != nil {
+		return err
+	}
+	copies, err := b.Copies.ListCopies(id)
+	if err != nil {
+		return err
+	}
+	for _, c := range copies {
+		if err := writeJSON(stdout, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runCopiesAdd(ctx context.Context, b *Bookshelf, args []string, stdout io.Writer) error {
+	if b.Copies == nil {
+		return errNoCopies
+	}
+	c := &Copy{}
+	fs := flag.NewFlagSet("copies add", flag.ContinueOnError)
+	fs.StringVar(&c.Barcode, "barcode", "", "barcode of the copy")
+	fs.StringVar(&c.Location, "location", "", "where the copy is kept")
+	fs.StringVar(&c.Condition, "condition", conditionGood, "condition: "+strings.Join(copyConditions, ", "))
+	acquired := fs.String("acquired", "", "when the copy was acquired, e.g. 2019-04")
+	price := fs.String("price", "", "what the copy cost, e.g. 12.50")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usagef("want exactly one book ID")
+	}
+	var err error
+	if c.BookID, err = parseID(fs.Arg(0)); err != nil {
+		return err
+	}
+	if c.Acquired, err = parsePartialDate(*acquired); err != nil {
+		return usagef("%v", err)
+	}
+	if c.Price, err = parsePrice(*price); err != nil {
+		return usagef("%v", err)
+	}
+	if err := normalizeCopy(c); err != nil {
+		return usagef("%v", err)
+	}
+	if _, err := b.Copies.AddCopy(c); err != nil {
+		return err
+	}
+	return writeJSON(stdout, c)
+}
+
+func runCopiesDelete(ctx context.Context, b *Bookshelf, args []string, stdout io.Writer) error {
+	if b.Copies == nil {
+		return errNoCopies
+	}
+	if len(args) == 0 {
+		return usagef("want at least one ID")
+	}
+	var ids []uint
+	for _, a := range args {
+		id, err := parseID(a)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+	for _, id := range ids {
+		if err := b.Copies.DeleteCopy(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runLoansList(ctx context.Context, b *Bookshelf, args []string, stdout io.Writer) error {
+	if b.Loans == nil {
+		return errNoLoans
+	}
+	fs := flag.NewFlagSet("loans list", flag.ContinueOnError)
+	bookID := fs.Uint("book", 0, "only list the loans of the copies of this book")
+	userID := fs.Uint("user", 0, "only list the loans of this user")
+	active := fs.Bool("active", false, "only list copies not returned yet")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return usagef("unexpected arguments %q", fs.Args())
+	}
+	loans, err := b.Loans.ListLoans(LoanFilter{BookID: *bookID, UserID: *userID, Active: *active})
+	if err != nil {
+		return err
+	}
+	for _, l := range loans {
+		if err := writeJSON(stdout, l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runLoansCheckOut(ctx context.Context, b *Bookshelf, args []string, stdout io.Writer) error {
+	if b.Loans == nil {
+		return errNoLoans
+	}
+	if b.Users == nil {
+		return errNoUsers
+	}
+	fs := flag.NewFlagSet("loans checkout", flag.ContinueOnError)
+	userID := fs.Uint("user", 0, "ID of the borrower")
+	due := fs.String("due", "", "day the copy is due back, by default in two weeks")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usagef("want exactly one barcode")
+	}
+	if *userID == 0 {
+		return usagef("-user is required")
+	}
+	if _, err := b.Users.GetUser(*userID); err != nil {
+		return err
+	}
+	c, err := b.Copies.FindCopy(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	l := &Loan{CopyID: c.ID, UserID: *userID, CheckedOut: now}
+	if l.Due, err = dueDate(now, *due); err != nil {
+		return usagef("%v", err)
+	}
+	if _, err := b.Loans.CheckOut(l); err != nil {
+		return err
+	}
+	return writeJSON(stdout, l)
+}
+
+func runLoansCheckIn(ctx context.Context, b *Bookshelf, args []string, stdout io.Writer) error {
+	if b.Loans == nil {
+		return errNoLoans
+	}
+	if len(args) != 1 {
+		return usagef("want exactly one barcode")
+	}
+	c, err := b.Copies.FindCopy(args[0])
+	if err != nil {
+		return err
+	}
+	l, err := b.Loans.CheckIn(c.ID, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	return writeJSON(stdout, l)
+}
+
+func runHoldsList(ctx context.Context, b *Bookshelf, args []string, stdout io.Writer) error {
+	if b.Holds == nil {
+		return errNoHolds
+	}
+	fs := flag.NewFlagSet("holds list", flag.ContinueOnError)
+	bookID := fs.Uint("book", 0, "only list the holds on this book")
+	userID := fs.Uint("user", 0, "only list the holds of this user")
+	active := fs.Bool("active", false, "only list waiting and ready holds")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return usagef("unexpected arguments %q", fs.Args())
+	}
+	holds, err := b.Holds.ListHolds(HoldFilter{BookID: *bookID, UserID: *userID, Active: *active})
+	if err != nil {
+		return err
+	}
+	for _, h := range holds {
+		if err := writeJSON(stdout, h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runHoldsPlace(ctx context.Context, b *Bookshelf, args []string, stdout io.Writer) error {
+	if b.Holds == nil {
+		return errNoHolds
+	}
+	if b.Users == nil {
+		return errNoUsers
+	}
+	fs := flag.NewFlagSet("holds place", flag.ContinueOnError)
+	userID := fs.Uint("user", 0, "ID of the holder")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usagef("want exactly one book ID")
+	}
+	if *userID == 0 {
+		return usagef("-user is required")
+	}
+	bookID, err := parseID(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if _, err := b.Users.GetUser(*userID); err != nil {
+		return err
+	}
+	h := &Hold{BookID: bookID, UserID: *userID, Placed: time.Now().UTC()}
+	if _, err := b.Holds.PlaceHold(h); err != nil {
+		return err
+	}
+	return writeJSON(stdout, h)
+}
+
+func runHoldsCancel(ctx context.Context, b *Bookshelf, args []string, stdout io.Writer) error {
+	if b.Holds == nil {
+		return errNoHolds
+	}
+	if len(args) == 0 {
+		return usagef("want at least one ID")
+	}
+	var ids []uint
+	for _, a := range args {
+		id, err := parseID(a)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+	for _, id := range ids {
+		if err := b.Holds.CancelHold(id, time.Now().UTC()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runHoldsExpire(ctx context.Context, b *Bookshelf, args []string, stdout io.Writer) error {
+	if b.Holds == nil {
+		return errNoHolds
+	}
+	if len(args) != 0 {
+		return usagef("unexpected arguments %q", args)
+	}
+	expired, err := b.Holds.ExpireHolds(time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	for _, h := range expired {
+		if err := writeJSON(stdout, h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runRemindersSend(ctx context.Context, b *Bookshelf, args []string, stdout io.Writer) error {
+	if len(args) != 0 {
+		return usagef("unexpected arguments %q", args)
+	}
+	report, err := b.sendReminders(ctx, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	return writeJSON(stdout, report)
+}
+
+func runRemindersLog(ctx context.Context, b *Bookshelf, args []string, stdout io.Writer) error {
+	if b.Reminders == nil {
+		return errNoReminders
+	}
+	fs := flag.NewFlagSet("reminders log", flag.ContinueOnError)
+	userID := fs.Uint("user", 0, "only list the reminders of this user")
+	status := fs.String("status", "", "only list reminders with this status: pending, sent, failed or skipped")
+	limit := fs.Int("limit", 0, "list this many reminders at most")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return usagef("unexpected arguments %q", fs.Args())
+	}
+	reminders, err := b.Reminders.ListReminders(ReminderFilter{UserID: *userID, Status: *status, Limit: *limit})
+	if err != nil {
+		return err
+	}
+	for _, r := range reminders {
+		if err := writeJSON(stdout, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runRemindersOptOut(ctx context.Context, b *Bookshelf, args []string, stdout io.Writer) error {
+	if b.Reminders == nil {
+		return errNoReminders
+	}
+	fs := flag.NewFlagSet("reminders opt-out", flag.ContinueOnError)
+	undo := fs.Bool("undo", false, "remind the user again")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usagef("want exactly one user ID")
+	}
+	id, err := parseID(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	return b.Reminders.SetOptOut(id, !*undo)
+}
+
+func runReviewsList(ctx context.Context, b *Bookshelf, args []string, stdout io.Writer) error {
+	if b.Reviews == nil {
+		return errNoReviews
+	}
+	fs := flag.NewFlagSet("reviews list", flag.ContinueOnError)
+	bookID := fs.Uint("book", 0, "only list the reviews of this book")
+	userID := fs.Uint("user", 0, "only list the reviews by this user")
+	limit := fs.Int("limit", 0, "list this many reviews at most")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return usagef("unexpected arguments %q", fs.Args())
+	}
+	reviews, err := b.Reviews.ListReviews(ReviewFilter{BookID: *bookID, UserID: *userID, Limit: *limit})
+	if err != nil {
+		return err
+	}
+	for _, r := range reviews {
+		if err := writeJSON(stdout, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runReviewsHide(ctx context.Context, b *Bookshelf, args []string, stdout io.Writer) error {
+	if b.Reviews == nil {
+		return errNoReviews
+	}
+	fs := flag.NewFlagSet("reviews hide", flag.ContinueOnError)
+	undo := fs.Bool("undo", false, "show the reviews again")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return usagef("want at least one ID")
+	}
+	var ids []uint
+	for _, a := range fs.Args() {
+		id, err := parseID(a)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+	for _, id := range ids {
+		if err := b.Reviews.HideReview(id, !*undo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runReviewsDelete(ctx context.Context, b *Bookshelf, args []string, stdout io.Writer) error {
+	if b.Reviews == nil {
+		return errNoReviews
+	}
+	if len(args) == 0 {
+		return usagef("want at least one ID")
+	}
+	var ids []uint
+	for _, a := range args {
+		id, err := parseID(a)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+	for _, id := range ids {
+		if err := b.Reviews.DeleteReview(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runAuthorsList(ctx context.Context, b *Bookshelf, args []string, stdout io.Writer) error {
+	if b.Authors == nil {
+		return errNoAuthors
+	}
+	fs := flag.NewFlagSet("authors list", flag.ContinueOnError)
+	q := fs.String("q", "", "only authors whose names contain this")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	authors, err := b.Authors.SearchAuthors(*q, 0)
+	if err != nil {
+		return err
+	}
+	for _, a := range authors {
+		if err := writeJSON(stdout, a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// auditCreditLine records the books whose Author changed with an author.
+func (b *Bookshelf) auditCreditLine(id uint, before, after *Book) error {
+	return b.auditCLI(AuditUpdate, id, before, after)
+}
+
+func runAuthorsRename(ctx context.Context, b *Bookshelf, args []string, stdout io.Writer) error {
+	if b.Authors == nil {
+		return errNoAuthors
+	}
+	if len(args) != 2 {
+		return usagef("want an ID and a name")
+	}
+	id, err := parseID(args[0])
+	if err != nil {
+		return err
+	}
+	name := strings.Join(strings.Fields(args[1]), " ")
+	if name == "" || len(name) > maxAuthorName {
+		return usagef("bad name %q", args[1])
+	}
+	if err := b.Authors.RenameAuthor(id, name); err != nil {
+		return err
+	}
+	return b.refreshCreditLines(id, b.auditCreditLine)
+}
+
+func runAuthorsMerge(ctx context.Context, b *Bookshelf, args []string, stdout io.Writer) error {
+	if b.Authors == nil {
+		return errNoAuthors
+	}
+	if len(args) != 2 {
+		return usagef("want the IDs of two authors")
+	}
+	from, err := parseID(args[0])
+	if err != nil {
+		return err
+	}
+	into, err := parseID(args[1])
+	if err != nil {
+		return err
+	}
+	if err := b.Authors.MergeAuthors(from, into); err != nil {
+		return err
+	}
+	return b.refreshCreditLines(into, b.auditCreditLine)
+}
+
+func runReindex(ctx context.Context, b *Bookshelf, args []string, stdout io.Writer) error {
+	if len(args) != 0 {
+		return usagef("unexpected arguments %q", args)
+	}
+	return runThumbnails(ctx, b, args, stdout)
+}
+
+func runThumbnails(ctx context.Context, b *Bookshelf, args []string, stdout io.Writer) error {
+	return b.backfillThumbnails(ctx, func(format string, v ...interface{}) {
+		fmt.Fprintf(stdout, format+"\n", v...)
+	})
+}
+
+func runImageGC(ctx context.Context, b *Bookshelf, args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("gc-images", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "only report what would be deleted")
+	grace := fs.Duration("grace", defaultImageGCGrace, "keep unreferenced images younger than this")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	report, err := b.collectImages(ctx, *grace, *dryRun)
+	if err != nil {
+		return err
+	}
+	report.Write(stdout)
+	if len(report.Failed) > 0 {
+		return fmt.Errorf("%d images could not be deleted", len(report.Failed))
+	}
+	return nil
+}
+
+func runConvertDates(ctx context.Context, b *Bookshelf, args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("convert-dates", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "only report what would be converted")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	db, ok := uncachedDB(b.DB).(*DB)
+	if !ok {
+		return errors.New("only the MySQL database has free-text dates")
+	}
+	report, err := db.convertPublishedDates(*dryRun)
+	if err != nil {
+		return err
+	}
+	return writeJSON(stdout, report)
+}
+
+func runDumpMigrations(ctx context.Context, b *Bookshelf, args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("dump-migrations", flag.ContinueOnError)
+	out := fs.String("out", "migrations", "directory to write the migrations to")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	written, err := writeMigrations(*out)
+	for _, name := range written {
+		fmt.Fprintln(stdout, name)
+	}
+	return err
+}
+
+func runMigrate(ctx context.Context, b *Bookshelf, args []string, stdout io.Writer) error {
+	db, ok := uncachedDB(b.DB).(*DB)
+	if !ok {
+		return errors.New("only the MySQL database has migrations")
+	}
+	if len(args) == 0 {
+		return usagef("missing action")
+	}
+	number := func(def int) (int, error) {
+		if len(args) < 2 {
+			if def < 0 {
+				return 0, usagef("%s needs a version", args[0])
+			}
+			return def, nil
+		}
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 0 {
+			return 0, usagef("bad number %q", args[1])
+		}
+		return n, nil
+	}
+	logf := func(format string, v ...interface{}) {
+		fmt.Fprintf(stdout, format+"\n", v...)
+	}
+	return withMigrator(ctx, db.client.DB(), logf, func(m *migrator) error {
+		switch args[0] {
+		case "up":
+			return m.up(ctx)
+		case "down":
+			n, err := number(1)
+			if err != nil {
+				return err
+			}
+			return m.down(ctx, n)
+		case "goto":
+			v, err := number(-1)
+			if err != nil {
+				return err
+			}
+			return m.gotoVersion(ctx, v)
+		case "force":
+			v, err := number(-1)
+			if err != nil {
+				return err
+			}
+			return m.force(ctx, v)
+		case "status":
+			s, err := m.status(ctx)
+			if err != nil {
+				return err
+			}
+			dirty := ""
+			if s.Dirty {
+				dirty = " (dirty)"
+			}
+			fmt.Fprintf(stdout, "version %d%s, latest %d\n", s.Version, dirty, m.latest())
+			for _, mig := range s.Pending {
+				fmt.Fprintf(stdout, "pending %d_%s\n", mig.Version, mig.Name)
+			}
+			return nil
+		}
+		return usagef("unknown action %q", args[0])
+	})
+}
+
+func runBackup(ctx context.Context, b *Bookshelf, args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	out := fs.String("out", "", "file to write, stdout if empty")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *out == "" {
+		_, err := b.writeBackup(ctx, stdout)
+		return err
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	m, err := b.writeBackup(ctx, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(*out)
+		return err
+	}
+	m.Files = nil
+	return writeJSON(stdout, m)
+}
+
+func runRestore(ctx context.Context, b *Bookshelf, args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	merge := fs.Bool("merge", false, "add to the books in the database")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usagef("want exactly one backup file")
+	}
+	var in io.Reader = os.Stdin
+	if name := fs.Arg(0); name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	ob, err := unpackBackup(in)
+	if err != nil {
+		return err
+	}
+	defer ob.Close()
+	report, err := b.restore(ctx, ob, *merge)
+	if err != nil {
+		return err
+	}
+	return writeJSON(stdout, report)
+}
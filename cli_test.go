@@ -0,0 +1,168 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// cli runs subcommands against a memory database.
+type cli struct {
+	t  *testing.T
+	bs *Bookshelf
+}
+
+func newCLI(t *testing.T) *cli {
+	bs, _ := newTestBookshelf(t)
+	return &cli{t: t, bs: bs}
+}
+
+func (c *cli) run(args ...string) (code int, stdout, stderr string) {
+	c.t.Helper()
+	var out, errOut bytes.Buffer
+	newBookshelf := func(context.Context) (*Bookshelf, error) { return c.bs, nil }
+	code = runCommand(context.Background(), newBookshelf, args, &out, &errOut)
+	return code, out.String(), errOut.String()
+}
+
+// mustRun runs a command which must succeed.
+func (c *cli) mustRun(args ...string) string {
+	c.t.Helper()
+	code, out, errOut := c.run(args...)
+	if code != exitOK {
+		c.t.Fatalf("%q: exit code %d: %s", args, code, errOut)
+	}
+	return out
+}
+
+func TestCLIBooks(t *testing.T) {
+	c := newCLI(t)
+
+	var added struct{ ID uint }
+	out := c.mustRun("books", "add", "-title", "Dune", "-author", "Frank Herbert")
+	if err := json.Unmarshal([]byte(out), &added); err != nil || added.ID == 0 {
+		t.Fatalf("books add: got %q, %v", out, err)
+	}
+
+	var book Book
+	out = c.mustRun("books", "get", "1")
+	if err := json.Unmarshal([]byte(out), &book); err != nil || book.Title != "Dune" || book.Author != "Frank Herbert" {
+		t.Errorf("books get: got %q, %v", out, err)
+	}
+	if out := c.mustRun("books", "list"); strings.Count(out, "\n") != 1 {
+		t.Errorf("books list: got %q, want one line", out)
+	}
+
+	entries, err := c.bs.Audit.ListAudit(AuditFilter{})
+	if err != nil || len(entries) != 1 || !strings.HasPrefix(entries[0].Actor, "cli") {
+		t.Errorf("audit log: got %+v, %v", entries, err)
+	}
+
+	c.mustRun("books", "delete", "1")
+	for _, tc := range []struct {
+		args []string
+		want int
+	}{
+		{[]string{"books", "get", "1"}, exitNotFound},
+		{[]string{"books", "delete", "1"}, exitNotFound},
+		{[]string{"books", "get", "x"}, exitUsage},
+		{[]string{"books", "get"}, exitUsage},
+		{[]string{"books", "add"}, exitUsage},
+		{[]string{"books", "add", "-nope"}, exitUsage},
+		{[]string{"books", "shelve"}, exitUsage},
+		{[]string{"books"}, exitUsage},
+		{[]string{"frobnicate"}, exitUsage},
+	} {
+		if code, _, _ := c.run(tc.args...); code != tc.want {
+			t.Errorf("%q: got exit code %d, want %d", tc.args, code, tc.want)
+		}
+	}
+}
+
+func TestCLIExportImport(t *testing.T) {
+	c := newCLI(t)
+	c.mustRun("books", "add", "-title", "A", "-description", "first")
+	c.mustRun("books", "add", "-title", "B", "-published", "1965")
+
+	export := c.mustRun("export")
+	file := filepath.Join(t.TempDir(), "books.jsonl")
+	if err := ioutil.WriteFile(file, []byte(export), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	other := newCLI(t)
+	other.mustRun("books", "add", "-title", "existing")
+	if out := other.mustRun("import", file); strings.TrimSpace(out) != `{"imported":2}` {
+		t.Errorf("import: got %q", out)
+	}
+	books, _ := other.bs.DB.ListBooks()
+	if len(books) != 3 {
+		t.Fatalf("got %d books after import, want 3", len(books))
+	}
+	if books[0].Title != "A" || books[0].Description != "first" || books[0].ID == 1 {
+		t.Errorf("imported book: got %+v, want a new ID", books[0])
+	}
+
+	// A broken file is not imported at all.
+	if err := ioutil.WriteFile(file, []byte(export+"{broken\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if code, _, errOut := other.run("import", file); code != exitError || !strings.Contains(errOut, "line 3") {
+		t.Errorf("broken import: got exit code %d, %s", code, errOut)
+	}
+	if books, _ := other.bs.DB.ListBooks(); len(books) != 3 {
+		t.Errorf("broken import added books: got %d", len(books))
+	}
+}
+
+func TestCLIUsers(t *testing.T) {
+	c := newCLI(t)
+	out := c.mustRun("users", "create", "-issuer", "https://idp", "-subject", "42", "-email", "ada@example.com", "-role", "admin")
+	var u User
+	if err := json.Unmarshal([]byte(out), &u); err != nil || u.Role != RoleAdmin || u.ID == 0 {
+		t.Fatalf("users create: got %q, %v", out, err)
+	}
+
+	// Updating keeps what is not given.
+	c.mustRun("users", "create", "-issuer", "https://idp", "-subject", "42", "-role", "staff")
+	got, err := c.bs.Users.FindUser("https://idp", "42")
+	if err != nil || got.Role != RoleStaff || got.Email != "ada@example.com" {
+		t.Errorf("after update: got %+v, %v", got, err)
+	}
+	if out := c.mustRun("users", "list"); strings.Count(out, "\n") != 1 {
+		t.Errorf("users list: got %q", out)
+	}
+	if code, _, _ := c.run("users", "create", "-subject", "1", "-role", "root"); code != exitUsage {
+		t.Errorf("unknown role: got exit code %d, want %d", code, exitUsage)
+	}
+}
+
+func TestCLIOffline(t *testing.T) {
+	var out, errOut bytes.Buffer
+	noDB := func(context.Context) (*Bookshelf, error) { return nil, errors.New("no database") }
+	dir := filepath.Join(t.TempDir(), "m")
+	if code := runCommand(context.Background(), noDB, []string{"dump-migrations", "-out", dir}, &out, &errOut); code != exitOK {
+		t.Errorf("dump-migrations: exit code %d: %s", code, errOut.String())
+	}
+	if code := runCommand(context.Background(), noDB, []string{"books", "list"}, &out, &errOut); code != exitError {
+		t.Errorf("books list without database: got exit code %d, want %d", code, exitError)
+	}
+}
@@ -0,0 +1,441 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxCollectionName is the size of the name column.
+const maxCollectionName = 100
+
+// Collection is a named, ordered list of books kept by a user, such as
+// "To read". Without sign-in, collections belong to no one (OwnerID 0) and
+// everyone may change them.
+type Collection struct {
+	ID      uint   `gorm:"column:id;primary_key" json:"id"`
+	OwnerID uint   `gorm:"column:owner_id" json:"owner_id"`
+	Name    string `gorm:"column:name" json:"name"`
+	// ShareToken, when set, lets anyone read the collection at
+	// /shared/TOKEN, see collectionShareHandler.
+	ShareToken string    `gorm:"column:share_token" json:"share_token,omitempty"`
+	CreatedAt  time.Time `gorm:"column:created_at" json:"created_at"`
+}
+
+// TableName tells gorm where collections live.
+func (Collection) TableName() string {
+	return "collections"
+}
+
+// collectionBook places a book in a collection.
+type collectionBook struct {
+	CollectionID uint `gorm:"column:collection_id;primary_key"`
+	BookID       uint `gorm:"column:book_id;primary_key"`
+	Position     int  `gorm:"column:position"`
+}
+
+// TableName tells gorm where the books of collections live.
+func (collectionBook) TableName() string {
+	return "collection_books"
+}
+
+// CollectionDatabase provides thread-safe access to collections.
+type CollectionDatabase interface {
+	// GetCollection retrieves a collection by its ID.
+	GetCollection(id uint) (*Collection, error)
+
+	// FindSharedCollection retrieves a collection by its share token.
+	FindSharedCollection(token string) (*Collection, error)
+
+	// ListCollections returns the collections of a user, ordered by name.
+	ListCollections(ownerID uint) ([]*Collection, error)
+
+	// AddCollection saves a given collection, assigning it a new ID. The
+	// names of the collections of a user are unique, ignoring case.
+	AddCollection(c *Collection) (id uint, err error)
+
+	// UpdateCollection updates the name and share token of a collection.
+	UpdateCollection(c *Collection) error
+
+	// DeleteCollection removes a collection, leaving its books alone.
+	DeleteCollection(id uint) error
+
+	// CollectionBooks returns the books of a collection, in its order.
+	CollectionBooks(id uint) ([]*Book, error)
+
+	// AddToCollection appends a book to a collection. Adding a book the
+	// collection holds already does nothing.
+	AddToCollection(id, bookID uint) error
+
+	// RemoveFromCollection takes a book out of a collection.
+	RemoveFromCollection(id, bookID uint) error
+
+	// ReorderCollection puts the books of a collection in the order of
+	// bookIDs, which must hold each of them once.
+	ReorderCollection(id uint, bookIDs []uint) error
+}
+
+var errNoCollections = errors.New("the configured database does not keep collections")
+
+// errBadCollection is returned for names and orders which cannot be saved.
+var errBadCollection = errors.New("bad collection")
+
+// normalizeCollectionName trims name and collapses its spaces.
+func normalizeCollectionName(name string) (string, error) {
+	name = strings.Join(strings.Fields(name), " ")
+	if name == "" {
+		return "", fmt.Errorf("%w: empty name", errBadCollection)
+	}
+	if len(name) > maxCollectionName {
+		return "", fmt.Errorf("%w: name longer than %d bytes", errBadCollection, maxCollectionName)
+	}
+	return name, nil
+}
+
+// checkOrder returns an error unless bookIDs hold each of current once.
+func checkOrder(current, bookIDs []uint) error {
+	if len(current) != len(bookIDs) {
+		return fmt.Errorf("%w: got %d books, want %d", errBadCollection, len(bookIDs), len(current))
+	}
+	want := make(map[uint]bool)
+	for _, id := range current {
+		want[id] = true
+	}
+	for _, id := range bookIDs {
+		if !want[id] {
+			return fmt.Errorf("%w: book %d missing or repeated", errBadCollection, id)
+		}
+		delete(want, id)
+	}
+	return nil
+}
+
+// newShareToken returns a random token for share links.
+func newShareToken() (string, error) {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// ownerOf returns the ID of the user whose collections r works with: the
+// signed-in user, or 0 without sign-in.
+func ownerOf(r *http.Request) uint {
+	if u := currentUser(r); u != nil {
+		return u.ID
+	}
+	return 0
+}
+
+// collectionFromRequest retrieves the collection with the ID in the URL's
+// path, or in the collection form value for forms on book pages.
+// Collections of other users are not found, except by admins.
+func (b *Bookshelf) collectionFromRequest(r *http.Request) (*Collection, error) {
+	if b.Collections == nil {
+		return nil, errNoCollections
+	}
+	s, ok := mux.Vars(r)["id"]
+	if !ok {
+		s = r.FormValue("collection")
+	}
+	id, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || id == 0 {
+		return nil, fmt.Errorf("%w: bad collection ID %q", errBadCollection, s)
+	}
+	c, err := b.Collections.GetCollection(uint(id))
+	if err != nil {
+		return nil, err
+	}
+	if u := currentUser(r); c.OwnerID != ownerOf(r) && (u == nil || !u.IsAdmin()) {
+		return nil, fmt.Errorf("collection with ID %d %w", id, errNotFound)
+	}
+	return c, nil
+}
+
+// userCollections returns the collections of the user, or none when the
+// database does not keep collections or nobody is signed in.
+func (b *Bookshelf) userCollections(r *http.Request) ([]*Collection, error) {
+	if b.Collections == nil || (b.authEnabled() && currentUser(r) == nil) {
+		return nil, nil
+	}
+	collections, err := b.Collections.ListCollections(ownerOf(r))
+	if err != nil {
+		return nil, fmt.Errorf("could not list collections: %v", err)
+	}
+	return collections, nil
+}
+
+// collectionErrorf reports err, telling clients asking for missing
+// collections and sending bad input so.
+func (b *Bookshelf) collectionErrorf(r *http.Request, err error) *appError {
+	e := b.appErrorf(r, err, "%v", err)
+	switch {
+	case errors.Is(err, errNotFound):
+		e.code = http.StatusNotFound
+	case errors.Is(err, errBadCollection):
+		e.code = http.StatusBadRequest
+	}
+	return e
+}
+
+// collectionsHandler lists the collections of the user.
+func (b *Bookshelf) collectionsHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if b.Collections == nil {
+		return b.appErrorf(r, errNoCollections, "%v", errNoCollections)
+	}
+	collections, err := b.Collections.ListCollections(ownerOf(r))
+	if err != nil {
+		return b.appErrorf(r, err, "could not list collections: %v", err)
+	}
+	return collectionsTmpl.Execute(b, w, r, collections)
+}
+
+// createCollectionHandler adds a collection named by the form.
+func (b *Bookshelf) createCollectionHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if b.Collections == nil {
+		return b.appErrorf(r, errNoCollections, "%v", errNoCollections)
+	}
+	name, err := normalizeCollectionName(r.FormValue("name"))
+	if err != nil {
+		return b.collectionErrorf(r, err)
+	}
+	c := &Collection{OwnerID: ownerOf(r), Name: name, CreatedAt: time.Now().UTC()}
+	id, err := b.Collections.AddCollection(c)
+	if err != nil {
+		return b.collectionErrorf(r, err)
+	}
+	http.Redirect(w, r, fmt.Sprintf("/collections/%d", id), http.StatusFound)
+	return nil
+}
+
+// collectionView is the data of templates/collection.html.
+type collectionView struct {
+	*Collection
+	Books []bookView
+	// Shared is set for visitors of a share link, who may not change the
+	// collection.
+	Shared bool
+	// ShareURL is the share link, when the collection is shared.
+	ShareURL string
+}
+
+// collectionHandler shows a collection to its owner.
+func (b *Bookshelf) collectionHandler(w http.ResponseWriter, r *http.Request) *appError {
+	c, err := b.collectionFromRequest(r)
+	if err != nil {
+		return b.collectionErrorf(r, err)
+	}
+	v, err := b.collectionView(c)
+	if err != nil {
+		return b.appErrorf(r, err, "%v", err)
+	}
+	if c.ShareToken != "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		v.ShareURL = fmt.Sprintf("%s://%s/shared/%s", scheme, r.Host, c.ShareToken)
+	}
+	return collectionTmpl.Execute(b, w, r, v)
+}
+
+// collectionShareHandler shows a collection to anyone having its share
+// link, without letting them change it.
+func (b *Bookshelf) collectionShareHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if b.Collections == nil {
+		return b.appErrorf(r, errNoCollections, "%v", errNoCollections)
+	}
+	c, err := b.Collections.FindSharedCollection(mux.Vars(r)["token"])
+	if err != nil {
+		return b.collectionErrorf(r, err)
+	}
+	v, err := b.collectionView(c)
+	if err != nil {
+		return b.appErrorf(r, err, "%v", err)
+	}
+	v.Shared = true
+	return collectionTmpl.Execute(b, w, r, v)
+}
+
+func (b *Bookshelf) collectionView(c *Collection) (*collectionView, error) {
+	books, err := b.Collections.CollectionBooks(c.ID)
+	if err != nil {
+		return nil, fmt.Errorf("could not list books: %v", err)
+	}
+	v := &collectionView{Collection: c, Books: make([]bookView, len(books))}
+	for i, book := range books {
+		v.Books[i] = b.viewOf(book)
+	}
+	return v, nil
+}
+
+// updateCollectionHandler renames a collection.
+func (b *Bookshelf) updateCollectionHandler(w http.ResponseWriter, r *http.Request) *appError {
+	c, err := b.collectionFromRequest(r)
+	if err != nil {
+		return b.collectionErrorf(r, err)
+	}
+	if c.Name, err = normalizeCollectionName(r.FormValue("name")); err != nil {
+		return b.collectionErrorf(r, err)
+	}
+	if err := b.Collections.UpdateCollection(c); err != nil {
+		return b.collectionErrorf(r, err)
+	}
+	http.Redirect(w, r, fmt.Sprintf("/collections/%d", c.ID), http.StatusFound)
+	return nil
+}
+
+// shareCollectionHandler creates the share link of a collection, or
+// revokes it when the form sets revoke. A new link replaces the old one.
+func (b *Bookshelf) shareCollectionHandler(w http.ResponseWriter, r *http.Request) *appError {
+	c, err := b.collectionFromRequest(r)
+	if err != nil {
+		return b.collectionErrorf(r, err)
+	}
+	c.ShareToken = ""
+	if r.FormValue("revoke") == "" {
+		if c.ShareToken, err = newShareToken(); err != nil {
+			return b.appErrorf(r, err, "could not create share link: %v", err)
+		}
+	}
+	if err := b.Collections.UpdateCollection(c); err != nil {
+		return b.collectionErrorf(r, err)
+	}
+	http.Redirect(w, r, fmt.Sprintf("/collections/%d", c.ID), http.StatusFound)
+	return nil
+}
+
+// deleteCollectionHandler removes a collection.
+func (b *Bookshelf) deleteCollectionHandler(w http.ResponseWriter, r *http.Request) *appError {
+	c, err := b.collectionFromRequest(r)
+	if err != nil {
+		return b.collectionErrorf(r, err)
+	}
+	if err := b.Collections.DeleteCollection(c.ID); err != nil {
+		return b.appErrorf(r, err, "could not delete collection: %v", err)
+	}
+	http.Redirect(w, r, "/collections", http.StatusFound)
+	return nil
+}
+
+// bookIDFromForm parses the book ID of the bookID form value or the path.
+func bookIDFromForm(r *http.Request) (uint, error) {
+	s := mux.Vars(r)["book"]
+	if s == "" {
+		s = r.FormValue("bookID")
+	}
+	id, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || id == 0 {
+		return 0, fmt.Errorf("%w: bad book ID %q", errBadCollection, s)
+	}
+	return uint(id), nil
+}
+
+// addToCollectionHandler appends the book of the form to a collection and
+// returns to the page of the book.
+func (b *Bookshelf) addToCollectionHandler(w http.ResponseWriter, r *http.Request) *appError {
+	c, err := b.collectionFromRequest(r)
+	if err != nil {
+		return b.collectionErrorf(r, err)
+	}
+	bookID, err := bookIDFromForm(r)
+	if err != nil {
+		return b.collectionErrorf(r, err)
+	}
+	if err := b.Collections.AddToCollection(c.ID, bookID); err != nil {
+		return b.collectionErrorf(r, err)
+	}
+	http.Redirect(w, r, fmt.Sprintf("/books/%d", bookID), http.StatusFound)
+	return nil
+}
+
+// removeFromCollectionHandler takes a book out of a collection.
+func (b *Bookshelf) removeFromCollectionHandler(w http.ResponseWriter, r *http.Request) *appError {
+	c, err := b.collectionFromRequest(r)
+	if err != nil {
+		return b.collectionErrorf(r, err)
+	}
+	bookID, err := bookIDFromForm(r)
+	if err != nil {
+		return b.collectionErrorf(r, err)
+	}
+	if err := b.Collections.RemoveFromCollection(c.ID, bookID); err != nil {
+		return b.collectionErrorf(r, err)
+	}
+	http.Redirect(w, r, fmt.Sprintf("/collections/%d", c.ID), http.StatusFound)
+	return nil
+}
+
+// moveInCollectionHandler moves a book of a collection one place up or
+// down, as the dir form value says, or reorders the whole collection when
+// the form has an order of comma-separated book IDs instead.
+func (b *Bookshelf) moveInCollectionHandler(w http.ResponseWriter, r *http.Request) *appError {
+	c, err := b.collectionFromRequest(r)
+	if err != nil {
+		return b.collectionErrorf(r, err)
+	}
+	books, err := b.Collections.CollectionBooks(c.ID)
+	if err != nil {
+		return b.appErrorf(r, err, "could not list books: %v", err)
+	}
+	order := make([]uint, len(books))
+	for i, book := range books {
+		order[i] = book.ID
+	}
+
+	if s := r.FormValue("order"); s != "" {
+		order = order[:0]
+		for _, f := range strings.Split(s, ",") {
+			id, err := strconv.ParseUint(strings.TrimSpace(f), 10, 32)
+			if err != nil {
+				return b.collectionErrorf(r, fmt.Errorf("%w: bad book ID %q", errBadCollection, f))
+			}
+			order = append(order, uint(id))
+		}
+	} else {
+		bookID, err := bookIDFromForm(r)
+		if err != nil {
+			return b.collectionErrorf(r, err)
+		}
+		step := 1
+		switch r.FormValue("dir") {
+		case "up":
+			step = -1
+		case "down":
+		default:
+			return b.collectionErrorf(r, fmt.Errorf("%w: bad direction %q", errBadCollection, r.FormValue("dir")))
+		}
+		for i, id := range order {
+			if j := i + step; id == bookID && j >= 0 && j < len(order) {
+				order[i], order[j] = order[j], order[i]
+				break
+			}
+		}
+	}
+	if err := b.Collections.ReorderCollection(c.ID, order); err != nil {
+		return b.collectionErrorf(r, err)
+	}
+	http.Redirect(w, r, fmt.Sprintf("/collections/%d", c.ID), http.StatusFound)
+	return nil
+}
@@ -0,0 +1,265 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestCheckOrder(t *testing.T) {
+	tests := []struct {
+		current, order []uint
+		ok             bool
+	}{
+		{nil, nil, true},
+		{[]uint{1, 2, 3}, []uint{3, 1, 2}, true},
+		{[]uint{1, 2, 3}, []uint{1, 2}, false},
+		{[]uint{1, 2, 3}, []uint{1, 1, 2}, false},
+		{[]uint{1, 2}, []uint{1, 4}, false},
+	}
+	for _, tc := range tests {
+		if err := checkOrder(tc.current, tc.order); (err == nil) != tc.ok {
+			t.Errorf("checkOrder(%v, %v): got %v", tc.current, tc.order, err)
+		}
+	}
+}
+
+func TestCollectionPages(t *testing.T) {
+	bs, srv := newTestBookshelf(t)
+
+	get := func(path string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	post := func(path string, form url.Values) (int, string) {
+		t.Helper()
+		resp, err := http.PostForm(srv.URL+path, form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode, resp.Request.URL.Path
+	}
+
+	var ids []uint
+	for _, title := range []string{"Dune", "Emma", "Ubik"} {
+		id, err := bs.DB.AddBook(&Book{Title: title})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	code, path := post("/collections", url.Values{"name": {"  To   read "}})
+	if code != http.StatusOK {
+		t.Fatalf("creating a collection: got status %d", code)
+	}
+	collections, _ := bs.Collections.ListCollections(0)
+	if len(collections) != 1 || collections[0].Name != "To read" {
+		t.Fatalf("got collections %+v, want To read", collections)
+	}
+	c := collections[0]
+	page := fmt.Sprintf("/collections/%d", c.ID)
+	if path != page {
+		t.Errorf("creating a collection: redirected to %s, want %s", path, page)
+	}
+	for _, name := range []string{"", "TO READ", strings.Repeat("x", maxCollectionName+1)} {
+		if code, _ := post("/collections", url.Values{"name": {name}}); code != http.StatusBadRequest {
+			t.Errorf("creating collection %q: got status %d, want 400", name, code)
+		}
+	}
+
+	// Books are added from their pages, which offer the collections.
+	if _, body := get(fmt.Sprintf("/books/%d", ids[0])); !strings.Contains(body, ">To read</option>") {
+		t.Errorf("book page does not offer the collection:\n%s", body)
+	}
+	for _, id := range ids {
+		code, path := post(fmt.Sprintf("/books/%d/collections", id), url.Values{"collection": {fmt.Sprint(c.ID)}})
+		if code != http.StatusOK || path != fmt.Sprintf("/books/%d", id) {
+			t.Errorf("adding book %d: got status %d at %s", id, code, path)
+		}
+	}
+	if code, _ := post(page+"/books", url.Values{"bookID": {"999"}}); code != http.StatusNotFound {
+		t.Errorf("adding a missing book: got status %d, want 404", code)
+	}
+
+	// order returns the titles of the collection page in their order.
+	order := func() string {
+		t.Helper()
+		_, body := get(page)
+		var titles []string
+		for _, title := range []string{"Dune", "Emma", "Ubik"} {
+			if strings.Contains(body, ">"+title+"</a>") {
+				titles = append(titles, title)
+			}
+		}
+		sort.Slice(titles, func(i, j int) bool {
+			return strings.Index(body, ">"+titles[i]+"<") < strings.Index(body, ">"+titles[j]+"<")
+		})
+		return strings.Join(titles, ",")
+	}
+	if got := order(); got != "Dune,Emma,Ubik" {
+		t.Errorf("collection page: got %s, want Dune,Emma,Ubik", got)
+	}
+	post(fmt.Sprintf("%s/books/%d:move", page, ids[2]), url.Values{"dir": {"up"}})
+	if got := order(); got != "Dune,Ubik,Emma" {
+		t.Errorf("after moving Ubik up: got %s, want Dune,Ubik,Emma", got)
+	}
+	post(page+":reorder", url.Values{"order": {fmt.Sprintf("%d,%d,%d", ids[1], ids[0], ids[2])}})
+	if got := order(); got != "Emma,Dune,Ubik" {
+		t.Errorf("after reordering: got %s, want Emma,Dune,Ubik", got)
+	}
+	for _, form := range []url.Values{
+		{"order": {fmt.Sprintf("%d,%d", ids[1], ids[0])}},
+		{"order": {"1,two,3"}},
+	} {
+		if code, _ := post(page+":reorder", form); code != http.StatusBadRequest {
+			t.Errorf("reordering by %v: got status %d, want 400", form, code)
+		}
+	}
+	if code, _ := post(fmt.Sprintf("%s/books/%d:move", page, ids[0]), url.Values{"dir": {"sideways"}}); code != http.StatusBadRequest {
+		t.Errorf("moving sideways: got status %d, want 400", code)
+	}
+	post(fmt.Sprintf("%s/books/%d:remove", page, ids[0]), nil)
+	if got := order(); got != "Emma,Ubik" {
+		t.Errorf("after removing Dune: got %s, want Emma,Ubik", got)
+	}
+
+	post(page, url.Values{"name": {"Favorites"}})
+	post(page+":share", nil)
+	c, _ = bs.Collections.GetCollection(c.ID)
+	if c.Name != "Favorites" || c.ShareToken == "" {
+		t.Fatalf("after renaming and sharing: got %+v", c)
+	}
+	if _, body := get(page); !strings.Contains(body, "/shared/"+c.ShareToken) {
+		t.Errorf("collection page does not show the share link:\n%s", body)
+	}
+	code, body := get("/shared/" + c.ShareToken)
+	if code != http.StatusOK || !strings.Contains(body, "Favorites") || !strings.Contains(body, "Emma") {
+		t.Errorf("shared page: got status %d:\n%s", code, body)
+	}
+	if strings.Contains(body, ":remove") || strings.Contains(body, ":delete") {
+		t.Errorf("shared page lets visitors change the collection:\n%s", body)
+	}
+
+	token := c.ShareToken
+	post(page+":share", url.Values{"revoke": {"1"}})
+	if code, _ := get("/shared/" + token); code != http.StatusNotFound {
+		t.Errorf("revoked share link: got status %d, want 404", code)
+	}
+
+	if code, path := post(page+":delete", nil); code != http.StatusOK || path != "/collections" {
+		t.Errorf("deleting: got status %d at %s", code, path)
+	}
+	if code, _ := get(page); code != http.StatusNotFound {
+		t.Errorf("deleted collection: got status %d, want 404", code)
+	}
+	if _, err := bs.DB.GetBook(ids[1]); err != nil {
+		t.Errorf("book of a deleted collection: %v", err)
+	}
+}
+
+func TestCollectionOwners(t *testing.T) {
+	m := newMockIssuer(t)
+	bs, srv := newOIDCBookshelf(t, m)
+
+	id, err := bs.DB.AddBook(&Book{Title: "Dune"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signIn := func(sub string) *http.Client {
+		t.Helper()
+		m.setClaims(map[string]interface{}{"sub": sub, "email": sub + "@example.com", "name": sub})
+		c := newBrowser(t)
+		resp, err := c.Get(srv.URL + "/collections")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: GET /collections: got status %d", sub, resp.StatusCode)
+		}
+		return c
+	}
+	alice, bob := signIn("alice"), signIn("bob")
+
+	resp, err := alice.PostForm(srv.URL+"/collections", url.Values{"name": {"Mine"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	page := resp.Request.URL.Path
+	for _, p := range []string{page + ":share", fmt.Sprintf("%s/books", page)} {
+		resp, err := alice.PostForm(srv.URL+p, url.Values{"bookID": {fmt.Sprint(id)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	resp, err = bob.Get(srv.URL + page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET %s of another user: got status %d, want 404", page, resp.StatusCode)
+	}
+	resp, err = bob.PostForm(srv.URL+page+":delete", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("deleting the collection of another user: got status %d, want 404", resp.StatusCode)
+	}
+
+	users, _ := bs.Users.ListUsers()
+	var shared *Collection
+	for _, u := range users {
+		collections, _ := bs.Collections.ListCollections(u.ID)
+		if len(collections) > 0 && u.Subject != "alice" {
+			t.Errorf("user %s got the collections %+v", u.Subject, collections)
+		}
+		if u.Subject == "alice" && len(collections) == 1 {
+			shared = collections[0]
+		}
+	}
+	if shared == nil || shared.ShareToken == "" {
+		t.Fatalf("got collection %+v, want it shared", shared)
+	}
+
+	// Share links need no sign-in.
+	resp, err = http.Get(srv.URL + "/shared/" + shared.ShareToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "Dune") {
+		t.Errorf("shared page: got status %d:\n%s", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,326 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Conditions of copies, from best to worst. Lost copies are kept for the
+// record but never available.
+const (
+	conditionNew  = "new"
+	conditionGood = "good"
+	conditionFair = "fair"
+	conditionPoor = "poor"
+	conditionLost = "lost"
+)
+
+// copyConditions are the conditions offered by the copy form, in its order.
+var copyConditions = []string{conditionNew, conditionGood, conditionFair, conditionPoor, conditionLost}
+
+// Sizes of the columns of copies.
+const (
+	maxBarcode  = 64
+	maxLocation = 100
+	// maxPrice is the largest price in cents, which fits an INT.
+	maxPrice = 99999999
+)
+
+// Copy is a physical copy of a book owned by the library.
+type Copy struct {
+	ID     uint `gorm:"column:id;primary_key" json:"id"`
+	BookID uint `gorm:"column:book_id" json:"book_id"`
+	// Barcode identifies the copy, e.g. by the label stuck on it. It is
+	// unique among all copies.
+	Barcode string `gorm:"column:barcode" json:"barcode"`
+	// Location is where the copy is kept, such as a room and shelf.
+	Location  string `gorm:"column:location" json:"location,omitempty"`
+	Condition string `gorm:"column:book_condition" json:"condition"`
+	// Acquired is stored in the acquired_year, acquired_month and
+	// acquired_day columns.
+	Acquired PartialDate `gorm:"embedded;embedded_prefix:acquired_" json:"acquired"`
+	// Price is what the copy cost in cents, 0 when unknown.
+	Price int64 `gorm:"column:price" json:"price,omitempty"`
+}
+
+// TableName tells gorm where copies live.
+func (Copy) TableName() string {
+	return "copies"
+}
+
+// PriceString formats the price of c, e.g. "12.50", or "" when unknown.
+func (c *Copy) PriceString() string {
+	if c.Price == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d.%02d", c.Price/100, c.Price%100)
+}
+
+// CopyCount counts the copies of a book.
+type CopyCount struct {
+	Total     int
+	Available int
+}
+
+// CopyDatabase provides thread-safe access to the copies of books.
+type CopyDatabase interface {
+	// GetCopy retrieves a copy by its ID.
+	GetCopy(id uint) (*Copy, error)
+
+	// FindCopy retrieves a copy by its barcode.
+	FindCopy(barcode string) (*Copy, error)
+
+	// ListCopies returns the copies of a book, ordered by barcode.
+	ListCopies(bookID uint) ([]*Copy, error)
+
+	// AllCopies returns the copies of all books, ordered by book ID and
+	// barcode.
+	AllCopies() ([]*Copy, error)
+
+	// AddCopy saves a given copy of a book, assigning it a new ID.
+	AddCopy(c *Copy) (id uint, err error)
+
+	// UpdateCopy updates the entry for a given copy. Copies stay with
+	// their books.
+	UpdateCopy(c *Copy) error
+
+	// DeleteCopy removes a given copy by its ID.
+	DeleteCopy(id uint) error
+
+	// CopyCounts counts the copies of the given books. Books without
+	// copies are missing from the map.
+	CopyCounts(bookIDs []uint) (map[uint]CopyCount, error)
+}
+
+var errNoCopies = errors.New("the configured database does not keep copies")
+
+// errBadCopy is wrapped by the errors about copies which cannot be saved.
+var errBadCopy = errors.New("bad copy")
+
+// lendable reports whether a copy in condition may be lent.
+func lendable(condition string) bool {
+	return condition != conditionLost
+}
+
+// normalizeCopy trims the fields of c and checks them. The condition
+// defaults to conditionGood.
+func normalizeCopy(c *Copy) error {
+	c.Barcode = strings.TrimSpace(c.Barcode)
+	if c.Barcode == "" {
+		return fmt.Errorf("%w: empty barcode", errBadCopy)
+	}
+	if len(c.Barcode) > maxBarcode || strings.ContainsAny(c.Barcode, " \t\r\n") {
+		return fmt.Errorf("%w: barcode %q", errBadCopy, c.Barcode)
+	}
+	c.Location = strings.Join(strings.Fields(c.Location), " ")
+	if len(c.Location) > maxLocation {
+		return fmt.Errorf("%w: location longer than %d bytes", errBadCopy, maxLocation)
+	}
+	if c.Condition == "" {
+		c.Condition = conditionGood
+	}
+	if !validCondition(c.Condition) {
+		return fmt.Errorf("%w: unknown condition %q", errBadCopy, c.Condition)
+	}
+	if !c.Acquired.IsZero() {
+		if err := c.Acquired.validate(); err != nil {
+			return err
+		}
+	}
+	if c.Price < 0 || c.Price > maxPrice {
+		return fmt.Errorf("%w: price out of range", errBadCopy)
+	}
+	return nil
+}
+
+func validCondition(condition string) bool {
+	for _, c := range copyConditions {
+		if c == condition {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePrice parses prices such as "12", "12.5" and "12.50" into cents.
+// The empty string is the unknown price, 0.
+func parsePrice(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	units, cents := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		units, cents = s[:i], s[i+1:]
+	}
+	if units == "" || len(cents) > 2 || strings.ContainsAny(units+cents, "+-") {
+		return 0, fmt.Errorf("%w: price %q", errBadCopy, s)
+	}
+	for len(cents) < 2 {
+		cents += "0"
+	}
+	p, err := strconv.ParseInt(units+cents, 10, 64)
+	if err != nil || p > maxPrice {
+		return 0, fmt.Errorf("%w: price %q", errBadCopy, s)
+	}
+	return p, nil
+}
+
+// copyFromForm reads the fields of the copy form into c.
+func copyFromForm(r *http.Request, c *Copy) error {
+	c.Barcode = r.FormValue("barcode")
+	c.Location = r.FormValue("location")
+	c.Condition = r.FormValue("condition")
+	var err error
+	if c.Acquired, err = parsePartialDate(r.FormValue("acquired")); err != nil {
+		return err
+	}
+	if c.Price, err = parsePrice(r.FormValue("price")); err != nil {
+		return err
+	}
+	return normalizeCopy(c)
+}
+
+// conditionsOf returns the conditions copies may be in, or none when copies
+// is nil.
+func conditionsOf(copies CopyDatabase) []string {
+	if copies == nil {
+		return nil
+	}
+	return copyConditions
+}
+
+// copyFromRequest retrieves the copy with the ID in the URL's path.
+func (b *Bookshelf) copyFromRequest(r *http.Request) (*Copy, error) {
+	if b.Copies == nil {
+		return nil, errNoCopies
+	}
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil || id == 0 {
+		return nil, fmt.Errorf("bad copy ID %q", mux.Vars(r)["id"])
+	}
+	return b.Copies.GetCopy(uint(id))
+}
+
+// copyErrorf reports err, telling clients asking for missing copies and
+// sending bad input so.
+func (b *Bookshelf) copyErrorf(r *http.Request, err error) *appError {
+	e := b.appErrorf(r, err, "%v", err)
+	switch {
+	case errors.Is(err, errNotFound):
+		e.code = http.StatusNotFound
+	case errors.Is(err, errBadCopy), errors.Is(err, errBadDate):
+		e.code = http.StatusBadRequest
+	}
+	return e
+}
+
+// copyCounts counts the copies of books, or returns nil when the database
+// does not keep copies.
+func (b *Bookshelf) copyCounts(books []*Book) (map[uint]CopyCount, error) {
+	if b.Copies == nil {
+		return nil, nil
+	}
+	ids := make([]uint, len(books))
+	for i, book := range books {
+		ids[i] = book.ID
+	}
+	counts, err := b.Copies.CopyCounts(ids)
+	if err != nil {
+		return nil, fmt.Errorf("could not count copies: %v", err)
+	}
+	return counts, nil
+}
+
+// addCopyHandler adds a copy of the book in the URL's path and returns to
+// the page of the book.
+func (b *Bookshelf) addCopyHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if b.Copies == nil {
+		return b.appErrorf(r, errNoCopies, "%v", errNoCopies)
+	}
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil || id == 0 {
+		return b.copyErrorf(r, fmt.Errorf("%w: bad book ID %q", errBadCopy, mux.Vars(r)["id"]))
+	}
+	c := &Copy{BookID: uint(id)}
+	if err := copyFromForm(r, c); err != nil {
+		return b.copyErrorf(r, err)
+	}
+	if _, err := b.Copies.AddCopy(c); err != nil {
+		return b.copyErrorf(r, err)
+	}
+	http.Redirect(w, r, fmt.Sprintf("/books/%d#copies", c.BookID), http.StatusFound)
+	return nil
+}
+
+// copyView is the data of templates/copy.html.
+type copyView struct {
+	*Copy
+	Book       *Book
+	Conditions []string
+}
+
+// editCopyHandler displays a form to change a copy.
+func (b *Bookshelf) editCopyHandler(w http.ResponseWriter, r *http.Request) *appError {
+	c, err := b.copyFromRequest(r)
+	if err != nil {
+		return b.copyErrorf(r, err)
+	}
+	book, err := b.DB.GetBook(c.BookID)
+	if err != nil {
+		return b.appErrorf(r, err, "could not find book: %v", err)
+	}
+	return copyTmpl.Execute(b, w, r, copyView{c, book, copyConditions})
+}
+
+// updateCopyHandler changes a copy and returns to the page of its book.
+func (b *Bookshelf) updateCopyHandler(w http.ResponseWriter, r *http.Request) *appError {
+	c, err := b.copyFromRequest(r)
+	if err != nil {
+		return b.copyErrorf(r, err)
+	}
+	if err := copyFromForm(r, c); err != nil {
+		return b.copyErrorf(r, err)
+	}
+	if err := b.Copies.UpdateCopy(c); err != nil {
+		return b.copyErrorf(r, err)
+	}
+	http.Redirect(w, r, fmt.Sprintf("/books/%d#copies", c.BookID), http.StatusFound)
+	return nil
+}
+
+// deleteCopyHandler removes a copy and returns to the page of its book.
+func (b *Bookshelf) deleteCopyHandler(w http.ResponseWriter, r *http.Request) *appError {
+	c, err := b.copyFromRequest(r)
+	if err != nil {
+		return b.copyErrorf(r, err)
+	}
+	if err := b.Copies.DeleteCopy(c.ID); err != nil {
+		e := b.copyErrorf(r, err)
+		// The copy is on loan or kept for a hold.
+		if errors.Is(err, errBadCopy) {
+			e.code = http.StatusConflict
+		}
+		return e
+	}
+	http.Redirect(w, r, fmt.Sprintf("/books/%d#copies", c.BookID), http.StatusFound)
+	return nil
+}
@@ -0,0 +1,206 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParsePrice(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{"", 0, true},
+		{"12", 1200, true},
+		{" 12.5 ", 1250, true},
+		{"12.50", 1250, true},
+		{"0.99", 99, true},
+		{"12.", 1200, true},
+		{".5", 0, false},
+		{"12.505", 0, false},
+		{"-3", 0, false},
+		{"twelve", 0, false},
+		{"1000000", 0, false},
+	}
+	for _, tc := range tests {
+		got, err := parsePrice(tc.in)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("parsePrice(%q): got %d, %v, want %d", tc.in, got, err, tc.want)
+		}
+		if err != nil && !errors.Is(err, errBadCopy) {
+			t.Errorf("parsePrice(%q): error %v does not wrap errBadCopy", tc.in, err)
+		}
+	}
+	if got := (&Copy{Price: 1205}).PriceString(); got != "12.05" {
+		t.Errorf("PriceString: got %q, want 12.05", got)
+	}
+}
+
+func TestNormalizeCopy(t *testing.T) {
+	c := &Copy{Barcode: " 0042 ", Location: " Room 2,  shelf B "}
+	if err := normalizeCopy(c); err != nil {
+		t.Fatal(err)
+	}
+	if c.Barcode != "0042" || c.Location != "Room 2, shelf B" || c.Condition != conditionGood {
+		t.Errorf("normalizeCopy: got %+v", c)
+	}
+	for _, c := range []*Copy{
+		{},
+		{Barcode: "00 42"},
+		{Barcode: strings.Repeat("1", maxBarcode+1)},
+		{Barcode: "1", Condition: "mint"},
+		{Barcode: "1", Location: strings.Repeat("x", maxLocation+1)},
+		{Barcode: "1", Acquired: PartialDate{Year: 2019, Month: 13}},
+	} {
+		if err := normalizeCopy(c); err == nil {
+			t.Errorf("normalizeCopy(%+v): got no error", c)
+		}
+	}
+}
+
+func TestCopyPages(t *testing.T) {
+	bs, srv := newTestBookshelf(t)
+
+	get := func(path string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	post := func(path string, form url.Values) int {
+		t.Helper()
+		resp, err := http.PostForm(srv.URL+path, form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	id, err := bs.DB.AddBook(&Book{Title: "Dune"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := fmt.Sprintf("/books/%d", id)
+	if _, body := get(page); !strings.Contains(body, "no copies") {
+		t.Errorf("book page without copies:\n%s", body)
+	}
+
+	for _, form := range []url.Values{
+		{"barcode": {"0001"}, "location": {"Shelf A"}, "acquired": {"2019-04"}, "price": {"9.99"}},
+		{"barcode": {"0002"}, "condition": {"lost"}},
+	} {
+		if code := post(page+"/copies", form); code != http.StatusOK {
+			t.Fatalf("adding copy %v: got status %d", form, code)
+		}
+	}
+	for _, form := range []url.Values{
+		{"barcode": {"0001"}},
+		{"barcode": {""}},
+		{"barcode": {"0003"}, "condition": {"mint"}},
+		{"barcode": {"0003"}, "price": {"cheap"}},
+		{"barcode": {"0003"}, "acquired": {"someday"}},
+	} {
+		if code := post(page+"/copies", form); code != http.StatusBadRequest {
+			t.Errorf("adding copy %v: got status %d, want 400", form, code)
+		}
+	}
+	if code := post("/books/999/copies", url.Values{"barcode": {"0003"}}); code != http.StatusNotFound {
+		t.Errorf("adding a copy of a missing book: got status %d, want 404", code)
+	}
+
+	_, body := get(page)
+	for _, want := range []string{"0001", "Shelf A", "April 2019", "9.99", "lost"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("book page does not show %q:\n%s", want, body)
+		}
+	}
+	if _, body := get("/books"); !strings.Contains(body, "1 of 2 copies available") {
+		t.Errorf("book list does not count the copies:\n%s", body)
+	}
+
+	c, err := bs.Copies.FindCopy("0002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyPage := fmt.Sprintf("/copies/%d", c.ID)
+	if code, body := get(copyPage + "/edit"); code != http.StatusOK || !strings.Contains(body, `value="0002"`) {
+		t.Errorf("edit page: got status %d:\n%s", code, body)
+	}
+	if code := post(copyPage, url.Values{"barcode": {"0002"}, "condition": {"fair"}, "location": {"Shelf B"}}); code != http.StatusOK {
+		t.Errorf("updating: got status %d", code)
+	}
+	if _, body := get("/books"); !strings.Contains(body, "2 of 2 copies available") {
+		t.Errorf("book list after finding the lost copy:\n%s", body)
+	}
+	if code := post(copyPage, url.Values{"barcode": {"0001"}}); code != http.StatusBadRequest {
+		t.Errorf("updating to a taken barcode: got status %d, want 400", code)
+	}
+	if code := post(copyPage+":delete", nil); code != http.StatusOK {
+		t.Errorf("deleting: got status %d", code)
+	}
+	if code, _ := get(copyPage + "/edit"); code != http.StatusNotFound {
+		t.Errorf("edit page of a deleted copy: got status %d, want 404", code)
+	}
+}
+
+func TestCLICopies(t *testing.T) {
+	c := newCLI(t)
+	c.mustRun("books", "add", "-title", "Dune")
+	c.mustRun("copies", "add", "-barcode", "0001", "-location", "Shelf A", "-price", "12.50", "1")
+	c.mustRun("copies", "add", "-barcode", "0002", "-condition", "poor", "1")
+	for _, args := range [][]string{
+		{"copies", "add", "1"},
+		{"copies", "add", "-barcode", "0003", "-condition", "mint", "1"},
+		{"copies", "add", "-barcode", "0003", "-price", "cheap", "1"},
+	} {
+		if code, _, _ := c.run(args...); code != exitUsage {
+			t.Errorf("%q: got exit code %d, want %d", args, code, exitUsage)
+		}
+	}
+	if code, _, _ := c.run("copies", "add", "-barcode", "0003", "2"); code != exitNotFound {
+		t.Errorf("copies add of a missing book: got exit code %d, want %d", code, exitNotFound)
+	}
+
+	out := c.mustRun("copies", "list", "1")
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("copies list: got %q", out)
+	}
+	var first Copy
+	if err := json.Unmarshal([]byte(lines[0]), &first); err != nil {
+		t.Fatal(err)
+	}
+	if first.Barcode != "0001" || first.Location != "Shelf A" || first.Price != 1250 || first.Condition != conditionGood {
+		t.Errorf("copies list: got %+v", first)
+	}
+
+	c.mustRun("copies", "delete", fmt.Sprint(first.ID))
+	if out := c.mustRun("copies", "list", "1"); strings.Count(out, "\n") != 1 {
+		t.Errorf("copies list after delete: got %q", out)
+	}
+}
@@ -0,0 +1,270 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PartialDate is a date known to the year, the month or the day, as
+// publication dates often are. Month and Day are 0 when unknown; the zero
+// PartialDate is an unknown date.
+type PartialDate struct {
+	Year  int `gorm:"column:year"`
+	Month int `gorm:"column:month"`
+	Day   int `gorm:"column:day"`
+}
+
+// errBadDate is wrapped by the errors of parsePartialDate.
+var errBadDate = errors.New("unrecognized date")
+
+// IsZero reports whether the date is unknown.
+func (d PartialDate) IsZero() bool {
+	return d.Year == 0
+}
+
+// String formats the date as 2006, 2006-01 or 2006-01-02, depending on its
+// precision, and the unknown date as "".
+func (d PartialDate) String() string {
+	switch {
+	case d.Year == 0:
+		return ""
+	case d.Month == 0:
+		return fmt.Sprintf("%04d", d.Year)
+	case d.Day == 0:
+		return fmt.Sprintf("%04d-%02d", d.Year, d.Month)
+	}
+	return fmt.Sprintf("%04d-%02d-%02d", d.Year, d.Month, d.Day)
+}
+
+// Display formats the date for people, e.g. "March 1965".
+func (d PartialDate) Display() string {
+	switch {
+	case d.Year == 0:
+		return ""
+	case d.Month == 0:
+		return strconv.Itoa(d.Year)
+	case d.Day == 0:
+		return fmt.Sprintf("%s %d", time.Month(d.Month), d.Year)
+	}
+	return fmt.Sprintf("%s %d, %d", time.Month(d.Month), d.Day, d.Year)
+}
+
+// Compare returns -1, 0 or +1 as d is before, equal to or after e. A date
+// known to the year only is before all dates of that year known to the
+// month, which are before those known to the day.
+func (d PartialDate) Compare(e PartialDate) int {
+	for _, p := range [][2]int{{d.Year, e.Year}, {d.Month, e.Month}, {d.Day, e.Day}} {
+		if p[0] < p[1] {
+			return -1
+		}
+		if p[0] > p[1] {
+			return +1
+		}
+	}
+	return 0
+}
+
+// validate checks the month and day of d exist.
+func (d PartialDate) validate() error {
+	if d.Year < 1 || d.Year > 9999 {
+		return fmt.Errorf("%w: year %d out of range", errBadDate, d.Year)
+	}
+	if d.Month == 0 {
+		if d.Day != 0 {
+			return fmt.Errorf("%w: day without month", errBadDate)
+		}
+		return nil
+	}
+	if d.Month < 1 || d.Month > 12 {
+		return fmt.Errorf("%w: month %d out of range", errBadDate, d.Month)
+	}
+	if d.Day == 0 {
+		return nil
+	}
+	t := time.Date(d.Year, time.Month(d.Month), d.Day, 0, 0, 0, 0, time.UTC)
+	if t.Day() != d.Day {
+		return fmt.Errorf("%w: %s has no day %d", errBadDate, time.Month(d.Month), d.Day)
+	}
+	return nil
+}
+
+var (
+	// isoDate matches 2006, 2006-01, 2006-01-02 and the same with / or .
+	isoDate = regexp.MustCompile(`^(\d{4})(?:[-/.](\d{1,2})(?:[-/.](\d{1,2}))?)?$`)
+	// circa matches the qualifiers before years in catalogs.
+	circa = regexp.MustCompile(`^(?i)(?:c\.|ca\.|circa)\s*`)
+)
+
+// dateLayouts are the formats with month names parsePartialDate accepts,
+// with the precision they give.
+var dateLayouts = []struct {
+	layout string
+	day    bool
+}{
+	{"January 2006", false},
+	{"Jan 2006", false},
+	{"Jan. 2006", false},
+	{"January 2, 2006", true},
+	{"January 2 2006", true},
+	{"Jan 2, 2006", true},
+	{"Jan 2 2006", true},
+	{"Jan. 2, 2006", true},
+	{"2 January 2006", true},
+	{"2 Jan 2006", true},
+	{"2 Jan. 2006", true},
+	{"02-Jan-2006", true},
+}
+
+// parsePartialDate parses the dates people commonly type: 1965, 1965-03,
+// 1965-03-01 (or with / or . instead of -), March 1965, Mar 1965,
+// March 1, 1965, 1 March 1965, c. 1965 and [1965]. Dates with numeric
+// months before the year, e.g. 03/01/1965, are refused as ambiguous. The
+// empty string is the unknown date.
+func parsePartialDate(s string) (PartialDate, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return PartialDate{}, nil
+	}
+	v := strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	v = strings.TrimSpace(circa.ReplaceAllString(v, ""))
+	v = strings.Join(strings.Fields(v), " ")
+
+	var d PartialDate
+	if m := isoDate.FindStringSubmatch(v); m != nil {
+		d.Year, _ = strconv.Atoi(m[1])
+		if m[2] != "" {
+			d.Month, _ = strconv.Atoi(m[2])
+		}
+		if m[3] != "" {
+			d.Day, _ = strconv.Atoi(m[3])
+		}
+	} else {
+		found := false
+		for _, l := range dateLayouts {
+			t, err := time.Parse(l.layout, v)
+			if err != nil {
+				continue
+			}
+			d = PartialDate{Year: t.Year(), Month: int(t.Month())}
+			if l.day {
+				d.Day = t.Day()
+			}
+			found = true
+			break
+		}
+		if !found {
+			return PartialDate{}, fmt.Errorf("%w %q, want e.g. 1965, 1965-03 or 1965-03-01", errBadDate, s)
+		}
+	}
+	if err := d.validate(); err != nil {
+		return PartialDate{}, fmt.Errorf("%q: %w", s, err)
+	}
+	return d, nil
+}
+
+// MarshalJSON encodes the date as a string, see String.
+func (d PartialDate) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON decodes any string parsePartialDate accepts.
+func (d *PartialDate) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	return d.Set(s)
+}
+
+// Set parses s, so that a PartialDate can be a flag.Value.
+func (d *PartialDate) Set(s string) error {
+	v, err := parsePartialDate(s)
+	if err != nil {
+		return err
+	}
+	*d = v
+	return nil
+}
+
+// unparsedDate is a free-text publication date convertPublishedDates could
+// not parse.
+type unparsedDate struct {
+	ID    uint   `json:"id"`
+	Title string `json:"title"`
+	Text  string `json:"published_at"`
+	Error string `json:"error"`
+}
+
+// dateConversion reports the result of convertPublishedDates.
+type dateConversion struct {
+	Converted int            `json:"converted"`
+	Unparsed  []unparsedDate `json:"unparsed"`
+}
+
+// convertPublishedDates parses the free-text dates of the published_at
+// column, which migration 4 did not convert, into the structured columns.
+// Unless dryRun is set, the converted ones are written.
+func (db *DB) convertPublishedDates(dryRun bool) (*dateConversion, error) {
+	rows, err := db.client.Raw(`SELECT id, title, published_at FROM books
+  WHERE published_year = 0 AND TRIM(COALESCE(published_at, '')) <> ''
+  ORDER BY id`).Rows()
+	if err != nil {
+		return nil, fmt.Errorf("DB: convertPublishedDates: %v", err)
+	}
+	type parsed struct {
+		id   uint
+		date PartialDate
+	}
+	var todo []parsed
+	report := &dateConversion{}
+	for rows.Next() {
+		var u unparsedDate
+		if err := rows.Scan(&u.ID, &u.Title, &u.Text); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("DB: convertPublishedDates: %v", err)
+		}
+		d, err := parsePartialDate(u.Text)
+		if err != nil {
+			u.Error = err.Error()
+			report.Unparsed = append(report.Unparsed, u)
+			continue
+		}
+		todo = append(todo, parsed{u.ID, d})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("DB: convertPublishedDates: %v", err)
+	}
+
+	for _, p := range todo {
+		if !dryRun {
+			err := db.client.Exec(`UPDATE books
+  SET published_year = ?, published_month = ?, published_day = ?
+  WHERE id = ? AND published_year = 0`,
+				p.date.Year, p.date.Month, p.date.Day, p.id).Error
+			if err != nil {
+				return report, fmt.Errorf("DB: convertPublishedDates: book %d: %v", p.id, err)
+			}
+		}
+		report.Converted++
+	}
+	return report, nil
+}
@@ -0,0 +1,184 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestParsePartialDate(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string
+	}{
+		{"", ""},
+		{"1965", "1965"},
+		{" 1965 ", "1965"},
+		{"[1965]", "1965"},
+		{"c. 1965", "1965"},
+		{"circa 1965", "1965"},
+		{"1965-08", "1965-08"},
+		{"1965-8", "1965-08"},
+		{"1965/08/01", "1965-08-01"},
+		{"1965.08.01", "1965-08-01"},
+		{"1965-08-01", "1965-08-01"},
+		{"August 1965", "1965-08"},
+		{"Aug 1965", "1965-08"},
+		{"aug. 1965", "1965-08"},
+		{"August 1, 1965", "1965-08-01"},
+		{"Aug 1 1965", "1965-08-01"},
+		{"1 August 1965", "1965-08-01"},
+		{"01-Aug-1965", "1965-08-01"},
+		{"2000-02-29", "2000-02-29"},
+	} {
+		d, err := parsePartialDate(tc.in)
+		if err != nil {
+			t.Errorf("parsePartialDate(%q): %v", tc.in, err)
+			continue
+		}
+		if got := d.String(); got != tc.want {
+			t.Errorf("parsePartialDate(%q): got %s, want %s", tc.in, got, tc.want)
+		}
+	}
+
+	for _, in := range []string{
+		"08/01/1965",
+		"65",
+		"0000",
+		"1965-13",
+		"1965-02-30",
+		"1999-02-29",
+		"sometime in the sixties",
+		"1965-08-01T00:00:00Z",
+	} {
+		if d, err := parsePartialDate(in); !errors.Is(err, errBadDate) {
+			t.Errorf("parsePartialDate(%q): got %v, %v, want errBadDate", in, d, err)
+		}
+	}
+}
+
+func TestPartialDate(t *testing.T) {
+	year := PartialDate{Year: 1965}
+	month := PartialDate{Year: 1965, Month: 8}
+	day := PartialDate{Year: 1965, Month: 8, Day: 1}
+
+	for _, tc := range []struct {
+		d    PartialDate
+		want string
+	}{
+		{PartialDate{}, ""},
+		{year, "1965"},
+		{month, "August 1965"},
+		{day, "August 1, 1965"},
+	} {
+		if got := tc.d.Display(); got != tc.want {
+			t.Errorf("%v.Display(): got %q, want %q", tc.d, got, tc.want)
+		}
+	}
+
+	if year.Compare(month) >= 0 || month.Compare(day) >= 0 || day.Compare(PartialDate{Year: 1966}) >= 0 || day.Compare(day) != 0 {
+		t.Error("Compare: wrong order")
+	}
+
+	data, err := json.Marshal(struct{ D PartialDate }{month})
+	if err != nil || string(data) != `{"D":"1965-08"}` {
+		t.Errorf("Marshal: got %s, %v", data, err)
+	}
+	var v struct{ D PartialDate }
+	if err := json.Unmarshal([]byte(`{"D":"August 1, 1965"}`), &v); err != nil || v.D != day {
+		t.Errorf("Unmarshal: got %v, %v", v.D, err)
+	}
+	if err := json.Unmarshal([]byte(`{"D":"soon"}`), &v); err == nil {
+		t.Error("Unmarshal of a bad date succeeded")
+	}
+}
+
+func TestListBooksByPublication(t *testing.T) {
+	bs, srv := newTestBookshelf(t)
+	for _, b := range []*Book{
+		{Title: "Dune", PublishedDate: PartialDate{Year: 1965, Month: 8}},
+		{Title: "Foundation", PublishedDate: PartialDate{Year: 1951}},
+		{Title: "Hyperion", PublishedDate: PartialDate{Year: 1989}},
+		{Title: "Undated"},
+	} {
+		if _, err := bs.DB.AddBook(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list := func(query string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(srv.URL + "/books?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		// The titles listed, in the order of the page.
+		var titles []string
+		for _, title := range []string{"Dune", "Foundation", "Hyperion", "Undated"} {
+			if strings.Contains(string(body), ">"+title+"</a>") {
+				titles = append(titles, title)
+			}
+		}
+		sort.Slice(titles, func(i, j int) bool {
+			return strings.Index(string(body), ">"+titles[i]+"</a>") < strings.Index(string(body), ">"+titles[j]+"</a>")
+		})
+		return resp.StatusCode, strings.Join(titles, ",")
+	}
+
+	for _, tc := range []struct {
+		query url.Values
+		want  string
+	}{
+		{url.Values{}, "Dune,Foundation,Hyperion,Undated"},
+		{url.Values{"sort": {"published"}}, "Foundation,Dune,Hyperion,Undated"},
+		{url.Values{"sort": {"-published"}}, "Hyperion,Dune,Foundation,Undated"},
+		{url.Values{"from": {"1960"}, "to": {"1980"}}, "Dune"},
+		{url.Values{"from": {"1960"}, "sort": {"published"}}, "Dune,Hyperion"},
+	} {
+		code, got := list(tc.query.Encode())
+		if code != http.StatusOK || got != tc.want {
+			t.Errorf("%s: got %d %s, want %s", tc.query.Encode(), code, got, tc.want)
+		}
+	}
+	for _, query := range []string{"sort=author", "from=sixties", "from=1990&to=1980"} {
+		if code, _ := list(query); code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want 400", query, code)
+		}
+	}
+
+	// Dates are parsed from the form, bad ones refused.
+	for date, want := range map[string]int{"August 1965": http.StatusOK, "the sixties": http.StatusBadRequest} {
+		resp, err := http.PostForm(srv.URL+"/books", url.Values{"title": {"Form"}, "publishedDate": {date}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("publishedDate %q: got status %d, want %d", date, resp.StatusCode, want)
+		}
+	}
+	books, _ := bs.DB.QueryBooks(BookQuery{PublishedFrom: 1965, PublishedTo: 1965})
+	if len(books) != 2 {
+		t.Errorf("got %d books of 1965, want Dune and the one from the form", len(books))
+	}
+}
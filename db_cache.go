@@ -0,0 +1,321 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBookCacheSize = 1000
+	defaultBookCacheTTL  = 30 * time.Second
+)
+
+// cachedDB is a read-through cache in front of another BookDatabase. It
+// keeps up to size books for ttl, evicting the least recently used ones
+// first, and lists of books for ttl as well. Changes made through
+// the cache invalidate it at once; changes made elsewhere, e.g. by another
+// replica, show after at most ttl.
+type cachedDB struct {
+	next BookDatabase
+	size int
+	ttl  time.Duration
+	now  func() time.Time
+
+	mu    sync.Mutex
+	lru   *list.List             // of *bookCacheEntry, most recently used first.
+	books map[uint]*list.Element // maps from Book ID into lru.
+	// lists are the results of ListBooks, QueryBooks and Facets.
+	lists map[listCacheKey]*listCacheEntry
+	// generation is incremented by every change, so that results read
+	// from next while a change happened are not cached.
+	generation uint64
+	stats      CacheStats
+}
+
+var _ BookDatabase = &cachedDB{}
+
+type bookCacheEntry struct {
+	book    *Book
+	expires time.Time
+}
+
+// listCacheKey tells ListBooks, which sets all, from QueryBooks and
+// Facets, which sets facets.
+type listCacheKey struct {
+	all    bool
+	facets bool
+	q      BookQuery
+}
+
+type listCacheEntry struct {
+	books   []*Book
+	facets  *Facets
+	expires time.Time
+}
+
+// maxCachedLists bounds the number of cached queries: the filters can be
+// chosen freely by visitors.
+const maxCachedLists = 64
+
+// CacheStats counts the work of a cachedDB.
+type CacheStats struct {
+	Hits          uint64 `json:"hits"`
+	Misses        uint64 `json:"misses"`
+	ListHits      uint64 `json:"list_hits"`
+	ListMisses    uint64 `json:"list_misses"`
+	Evictions     uint64 `json:"evictions"`
+	Invalidations uint64 `json:"invalidations"`
+	Entries       int    `json:"entries"`
+}
+
+// newCachedDB wraps next in a cache of size books kept for ttl.
+func newCachedDB(next BookDatabase, size int, ttl time.Duration) *cachedDB {
+	return &cachedDB{
+		next:  next,
+		size:  size,
+		ttl:   ttl,
+		now:   time.Now,
+		lru:   list.New(),
+		books: make(map[uint]*list.Element),
+		lists: make(map[listCacheKey]*listCacheEntry),
+	}
+}
+
+// uncachedDB returns the database behind the cache, if db is one.
+func uncachedDB(db BookDatabase) BookDatabase {
+	if c, ok := db.(*cachedDB); ok {
+		return c.next
+	}
+	return db
+}
+
+// copyBook keeps callers from changing cached books.
+func copyBook(b *Book) *Book {
+	c := *b
+	c.Credits = append([]Credit(nil), b.Credits...)
+	c.Genres = append([]string(nil), b.Genres...)
+	c.Tags = append([]string(nil), b.Tags...)
+	if b.Series != nil {
+		e := *b.Series
+		c.Series = &e
+	}
+	return &c
+}
+
+// GetBook retrieves a book by its ID.
+func (db *cachedDB) GetBook(id uint) (*Book, error) {
+	db.mu.Lock()
+	if el, ok := db.books[id]; ok {
+		e := el.Value.(*bookCacheEntry)
+		if db.now().Before(e.expires) {
+			db.lru.MoveToFront(el)
+			db.stats.Hits++
+			b := copyBook(e.book)
+			db.mu.Unlock()
+			return b, nil
+		}
+		db.remove(el)
+	}
+	db.stats.Misses++
+	gen := db.generation
+	db.mu.Unlock()
+
+	b, err := db.next.GetBook(id)
+	if err != nil {
+		return nil, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if gen == db.generation {
+		db.put(b)
+	}
+	return copyBook(b), nil
+}
+
+// put caches b, evicting the least recently used books beyond size.
+func (db *cachedDB) put(b *Book) {
+	e := &bookCacheEntry{book: copyBook(b), expires: db.now().Add(db.ttl)}
+	if el, ok := db.books[b.ID]; ok {
+		el.Value = e
+		db.lru.MoveToFront(el)
+		return
+	}
+	db.books[b.ID] = db.lru.PushFront(e)
+	for db.lru.Len() > db.size {
+		db.remove(db.lru.Back())
+		db.stats.Evictions++
+	}
+}
+
+func (db *cachedDB) remove(el *list.Element) {
+	delete(db.books, el.Value.(*bookCacheEntry).book.ID)
+	db.lru.Remove(el)
+}
+
+// invalidate drops book id, or no book if id is 0, and the list.
+func (db *cachedDB) invalidate(id uint) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.generation++
+	db.stats.Invalidations++
+	if el, ok := db.books[id]; ok {
+		db.remove(el)
+	}
+	db.lists = make(map[listCacheKey]*listCacheEntry)
+}
+
+// invalidateCache drops book id from the cache in front of db, if any,
+// for changes which do not go through the cache, e.g. of its authors.
+func invalidateCache(db BookDatabase, id uint) {
+	if c, ok := db.(*cachedDB); ok {
+		c.invalidate(id)
+	}
+}
+
+// AddBook saves a given book, assigning it a new ID.
+func (db *cachedDB) AddBook(b *Book) (id uint, err error) {
+	defer db.invalidate(0)
+	return db.next.AddBook(b)
+}
+
+// DeleteBook removes a given book by its ID.
+func (db *cachedDB) DeleteBook(id uint) error {
+	defer db.invalidate(id)
+	return db.next.DeleteBook(id)
+}
+
+// UpdateBook updates the entry for a given book.
+func (db *cachedDB) UpdateBook(b *Book) error {
+	defer db.invalidate(b.ID)
+	return db.next.UpdateBook(b)
+}
+
+// ListBooks returns a list of books, ordered by title.
+func (db *cachedDB) ListBooks() ([]*Book, error) {
+	return db.cachedList(listCacheKey{all: true}, db.next.ListBooks)
+}
+
+// QueryBooks returns the books selected by q, in its order. Orders by
+// rating are not cached, since reviews do not go through the cache.
+func (db *cachedDB) QueryBooks(q BookQuery) ([]*Book, error) {
+	if q.Sort == sortRating {
+		return db.next.QueryBooks(q)
+	}
+	return db.cachedList(listCacheKey{q: q}, func() ([]*Book, error) {
+		return db.next.QueryBooks(q)
+	})
+}
+
+// Facets counts the facets of the books selected by q.
+func (db *cachedDB) Facets(q BookQuery) (*Facets, error) {
+	e, err := db.cachedEntry(listCacheKey{facets: true, q: q}, func() (*listCacheEntry, error) {
+		f, err := db.next.Facets(q)
+		return &listCacheEntry{facets: f}, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return e.facets.copy(), nil
+}
+
+// ListGenres returns the genre vocabulary, which is not cached.
+func (db *cachedDB) ListGenres() ([]string, error) {
+	return db.next.ListGenres()
+}
+
+// AddGenre adds a genre to the vocabulary.
+func (db *cachedDB) AddGenre(name string) error {
+	return db.next.AddGenre(name)
+}
+
+// cachedList returns the list cached under key, calling load on a miss.
+func (db *cachedDB) cachedList(key listCacheKey, load func() ([]*Book, error)) ([]*Book, error) {
+	e, err := db.cachedEntry(key, func() (*listCacheEntry, error) {
+		books, err := load()
+		return &listCacheEntry{books: copyBooks(books)}, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return copyBooks(e.books), nil
+}
+
+// cachedEntry returns the entry cached under key, calling load on a miss.
+// Callers copy what they return from the entry.
+func (db *cachedDB) cachedEntry(key listCacheKey, load func() (*listCacheEntry, error)) (*listCacheEntry, error) {
+	db.mu.Lock()
+	if e, ok := db.lists[key]; ok && db.now().Before(e.expires) {
+		db.stats.ListHits++
+		db.mu.Unlock()
+		return e, nil
+	}
+	db.stats.ListMisses++
+	gen := db.generation
+	db.mu.Unlock()
+
+	e, err := load()
+	if err != nil {
+		return nil, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if gen == db.generation {
+		if len(db.lists) >= maxCachedLists {
+			db.lists = make(map[listCacheKey]*listCacheEntry)
+		}
+		e.expires = db.now().Add(db.ttl)
+		db.lists[key] = e
+	}
+	return e, nil
+}
+
+func copyBooks(books []*Book) []*Book {
+	var c []*Book
+	for _, b := range books {
+		c = append(c, copyBook(b))
+	}
+	return c
+}
+
+// Stats returns the counters of the cache.
+func (db *cachedDB) Stats() CacheStats {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	s := db.stats
+	s.Entries = db.lru.Len()
+	return s
+}
+
+// cacheStatsHandler reports the statistics of the book cache as JSON.
+func (b *Bookshelf) cacheStatsHandler(w http.ResponseWriter, r *http.Request) *appError {
+	db, ok := b.DB.(*cachedDB)
+	if !ok {
+		http.Error(w, "the book cache is disabled", http.StatusNotFound)
+		return nil
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(db.Stats()); err != nil {
+		return b.appErrorf(r, err, "could not write cache stats: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// countingDB counts the calls reaching the database behind a cache.
+type countingDB struct {
+	BookDatabase
+	gets, lists int
+}
+
+func (db *countingDB) GetBook(id uint) (*Book, error) {
+	db.gets++
+	return db.BookDatabase.GetBook(id)
+}
+
+func (db *countingDB) ListBooks() ([]*Book, error) {
+	db.lists++
+	return db.BookDatabase.ListBooks()
+}
+
+func newTestCache(size int) (*cachedDB, *countingDB, *time.Time) {
+	next := &countingDB{BookDatabase: newMemoryDB()}
+	db := newCachedDB(next, size, time.Minute)
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	db.now = func() time.Time { return now }
+	return db, next, &now
+}
+
+func TestCachedDBGetBook(t *testing.T) {
+	db, next, now := newTestCache(2)
+	var ids []uint
+	for _, title := range []string{"a", "b", "c"} {
+		id, err := db.AddBook(&Book{Title: title})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	get := func(id uint) *Book {
+		t.Helper()
+		b, err := db.GetBook(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	get(ids[0])
+	get(ids[0])
+	if next.gets != 1 {
+		t.Errorf("got %d reads of the database, want 1", next.gets)
+	}
+
+	// Callers cannot change the cached book.
+	get(ids[0]).Title = "changed"
+	if b := get(ids[0]); b.Title != "a" {
+		t.Errorf("cached book was changed to %q", b.Title)
+	}
+
+	// b and c evict a, the least recently used.
+	get(ids[1])
+	get(ids[2])
+	next.gets = 0
+	get(ids[0])
+	if next.gets != 1 {
+		t.Errorf("evicted book: got %d reads of the database, want 1", next.gets)
+	}
+
+	// Entries expire after the TTL.
+	*now = now.Add(2 * time.Minute)
+	next.gets = 0
+	get(ids[0])
+	if next.gets != 1 {
+		t.Errorf("expired book: got %d reads of the database, want 1", next.gets)
+	}
+
+	// Updates invalidate.
+	if err := db.UpdateBook(&Book{ID: ids[0], Title: "new"}); err != nil {
+		t.Fatal(err)
+	}
+	if b := get(ids[0]); b.Title != "new" {
+		t.Errorf("after update: got title %q, want new", b.Title)
+	}
+
+	s := db.Stats()
+	if s.Hits != 3 || s.Misses != 6 || s.Evictions != 2 || s.Invalidations != 4 || s.Entries != 2 {
+		t.Errorf("got stats %+v", s)
+	}
+}
+
+func TestCachedDBListBooks(t *testing.T) {
+	db, next, now := newTestCache(10)
+
+	list := func(want int) {
+		t.Helper()
+		books, err := db.ListBooks()
+		if err != nil || len(books) != want {
+			t.Fatalf("ListBooks: got %d books, %v, want %d", len(books), err, want)
+		}
+	}
+	list(0)
+	list(0)
+	if next.lists != 1 {
+		t.Errorf("empty list: got %d reads of the database, want 1", next.lists)
+	}
+
+	id, _ := db.AddBook(&Book{Title: "a"})
+	list(1)
+	list(1)
+	if next.lists != 2 {
+		t.Errorf("after add: got %d reads of the database, want 2", next.lists)
+	}
+
+	*now = now.Add(2 * time.Minute)
+	list(1)
+	if next.lists != 3 {
+		t.Errorf("expired list: got %d reads of the database, want 3", next.lists)
+	}
+
+	db.DeleteBook(id)
+	list(0)
+	if s := db.Stats(); s.ListHits != 2 || s.ListMisses != 4 {
+		t.Errorf("got stats %+v", s)
+	}
+}
+
+func TestCacheStatsHandler(t *testing.T) {
+	bs, srv := newTestBookshelf(t)
+
+	resp, err := http.Get(srv.URL + "/admin/cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("without cache: got status %d, want 404", resp.StatusCode)
+	}
+
+	bs.DB = newCachedDB(bs.DB, 10, time.Minute)
+	bs.DB.ListBooks()
+	resp, err = http.Get(srv.URL + "/admin/cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var s CacheStats
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil || s.ListMisses != 1 {
+		t.Errorf("got %+v, %v", s, err)
+	}
+}
+
+func TestCacheSeesCredits(t *testing.T) {
+	bs, _ := newTestBookshelf(t)
+	bs.DB = newCachedDB(bs.DB, 10, time.Minute)
+
+	book := &Book{Title: "Emma", Credits: []Credit{{Name: "Jane Austen", Role: creditAuthor}}}
+	id, err := bs.DB.AddBook(book)
+	if err != nil {
+		t.Fatal(err)
+	}
+	book.ID = id
+	// Read between saving the book and its credits.
+	if _, err := bs.DB.Facets(BookQuery{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.saveCredits(book); err != nil {
+		t.Fatal(err)
+	}
+	f, err := bs.DB.Facets(BookQuery{})
+	if err != nil || len(f.Authors) != 1 || f.Authors[0].Label != "Jane Austen" {
+		t.Errorf("Facets after saving credits: got %+v, %v", f, err)
+	}
+}
@@ -34,7 +34,9 @@ import (
 	"errors"
 	"fmt"
 	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
 // memoryDB is a simple in-memory persistence layer for books.
@@ -42,14 +44,81 @@ type memoryDB struct {
 	mu     sync.Mutex
 	nextID uint           // next ID to assign to a book.
 	books  map[uint]*Book // maps from Book ID to Book.
+
+	nextUserID uint           // next ID to assign to a user.
+	users      map[uint]*User // maps from User ID to User.
+
+	audit []*AuditEntry // in the order of appending.
+
+	nextAuthorID uint                  // next ID to assign to an author.
+	authors      map[uint]*Author      // maps from Author ID to Author.
+	credits      map[uint][]bookAuthor // maps from Book ID to its credits, in order.
+
+	genres []string // the genre vocabulary, in order.
+
+	nextSeriesID uint                 // next ID to assign to a series.
+	series       map[uint]*Series     // maps from Series ID to Series.
+	bookSeries   map[uint]*bookSeries // maps from Book ID to its series.
+
+	nextCollectionID uint                 // next ID to assign to a collection.
+	collections      map[uint]*Collection // maps from Collection ID to Collection.
+	collectionBooks  map[uint][]uint      // maps from Collection ID to its Book IDs, in order.
+
+	nextCopyID uint           // next ID to assign to a copy.
+	copies     map[uint]*Copy // maps from Copy ID to Copy.
+
+	nextLoanID uint    // next ID to assign to a loan.
+	loans      []*Loan // in the order of checking out.
+
+	nextHoldID uint    // next ID to assign to a hold.
+	holds      []*Hold // in the order of placing.
+
+	nextReminderID uint          // next ID to assign to a reminder.
+	reminders      []*Reminder   // in the order of queueing.
+	optOuts        map[uint]bool // the IDs of users declining reminders.
+
+	nextReviewID uint      // next ID to assign to a review.
+	reviews      []*Review // in the order of writing.
 }
 
 var _ BookDatabase = &memoryDB{}
+var _ UserDatabase = &memoryDB{}
+var _ AuditLog = &memoryDB{}
+var _ AuthorDatabase = &memoryDB{}
+var _ SeriesDatabase = &memoryDB{}
+var _ CollectionDatabase = &memoryDB{}
+var _ CopyDatabase = &memoryDB{}
+var _ LoanDatabase = &memoryDB{}
+var _ HoldDatabase = &memoryDB{}
+var _ ReminderDatabase = &memoryDB{}
+var _ ReviewDatabase = &memoryDB{}
 
 func newMemoryDB() *memoryDB {
 	return &memoryDB{
-		books:  make(map[uint]*Book),
-		nextID: 1,
+		books:        make(map[uint]*Book),
+		nextID:       1,
+		users:        make(map[uint]*User),
+		nextUserID:   1,
+		authors:      make(map[uint]*Author),
+		nextAuthorID: 1,
+		credits:      make(map[uint][]bookAuthor),
+		genres:       append([]string(nil), defaultGenres...),
+		series:       make(map[uint]*Series),
+		nextSeriesID: 1,
+		bookSeries:   make(map[uint]*bookSeries),
+
+		nextCollectionID: 1,
+		collections:      make(map[uint]*Collection),
+		collectionBooks:  make(map[uint][]uint),
+
+		nextCopyID: 1,
+		copies:     make(map[uint]*Copy),
+		nextLoanID: 1,
+		nextHoldID: 1,
+
+		nextReminderID: 1,
+		optOuts:        make(map[uint]bool),
+		nextReviewID:   1,
 	}
 }
 
@@ -59,6 +128,15 @@ func (db *memoryDB) Close(context.Context) error {
 	defer db.mu.Unlock()
 
 	db.books = nil
+	db.users = nil
+	db.audit = nil
+	db.authors = nil
+	db.credits = nil
+	db.genres = nil
+	db.series = nil
+	db.bookSeries = nil
+	db.collections = nil
+	db.collectionBooks = nil
 
 	return nil
 }
@@ -70,7 +148,7 @@ func (db *memoryDB) GetBook(id uint) (*Book, error) {
 
 	book, ok := db.books[id]
 	if !ok {
-		return nil, fmt.Errorf("memorydb: book not found with ID %q", id)
+		return nil, fmt.Errorf("memorydb: book with ID %d %w", id, errNotFound)
 	}
 	return book, nil
 }
@@ -80,6 +158,9 @@ func (db *memoryDB) AddBook(b *Book) (id uint, err error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
+	if err := db.checkGenres(b.Genres); err != nil {
+		return 0, err
+	}
 	//b.ID = strconv.FormatInt(db.nextID, 10)
 	b.ID = db.nextID
 	//s := strconv.Itoa(b.ID)
@@ -91,7 +172,9 @@ func (db *memoryDB) AddBook(b *Book) (id uint, err error) {
 	return b.ID, nil
 }
 
-// DeleteBook removes a given book by its ID.
+// DeleteBook removes a given book by its ID, unless a copy of it is on
+// loan or kept for a hold. Its loans and holds are kept for their history,
+// with the holds still waiting cancelled.
 func (db *memoryDB) DeleteBook(id uint) error {
 	if id == 0 {
 		return errors.New("memorydb: book with unassigned ID passed into DeleteBook")
@@ -101,9 +184,43 @@ func (db *memoryDB) DeleteBook(id uint) error {
 	defer db.mu.Unlock()
 
 	if _, ok := db.books[id]; !ok {
-		return fmt.Errorf("memorydb: could not delete book with ID %q, does not exist", id)
+		return fmt.Errorf("memorydb: could not delete book with ID %d: %w", id, errNotFound)
+	}
+	for _, l := range db.loans {
+		if l.BookID == id && l.Active() {
+			return fmt.Errorf("memorydb: could not delete book with ID %d: %w: copy %d is on loan", id, errBadCopy, l.CopyID)
+		}
+	}
+	for _, h := range db.holds {
+		if h.BookID == id && h.Ready() {
+			return fmt.Errorf("memorydb: could not delete book with ID %d: %w: copy %d is on hold", id, errBadCopy, h.CopyID)
+		}
 	}
 	delete(db.books, id)
+	delete(db.credits, id)
+	db.leaveSeries(id)
+	for cid, ids := range db.collectionBooks {
+		db.collectionBooks[cid] = removeID(ids, id)
+	}
+	for cid, c := range db.copies {
+		if c.BookID == id {
+			delete(db.copies, cid)
+		}
+	}
+	now := time.Now().UTC()
+	for _, h := range db.holds {
+		if h.BookID == id && h.Active() {
+			h.Status = holdCancelled
+			h.Closed = &now
+		}
+	}
+	var reviews []*Review
+	for _, r := range db.reviews {
+		if r.BookID != id {
+			reviews = append(reviews, r)
+		}
+	}
+	db.reviews = reviews
 	return nil
 }
 
@@ -117,10 +234,23 @@ func (db *memoryDB) UpdateBook(b *Book) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
+	if err := db.checkGenres(b.Genres); err != nil {
+		return err
+	}
 	db.books[b.ID] = b
 	return nil
 }
 
+// checkGenres returns an error unless genres are in the vocabulary.
+func (db *memoryDB) checkGenres(genres []string) error {
+	for _, g := range genres {
+		if !containsFold(db.genres, g) {
+			return fmt.Errorf("memorydb: %w %q", errUnknownGenre, g)
+		}
+	}
+	return nil
+}
+
 // ListBooks returns a list of books, ordered by title.
 func (db *memoryDB) ListBooks() ([]*Book, error) {
 	db.mu.Lock()
@@ -136,3 +266,1320 @@ func (db *memoryDB) ListBooks() ([]*Book, error) {
 	})
 	return books, nil
 }
+
+// QueryBooks returns the books selected by q, in its order.
+func (db *memoryDB) QueryBooks(q BookQuery) ([]*Book, error) {
+	if err := q.validate(); err != nil {
+		return nil, fmt.Errorf("memorydb: %v", err)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	books := db.queryBooks(q)
+	q.sortBooks(books)
+	if q.Sort == sortRating {
+		ratings := db.ratings()
+		sort.SliceStable(books, func(i, j int) bool {
+			return ratings[books[i].ID].better(ratings[books[j].ID])
+		})
+	}
+	return books, nil
+}
+
+// queryBooks returns the books selected by q, in no order.
+func (db *memoryDB) queryBooks(q BookQuery) []*Book {
+	var books []*Book
+	for _, b := range db.books {
+		if q.match(b) && (q.AuthorID == 0 || db.credited(b.ID, q.AuthorID)) {
+			books = append(books, b)
+		}
+	}
+	return books
+}
+
+// credited reports whether the author is credited for the book.
+func (db *memoryDB) credited(bookID, authorID uint) bool {
+	for _, row := range db.credits[bookID] {
+		if row.AuthorID == authorID {
+			return true
+		}
+	}
+	return false
+}
+
+// Facets counts the genres, tags, authors and decades of the books
+// selected by q.
+func (db *memoryDB) Facets(q BookQuery) (*Facets, error) {
+	if err := q.validate(); err != nil {
+		return nil, fmt.Errorf("memorydb: %v", err)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	c := newFacetCounter()
+	for _, b := range db.queryBooks(q) {
+		var authors []*Author
+		seen := make(map[uint]bool)
+		for _, row := range db.credits[b.ID] {
+			if !seen[row.AuthorID] {
+				seen[row.AuthorID] = true
+				authors = append(authors, db.authors[row.AuthorID])
+			}
+		}
+		c.addBook(b, authors)
+	}
+	return c.facets(), nil
+}
+
+// ListGenres returns the genre vocabulary, in its order.
+func (db *memoryDB) ListGenres() ([]string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return append([]string(nil), db.genres...), nil
+}
+
+// AddGenre adds a genre to the end of the vocabulary.
+func (db *memoryDB) AddGenre(name string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if containsFold(db.genres, name) {
+		return fmt.Errorf("memorydb: genre %q exists already", name)
+	}
+	db.genres = append(db.genres, name)
+	return nil
+}
+
+// GetUser retrieves a user by its ID.
+func (db *memoryDB) GetUser(id uint) (*User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	u, ok := db.users[id]
+	if !ok {
+		return nil, fmt.Errorf("memorydb: user with ID %d %w", id, errNotFound)
+	}
+	c := *u
+	return &c, nil
+}
+
+// FindUser retrieves a user by its issuer and subject.
+func (db *memoryDB) FindUser(issuer, subject string) (*User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, u := range db.users {
+		if u.Issuer == issuer && u.Subject == subject {
+			c := *u
+			return &c, nil
+		}
+	}
+	return nil, fmt.Errorf("memorydb: user %s#%s %w", issuer, subject, errNotFound)
+}
+
+// UpsertUser saves a given user, matching an existing entry by its issuer
+// and subject.
+func (db *memoryDB) UpsertUser(u *User) (uint, error) {
+	if u.Subject == "" {
+		return 0, errors.New("memorydb: user without subject passed into UpsertUser")
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for id, old := range db.users {
+		if old.Issuer == u.Issuer && old.Subject == u.Subject {
+			u.ID = id
+			u.CreatedAt = old.CreatedAt
+			c := *u
+			db.users[id] = &c
+			return id, nil
+		}
+	}
+	u.ID = db.nextUserID
+	if u.CreatedAt.IsZero() {
+		u.CreatedAt = time.Now()
+	}
+	c := *u
+	db.users[u.ID] = &c
+	db.nextUserID++
+	return u.ID, nil
+}
+
+// ListUsers returns a list of users, ordered by ID.
+func (db *memoryDB) ListUsers() ([]*User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var users []*User
+	for _, u := range db.users {
+		c := *u
+		users = append(users, &c)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].ID < users[j].ID
+	})
+	return users, nil
+}
+
+// AppendAudit adds an entry, assigning it a new ID.
+func (db *memoryDB) AppendAudit(e *AuditEntry) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	e.ID = uint(len(db.audit) + 1)
+	c := *e
+	db.audit = append(db.audit, &c)
+	return nil
+}
+
+// ListAudit returns the entries selected by f, newest first.
+func (db *memoryDB) ListAudit(f AuditFilter) ([]*AuditEntry, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var entries []*AuditEntry
+	for i := len(db.audit) - 1; i >= 0; i-- {
+		if f.Limit > 0 && len(entries) == f.Limit {
+			break
+		}
+		if e := db.audit[i]; f.match(e) {
+			c := *e
+			entries = append(entries, &c)
+		}
+	}
+	return entries, nil
+}
+
+// GetAuthor retrieves an author by its ID.
+func (db *memoryDB) GetAuthor(id uint) (*Author, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	a, ok := db.authors[id]
+	if !ok {
+		return nil, fmt.Errorf("memorydb: author with ID %d %w", id, errNotFound)
+	}
+	c := *a
+	return &c, nil
+}
+
+// SearchAuthors returns the authors whose names contain q, ignoring case,
+// ordered by name. limit caps the number of authors unless 0.
+func (db *memoryDB) SearchAuthors(q string, limit int) ([]*Author, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	q = strings.ToLower(q)
+	var authors []*Author
+	for _, a := range db.authors {
+		if strings.Contains(strings.ToLower(a.Name), q) {
+			c := *a
+			authors = append(authors, &c)
+		}
+	}
+	sort.Slice(authors, func(i, j int) bool {
+		return authors[i].Name < authors[j].Name
+	})
+	if limit > 0 && len(authors) > limit {
+		authors = authors[:limit]
+	}
+	return authors, nil
+}
+
+// SetCredits replaces the credits of a book, adding authors not known by
+// name yet.
+func (db *memoryDB) SetCredits(bookID uint, credits []Credit) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.books[bookID]; !ok {
+		return fmt.Errorf("memorydb: book with ID %d %w", bookID, errNotFound)
+	}
+	var rows []bookAuthor
+	for i := range credits {
+		c := &credits[i]
+		a := db.findAuthor(c.Name)
+		if a == nil {
+			a = &Author{ID: db.nextAuthorID, Name: c.Name}
+			db.authors[a.ID] = a
+			db.nextAuthorID++
+		}
+		c.AuthorID, c.Name = a.ID, a.Name
+		rows = append(rows, bookAuthor{BookID: bookID, AuthorID: a.ID, Role: c.Role, Position: i})
+	}
+	db.credits[bookID] = rows
+	return nil
+}
+
+// findAuthor returns the author called name, ignoring case, or nil.
+func (db *memoryDB) findAuthor(name string) *Author {
+	for _, a := range db.authors {
+		if strings.EqualFold(a.Name, name) {
+			return a
+		}
+	}
+	return nil
+}
+
+// Credits returns the credits of a book, in their order.
+func (db *memoryDB) Credits(bookID uint) ([]Credit, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var credits []Credit
+	for _, row := range db.credits[bookID] {
+		credits = append(credits, Credit{AuthorID: row.AuthorID, Name: db.authors[row.AuthorID].Name, Role: row.Role})
+	}
+	return credits, nil
+}
+
+// Works returns the books an author is credited for, ordered by title.
+func (db *memoryDB) Works(authorID uint) ([]Work, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.authors[authorID]; !ok {
+		return nil, fmt.Errorf("memorydb: author with ID %d %w", authorID, errNotFound)
+	}
+	var works []Work
+	for bookID, rows := range db.credits {
+		for _, row := range rows {
+			if row.AuthorID == authorID {
+				works = append(works, Work{Book: db.books[bookID], Role: row.Role})
+			}
+		}
+	}
+	sort.Slice(works, func(i, j int) bool {
+		if works[i].Book.Title != works[j].Book.Title {
+			return works[i].Book.Title < works[j].Book.Title
+		}
+		return works[i].Book.ID < works[j].Book.ID
+	})
+	return works, nil
+}
+
+// RenameAuthor changes the name of an author.
+func (db *memoryDB) RenameAuthor(id uint, name string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	a, ok := db.authors[id]
+	if !ok {
+		return fmt.Errorf("memorydb: author with ID %d %w", id, errNotFound)
+	}
+	if other := db.findAuthor(name); other != nil && other.ID != id {
+		return fmt.Errorf("memorydb: author %q exists already, merge instead", name)
+	}
+	a.Name = name
+	return nil
+}
+
+// MergeAuthors moves the credits of author from to author into and removes
+// from.
+func (db *memoryDB) MergeAuthors(from, into uint) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, id := range []uint{from, into} {
+		if _, ok := db.authors[id]; !ok {
+			return fmt.Errorf("memorydb: author with ID %d %w", id, errNotFound)
+		}
+	}
+	if from == into {
+		return errors.New("memorydb: cannot merge an author into itself")
+	}
+	for bookID, rows := range db.credits {
+		var merged []bookAuthor
+		for _, row := range rows {
+			if row.AuthorID == from {
+				row.AuthorID = into
+			}
+			if !hasCredit(merged, row.AuthorID, row.Role) {
+				merged = append(merged, row)
+			}
+		}
+		db.credits[bookID] = merged
+	}
+	delete(db.authors, from)
+	return nil
+}
+
+func hasCredit(rows []bookAuthor, authorID uint, role string) bool {
+	for _, row := range rows {
+		if row.AuthorID == authorID && row.Role == role {
+			return true
+		}
+	}
+	return false
+}
+
+// GetSeries retrieves a series by its ID.
+func (db *memoryDB) GetSeries(id uint) (*Series, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	series, ok := db.series[id]
+	if !ok {
+		return nil, fmt.Errorf("memorydb: series with ID %d %w", id, errNotFound)
+	}
+	return series, nil
+}
+
+// ListSeries returns all series, ordered by name.
+func (db *memoryDB) ListSeries() ([]*Series, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var series []*Series
+	for _, s := range db.series {
+		series = append(series, s)
+	}
+	sort.Slice(series, func(i, j int) bool {
+		return series[i].Name < series[j].Name
+	})
+	return series, nil
+}
+
+// SetSeries places a book in a series, or takes it out of its series if e
+// is nil.
+func (db *memoryDB) SetSeries(bookID uint, e *SeriesEntry) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.books[bookID]; !ok {
+		return fmt.Errorf("memorydb: book with ID %d %w", bookID, errNotFound)
+	}
+	db.leaveSeries(bookID)
+	if e == nil {
+		return nil
+	}
+	var series *Series
+	for _, s := range db.series {
+		if strings.EqualFold(s.Name, e.Name) {
+			series = s
+		}
+	}
+	if series == nil {
+		series = &Series{ID: db.nextSeriesID, Name: e.Name}
+		db.series[series.ID] = series
+		db.nextSeriesID++
+	}
+	e.SeriesID, e.Name = series.ID, series.Name
+	db.bookSeries[bookID] = &bookSeries{BookID: bookID, SeriesID: series.ID, Number: e.Number}
+	return nil
+}
+
+// leaveSeries takes a book out of its series, removing the series if no
+// book is left in it.
+func (db *memoryDB) leaveSeries(bookID uint) {
+	row, ok := db.bookSeries[bookID]
+	if !ok {
+		return
+	}
+	delete(db.bookSeries, bookID)
+	for _, other := range db.bookSeries {
+		if other.SeriesID == row.SeriesID {
+			return
+		}
+	}
+	delete(db.series, row.SeriesID)
+}
+
+// BookSeries returns the series of a book, or nil.
+func (db *memoryDB) BookSeries(bookID uint) (*SeriesEntry, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	row, ok := db.bookSeries[bookID]
+	if !ok {
+		return nil, nil
+	}
+	return &SeriesEntry{SeriesID: row.SeriesID, Name: db.series[row.SeriesID].Name, Number: row.Number}, nil
+}
+
+// Volumes returns the books of a series, in reading order.
+func (db *memoryDB) Volumes(seriesID uint) ([]Volume, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.series[seriesID]; !ok {
+		return nil, fmt.Errorf("memorydb: series with ID %d %w", seriesID, errNotFound)
+	}
+	var volumes []Volume
+	for bookID, row := range db.bookSeries {
+		if row.SeriesID == seriesID {
+			volumes = append(volumes, Volume{Book: db.books[bookID], Number: row.Number})
+		}
+	}
+	sortVolumes(volumes)
+	return volumes, nil
+}
+
+// RenameSeries changes the name of a series.
+func (db *memoryDB) RenameSeries(id uint, name string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	series, ok := db.series[id]
+	if !ok {
+		return fmt.Errorf("memorydb: series with ID %d %w", id, errNotFound)
+	}
+	for _, other := range db.series {
+		if other.ID != id && strings.EqualFold(other.Name, name) {
+			return fmt.Errorf("memorydb: series %q exists already", other.Name)
+		}
+	}
+	series.Name = name
+	return nil
+}
+
+// GetCollection retrieves a collection by its ID.
+func (db *memoryDB) GetCollection(id uint) (*Collection, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	c, ok := db.collections[id]
+	if !ok {
+		return nil, fmt.Errorf("memorydb: collection with ID %d %w", id, errNotFound)
+	}
+	copied := *c
+	return &copied, nil
+}
+
+// FindSharedCollection retrieves a collection by its share token.
+func (db *memoryDB) FindSharedCollection(token string) (*Collection, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, c := range db.collections {
+		if token != "" && c.ShareToken == token {
+			copied := *c
+			return &copied, nil
+		}
+	}
+	return nil, fmt.Errorf("memorydb: shared collection %w", errNotFound)
+}
+
+// ListCollections returns the collections of a user, ordered by name.
+func (db *memoryDB) ListCollections(ownerID uint) ([]*Collection, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var collections []*Collection
+	for _, c := range db.collections {
+		if c.OwnerID == ownerID {
+			copied := *c
+			collections = append(collections, &copied)
+		}
+	}
+	sort.Slice(collections, func(i, j int) bool {
+		return collections[i].Name < collections[j].Name
+	})
+	return collections, nil
+}
+
+// AddCollection saves a given collection, assigning it a new ID.
+func (db *memoryDB) AddCollection(c *Collection) (uint, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.checkCollectionName(c); err != nil {
+		return 0, err
+	}
+	c.ID = db.nextCollectionID
+	db.nextCollectionID++
+	copied := *c
+	db.collections[c.ID] = &copied
+	return c.ID, nil
+}
+
+// checkCollectionName returns an error if the owner of c has another
+// collection of its name.
+func (db *memoryDB) checkCollectionName(c *Collection) error {
+	for _, other := range db.collections {
+		if other.ID != c.ID && other.OwnerID == c.OwnerID && strings.EqualFold(other.Name, c.Name) {
+			return fmt.Errorf("memorydb: %w: collection %q exists already", errBadCollection, other.Name)
+		}
+	}
+	return nil
+}
+
+// UpdateCollection updates the name and share token of a collection.
+func (db *memoryDB) UpdateCollection(c *Collection) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	stored, ok := db.collections[c.ID]
+	if !ok {
+		return fmt.Errorf("memorydb: collection with ID %d %w", c.ID, errNotFound)
+	}
+	if err := db.checkCollectionName(c); err != nil {
+		return err
+	}
+	stored.Name, stored.ShareToken = c.Name, c.ShareToken
+	return nil
+}
+
+// DeleteCollection removes a collection.
+func (db *memoryDB) DeleteCollection(id uint) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.collections[id]; !ok {
+		return fmt.Errorf("memorydb: collection with ID %d %w", id, errNotFound)
+	}
+	delete(db.collections, id)
+	delete(db.collectionBooks, id)
+	return nil
+}
+
+// CollectionBooks returns the books of a collection, in its order.
+func (db *memoryDB) CollectionBooks(id uint) ([]*Book, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.collections[id]; !ok {
+		return nil, fmt.Errorf("memorydb: collection with ID %d %w", id, errNotFound)
+	}
+	var books []*Book
+	for _, bookID := range db.collectionBooks[id] {
+		books = append(books, db.books[bookID])
+	}
+	return books, nil
+}
+
+// AddToCollection appends a book to a collection.
+func (db *memoryDB) AddToCollection(id, bookID uint) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.collections[id]; !ok {
+		return fmt.Errorf("memorydb: collection with ID %d %w", id, errNotFound)
+	}
+	if _, ok := db.books[bookID]; !ok {
+		return fmt.Errorf("memorydb: book with ID %d %w", bookID, errNotFound)
+	}
+	for _, other := range db.collectionBooks[id] {
+		if other == bookID {
+			return nil
+		}
+	}
+	db.collectionBooks[id] = append(db.collectionBooks[id], bookID)
+	return nil
+}
+
+// RemoveFromCollection takes a book out of a collection.
+func (db *memoryDB) RemoveFromCollection(id, bookID uint) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.collections[id]; !ok {
+		return fmt.Errorf("memorydb: collection with ID %d %w", id, errNotFound)
+	}
+	db.collectionBooks[id] = removeID(db.collectionBooks[id], bookID)
+	return nil
+}
+
+func removeID(ids []uint, id uint) []uint {
+	var kept []uint
+	for _, other := range ids {
+		if other != id {
+			kept = append(kept, other)
+		}
+	}
+	return kept
+}
+
+// ReorderCollection puts the books of a collection in the order of bookIDs.
+func (db *memoryDB) ReorderCollection(id uint, bookIDs []uint) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.collections[id]; !ok {
+		return fmt.Errorf("memorydb: collection with ID %d %w", id, errNotFound)
+	}
+	if err := checkOrder(db.collectionBooks[id], bookIDs); err != nil {
+		return fmt.Errorf("memorydb: %w", err)
+	}
+	db.collectionBooks[id] = append([]uint(nil), bookIDs...)
+	return nil
+}
+
+// GetCopy retrieves a copy by its ID.
+func (db *memoryDB) GetCopy(id uint) (*Copy, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	c, ok := db.copies[id]
+	if !ok {
+		return nil, fmt.Errorf("memorydb: copy with ID %d %w", id, errNotFound)
+	}
+	copied := *c
+	return &copied, nil
+}
+
+// FindCopy retrieves a copy by its barcode.
+func (db *memoryDB) FindCopy(barcode string) (*Copy, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, c := range db.copies {
+		if strings.EqualFold(c.Barcode, barcode) {
+			copied := *c
+			return &copied, nil
+		}
+	}
+	return nil, fmt.Errorf("memorydb: copy with barcode %q %w", barcode, errNotFound)
+}
+
+// ListCopies returns the copies of a book, ordered by barcode.
+func (db *memoryDB) ListCopies(bookID uint) ([]*Copy, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	copies := make([]*Copy, 0)
+	for _, c := range db.copies {
+		if c.BookID == bookID {
+			copied := *c
+			copies = append(copies, &copied)
+		}
+	}
+	sort.Slice(copies, func(i, j int) bool {
+		return copies[i].Barcode < copies[j].Barcode
+	})
+	return copies, nil
+}
+
+// AllCopies returns the copies of all books, ordered by book ID and
+// barcode.
+func (db *memoryDB) AllCopies() ([]*Copy, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	copies := make([]*Copy, 0, len(db.copies))
+	for _, c := range db.copies {
+		copied := *c
+		copies = append(copies, &copied)
+	}
+	sort.Slice(copies, func(i, j int) bool {
+		if copies[i].BookID != copies[j].BookID {
+			return copies[i].BookID < copies[j].BookID
+		}
+		return copies[i].Barcode < copies[j].Barcode
+	})
+	return copies, nil
+}
+
+// checkBarcode returns an error if another copy has the barcode of c.
+func (db *memoryDB) checkBarcode(c *Copy) error {
+	for _, other := range db.copies {
+		if other.ID != c.ID && strings.EqualFold(other.Barcode, c.Barcode) {
+			return fmt.Errorf("memorydb: %w: barcode %q is taken", errBadCopy, other.Barcode)
+		}
+	}
+	return nil
+}
+
+// AddCopy saves a given copy of a book, assigning it a new ID.
+func (db *memoryDB) AddCopy(c *Copy) (uint, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.books[c.BookID]; !ok {
+		return 0, fmt.Errorf("memorydb: book with ID %d %w", c.BookID, errNotFound)
+	}
+	if err := db.checkBarcode(c); err != nil {
+		return 0, err
+	}
+	c.ID = db.nextCopyID
+	db.nextCopyID++
+	copied := *c
+	db.copies[c.ID] = &copied
+	return c.ID, nil
+}
+
+// UpdateCopy updates the entry for a given copy.
+func (db *memoryDB) UpdateCopy(c *Copy) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	old, ok := db.copies[c.ID]
+	if !ok {
+		return fmt.Errorf("memorydb: copy with ID %d %w", c.ID, errNotFound)
+	}
+	if err := db.checkBarcode(c); err != nil {
+		return err
+	}
+	copied := *c
+	copied.BookID = old.BookID
+	db.copies[c.ID] = &copied
+	return nil
+}
+
+// DeleteCopy removes a given copy by its ID. Its loans are kept for their
+// history.
+func (db *memoryDB) DeleteCopy(id uint) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.copies[id]; !ok {
+		return fmt.Errorf("memorydb: could not delete copy with ID %d: %w", id, errNotFound)
+	}
+	if db.activeLoan(id) != nil {
+		return fmt.Errorf("memorydb: could not delete copy with ID %d: %w: on loan", id, errBadCopy)
+	}
+	if db.readyHold(id) != nil {
+		return fmt.Errorf("memorydb: could not delete copy with ID %d: %w: on hold", id, errBadCopy)
+	}
+	delete(db.copies, id)
+	return nil
+}
+
+// CopyCounts counts the copies of the given books.
+func (db *memoryDB) CopyCounts(bookIDs []uint) (map[uint]CopyCount, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	wanted := make(map[uint]bool)
+	for _, id := range bookIDs {
+		wanted[id] = true
+	}
+	counts := make(map[uint]CopyCount)
+	for _, c := range db.copies {
+		if !wanted[c.BookID] {
+			continue
+		}
+		n := counts[c.BookID]
+		n.Total++
+		if db.free(c) {
+			n.Available++
+		}
+		counts[c.BookID] = n
+	}
+	return counts, nil
+}
+
+// activeLoan returns the active loan of a copy, or nil.
+func (db *memoryDB) activeLoan(copyID uint) *Loan {
+	for _, l := range db.loans {
+		if l.CopyID == copyID && l.Active() {
+			return l
+		}
+	}
+	return nil
+}
+
+// CheckOut lends a copy.
+func (db *memoryDB) CheckOut(l *Loan) (uint, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	c, ok := db.copies[l.CopyID]
+	if !ok {
+		return 0, fmt.Errorf("memorydb: copy with ID %d %w", l.CopyID, errNotFound)
+	}
+	if !lendable(c.Condition) {
+		return 0, fmt.Errorf("memorydb: %w: copy %q is %s", errUnavailable, c.Barcode, c.Condition)
+	}
+	if db.activeLoan(c.ID) != nil {
+		return 0, fmt.Errorf("memorydb: %w: copy %q is on loan", errUnavailable, c.Barcode)
+	}
+	if h := db.readyHold(c.ID); h != nil && h.UserID != l.UserID {
+		return 0, fmt.Errorf("memorydb: %w: copy %q is on hold", errUnavailable, c.Barcode)
+	}
+	l.ID = db.nextLoanID
+	db.nextLoanID++
+	l.BookID = c.BookID
+	copied := *l
+	db.loans = append(db.loans, &copied)
+
+	// The loan fulfills the holds of the borrower on the book, releasing
+	// any other copy kept for them.
+	for _, h := range db.holds {
+		if h.BookID != c.BookID || h.UserID != l.UserID || !h.Active() {
+			continue
+		}
+		ready := h.Ready()
+		closed := l.CheckedOut
+		h.Status = holdFulfilled
+		h.Closed = &closed
+		if ready && h.CopyID != c.ID {
+			db.allocate(db.copies[h.CopyID], l.CheckedOut)
+		}
+	}
+	return l.ID, nil
+}
+
+// AddLoanRecord adds a returned loan as it is, setting its ID.
+func (db *memoryDB) AddLoanRecord(l *Loan) (uint, error) {
+	if l.Active() {
+		return 0, fmt.Errorf("memorydb: %w: loan of copy %d is not returned", errBadLoan, l.CopyID)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	l.ID = db.nextLoanID
+	db.nextLoanID++
+	copied := *l
+	db.loans = append(db.loans, &copied)
+	return l.ID, nil
+}
+
+// CheckIn ends the active loan of a copy.
+func (db *memoryDB) CheckIn(copyID uint, at time.Time) (*Loan, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	l := db.activeLoan(copyID)
+	if l == nil {
+		return nil, fmt.Errorf("memorydb: loan of copy %d %w", copyID, errNotFound)
+	}
+	l.Returned = &at
+	db.allocate(db.copies[copyID], at)
+	copied := *l
+	return &copied, nil
+}
+
+// GetLoan retrieves a loan by its ID.
+func (db *memoryDB) GetLoan(id uint) (*Loan, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, l := range db.loans {
+		if l.ID == id {
+			copied := *l
+			return &copied, nil
+		}
+	}
+	return nil, fmt.Errorf("memorydb: loan with ID %d %w", id, errNotFound)
+}
+
+// ListLoans returns the loans selected by f, newest first.
+func (db *memoryDB) ListLoans(f LoanFilter) ([]*Loan, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	loans := make([]*Loan, 0)
+	for i := len(db.loans) - 1; i >= 0; i-- {
+		if l := db.loans[i]; f.match(l) {
+			copied := *l
+			loans = append(loans, &copied)
+		}
+	}
+	return loans, nil
+}
+
+// readyHold returns the ready hold a copy is kept for, or nil.
+func (db *memoryDB) readyHold(copyID uint) *Hold {
+	for _, h := range db.holds {
+		if h.CopyID == copyID && h.Ready() {
+			return h
+		}
+	}
+	return nil
+}
+
+// free reports whether a copy could be lent to anyone.
+func (db *memoryDB) free(c *Copy) bool {
+	return lendable(c.Condition) && db.activeLoan(c.ID) == nil && db.readyHold(c.ID) == nil
+}
+
+// allocate keeps a free copy for the oldest hold waiting for its book.
+func (db *memoryDB) allocate(c *Copy, at time.Time) {
+	if c == nil || !db.free(c) {
+		return
+	}
+	for _, h := range db.holds {
+		if h.BookID == c.BookID && h.Status == holdWaiting {
+			expires := at.Add(holdPickupWindow)
+			h.Status = holdReady
+			h.CopyID = c.ID
+			h.Expires = &expires
+			return
+		}
+	}
+}
+
+// GetHold retrieves a hold by its ID.
+func (db *memoryDB) GetHold(id uint) (*Hold, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, h := range db.holds {
+		if h.ID == id {
+			copied := *h
+			return &copied, nil
+		}
+	}
+	return nil, fmt.Errorf("memorydb: hold with ID %d %w", id, errNotFound)
+}
+
+// PlaceHold queues a user for a book.
+func (db *memoryDB) PlaceHold(h *Hold) (uint, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.books[h.BookID]; !ok {
+		return 0, fmt.Errorf("memorydb: book with ID %d %w", h.BookID, errNotFound)
+	}
+	for _, other := range db.holds {
+		if other.BookID == h.BookID && other.UserID == h.UserID && other.Active() {
+			return 0, fmt.Errorf("memorydb: %w: user %d holds book %d already", errBadHold, h.UserID, h.BookID)
+		}
+	}
+	for _, l := range db.loans {
+		if l.BookID == h.BookID && l.UserID == h.UserID && l.Active() {
+			return 0, fmt.Errorf("memorydb: %w: user %d borrowed book %d already", errBadHold, h.UserID, h.BookID)
+		}
+	}
+	var free []*Copy
+	lendables := 0
+	for _, c := range db.copies {
+		if c.BookID != h.BookID || !lendable(c.Condition) {
+			continue
+		}
+		lendables++
+		if db.free(c) {
+			free = append(free, c)
+		}
+	}
+	if lendables == 0 {
+		return 0, fmt.Errorf("memorydb: %w: book %d has no copies to lend", errBadHold, h.BookID)
+	}
+	h.ID = db.nextHoldID
+	db.nextHoldID++
+	h.Status = holdWaiting
+	copied := *h
+	db.holds = append(db.holds, &copied)
+	if len(free) > 0 {
+		sort.Slice(free, func(i, j int) bool { return free[i].Barcode < free[j].Barcode })
+		db.allocate(free[0], h.Placed)
+		*h = copied
+	}
+	return h.ID, nil
+}
+
+// AddHoldRecord adds a closed hold as it is, setting its ID.
+func (db *memoryDB) AddHoldRecord(h *Hold) (uint, error) {
+	if h.Active() {
+		return 0, fmt.Errorf("memorydb: %w: hold of user %d is %s", errBadHold, h.UserID, h.Status)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	h.ID = db.nextHoldID
+	db.nextHoldID++
+	copied := *h
+	db.holds = append(db.holds, &copied)
+	return h.ID, nil
+}
+
+// CancelHold closes an active hold.
+func (db *memoryDB) CancelHold(id uint, at time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, h := range db.holds {
+		if h.ID != id {
+			continue
+		}
+		if !h.Active() {
+			return fmt.Errorf("memorydb: %w: hold %d is %s", errBadHold, id, h.Status)
+		}
+		ready := h.Ready()
+		h.Status = holdCancelled
+		h.Closed = &at
+		if ready {
+			db.allocate(db.copies[h.CopyID], at)
+		}
+		return nil
+	}
+	return fmt.Errorf("memorydb: hold with ID %d %w", id, errNotFound)
+}
+
+// ListHolds returns the holds selected by f, oldest first.
+func (db *memoryDB) ListHolds(f HoldFilter) ([]*Hold, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	holds := make([]*Hold, 0)
+	for _, h := range db.holds {
+		if f.match(h) {
+			copied := *h
+			holds = append(holds, &copied)
+		}
+	}
+	return holds, nil
+}
+
+// ExpireHolds closes the ready holds whose pickup window passed by now.
+func (db *memoryDB) ExpireHolds(now time.Time) ([]*Hold, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	expired := make([]*Hold, 0)
+	for _, h := range db.holds {
+		if !h.Ready() || h.Expires.After(now) {
+			continue
+		}
+		h.Status = holdExpired
+		h.Closed = &now
+		db.allocate(db.copies[h.CopyID], now)
+		copied := *h
+		expired = append(expired, &copied)
+	}
+	return expired, nil
+}
+
+// QueueReminder adds a pending reminder unless its loan got one of its
+// kind before.
+func (db *memoryDB) QueueReminder(r *Reminder) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, other := range db.reminders {
+		if other.LoanID == r.LoanID && other.Kind == r.Kind {
+			return false, nil
+		}
+	}
+	r.ID = db.nextReminderID
+	db.nextReminderID++
+	copied := *r
+	db.reminders = append(db.reminders, &copied)
+	return true, nil
+}
+
+// ClaimReminder takes a pending reminder whose next attempt is due by now
+// for an attempt to send it, by moving its next attempt to until.
+func (db *memoryDB) ClaimReminder(id uint, now, until time.Time) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, r := range db.reminders {
+		if r.ID == id {
+			if r.Status != reminderPending || r.NextAttempt.After(now) {
+				return false, nil
+			}
+			r.NextAttempt = until
+			return true, nil
+		}
+	}
+	return false, fmt.Errorf("memorydb: reminder with ID %d %w", id, errNotFound)
+}
+
+// UpdateReminder saves the outcome of an attempt to send a reminder.
+func (db *memoryDB) UpdateReminder(r *Reminder) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for i, old := range db.reminders {
+		if old.ID == r.ID {
+			copied := *r
+			db.reminders[i] = &copied
+			return nil
+		}
+	}
+	return fmt.Errorf("memorydb: reminder with ID %d %w", r.ID, errNotFound)
+}
+
+// ListReminders returns the reminders selected by f, newest first.
+func (db *memoryDB) ListReminders(f ReminderFilter) ([]*Reminder, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	reminders := make([]*Reminder, 0)
+	for i := len(db.reminders) - 1; i >= 0; i-- {
+		if f.Limit > 0 && len(reminders) == f.Limit {
+			break
+		}
+		if r := db.reminders[i]; f.match(r) {
+			copied := *r
+			reminders = append(reminders, &copied)
+		}
+	}
+	return reminders, nil
+}
+
+// SetOptOut records whether a user declines reminders.
+func (db *memoryDB) SetOptOut(userID uint, out bool) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.users[userID]; !ok {
+		return fmt.Errorf("memorydb: user with ID %d %w", userID, errNotFound)
+	}
+	if out {
+		db.optOuts[userID] = true
+	} else {
+		delete(db.optOuts, userID)
+	}
+	return nil
+}
+
+// OptedOut reports whether a user declines reminders.
+func (db *memoryDB) OptedOut(userID uint) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.optOuts[userID], nil
+}
+
+// ListOptOuts returns the IDs of the users declining reminders.
+func (db *memoryDB) ListOptOuts() ([]uint, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	ids := make([]uint, 0, len(db.optOuts))
+	for id := range db.optOuts {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// GetReview retrieves a review by its ID.
+func (db *memoryDB) GetReview(id uint) (*Review, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, r := range db.reviews {
+		if r.ID == id {
+			copied := *r
+			return &copied, nil
+		}
+	}
+	return nil, fmt.Errorf("memorydb: review with ID %d %w", id, errNotFound)
+}
+
+// FindReview retrieves the review of a book by a user.
+func (db *memoryDB) FindReview(bookID, userID uint) (*Review, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if r := db.findReview(bookID, userID); r != nil {
+		copied := *r
+		return &copied, nil
+	}
+	return nil, fmt.Errorf("memorydb: review of book %d by user %d %w", bookID, userID, errNotFound)
+}
+
+func (db *memoryDB) findReview(bookID, userID uint) *Review {
+	for _, r := range db.reviews {
+		if r.BookID == bookID && r.UserID == userID {
+			return r
+		}
+	}
+	return nil
+}
+
+// SaveReview adds the review of a user on a book, or replaces their
+// earlier one.
+func (db *memoryDB) SaveReview(r *Review) (uint, error) {
+	if err := normalizeReview(r); err != nil {
+		return 0, fmt.Errorf("memorydb: %w", err)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.books[r.BookID]; !ok {
+		return 0, fmt.Errorf("memorydb: book with ID %d %w", r.BookID, errNotFound)
+	}
+	if _, ok := db.users[r.UserID]; !ok {
+		return 0, fmt.Errorf("memorydb: user with ID %d %w", r.UserID, errNotFound)
+	}
+	if old := db.findReview(r.BookID, r.UserID); old != nil {
+		r.ID, r.Created, r.Hidden = old.ID, old.Created, old.Hidden
+		old.Rating, old.Body, old.Updated = r.Rating, r.Body, r.Updated
+		return r.ID, nil
+	}
+	r.ID = db.nextReviewID
+	db.nextReviewID++
+	copied := *r
+	db.reviews = append(db.reviews, &copied)
+	return r.ID, nil
+}
+
+// DeleteReview removes a review by its ID.
+func (db *memoryDB) DeleteReview(id uint) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for i, r := range db.reviews {
+		if r.ID == id {
+			db.reviews = append(db.reviews[:i], db.reviews[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("memorydb: could not delete review with ID %d: %w", id, errNotFound)
+}
+
+// HideReview takes a review down or puts it back up.
+func (db *memoryDB) HideReview(id uint, hidden bool) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, r := range db.reviews {
+		if r.ID == id {
+			r.Hidden = hidden
+			return nil
+		}
+	}
+	return fmt.Errorf("memorydb: review with ID %d %w", id, errNotFound)
+}
+
+// ListReviews returns the reviews selected by f, newest first.
+func (db *memoryDB) ListReviews(f ReviewFilter) ([]*Review, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	reviews := make([]*Review, 0)
+	for i := len(db.reviews) - 1; i >= 0; i-- {
+		if f.Limit > 0 && len(reviews) == f.Limit {
+			break
+		}
+		if r := db.reviews[i]; f.match(r) {
+			copied := *r
+			reviews = append(reviews, &copied)
+		}
+	}
+	return reviews, nil
+}
+
+// Ratings sums up the visible reviews of the given books.
+func (db *memoryDB) Ratings(bookIDs []uint) (map[uint]RatingSummary, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	all := db.ratings()
+	ratings := make(map[uint]RatingSummary, len(bookIDs))
+	for _, id := range bookIDs {
+		if s, ok := all[id]; ok {
+			ratings[id] = s
+		}
+	}
+	return ratings, nil
+}
+
+// ratings sums up the visible reviews of all books.
+func (db *memoryDB) ratings() map[uint]RatingSummary {
+	sums := make(map[uint]int)
+	ratings := make(map[uint]RatingSummary)
+	for _, r := range db.reviews {
+		if r.Hidden {
+			continue
+		}
+		s := ratings[r.BookID]
+		s.Count++
+		sums[r.BookID] += r.Rating
+		s.Average = float64(sums[r.BookID]) / float64(s.Count)
+		ratings[r.BookID] = s
+	}
+	return ratings
+}
@@ -14,7 +14,13 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/mysql"
@@ -25,8 +31,21 @@ type DB struct {
 	client *gorm.DB
 }
 
-// Ensure DB conforms to the BookDatabase interface.
+// Ensure DB conforms to the BookDatabase, UserDatabase, AuditLog,
+// AuthorDatabase, SeriesDatabase, CollectionDatabase, CopyDatabase and
+// LoanDatabase interfaces.
 var _ BookDatabase = &DB{}
+var _ UserDatabase = &DB{}
+var _ AuditLog = &DB{}
+var _ AuthorDatabase = &DB{}
+var _ SeriesDatabase = &DB{}
+var _ CollectionDatabase = &DB{}
+var _ CopyDatabase = &DB{}
+var _ LoanDatabase = &DB{}
+var _ HoldDatabase = &DB{}
+var _ ReminderDatabase = &DB{}
+var _ ReviewDatabase = &DB{}
+var _ snapshotDatabase = &DB{}
 
 // [START getting_started_bookshelf_mysql]
 
@@ -48,13 +67,38 @@ func (db *DB) Close() error {
 	return db.client.Close()
 }
 
+// ReadSnapshot calls read with a view of the database in a read-only
+// REPEATABLE READ transaction, which is rolled back afterwards. InnoDB
+// takes the snapshot of all tables at the first read of the transaction,
+// which is issued right away: this does what START TRANSACTION WITH
+// CONSISTENT SNAPSHOT does, which database/sql cannot send.
+func (db *DB) ReadSnapshot(ctx context.Context, read func(BookDatabase) error) error {
+	tx := db.client.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if tx.Error != nil {
+		return fmt.Errorf("DB: ReadSnapshot: %v", tx.Error)
+	}
+	defer tx.Rollback()
+
+	var n int
+	if err := tx.Model(&Book{}).Count(&n).Error; err != nil {
+		return fmt.Errorf("DB: ReadSnapshot: %v", err)
+	}
+	return read(&DB{client: tx})
+}
+
 // GetBook retrieves a book by its ID.
 func (db *DB) GetBook(id uint) (*Book, error) {
 	b := &Book{}
 	err := db.client.Find(b, id).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, fmt.Errorf("DB: Get: book with ID %d %w", id, errNotFound)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("DB: Get: %v", err)
 	}
+	if err := db.loadLabels([]*Book{b}); err != nil {
+		return nil, fmt.Errorf("DB: Get: %v", err)
+	}
 	return b, nil
 }
 
@@ -67,7 +111,13 @@ func (db *DB) AddBook(b *Book) (uint, error) {
 	if !creatable {
 		return 0, fmt.Errorf("DB: Already exists %s", b.Title)
 	}
-	if err := db.client.Create(b).Error; err != nil {
+	err := db.client.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(b).Error; err != nil {
+			return err
+		}
+		return setLabels(tx, b)
+	})
+	if err != nil {
 		return 0, fmt.Errorf("DB: Create: %v", err)
 	}
 	creatable = db.client.NewRecord(b)
@@ -77,12 +127,44 @@ func (db *DB) AddBook(b *Book) (uint, error) {
 	return b.ID, nil
 }
 
-// DeleteBook removes a given book by its ID.
+// DeleteBook removes a given book by its ID, unless a copy of it is on
+// loan or kept for a hold. Its loans and holds are kept for their history,
+// with the holds still waiting cancelled.
 func (db *DB) DeleteBook(id uint) error {
-	b := &Book{
-		ID: id,
+	// The lock of the book keeps copies from being lent or kept for holds
+	// meanwhile, see CheckOut.
+	err := db.client.Transaction(func(tx *gorm.DB) error {
+		if err := lockBook(tx, id); err != nil {
+			return err
+		}
+		var active int
+		if err := tx.Model(&Loan{}).Where("book_id = ? AND returned_at IS NULL", id).Count(&active).Error; err != nil {
+			return err
+		}
+		if active > 0 {
+			return fmt.Errorf("%w: a copy of book %d is on loan", errBadCopy, id)
+		}
+		var held int
+		if err := tx.Model(&Hold{}).Where("book_id = ? AND status = ?", id, holdReady).Count(&held).Error; err != nil {
+			return err
+		}
+		if held > 0 {
+			return fmt.Errorf("%w: a copy of book %d is on hold", errBadCopy, id)
+		}
+		err := tx.Model(&Hold{}).Where("book_id = ? AND status = ?", id, holdWaiting).
+			Updates(map[string]interface{}{"status": holdCancelled, "closed_at": time.Now().UTC()}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Delete(&Book{ID: id}).Error
+	})
+	if err != nil {
+		return fmt.Errorf("DB: Delete: %w", err)
 	}
-	if err := db.client.Delete(b).Error; err != nil {
+	// The series of the book goes with its last book, see SetSeries.
+	err = db.client.Exec(`DELETE FROM series
+  WHERE NOT EXISTS (SELECT 1 FROM book_series WHERE series_id = series.id)`).Error
+	if err != nil {
 		return fmt.Errorf("DB: Delete: %v", err)
 	}
 	return nil
@@ -90,12 +172,85 @@ func (db *DB) DeleteBook(id uint) error {
 
 // UpdateBook updates the entry for a given book.
 func (db *DB) UpdateBook(b *Book) error {
-	if err := db.client.Save(b).Error; err != nil {
+	err := db.client.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(b).Error; err != nil {
+			return err
+		}
+		return setLabels(tx, b)
+	})
+	if err != nil {
 		return fmt.Errorf("DB: Set: %v", err)
 	}
 	return nil
 }
 
+// setLabels replaces the genres and tags of b.
+func setLabels(tx *gorm.DB, b *Book) error {
+	if err := tx.Where("book_id = ?", b.ID).Delete(&bookGenre{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("book_id = ?", b.ID).Delete(&bookTag{}).Error; err != nil {
+		return err
+	}
+	for _, name := range b.Genres {
+		g := &genre{}
+		err := tx.Where("name = ?", name).First(g).Error
+		if gorm.IsRecordNotFoundError(err) {
+			return fmt.Errorf("%w %q", errUnknownGenre, name)
+		}
+		if err != nil {
+			return err
+		}
+		if err := tx.Create(&bookGenre{BookID: b.ID, GenreID: g.ID}).Error; err != nil {
+			return err
+		}
+	}
+	for _, t := range b.Tags {
+		if err := tx.Create(&bookTag{BookID: b.ID, Tag: t}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadLabels sets the genres and tags of books.
+func (db *DB) loadLabels(books []*Book) error {
+	if len(books) == 0 {
+		return nil
+	}
+	byID := make(map[uint]*Book, len(books))
+	ids := make([]uint, len(books))
+	for i, b := range books {
+		byID[b.ID] = b
+		ids[i] = b.ID
+		b.Genres, b.Tags = nil, nil
+	}
+	type genreRow struct {
+		BookID uint
+		Name   string
+	}
+	var genres []genreRow
+	err := db.client.Raw(`SELECT bg.book_id, g.name
+  FROM book_genres bg JOIN genres g ON g.id = bg.genre_id
+  WHERE bg.book_id IN (?) ORDER BY g.id`, ids).Scan(&genres).Error
+	if err != nil {
+		return err
+	}
+	for _, row := range genres {
+		b := byID[row.BookID]
+		b.Genres = append(b.Genres, row.Name)
+	}
+	var tags []bookTag
+	if err := db.client.Where("book_id IN (?)", ids).Order("tag").Find(&tags).Error; err != nil {
+		return err
+	}
+	for _, row := range tags {
+		b := byID[row.BookID]
+		b.Tags = append(b.Tags, row.Tag)
+	}
+	return nil
+}
+
 // ListBooks returns a list of books, ordered by title.
 func (db *DB) ListBooks() ([]*Book, error) {
 	books := make([]*Book, 0)
@@ -104,5 +259,1428 @@ func (db *DB) ListBooks() ([]*Book, error) {
 		return nil, fmt.Errorf(
 			"DB: could not list books up: %v", err)
 	}
+	if err := db.loadLabels(books); err != nil {
+		return nil, fmt.Errorf("DB: could not list books up: %v", err)
+	}
+	return books, nil
+}
+
+// QueryBooks returns the books selected by q, in its order.
+func (db *DB) QueryBooks(q BookQuery) ([]*Book, error) {
+	if err := q.validate(); err != nil {
+		return nil, fmt.Errorf("DB: QueryBooks: %v", err)
+	}
+	query := db.filterBooks(q)
+	switch q.Sort {
+	case sortPublished:
+		query = query.Order("published_year = 0, published_year, published_month, published_day")
+	case sortPublishedDesc:
+		query = query.Order("published_year = 0, published_year DESC, published_month DESC, published_day DESC")
+	case sortRating:
+		query = query.Select("books.*").Joins(`LEFT JOIN (SELECT book_id, AVG(rating) AS average, COUNT(*) AS n
+  FROM reviews WHERE NOT hidden GROUP BY book_id) ratings ON ratings.book_id = books.id`).
+			Order("ratings.average IS NULL, ratings.average DESC, ratings.n DESC")
+	}
+	books := make([]*Book, 0)
+	if err := query.Order("title, id").Find(&books).Error; err != nil {
+		return nil, fmt.Errorf("DB: QueryBooks: %v", err)
+	}
+	if err := db.loadLabels(books); err != nil {
+		return nil, fmt.Errorf("DB: QueryBooks: %v", err)
+	}
 	return books, nil
 }
+
+// filterBooks selects the books q selects, in no order.
+func (db *DB) filterBooks(q BookQuery) *gorm.DB {
+	query := db.client.Model(&Book{})
+	if q.PublishedFrom != 0 {
+		query = query.Where("published_year >= ?", q.PublishedFrom)
+	}
+	if q.PublishedTo != 0 {
+		query = query.Where("published_year BETWEEN 1 AND ?", q.PublishedTo)
+	}
+	if q.Genre != "" {
+		query = query.Where(`id IN (SELECT bg.book_id
+  FROM book_genres bg JOIN genres g ON g.id = bg.genre_id WHERE g.name = ?)`, q.Genre)
+	}
+	if q.Tag != "" {
+		query = query.Where("id IN (SELECT book_id FROM book_tags WHERE tag = ?)", q.Tag)
+	}
+	if q.AuthorID != 0 {
+		query = query.Where("id IN (SELECT book_id FROM book_authors WHERE author_id = ?)", q.AuthorID)
+	}
+	return query
+}
+
+// Facets counts the genres, tags, authors and decades of the books
+// selected by q.
+func (db *DB) Facets(q BookQuery) (*Facets, error) {
+	if err := q.validate(); err != nil {
+		return nil, fmt.Errorf("DB: Facets: %v", err)
+	}
+	ids := db.filterBooks(q).Select("id").QueryExpr()
+	f := &Facets{Genres: []Facet{}, Tags: []Facet{}, Authors: []Facet{}, Decades: []Facet{}}
+	for _, c := range []struct {
+		facets *[]Facet
+		sql    string
+	}{
+		{&f.Genres, `SELECT g.name AS value, g.name AS label, COUNT(*) AS count
+  FROM book_genres bg JOIN genres g ON g.id = bg.genre_id
+  WHERE bg.book_id IN (?) GROUP BY g.id, g.name`},
+		{&f.Tags, `SELECT tag AS value, tag AS label, COUNT(*) AS count
+  FROM book_tags WHERE book_id IN (?) GROUP BY tag`},
+		{&f.Authors, `SELECT ba.author_id AS value, a.name AS label, COUNT(DISTINCT ba.book_id) AS count
+  FROM book_authors ba JOIN authors a ON a.id = ba.author_id
+  WHERE ba.book_id IN (?) GROUP BY ba.author_id, a.name`},
+		{&f.Decades, `SELECT published_year DIV 10 * 10 AS value, COUNT(*) AS count
+  FROM books WHERE published_year > 0 AND id IN (?) GROUP BY value`},
+	} {
+		if err := db.client.Raw(c.sql, ids).Scan(c.facets).Error; err != nil {
+			return nil, fmt.Errorf("DB: Facets: %v", err)
+		}
+	}
+	for i := range f.Decades {
+		d, _ := strconv.Atoi(f.Decades[i].Value)
+		f.Decades[i].Label = decadeLabel(d)
+	}
+	f.sort()
+	return f, nil
+}
+
+// ListGenres returns the genre vocabulary, in its order.
+func (db *DB) ListGenres() ([]string, error) {
+	var genres []genre
+	if err := db.client.Order("id").Find(&genres).Error; err != nil {
+		return nil, fmt.Errorf("DB: ListGenres: %v", err)
+	}
+	names := make([]string, len(genres))
+	for i, g := range genres {
+		names[i] = g.Name
+	}
+	return names, nil
+}
+
+// AddGenre adds a genre to the end of the vocabulary.
+func (db *DB) AddGenre(name string) error {
+	err := db.client.Where("name = ?", name).First(&genre{}).Error
+	if err == nil {
+		return fmt.Errorf("DB: AddGenre: genre %q exists already", name)
+	}
+	if !gorm.IsRecordNotFoundError(err) {
+		return fmt.Errorf("DB: AddGenre: %v", err)
+	}
+	if err := db.client.Create(&genre{Name: name}).Error; err != nil {
+		return fmt.Errorf("DB: AddGenre: %v", err)
+	}
+	return nil
+}
+
+// GetUser retrieves a user by its ID.
+func (db *DB) GetUser(id uint) (*User, error) {
+	u := &User{}
+	err := db.client.First(u, id).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, fmt.Errorf("DB: GetUser: user with ID %d %w", id, errNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("DB: GetUser: %v", err)
+	}
+	return u, nil
+}
+
+// FindUser retrieves a user by its issuer and subject.
+func (db *DB) FindUser(issuer, subject string) (*User, error) {
+	u := &User{}
+	err := db.client.Where("issuer = ? AND subject = ?", issuer, subject).First(u).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, fmt.Errorf("DB: FindUser: user %s#%s %w", issuer, subject, errNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("DB: FindUser: %v", err)
+	}
+	return u, nil
+}
+
+// UpsertUser saves a given user, matching an existing entry by its issuer
+// and subject.
+func (db *DB) UpsertUser(u *User) (uint, error) {
+	old := &User{}
+	err := db.client.Where("issuer = ? AND subject = ?", u.Issuer, u.Subject).First(old).Error
+	switch {
+	case gorm.IsRecordNotFoundError(err):
+		u.ID = 0
+		if u.CreatedAt.IsZero() {
+			u.CreatedAt = time.Now()
+		}
+		if err := db.client.Create(u).Error; err != nil {
+			return 0, fmt.Errorf("DB: UpsertUser: %v", err)
+		}
+	case err != nil:
+		return 0, fmt.Errorf("DB: UpsertUser: %v", err)
+	default:
+		u.ID = old.ID
+		u.CreatedAt = old.CreatedAt
+		if err := db.client.Save(u).Error; err != nil {
+			return 0, fmt.Errorf("DB: UpsertUser: %v", err)
+		}
+	}
+	return u.ID, nil
+}
+
+// ListUsers returns a list of users, ordered by ID.
+func (db *DB) ListUsers() ([]*User, error) {
+	users := make([]*User, 0)
+	if err := db.client.Order("id").Find(&users).Error; err != nil {
+		return nil, fmt.Errorf("DB: could not list users: %v", err)
+	}
+	return users, nil
+}
+
+// AppendAudit adds an entry, assigning it a new ID.
+func (db *DB) AppendAudit(e *AuditEntry) error {
+	e.ID = 0
+	if err := db.client.Create(e).Error; err != nil {
+		return fmt.Errorf("DB: AppendAudit: %v", err)
+	}
+	return nil
+}
+
+// ListAudit returns the entries selected by f, newest first.
+func (db *DB) ListAudit(f AuditFilter) ([]*AuditEntry, error) {
+	q := db.client.Order("id DESC")
+	if f.Actor != "" {
+		q = q.Where("actor = ?", f.Actor)
+	}
+	if f.Action != "" {
+		q = q.Where("action = ?", f.Action)
+	}
+	if f.BookID != 0 {
+		q = q.Where("book_id = ?", f.BookID)
+	}
+	if !f.Since.IsZero() {
+		q = q.Where("time >= ?", f.Since)
+	}
+	if !f.Until.IsZero() {
+		q = q.Where("time < ?", f.Until)
+	}
+	if f.Limit > 0 {
+		q = q.Limit(f.Limit)
+	}
+	entries := make([]*AuditEntry, 0)
+	if err := q.Find(&entries).Error; err != nil {
+		return nil, fmt.Errorf("DB: could not list audit log: %v", err)
+	}
+	return entries, nil
+}
+
+// GetAuthor retrieves an author by its ID.
+func (db *DB) GetAuthor(id uint) (*Author, error) {
+	a := &Author{}
+	err := db.client.First(a, id).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, fmt.Errorf("DB: GetAuthor: author with ID %d %w", id, errNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("DB: GetAuthor: %v", err)
+	}
+	return a, nil
+}
+
+// likeEscaper escapes the wildcards of LIKE patterns.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// SearchAuthors returns the authors whose names contain q, ignoring case,
+// ordered by name. limit caps the number of authors unless 0.
+func (db *DB) SearchAuthors(q string, limit int) ([]*Author, error) {
+	query := db.client.Order("name")
+	if q != "" {
+		query = query.Where("name LIKE ?", "%"+likeEscaper.Replace(q)+"%")
+	}
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	authors := make([]*Author, 0)
+	if err := query.Find(&authors).Error; err != nil {
+		return nil, fmt.Errorf("DB: SearchAuthors: %v", err)
+	}
+	return authors, nil
+}
+
+// SetCredits replaces the credits of a book, adding authors not known by
+// name yet. Names are matched by the collation of the name column, which
+// ignores case.
+func (db *DB) SetCredits(bookID uint, credits []Credit) error {
+	err := db.client.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("book_id = ?", bookID).Delete(&bookAuthor{}).Error; err != nil {
+			return err
+		}
+		for i := range credits {
+			c := &credits[i]
+			a := &Author{}
+			err := tx.Where("name = ?", c.Name).First(a).Error
+			if gorm.IsRecordNotFoundError(err) {
+				a = &Author{Name: c.Name}
+				err = tx.Create(a).Error
+			}
+			if err != nil {
+				return err
+			}
+			c.AuthorID, c.Name = a.ID, a.Name
+			row := &bookAuthor{BookID: bookID, AuthorID: a.ID, Role: c.Role, Position: i}
+			if err := tx.Create(row).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("DB: SetCredits: %v", err)
+	}
+	return nil
+}
+
+// Credits returns the credits of a book, in their order.
+func (db *DB) Credits(bookID uint) ([]Credit, error) {
+	var credits []Credit
+	err := db.client.Raw(`SELECT ba.author_id, a.name, ba.role
+  FROM book_authors ba JOIN authors a ON a.id = ba.author_id
+  WHERE ba.book_id = ? ORDER BY ba.position`, bookID).Scan(&credits).Error
+	if err != nil {
+		return nil, fmt.Errorf("DB: Credits: %v", err)
+	}
+	return credits, nil
+}
+
+// Works returns the books an author is credited for, ordered by title.
+func (db *DB) Works(authorID uint) ([]Work, error) {
+	if _, err := db.GetAuthor(authorID); err != nil {
+		return nil, err
+	}
+	var rows []bookAuthor
+	if err := db.client.Where("author_id = ?", authorID).Find(&rows).Error; err != nil {
+		return nil, fmt.Errorf("DB: Works: %v", err)
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	roles := make(map[uint][]string)
+	var ids []uint
+	for _, row := range rows {
+		if roles[row.BookID] == nil {
+			ids = append(ids, row.BookID)
+		}
+		roles[row.BookID] = append(roles[row.BookID], row.Role)
+	}
+	books := make([]*Book, 0)
+	if err := db.client.Where("id IN (?)", ids).Order("title, id").Find(&books).Error; err != nil {
+		return nil, fmt.Errorf("DB: Works: %v", err)
+	}
+	if err := db.loadLabels(books); err != nil {
+		return nil, fmt.Errorf("DB: Works: %v", err)
+	}
+	var works []Work
+	for _, b := range books {
+		for _, role := range roles[b.ID] {
+			works = append(works, Work{Book: b, Role: role})
+		}
+	}
+	return works, nil
+}
+
+// RenameAuthor changes the name of an author.
+func (db *DB) RenameAuthor(id uint, name string) error {
+	a, err := db.GetAuthor(id)
+	if err != nil {
+		return err
+	}
+	other := &Author{}
+	err = db.client.Where("name = ? AND id <> ?", name, id).First(other).Error
+	if err == nil {
+		return fmt.Errorf("DB: RenameAuthor: author %q exists already, merge instead", other.Name)
+	}
+	if !gorm.IsRecordNotFoundError(err) {
+		return fmt.Errorf("DB: RenameAuthor: %v", err)
+	}
+	a.Name = name
+	if err := db.client.Save(a).Error; err != nil {
+		return fmt.Errorf("DB: RenameAuthor: %v", err)
+	}
+	return nil
+}
+
+// MergeAuthors moves the credits of author from to author into and removes
+// from.
+func (db *DB) MergeAuthors(from, into uint) error {
+	if from == into {
+		return errors.New("DB: MergeAuthors: cannot merge an author into itself")
+	}
+	for _, id := range []uint{from, into} {
+		if _, err := db.GetAuthor(id); err != nil {
+			return err
+		}
+	}
+	err := db.client.Transaction(func(tx *gorm.DB) error {
+		// Books crediting both in the same role keep a single credit.
+		err := tx.Exec(`INSERT IGNORE INTO book_authors (book_id, author_id, role, position)
+  SELECT book_id, ?, role, position FROM book_authors WHERE author_id = ?`, into, from).Error
+		if err != nil {
+			return err
+		}
+		if err := tx.Where("author_id = ?", from).Delete(&bookAuthor{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&Author{ID: from}).Error
+	})
+	if err != nil {
+		return fmt.Errorf("DB: MergeAuthors: %v", err)
+	}
+	return nil
+}
+
+// GetSeries retrieves a series by its ID.
+func (db *DB) GetSeries(id uint) (*Series, error) {
+	s := &Series{}
+	err := db.client.First(s, id).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, fmt.Errorf("DB: GetSeries: series with ID %d %w", id, errNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("DB: GetSeries: %v", err)
+	}
+	return s, nil
+}
+
+// ListSeries returns all series, ordered by name.
+func (db *DB) ListSeries() ([]*Series, error) {
+	series := make([]*Series, 0)
+	if err := db.client.Order("name").Find(&series).Error; err != nil {
+		return nil, fmt.Errorf("DB: ListSeries: %v", err)
+	}
+	return series, nil
+}
+
+// SetSeries places a book in a series, or takes it out of its series if e
+// is nil. Names are matched by the collation of the name column, which
+// ignores case.
+func (db *DB) SetSeries(bookID uint, e *SeriesEntry) error {
+	err := db.client.Transaction(func(tx *gorm.DB) error {
+		old := &bookSeries{}
+		err := tx.Where("book_id = ?", bookID).First(old).Error
+		if err != nil && !gorm.IsRecordNotFoundError(err) {
+			return err
+		}
+		if err == nil {
+			if err := tx.Delete(old).Error; err != nil {
+				return err
+			}
+			// Series left without books are removed.
+			err := tx.Exec(`DELETE FROM series WHERE id = ?
+  AND NOT EXISTS (SELECT 1 FROM book_series WHERE series_id = ?)`, old.SeriesID, old.SeriesID).Error
+			if err != nil {
+				return err
+			}
+		}
+		if e == nil {
+			return nil
+		}
+		s := &Series{}
+		err = tx.Where("name = ?", e.Name).First(s).Error
+		if gorm.IsRecordNotFoundError(err) {
+			s = &Series{Name: e.Name}
+			err = tx.Create(s).Error
+		}
+		if err != nil {
+			return err
+		}
+		e.SeriesID, e.Name = s.ID, s.Name
+		return tx.Create(&bookSeries{BookID: bookID, SeriesID: s.ID, Number: e.Number}).Error
+	})
+	if err != nil {
+		return fmt.Errorf("DB: SetSeries: %v", err)
+	}
+	return nil
+}
+
+// BookSeries returns the series of a book, or nil.
+func (db *DB) BookSeries(bookID uint) (*SeriesEntry, error) {
+	var entries []SeriesEntry
+	err := db.client.Raw(`SELECT bs.series_id, s.name, bs.number
+  FROM book_series bs JOIN series s ON s.id = bs.series_id
+  WHERE bs.book_id = ?`, bookID).Scan(&entries).Error
+	if err != nil {
+		return nil, fmt.Errorf("DB: BookSeries: %v", err)
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	return &entries[0], nil
+}
+
+// Volumes returns the books of a series, in reading order.
+func (db *DB) Volumes(seriesID uint) ([]Volume, error) {
+	if _, err := db.GetSeries(seriesID); err != nil {
+		return nil, err
+	}
+	var rows []bookSeries
+	if err := db.client.Where("series_id = ?", seriesID).Find(&rows).Error; err != nil {
+		return nil, fmt.Errorf("DB: Volumes: %v", err)
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	numbers := make(map[uint]float64)
+	var ids []uint
+	for _, row := range rows {
+		numbers[row.BookID] = row.Number
+		ids = append(ids, row.BookID)
+	}
+	books := make([]*Book, 0)
+	if err := db.client.Where("id IN (?)", ids).Find(&books).Error; err != nil {
+		return nil, fmt.Errorf("DB: Volumes: %v", err)
+	}
+	if err := db.loadLabels(books); err != nil {
+		return nil, fmt.Errorf("DB: Volumes: %v", err)
+	}
+	volumes := make([]Volume, len(books))
+	for i, b := range books {
+		volumes[i] = Volume{Book: b, Number: numbers[b.ID]}
+	}
+	sortVolumes(volumes)
+	return volumes, nil
+}
+
+// RenameSeries changes the name of a series.
+func (db *DB) RenameSeries(id uint, name string) error {
+	s, err := db.GetSeries(id)
+	if err != nil {
+		return err
+	}
+	other := &Series{}
+	err = db.client.Where("name = ? AND id <> ?", name, id).First(other).Error
+	if err == nil {
+		return fmt.Errorf("DB: RenameSeries: series %q exists already", other.Name)
+	}
+	if !gorm.IsRecordNotFoundError(err) {
+		return fmt.Errorf("DB: RenameSeries: %v", err)
+	}
+	s.Name = name
+	if err := db.client.Save(s).Error; err != nil {
+		return fmt.Errorf("DB: RenameSeries: %v", err)
+	}
+	return nil
+}
+
+// GetCollection retrieves a collection by its ID.
+func (db *DB) GetCollection(id uint) (*Collection, error) {
+	c := &Collection{}
+	err := db.client.First(c, id).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, fmt.Errorf("DB: GetCollection: collection with ID %d %w", id, errNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("DB: GetCollection: %v", err)
+	}
+	return c, nil
+}
+
+// FindSharedCollection retrieves a collection by its share token.
+func (db *DB) FindSharedCollection(token string) (*Collection, error) {
+	if token == "" {
+		return nil, fmt.Errorf("DB: FindSharedCollection: shared collection %w", errNotFound)
+	}
+	c := &Collection{}
+	err := db.client.Where("share_token = ?", token).First(c).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, fmt.Errorf("DB: FindSharedCollection: shared collection %w", errNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("DB: FindSharedCollection: %v", err)
+	}
+	return c, nil
+}
+
+// ListCollections returns the collections of a user, ordered by name.
+func (db *DB) ListCollections(ownerID uint) ([]*Collection, error) {
+	collections := make([]*Collection, 0)
+	err := db.client.Where("owner_id = ?", ownerID).Order("name").Find(&collections).Error
+	if err != nil {
+		return nil, fmt.Errorf("DB: ListCollections: %v", err)
+	}
+	return collections, nil
+}
+
+// checkCollectionName returns an error if the owner of c has another
+// collection of its name, ignoring case by the collation of the column.
+func (db *DB) checkCollectionName(c *Collection) error {
+	other := &Collection{}
+	err := db.client.Where("owner_id = ? AND name = ? AND id <> ?", c.OwnerID, c.Name, c.ID).First(other).Error
+	if err == nil {
+		return fmt.Errorf("%w: collection %q exists already", errBadCollection, other.Name)
+	}
+	if !gorm.IsRecordNotFoundError(err) {
+		return err
+	}
+	return nil
+}
+
+// AddCollection saves a given collection, assigning it a new ID.
+func (db *DB) AddCollection(c *Collection) (uint, error) {
+	if err := db.checkCollectionName(c); err != nil {
+		return 0, fmt.Errorf("DB: AddCollection: %w", err)
+	}
+	if err := db.client.Create(c).Error; err != nil {
+		return 0, fmt.Errorf("DB: AddCollection: %v", err)
+	}
+	return c.ID, nil
+}
+
+// UpdateCollection updates the name and share token of a collection.
+func (db *DB) UpdateCollection(c *Collection) error {
+	if _, err := db.GetCollection(c.ID); err != nil {
+		return err
+	}
+	if err := db.checkCollectionName(c); err != nil {
+		return fmt.Errorf("DB: UpdateCollection: %w", err)
+	}
+	err := db.client.Model(&Collection{ID: c.ID}).
+		Updates(map[string]interface{}{"name": c.Name, "share_token": c.ShareToken}).Error
+	if err != nil {
+		return fmt.Errorf("DB: UpdateCollection: %v", err)
+	}
+	return nil
+}
+
+// DeleteCollection removes a collection. Its books go with it, see the
+// foreign keys of collection_books.
+func (db *DB) DeleteCollection(id uint) error {
+	if _, err := db.GetCollection(id); err != nil {
+		return err
+	}
+	if err := db.client.Delete(&Collection{ID: id}).Error; err != nil {
+		return fmt.Errorf("DB: DeleteCollection: %v", err)
+	}
+	return nil
+}
+
+// CollectionBooks returns the books of a collection, in its order.
+func (db *DB) CollectionBooks(id uint) ([]*Book, error) {
+	if _, err := db.GetCollection(id); err != nil {
+		return nil, err
+	}
+	books := make([]*Book, 0)
+	err := db.client.Joins("JOIN collection_books cb ON cb.book_id = books.id").
+		Where("cb.collection_id = ?", id).Order("cb.position").Find(&books).Error
+	if err != nil {
+		return nil, fmt.Errorf("DB: CollectionBooks: %v", err)
+	}
+	if err := db.loadLabels(books); err != nil {
+		return nil, fmt.Errorf("DB: CollectionBooks: %v", err)
+	}
+	return books, nil
+}
+
+// AddToCollection appends a book to a collection.
+func (db *DB) AddToCollection(id, bookID uint) error {
+	if _, err := db.GetCollection(id); err != nil {
+		return err
+	}
+	if err := db.client.First(&Book{}, bookID).Error; gorm.IsRecordNotFoundError(err) {
+		return fmt.Errorf("DB: AddToCollection: book with ID %d %w", bookID, errNotFound)
+	}
+	err := db.client.Exec(`INSERT IGNORE INTO collection_books (collection_id, book_id, position)
+  SELECT ?, ?, COALESCE(MAX(position) + 1, 0) FROM collection_books WHERE collection_id = ?`,
+		id, bookID, id).Error
+	if err != nil {
+		return fmt.Errorf("DB: AddToCollection: %v", err)
+	}
+	return nil
+}
+
+// RemoveFromCollection takes a book out of a collection.
+func (db *DB) RemoveFromCollection(id, bookID uint) error {
+	if _, err := db.GetCollection(id); err != nil {
+		return err
+	}
+	err := db.client.Where("collection_id = ? AND book_id = ?", id, bookID).Delete(&collectionBook{}).Error
+	if err != nil {
+		return fmt.Errorf("DB: RemoveFromCollection: %v", err)
+	}
+	return nil
+}
+
+// ReorderCollection puts the books of a collection in the order of bookIDs.
+func (db *DB) ReorderCollection(id uint, bookIDs []uint) error {
+	if _, err := db.GetCollection(id); err != nil {
+		return err
+	}
+	err := db.client.Transaction(func(tx *gorm.DB) error {
+		var rows []collectionBook
+		if err := tx.Set("gorm:query_option", "FOR UPDATE").
+			Where("collection_id = ?", id).Find(&rows).Error; err != nil {
+			return err
+		}
+		current := make([]uint, len(rows))
+		for i, row := range rows {
+			current[i] = row.BookID
+		}
+		if err := checkOrder(current, bookIDs); err != nil {
+			return err
+		}
+		for i, bookID := range bookIDs {
+			err := tx.Model(&collectionBook{}).
+				Where("collection_id = ? AND book_id = ?", id, bookID).
+				Update("position", i).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("DB: ReorderCollection: %w", err)
+	}
+	return nil
+}
+
+// GetCopy retrieves a copy by its ID.
+func (db *DB) GetCopy(id uint) (*Copy, error) {
+	c := &Copy{}
+	err := db.client.First(c, id).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, fmt.Errorf("DB: GetCopy: copy with ID %d %w", id, errNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("DB: GetCopy: %v", err)
+	}
+	return c, nil
+}
+
+// FindCopy retrieves a copy by its barcode.
+func (db *DB) FindCopy(barcode string) (*Copy, error) {
+	c := &Copy{}
+	err := db.client.Where("barcode = ?", barcode).First(c).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, fmt.Errorf("DB: FindCopy: copy with barcode %q %w", barcode, errNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("DB: FindCopy: %v", err)
+	}
+	return c, nil
+}
+
+// ListCopies returns the copies of a book, ordered by barcode.
+func (db *DB) ListCopies(bookID uint) ([]*Copy, error) {
+	copies := make([]*Copy, 0)
+	if err := db.client.Where("book_id = ?", bookID).Order("barcode").Find(&copies).Error; err != nil {
+		return nil, fmt.Errorf("DB: ListCopies: %v", err)
+	}
+	return copies, nil
+}
+
+// AllCopies returns the copies of all books, ordered by book ID and
+// barcode.
+func (db *DB) AllCopies() ([]*Copy, error) {
+	copies := make([]*Copy, 0)
+	if err := db.client.Order("book_id, barcode").Find(&copies).Error; err != nil {
+		return nil, fmt.Errorf("DB: AllCopies: %v", err)
+	}
+	return copies, nil
+}
+
+// checkBarcode returns an error if another copy has the barcode of c,
+// ignoring case by the collation of the column.
+func (db *DB) checkBarcode(c *Copy) error {
+	other := &Copy{}
+	err := db.client.Where("barcode = ? AND id <> ?", c.Barcode, c.ID).First(other).Error
+	if err == nil {
+		return fmt.Errorf("%w: barcode %q is taken", errBadCopy, other.Barcode)
+	}
+	if !gorm.IsRecordNotFoundError(err) {
+		return err
+	}
+	return nil
+}
+
+// AddCopy saves a given copy of a book, assigning it a new ID.
+func (db *DB) AddCopy(c *Copy) (uint, error) {
+	if err := db.client.First(&Book{}, c.BookID).Error; gorm.IsRecordNotFoundError(err) {
+		return 0, fmt.Errorf("DB: AddCopy: book with ID %d %w", c.BookID, errNotFound)
+	}
+	if err := db.checkBarcode(c); err != nil {
+		return 0, fmt.Errorf("DB: AddCopy: %w", err)
+	}
+	if err := db.client.Create(c).Error; err != nil {
+		return 0, fmt.Errorf("DB: AddCopy: %v", err)
+	}
+	return c.ID, nil
+}
+
+// UpdateCopy updates the entry for a given copy.
+func (db *DB) UpdateCopy(c *Copy) error {
+	old, err := db.GetCopy(c.ID)
+	if err != nil {
+		return err
+	}
+	if err := db.checkBarcode(c); err != nil {
+		return fmt.Errorf("DB: UpdateCopy: %w", err)
+	}
+	c.BookID = old.BookID
+	if err := db.client.Save(c).Error; err != nil {
+		return fmt.Errorf("DB: UpdateCopy: %v", err)
+	}
+	return nil
+}
+
+// DeleteCopy removes a given copy by its ID. Its loans are kept for their
+// history.
+func (db *DB) DeleteCopy(id uint) error {
+	c, err := db.GetCopy(id)
+	if err != nil {
+		return err
+	}
+	// The lock of the book keeps the copy from being lent or kept for a
+	// hold meanwhile, see CheckOut.
+	err = db.client.Transaction(func(tx *gorm.DB) error {
+		if err := lockBook(tx, c.BookID); err != nil {
+			return err
+		}
+		var active int
+		if err := tx.Model(&Loan{}).Where("copy_id = ? AND returned_at IS NULL", id).Count(&active).Error; err != nil {
+			return err
+		}
+		if active > 0 {
+			return fmt.Errorf("%w: copy %d is on loan", errBadCopy, id)
+		}
+		var held int
+		if err := tx.Model(&Hold{}).Where("copy_id = ? AND status = ?", id, holdReady).Count(&held).Error; err != nil {
+			return err
+		}
+		if held > 0 {
+			return fmt.Errorf("%w: copy %d is on hold", errBadCopy, id)
+		}
+		return tx.Delete(&Copy{ID: id}).Error
+	})
+	if err != nil {
+		return fmt.Errorf("DB: DeleteCopy: %w", err)
+	}
+	return nil
+}
+
+// CopyCounts counts the copies of the given books.
+func (db *DB) CopyCounts(bookIDs []uint) (map[uint]CopyCount, error) {
+	counts := make(map[uint]CopyCount)
+	if len(bookIDs) == 0 {
+		return counts, nil
+	}
+	var rows []struct {
+		BookID    uint
+		Total     int
+		Available int
+	}
+	err := db.client.Raw(`SELECT book_id, COUNT(*) AS total, SUM(book_condition <> ? AND NOT EXISTS (
+    SELECT 1 FROM loans l WHERE l.copy_id = copies.id AND l.returned_at IS NULL) AND NOT EXISTS (
+    SELECT 1 FROM holds h WHERE h.copy_id = copies.id AND h.status = ?)) AS available
+  FROM copies WHERE book_id IN (?) GROUP BY book_id`, conditionLost, holdReady, bookIDs).Scan(&rows).Error
+	if err != nil {
+		return nil, fmt.Errorf("DB: CopyCounts: %v", err)
+	}
+	for _, row := range rows {
+		counts[row.BookID] = CopyCount{Total: row.Total, Available: row.Available}
+	}
+	return counts, nil
+}
+
+// CheckOut lends a copy. The rows of its book and of the copy are locked
+// meanwhile, so that concurrent check-outs of it wait for each other and
+// see its loan, and its holds do not change underneath.
+func (db *DB) CheckOut(l *Loan) (uint, error) {
+	err := db.client.Transaction(func(tx *gorm.DB) error {
+		c := &Copy{}
+		err := tx.First(c, l.CopyID).Error
+		if gorm.IsRecordNotFoundError(err) {
+			return fmt.Errorf("copy with ID %d %w", l.CopyID, errNotFound)
+		}
+		if err != nil {
+			return err
+		}
+		if err := lockBook(tx, c.BookID); err != nil {
+			return err
+		}
+		if err := tx.Set("gorm:query_option", "FOR UPDATE").First(c, l.CopyID).Error; err != nil {
+			return err
+		}
+		if !lendable(c.Condition) {
+			return fmt.Errorf("%w: copy %q is %s", errUnavailable, c.Barcode, c.Condition)
+		}
+		var active int
+		if err := tx.Model(&Loan{}).Where("copy_id = ? AND returned_at IS NULL", c.ID).Count(&active).Error; err != nil {
+			return err
+		}
+		if active > 0 {
+			return fmt.Errorf("%w: copy %q is on loan", errUnavailable, c.Barcode)
+		}
+		var held []*Hold
+		if err := tx.Where("copy_id = ? AND status = ? AND user_id <> ?", c.ID, holdReady, l.UserID).Find(&held).Error; err != nil {
+			return err
+		}
+		if len(held) > 0 {
+			return fmt.Errorf("%w: copy %q is on hold", errUnavailable, c.Barcode)
+		}
+		l.BookID = c.BookID
+		if err := tx.Create(l).Error; err != nil {
+			return err
+		}
+
+		// The loan fulfills the holds of the borrower on the book,
+		// releasing any other copy kept for them.
+		var holds []*Hold
+		err = tx.Where("book_id = ? AND user_id = ? AND status IN (?)", c.BookID, l.UserID, []string{holdWaiting, holdReady}).
+			Find(&holds).Error
+		if err != nil {
+			return err
+		}
+		for _, h := range holds {
+			release := h.Ready() && h.CopyID != c.ID
+			err := tx.Model(h).Updates(map[string]interface{}{"status": holdFulfilled, "closed_at": l.CheckedOut}).Error
+			if err != nil {
+				return err
+			}
+			if release {
+				if err := allocateCopy(tx, h.CopyID, l.CheckedOut); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("DB: CheckOut: %w", err)
+	}
+	return l.ID, nil
+}
+
+// AddLoanRecord adds a returned loan as it is, setting its ID.
+func (db *DB) AddLoanRecord(l *Loan) (uint, error) {
+	if l.Active() {
+		return 0, fmt.Errorf("DB: AddLoanRecord: %w: loan of copy %d is not returned", errBadLoan, l.CopyID)
+	}
+	if err := db.client.Create(l).Error; err != nil {
+		return 0, fmt.Errorf("DB: AddLoanRecord: %v", err)
+	}
+	return l.ID, nil
+}
+
+// CheckIn ends the active loan of a copy, keeping the copy for the next
+// hold on its book.
+func (db *DB) CheckIn(copyID uint, at time.Time) (*Loan, error) {
+	l := &Loan{}
+	err := db.client.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("copy_id = ? AND returned_at IS NULL", copyID).First(l).Error
+		if gorm.IsRecordNotFoundError(err) {
+			return fmt.Errorf("loan of copy %d %w", copyID, errNotFound)
+		}
+		if err != nil {
+			return err
+		}
+		if err := lockBook(tx, l.BookID); err != nil {
+			return err
+		}
+		err = tx.Set("gorm:query_option", "FOR UPDATE").
+			Where("copy_id = ? AND returned_at IS NULL", copyID).First(l).Error
+		if gorm.IsRecordNotFoundError(err) {
+			return fmt.Errorf("loan of copy %d %w", copyID, errNotFound)
+		}
+		if err != nil {
+			return err
+		}
+		l.Returned = &at
+		if err := tx.Model(l).Update("returned_at", at).Error; err != nil {
+			return err
+		}
+		return allocateCopy(tx, copyID, at)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("DB: CheckIn: %w", err)
+	}
+	return l, nil
+}
+
+// GetLoan retrieves a loan by its ID.
+func (db *DB) GetLoan(id uint) (*Loan, error) {
+	l := &Loan{}
+	err := db.client.First(l, id).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, fmt.Errorf("DB: loan with ID %d %w", id, errNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("DB: GetLoan: %v", err)
+	}
+	return l, nil
+}
+
+// ListLoans returns the loans selected by f, newest first.
+func (db *DB) ListLoans(f LoanFilter) ([]*Loan, error) {
+	q := db.client
+	if f.CopyID != 0 {
+		q = q.Where("copy_id = ?", f.CopyID)
+	}
+	if f.BookID != 0 {
+		q = q.Where("book_id = ?", f.BookID)
+	}
+	if f.UserID != 0 {
+		q = q.Where("user_id = ?", f.UserID)
+	}
+	if f.Active {
+		q = q.Where("returned_at IS NULL")
+	}
+	if !f.DueBefore.IsZero() {
+		q = q.Where("due_at < ?", f.DueBefore)
+	}
+	loans := make([]*Loan, 0)
+	if err := q.Order("id DESC").Find(&loans).Error; err != nil {
+		return nil, fmt.Errorf("DB: ListLoans: %v", err)
+	}
+	return loans, nil
+}
+
+// lockBook locks the row of a book until the end of tx, serializing the
+// changes to the loans and holds of the book.
+func lockBook(tx *gorm.DB, bookID uint) error {
+	err := tx.Set("gorm:query_option", "FOR UPDATE").Select("id").First(&Book{}, bookID).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return fmt.Errorf("book with ID %d %w", bookID, errNotFound)
+	}
+	return err
+}
+
+// freeCopies selects the copies which could be lent to anyone.
+func freeCopies(tx *gorm.DB) *gorm.DB {
+	return tx.Model(&Copy{}).
+		Where("book_condition <> ?", conditionLost).
+		Where("NOT EXISTS (SELECT 1 FROM loans l WHERE l.copy_id = copies.id AND l.returned_at IS NULL)").
+		Where("NOT EXISTS (SELECT 1 FROM holds h WHERE h.copy_id = copies.id AND h.status = ?)", holdReady)
+}
+
+// allocateCopy keeps a free copy for the oldest hold waiting for its book.
+// The caller must hold the lock of the book.
+func allocateCopy(tx *gorm.DB, copyID uint, at time.Time) error {
+	var ids []uint
+	if err := freeCopies(tx).Where("id = ?", copyID).Pluck("id", &ids).Error; err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	c := &Copy{}
+	if err := tx.First(c, copyID).Error; err != nil {
+		return err
+	}
+	h := &Hold{}
+	err := tx.Where("book_id = ? AND status = ?", c.BookID, holdWaiting).Order("placed_at, id").First(h).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Model(h).Updates(map[string]interface{}{
+		"status":     holdReady,
+		"copy_id":    c.ID,
+		"expires_at": at.Add(holdPickupWindow),
+	}).Error
+}
+
+// GetHold retrieves a hold by its ID.
+func (db *DB) GetHold(id uint) (*Hold, error) {
+	h := &Hold{}
+	err := db.client.First(h, id).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, fmt.Errorf("DB: hold with ID %d %w", id, errNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("DB: GetHold: %v", err)
+	}
+	return h, nil
+}
+
+// PlaceHold queues a user for a book. The row of the book is locked
+// meanwhile.
+func (db *DB) PlaceHold(h *Hold) (uint, error) {
+	err := db.client.Transaction(func(tx *gorm.DB) error {
+		if err := lockBook(tx, h.BookID); err != nil {
+			return err
+		}
+		var n int
+		err := tx.Model(&Hold{}).Where("book_id = ? AND user_id = ? AND status IN (?)", h.BookID, h.UserID, []string{holdWaiting, holdReady}).
+			Count(&n).Error
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return fmt.Errorf("%w: user %d holds book %d already", errBadHold, h.UserID, h.BookID)
+		}
+		if err := tx.Model(&Loan{}).Where("book_id = ? AND user_id = ? AND returned_at IS NULL", h.BookID, h.UserID).Count(&n).Error; err != nil {
+			return err
+		}
+		if n > 0 {
+			return fmt.Errorf("%w: user %d borrowed book %d already", errBadHold, h.UserID, h.BookID)
+		}
+		if err := tx.Model(&Copy{}).Where("book_id = ? AND book_condition <> ?", h.BookID, conditionLost).Count(&n).Error; err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("%w: book %d has no copies to lend", errBadHold, h.BookID)
+		}
+		h.Status = holdWaiting
+		if err := tx.Create(h).Error; err != nil {
+			return err
+		}
+		var free []uint
+		if err := freeCopies(tx).Where("book_id = ?", h.BookID).Order("barcode").Limit(1).Pluck("id", &free).Error; err != nil {
+			return err
+		}
+		if len(free) == 0 {
+			return nil
+		}
+		if err := allocateCopy(tx, free[0], h.Placed); err != nil {
+			return err
+		}
+		return tx.First(h, h.ID).Error
+	})
+	if err != nil {
+		return 0, fmt.Errorf("DB: PlaceHold: %w", err)
+	}
+	return h.ID, nil
+}
+
+// AddHoldRecord adds a closed hold as it is, setting its ID.
+func (db *DB) AddHoldRecord(h *Hold) (uint, error) {
+	if h.Active() {
+		return 0, fmt.Errorf("DB: AddHoldRecord: %w: hold of user %d is %s", errBadHold, h.UserID, h.Status)
+	}
+	if err := db.client.Create(h).Error; err != nil {
+		return 0, fmt.Errorf("DB: AddHoldRecord: %v", err)
+	}
+	return h.ID, nil
+}
+
+// CancelHold closes an active hold, keeping a copy it was ready with for
+// the next hold.
+func (db *DB) CancelHold(id uint, at time.Time) error {
+	h, err := db.GetHold(id)
+	if err != nil {
+		return err
+	}
+	err = db.client.Transaction(func(tx *gorm.DB) error {
+		return closeHold(tx, h, holdCancelled, at)
+	})
+	if err != nil {
+		return fmt.Errorf("DB: CancelHold: %w", err)
+	}
+	return nil
+}
+
+// closeHold locks the book of an active hold and gives the hold status,
+// keeping a copy it was ready with for the next hold.
+func closeHold(tx *gorm.DB, h *Hold, status string, at time.Time) error {
+	if err := lockBook(tx, h.BookID); err != nil {
+		return err
+	}
+	if err := tx.First(h, h.ID).Error; err != nil {
+		return err
+	}
+	if !h.Active() {
+		return fmt.Errorf("%w: hold %d is %s", errBadHold, h.ID, h.Status)
+	}
+	ready := h.Ready()
+	if err := tx.Model(h).Updates(map[string]interface{}{"status": status, "closed_at": at}).Error; err != nil {
+		return err
+	}
+	if ready {
+		return allocateCopy(tx, h.CopyID, at)
+	}
+	return nil
+}
+
+// ListHolds returns the holds selected by f, oldest first.
+func (db *DB) ListHolds(f HoldFilter) ([]*Hold, error) {
+	q := db.client
+	if f.BookID != 0 {
+		q = q.Where("book_id = ?", f.BookID)
+	}
+	if f.UserID != 0 {
+		q = q.Where("user_id = ?", f.UserID)
+	}
+	if f.Active {
+		q = q.Where("status IN (?)", []string{holdWaiting, holdReady})
+	}
+	holds := make([]*Hold, 0)
+	if err := q.Order("placed_at, id").Find(&holds).Error; err != nil {
+		return nil, fmt.Errorf("DB: ListHolds: %v", err)
+	}
+	return holds, nil
+}
+
+// ExpireHolds closes the ready holds whose pickup window passed by now.
+func (db *DB) ExpireHolds(now time.Time) ([]*Hold, error) {
+	var lapsed []*Hold
+	if err := db.client.Where("status = ? AND expires_at <= ?", holdReady, now).Order("expires_at, id").Find(&lapsed).Error; err != nil {
+		return nil, fmt.Errorf("DB: ExpireHolds: %v", err)
+	}
+	expired := make([]*Hold, 0)
+	for _, h := range lapsed {
+		err := db.client.Transaction(func(tx *gorm.DB) error {
+			if err := closeHold(tx, h, holdExpired, now); err != nil {
+				return err
+			}
+			return tx.First(h, h.ID).Error
+		})
+		if errors.Is(err, errBadHold) {
+			// Picked up or cancelled meanwhile.
+			continue
+		}
+		if err != nil {
+			return expired, fmt.Errorf("DB: ExpireHolds: %w", err)
+		}
+		expired = append(expired, h)
+	}
+	return expired, nil
+}
+
+// reminderOptOut marks a user declining reminders.
+type reminderOptOut struct {
+	UserID uint `gorm:"column:user_id;primary_key"`
+}
+
+// TableName tells gorm where opt-outs live.
+func (reminderOptOut) TableName() string {
+	return "reminder_opt_outs"
+}
+
+// QueueReminder adds a pending reminder unless its loan got one of its
+// kind before. The unique key on loan_id and kind settles races.
+func (db *DB) QueueReminder(r *Reminder) (bool, error) {
+	var n int
+	if err := db.client.Model(&Reminder{}).Where("loan_id = ? AND kind = ?", r.LoanID, r.Kind).Count(&n).Error; err != nil {
+		return false, fmt.Errorf("DB: QueueReminder: %v", err)
+	}
+	if n > 0 {
+		return false, nil
+	}
+	if err := db.client.Create(r).Error; err != nil {
+		return false, fmt.Errorf("DB: QueueReminder: %v", err)
+	}
+	return true, nil
+}
+
+// ClaimReminder takes a pending reminder whose next attempt is due by now
+// for an attempt to send it, by moving its next attempt to until. Of
+// concurrent claims, the update of one matches the row.
+func (db *DB) ClaimReminder(id uint, now, until time.Time) (bool, error) {
+	res := db.client.Model(&Reminder{}).
+		Where("id = ? AND status = ? AND next_attempt_at <= ?", id, reminderPending, now).
+		Update("next_attempt_at", until)
+	if res.Error != nil {
+		return false, fmt.Errorf("DB: ClaimReminder: %v", res.Error)
+	}
+	return res.RowsAffected == 1, nil
+}
+
+// UpdateReminder saves the outcome of an attempt to send a reminder.
+func (db *DB) UpdateReminder(r *Reminder) error {
+	if err := db.client.Save(r).Error; err != nil {
+		return fmt.Errorf("DB: UpdateReminder: %v", err)
+	}
+	return nil
+}
+
+// ListReminders returns the reminders selected by f, newest first.
+func (db *DB) ListReminders(f ReminderFilter) ([]*Reminder, error) {
+	q := db.client
+	if f.UserID != 0 {
+		q = q.Where("user_id = ?", f.UserID)
+	}
+	if f.Status != "" {
+		q = q.Where("status = ?", f.Status)
+	}
+	if !f.AttemptBy.IsZero() {
+		q = q.Where("status = ? AND next_attempt_at <= ?", reminderPending, f.AttemptBy)
+	}
+	if f.Limit > 0 {
+		q = q.Limit(f.Limit)
+	}
+	reminders := make([]*Reminder, 0)
+	if err := q.Order("id DESC").Find(&reminders).Error; err != nil {
+		return nil, fmt.Errorf("DB: ListReminders: %v", err)
+	}
+	return reminders, nil
+}
+
+// SetOptOut records whether a user declines reminders.
+func (db *DB) SetOptOut(userID uint, out bool) error {
+	if _, err := db.GetUser(userID); err != nil {
+		return err
+	}
+	var err error
+	if out {
+		err = db.client.Exec("INSERT IGNORE INTO reminder_opt_outs (user_id) VALUES (?)", userID).Error
+	} else {
+		err = db.client.Delete(&reminderOptOut{UserID: userID}).Error
+	}
+	if err != nil {
+		return fmt.Errorf("DB: SetOptOut: %v", err)
+	}
+	return nil
+}
+
+// OptedOut reports whether a user declines reminders.
+func (db *DB) OptedOut(userID uint) (bool, error) {
+	var n int
+	if err := db.client.Model(&reminderOptOut{}).Where("user_id = ?", userID).Count(&n).Error; err != nil {
+		return false, fmt.Errorf("DB: OptedOut: %v", err)
+	}
+	return n > 0, nil
+}
+
+// ListOptOuts returns the IDs of the users declining reminders.
+func (db *DB) ListOptOuts() ([]uint, error) {
+	ids := make([]uint, 0)
+	if err := db.client.Model(&reminderOptOut{}).Order("user_id").Pluck("user_id", &ids).Error; err != nil {
+		return nil, fmt.Errorf("DB: ListOptOuts: %v", err)
+	}
+	return ids, nil
+}
+
+// GetReview retrieves a review by its ID.
+func (db *DB) GetReview(id uint) (*Review, error) {
+	r := &Review{}
+	err := db.client.First(r, id).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, fmt.Errorf("DB: review with ID %d %w", id, errNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("DB: GetReview: %v", err)
+	}
+	return r, nil
+}
+
+// FindReview retrieves the review of a book by a user.
+func (db *DB) FindReview(bookID, userID uint) (*Review, error) {
+	r := &Review{}
+	err := db.client.Where("book_id = ? AND user_id = ?", bookID, userID).First(r).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, fmt.Errorf("DB: review of book %d by user %d %w", bookID, userID, errNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("DB: FindReview: %v", err)
+	}
+	return r, nil
+}
+
+// SaveReview adds the review of a user on a book, or replaces their
+// earlier one. The unique key on book_id and user_id settles races.
+func (db *DB) SaveReview(r *Review) (uint, error) {
+	if err := normalizeReview(r); err != nil {
+		return 0, fmt.Errorf("DB: SaveReview: %w", err)
+	}
+	err := db.client.Transaction(func(tx *gorm.DB) error {
+		var n int
+		if err := tx.Model(&Book{}).Where("id = ?", r.BookID).Count(&n).Error; err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("book with ID %d %w", r.BookID, errNotFound)
+		}
+		if err := tx.Model(&User{}).Where("id = ?", r.UserID).Count(&n).Error; err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("user with ID %d %w", r.UserID, errNotFound)
+		}
+		old := &Review{}
+		err := tx.Set("gorm:query_option", "FOR UPDATE").
+			Where("book_id = ? AND user_id = ?", r.BookID, r.UserID).First(old).Error
+		if gorm.IsRecordNotFoundError(err) {
+			return tx.Create(r).Error
+		}
+		if err != nil {
+			return err
+		}
+		r.ID, r.Created, r.Hidden = old.ID, old.Created, old.Hidden
+		return tx.Model(old).Updates(map[string]interface{}{
+			"rating": r.Rating, "body": r.Body, "updated_at": r.Updated,
+		}).Error
+	})
+	if err != nil {
+		return 0, fmt.Errorf("DB: SaveReview: %w", err)
+	}
+	return r.ID, nil
+}
+
+// DeleteReview removes a review by its ID.
+func (db *DB) DeleteReview(id uint) error {
+	res := db.client.Delete(&Review{ID: id})
+	if res.Error != nil {
+		return fmt.Errorf("DB: DeleteReview: %v", res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("DB: could not delete review with ID %d: %w", id, errNotFound)
+	}
+	return nil
+}
+
+// HideReview takes a review down or puts it back up.
+func (db *DB) HideReview(id uint, hidden bool) error {
+	if _, err := db.GetReview(id); err != nil {
+		return err
+	}
+	if err := db.client.Model(&Review{ID: id}).Update("hidden", hidden).Error; err != nil {
+		return fmt.Errorf("DB: HideReview: %v", err)
+	}
+	return nil
+}
+
+// ListReviews returns the reviews selected by f, newest first.
+func (db *DB) ListReviews(f ReviewFilter) ([]*Review, error) {
+	q := db.client
+	if f.BookID != 0 {
+		q = q.Where("book_id = ?", f.BookID)
+	}
+	if f.UserID != 0 {
+		q = q.Where("user_id = ?", f.UserID)
+	}
+	if f.Visible {
+		q = q.Where("NOT hidden")
+	}
+	if f.Limit > 0 {
+		q = q.Limit(f.Limit)
+	}
+	reviews := make([]*Review, 0)
+	if err := q.Order("id DESC").Find(&reviews).Error; err != nil {
+		return nil, fmt.Errorf("DB: ListReviews: %v", err)
+	}
+	return reviews, nil
+}
+
+// Ratings sums up the visible reviews of the given books.
+func (db *DB) Ratings(bookIDs []uint) (map[uint]RatingSummary, error) {
+	ratings := make(map[uint]RatingSummary)
+	if len(bookIDs) == 0 {
+		return ratings, nil
+	}
+	var rows []struct {
+		BookID  uint
+		Count   int
+		Average float64
+	}
+	err := db.client.Raw(`SELECT book_id, COUNT(*) AS count, AVG(rating) AS average
+  FROM reviews WHERE NOT hidden AND book_id IN (?) GROUP BY book_id`, bookIDs).Scan(&rows).Error
+	if err != nil {
+		return nil, fmt.Errorf("DB: Ratings: %v", err)
+	}
+	for _, row := range rows {
+		ratings[row.BookID] = RatingSummary{Count: row.Count, Average: row.Average}
+	}
+	return ratings, nil
+}
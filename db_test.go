@@ -30,8 +30,11 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -44,7 +47,7 @@ func testDB(t *testing.T, db BookDatabase) {
 	b := &Book{
 		Author:        "testy mc testface",
 		Title:         fmt.Sprintf("t-%d", time.Now().Unix()),
-		PublishedDate: fmt.Sprintf("%d", time.Now().Unix()),
+		PublishedDate: PartialDate{Year: 1965, Month: 8},
 		Description:   "desc",
 	}
 
@@ -66,18 +69,1259 @@ func testDB(t *testing.T, db BookDatabase) {
 	if got, want := gotBook.Description, b.Description; got != want {
 		t.Errorf("Update description: got %q, want %q", got, want)
 	}
+	if got, want := gotBook.PublishedDate, b.PublishedDate; got != want {
+		t.Errorf("PublishedDate: got %v, want %v", got, want)
+	}
 
 	if err := db.DeleteBook(id); err != nil {
 		t.Error(err)
 	}
 
-	if _, err := db.GetBook(id); err == nil {
-		t.Error("want non-nil err")
+	if _, err := db.GetBook(id); !errors.Is(err, errNotFound) {
+		t.Errorf("got %v, want errNotFound", err)
+	}
+}
+
+func testQueryBooks(t *testing.T, db BookDatabase) {
+	t.Helper()
+
+	for _, b := range []*Book{
+		{Title: "q-unknown"},
+		{Title: "q-1965", PublishedDate: PartialDate{Year: 1965}},
+		{Title: "q-1965-08", PublishedDate: PartialDate{Year: 1965, Month: 8}},
+		{Title: "q-1951-06-01", PublishedDate: PartialDate{Year: 1951, Month: 6, Day: 1}},
+		{Title: "q-2001", PublishedDate: PartialDate{Year: 2001}},
+	} {
+		id, err := db.AddBook(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.DeleteBook(id)
+	}
+
+	for _, tc := range []struct {
+		q    BookQuery
+		want string
+	}{
+		{BookQuery{}, "q-1951-06-01,q-1965,q-1965-08,q-2001,q-unknown"},
+		{BookQuery{Sort: sortPublished}, "q-1951-06-01,q-1965,q-1965-08,q-2001,q-unknown"},
+		{BookQuery{Sort: sortPublishedDesc}, "q-2001,q-1965-08,q-1965,q-1951-06-01,q-unknown"},
+		{BookQuery{PublishedFrom: 1960, PublishedTo: 1999}, "q-1965,q-1965-08"},
+		{BookQuery{PublishedTo: 1960}, "q-1951-06-01"},
+	} {
+		books, err := db.QueryBooks(tc.q)
+		if err != nil {
+			t.Errorf("QueryBooks(%+v): %v", tc.q, err)
+			continue
+		}
+		var titles []string
+		for _, b := range books {
+			if strings.HasPrefix(b.Title, "q-") {
+				titles = append(titles, b.Title)
+			}
+		}
+		if got := strings.Join(titles, ","); got != tc.want {
+			t.Errorf("QueryBooks(%+v): got %s, want %s", tc.q, got, tc.want)
+		}
+	}
+	if _, err := db.QueryBooks(BookQuery{Sort: "author; DROP TABLE books"}); err == nil {
+		t.Error("QueryBooks with unknown order succeeded")
+	}
+}
+
+func testUserDB(t *testing.T, db UserDatabase) {
+	t.Helper()
+
+	subject := fmt.Sprintf("s-%d", time.Now().UnixNano())
+	u := &User{
+		Issuer:  "https://issuer.example.com",
+		Subject: subject,
+		Email:   "testy@example.com",
+		Role:    RoleViewer,
+	}
+	id, err := db.UpsertUser(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	again := &User{
+		Issuer:  u.Issuer,
+		Subject: subject,
+		Email:   "testy@example.com",
+		Role:    RoleStaff,
+	}
+	id2, err := db.UpsertUser(again)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id2 != id {
+		t.Errorf("UpsertUser: got ID %d for the same subject, want %d", id2, id)
+	}
+
+	got, err := db.GetUser(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Role != RoleStaff {
+		t.Errorf("UpsertUser: got role %q, want %q", got.Role, RoleStaff)
+	}
+
+	found, err := db.FindUser(u.Issuer, subject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.ID != id {
+		t.Errorf("FindUser: got ID %d, want %d", found.ID, id)
+	}
+	if _, err := db.FindUser(u.Issuer, subject+"-missing"); !errors.Is(err, errNotFound) {
+		t.Errorf("FindUser of a missing user: got %v, want errNotFound", err)
+	}
+}
+
+func testAuthorDB(t *testing.T, db interface {
+	BookDatabase
+	AuthorDatabase
+}) {
+	t.Helper()
+
+	suffix := fmt.Sprintf(" %d", time.Now().UnixNano())
+	id, err := db.AddBook(&Book{Title: "a-book"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.DeleteBook(id)
+
+	credits := []Credit{
+		{Name: "Terry Pratchett" + suffix, Role: creditAuthor},
+		{Name: "Neil Gaiman" + suffix, Role: creditAuthor},
+		{Name: "Pratchett, T." + suffix, Role: creditEditor},
+	}
+	if err := db.SetCredits(id, credits); err != nil {
+		t.Fatal(err)
+	}
+	if credits[0].AuthorID == 0 || credits[0].AuthorID == credits[1].AuthorID {
+		t.Fatalf("SetCredits: got author IDs %+v", credits)
+	}
+	got, err := db.Credits(id)
+	if err != nil || len(got) != 3 || got[1].Name != credits[1].Name || got[2].Role != creditEditor {
+		t.Fatalf("Credits: got %+v, %v", got, err)
+	}
+
+	// Names are matched ignoring case.
+	again := []Credit{{Name: strings.ToUpper(credits[1].Name), Role: creditAuthor}}
+	if err := db.SetCredits(id, again); err != nil {
+		t.Fatal(err)
+	}
+	if again[0].AuthorID != credits[1].AuthorID || again[0].Name != credits[1].Name {
+		t.Errorf("SetCredits: got %+v, want the existing author %+v", again[0], credits[1])
+	}
+	if err := db.SetCredits(id, credits); err != nil {
+		t.Fatal(err)
+	}
+
+	authors, err := db.SearchAuthors("pratchett"+suffix, 0)
+	if err != nil || len(authors) != 1 {
+		t.Errorf("SearchAuthors: got %+v, %v", authors, err)
+	}
+	if authors, _ := db.SearchAuthors(suffix, 2); len(authors) != 2 {
+		t.Errorf("SearchAuthors with limit 2: got %d authors", len(authors))
+	}
+	if authors, _ := db.SearchAuthors("%", 0); len(authors) != 0 {
+		t.Errorf("SearchAuthors(%%): got %+v, want none", authors)
+	}
+
+	works, err := db.Works(credits[0].AuthorID)
+	if err != nil || len(works) != 1 || works[0].Book.ID != id || works[0].Role != creditAuthor {
+		t.Errorf("Works: got %+v, %v", works, err)
+	}
+
+	if err := db.RenameAuthor(credits[0].AuthorID, credits[1].Name); err == nil {
+		t.Error("RenameAuthor to the name of another author succeeded")
+	}
+	renamed := "Sir Terry Pratchett" + suffix
+	if err := db.RenameAuthor(credits[0].AuthorID, renamed); err != nil {
+		t.Error(err)
+	}
+	if a, err := db.GetAuthor(credits[0].AuthorID); err != nil || a.Name != renamed {
+		t.Errorf("GetAuthor after rename: got %+v, %v", a, err)
+	}
+
+	// The variant is folded into the author.
+	if err := db.MergeAuthors(credits[2].AuthorID, credits[0].AuthorID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetAuthor(credits[2].AuthorID); !errors.Is(err, errNotFound) {
+		t.Errorf("merged author: got %v, want errNotFound", err)
+	}
+	works, err = db.Works(credits[0].AuthorID)
+	if err != nil || len(works) != 2 {
+		t.Errorf("Works after merge: got %+v, %v, want the book as author and editor", works, err)
+	}
+	if err := db.MergeAuthors(credits[0].AuthorID, credits[0].AuthorID); err == nil {
+		t.Error("MergeAuthors into itself succeeded")
+	}
+
+	if err := db.DeleteBook(id); err != nil {
+		t.Fatal(err)
+	}
+	if works, err := db.Works(credits[1].AuthorID); err != nil || len(works) != 0 {
+		t.Errorf("Works after deleting the book: got %+v, %v", works, err)
+	}
+}
+
+func testAuditLog(t *testing.T, db AuditLog) {
+	t.Helper()
+
+	start := time.Now().UTC().Add(-time.Second)
+	actor := fmt.Sprintf("a-%d@example.com", time.Now().UnixNano())
+	for _, action := range []string{AuditCreate, AuditUpdate, AuditDelete} {
+		e := &AuditEntry{
+			Time:   time.Now().UTC(),
+			Actor:  actor,
+			Action: action,
+			BookID: 42,
+			After:  []byte(`{"Title":"t"}`),
+		}
+		if err := db.AppendAudit(e); err != nil {
+			t.Fatal(err)
+		}
+		if e.ID == 0 {
+			t.Error("AppendAudit: want ID to be assigned")
+		}
+	}
+
+	entries, err := db.ListAudit(AuditFilter{Actor: actor, Since: start})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[0].Action != AuditDelete {
+		t.Fatalf("ListAudit: got %d entries, want 3 newest first", len(entries))
+	}
+	entries, err = db.ListAudit(AuditFilter{Actor: actor, Action: AuditUpdate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || string(entries[0].After) != `{"Title":"t"}` {
+		t.Errorf("ListAudit by action: got %+v", entries)
+	}
+	entries, err = db.ListAudit(AuditFilter{Actor: actor, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("ListAudit with limit: got %d entries, want 2", len(entries))
+	}
+}
+
+func testLabels(t *testing.T, db BookDatabase) {
+	t.Helper()
+
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	genres, err := db.ListGenres()
+	if err != nil || len(genres) < 2 {
+		t.Fatalf("ListGenres: got %q, %v", genres, err)
+	}
+	added := "Genre " + suffix
+	if err := db.AddGenre(added); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddGenre(strings.ToUpper(added)); err == nil {
+		t.Error("AddGenre of an existing genre succeeded")
+	}
+	if got, _ := db.ListGenres(); len(got) != len(genres)+1 || got[len(got)-1] != added {
+		t.Errorf("ListGenres after AddGenre: got %q", got)
+	}
+
+	tag, other := "tag-"+suffix, "other-"+suffix
+	books := []*Book{
+		{Title: "l1", Genres: []string{genres[0], added}, Tags: []string{other, tag}, PublishedDate: PartialDate{Year: 1965}},
+		{Title: "l2", Genres: []string{added}, Tags: []string{tag}, PublishedDate: PartialDate{Year: 1969}},
+		{Title: "l3", Tags: []string{tag}, PublishedDate: PartialDate{Year: 1971}},
+	}
+	for _, b := range books {
+		if _, err := db.AddBook(b); err != nil {
+			t.Fatal(err)
+		}
+		defer db.DeleteBook(b.ID)
+	}
+	if _, err := db.AddBook(&Book{Title: "l4", Genres: []string{"No such genre " + suffix}}); !errors.Is(err, errUnknownGenre) {
+		t.Errorf("AddBook with an unknown genre: got %v, want errUnknownGenre", err)
+	}
+
+	got, err := db.GetBook(books[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(got.Genres, got.Tags) != fmt.Sprint(books[0].Genres, books[0].Tags) {
+		t.Errorf("GetBook: got genres %q and tags %q", got.Genres, got.Tags)
+	}
+	update := *got
+	update.Genres, update.Tags = nil, []string{tag}
+	if err := db.UpdateBook(&update); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := db.GetBook(books[0].ID); len(got.Genres) != 0 || len(got.Tags) != 1 {
+		t.Errorf("GetBook after UpdateBook: got genres %q and tags %q", got.Genres, got.Tags)
+	}
+	if err := db.UpdateBook(books[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		q    BookQuery
+		want int
+	}{
+		{BookQuery{Tag: tag}, 3},
+		{BookQuery{Tag: other}, 1},
+		{BookQuery{Genre: added}, 2},
+		{BookQuery{Genre: added, Tag: tag, PublishedFrom: 1966}, 1},
+	} {
+		got, err := db.QueryBooks(tc.q)
+		if err != nil || len(got) != tc.want {
+			t.Errorf("QueryBooks(%+v): got %d books, %v, want %d", tc.q, len(got), err, tc.want)
+		}
+	}
+
+	f, err := db.Facets(BookQuery{Tag: tag})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprint(
+		[]Facet{{added, added, 2}, {genres[0], genres[0], 1}},
+		[]Facet{{tag, tag, 3}, {other, other, 1}},
+		[]Facet{{"1960", "1960s", 2}, {"1970", "1970s", 1}},
+	)
+	if got := fmt.Sprint(f.Genres, f.Tags, f.Decades); got != want {
+		t.Errorf("Facets:\ngot  %s\nwant %s", got, want)
+	}
+}
+
+func testSeriesDB(t *testing.T, db interface {
+	BookDatabase
+	SeriesDatabase
+}) {
+	t.Helper()
+
+	name := fmt.Sprint("Series ", time.Now().UnixNano())
+	var ids []uint
+	for _, title := range []string{"s3", "s1", "s2.5", "s-unnumbered"} {
+		id, err := db.AddBook(&Book{Title: title})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	defer func() {
+		for _, id := range ids {
+			db.DeleteBook(id)
+		}
+	}()
+
+	entries := []*SeriesEntry{
+		{Name: name, Number: 3},
+		{Name: strings.ToLower(name), Number: 1},
+		{Name: name, Number: 2.5},
+		{Name: name},
+	}
+	for i, e := range entries {
+		if err := db.SetSeries(ids[i], e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if entries[1].SeriesID != entries[0].SeriesID || entries[1].Name != name {
+		t.Errorf("SetSeries: got %+v, want the series of %+v", entries[1], entries[0])
+	}
+	seriesID := entries[0].SeriesID
+
+	e, err := db.BookSeries(ids[2])
+	if err != nil || e == nil || *e != *entries[2] {
+		t.Errorf("BookSeries: got %+v, %v, want %+v", e, err, entries[2])
+	}
+	volumes, err := db.Volumes(seriesID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var titles []string
+	for _, v := range volumes {
+		titles = append(titles, v.Book.Title)
+	}
+	if got := strings.Join(titles, ","); got != "s1,s2.5,s3,s-unnumbered" {
+		t.Errorf("Volumes: got %s, want s1,s2.5,s3,s-unnumbered", got)
+	}
+
+	if err := db.SetSeries(ids[3], nil); err != nil {
+		t.Fatal(err)
+	}
+	if e, err := db.BookSeries(ids[3]); err != nil || e != nil {
+		t.Errorf("BookSeries after SetSeries(nil): got %+v, %v", e, err)
+	}
+
+	renamed := name + " (renamed)"
+	if err := db.RenameSeries(seriesID, renamed); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := db.GetSeries(seriesID); err != nil || s.Name != renamed {
+		t.Errorf("GetSeries after rename: got %+v, %v", s, err)
+	}
+	series, err := db.ListSeries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, s := range series {
+		found = found || s.ID == seriesID
+	}
+	if !found {
+		t.Errorf("ListSeries: series %d missing from %+v", seriesID, series)
+	}
+
+	// The series goes with its last book.
+	for _, id := range ids[:3] {
+		if err := db.DeleteBook(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.GetSeries(seriesID); !errors.Is(err, errNotFound) {
+		t.Errorf("GetSeries of a series without books: got %v, want errNotFound", err)
+	}
+}
+
+func testCollectionDB(t *testing.T, db interface {
+	BookDatabase
+	CollectionDatabase
+}) {
+	t.Helper()
+
+	var ids []uint
+	for _, title := range []string{"c1", "c2", "c3"} {
+		id, err := db.AddBook(&Book{Title: title})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	defer func() {
+		for _, id := range ids {
+			db.DeleteBook(id)
+		}
+	}()
+
+	owner := uint(time.Now().UnixNano() % 1000000)
+	c := &Collection{OwnerID: owner, Name: "To read", CreatedAt: time.Now().UTC().Truncate(time.Second)}
+	id, err := db.AddCollection(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.DeleteCollection(id)
+	if _, err := db.AddCollection(&Collection{OwnerID: owner, Name: "to READ", CreatedAt: c.CreatedAt}); !errors.Is(err, errBadCollection) {
+		t.Errorf("AddCollection of a taken name: got %v, want errBadCollection", err)
+	}
+	other, err := db.AddCollection(&Collection{OwnerID: owner + 1, Name: "To read", CreatedAt: c.CreatedAt})
+	if err != nil {
+		t.Errorf("AddCollection of the name of another owner: %v", err)
+	}
+	defer db.DeleteCollection(other)
+
+	for _, bookID := range []uint{ids[0], ids[1], ids[2], ids[0]} {
+		if err := db.AddToCollection(id, bookID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.AddToCollection(id, ids[2]+1000); !errors.Is(err, errNotFound) {
+		t.Errorf("AddToCollection of a missing book: got %v, want errNotFound", err)
+	}
+	titles := func() string {
+		t.Helper()
+		books, err := db.CollectionBooks(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var titles []string
+		for _, b := range books {
+			titles = append(titles, b.Title)
+		}
+		return strings.Join(titles, ",")
+	}
+	if got := titles(); got != "c1,c2,c3" {
+		t.Errorf("CollectionBooks: got %s, want c1,c2,c3", got)
+	}
+
+	if err := db.ReorderCollection(id, []uint{ids[2], ids[0], ids[1]}); err != nil {
+		t.Fatal(err)
+	}
+	if got := titles(); got != "c3,c1,c2" {
+		t.Errorf("CollectionBooks after reordering: got %s, want c3,c1,c2", got)
+	}
+	if err := db.ReorderCollection(id, []uint{ids[0], ids[0], ids[1]}); !errors.Is(err, errBadCollection) {
+		t.Errorf("ReorderCollection with a repeated book: got %v, want errBadCollection", err)
+	}
+	if err := db.RemoveFromCollection(id, ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	// Deleted books leave their collections.
+	if err := db.DeleteBook(ids[1]); err != nil {
+		t.Fatal(err)
+	}
+	if got := titles(); got != "c3" {
+		t.Errorf("CollectionBooks after removing: got %s, want c3", got)
+	}
+
+	c.ID = id
+	c.Name = "Read"
+	c.ShareToken = fmt.Sprint("token", time.Now().UnixNano())
+	if err := db.UpdateCollection(c); err != nil {
+		t.Fatal(err)
+	}
+	shared, err := db.FindSharedCollection(c.ShareToken)
+	if err != nil || shared.ID != id || shared.Name != "Read" {
+		t.Errorf("FindSharedCollection: got %+v, %v", shared, err)
+	}
+	if _, err := db.FindSharedCollection(""); !errors.Is(err, errNotFound) {
+		t.Errorf("FindSharedCollection of no token: got %v, want errNotFound", err)
+	}
+	collections, err := db.ListCollections(owner)
+	if err != nil || len(collections) != 1 || collections[0].Name != "Read" {
+		t.Errorf("ListCollections: got %+v, %v", collections, err)
+	}
+
+	if err := db.DeleteCollection(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetCollection(id); !errors.Is(err, errNotFound) {
+		t.Errorf("GetCollection after delete: got %v, want errNotFound", err)
+	}
+	if _, err := db.GetBook(ids[2]); err != nil {
+		t.Errorf("GetBook of a book of a deleted collection: %v", err)
+	}
+}
+
+func testCopyDB(t *testing.T, db interface {
+	BookDatabase
+	CopyDatabase
+}) {
+	t.Helper()
+
+	var ids []uint
+	for _, title := range []string{"copied", "uncopied"} {
+		id, err := db.AddBook(&Book{Title: title})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	defer func() {
+		for _, id := range ids {
+			db.DeleteBook(id)
+		}
+	}()
+
+	prefix := fmt.Sprint(time.Now().UnixNano())
+	copies := []*Copy{
+		{BookID: ids[0], Barcode: prefix + "-b", Condition: conditionGood, Location: "Shelf 1", Price: 1250},
+		{BookID: ids[0], Barcode: prefix + "-a", Condition: conditionLost, Acquired: PartialDate{Year: 2019, Month: 4}},
+	}
+	for _, c := range copies {
+		if _, err := db.AddCopy(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.AddCopy(&Copy{BookID: ids[1], Barcode: strings.ToUpper(prefix + "-A"), Condition: conditionGood}); !errors.Is(err, errBadCopy) {
+		t.Errorf("AddCopy of a taken barcode: got %v, want errBadCopy", err)
+	}
+	if _, err := db.AddCopy(&Copy{BookID: ids[1] + 1000, Barcode: prefix + "-c", Condition: conditionGood}); !errors.Is(err, errNotFound) {
+		t.Errorf("AddCopy of a missing book: got %v, want errNotFound", err)
+	}
+
+	got, err := db.ListCopies(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || *got[0] != *copies[1] || *got[1] != *copies[0] {
+		t.Errorf("ListCopies: got %+v, want %+v ordered by barcode", got, copies)
+	}
+	all, err := db.AllCopies()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mine []*Copy
+	for _, c := range all {
+		if c.BookID == ids[0] {
+			mine = append(mine, c)
+		}
+	}
+	if len(mine) != 2 || *mine[0] != *copies[1] || *mine[1] != *copies[0] {
+		t.Errorf("AllCopies: got %+v, want %+v ordered by barcode", mine, copies)
+	}
+	if c, err := db.FindCopy(copies[0].Barcode); err != nil || c.ID != copies[0].ID {
+		t.Errorf("FindCopy: got %+v, %v", c, err)
+	}
+
+	counts, err := db.CopyCounts(ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 1 || counts[ids[0]] != (CopyCount{Total: 2, Available: 1}) {
+		t.Errorf("CopyCounts: got %+v", counts)
+	}
+
+	update := *copies[1]
+	update.Condition = conditionFair
+	update.BookID = ids[1]
+	if err := db.UpdateCopy(&update); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := db.GetCopy(update.ID); err != nil || c.Condition != conditionFair || c.BookID != ids[0] {
+		t.Errorf("GetCopy after update: got %+v, %v", c, err)
+	}
+	update.Barcode = copies[0].Barcode
+	if err := db.UpdateCopy(&update); !errors.Is(err, errBadCopy) {
+		t.Errorf("UpdateCopy to a taken barcode: got %v, want errBadCopy", err)
+	}
+
+	if err := db.DeleteCopy(copies[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetCopy(copies[0].ID); !errors.Is(err, errNotFound) {
+		t.Errorf("GetCopy after delete: got %v, want errNotFound", err)
+	}
+	// Copies go with their book.
+	if err := db.DeleteBook(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetCopy(copies[1].ID); !errors.Is(err, errNotFound) {
+		t.Errorf("GetCopy after deleting the book: got %v, want errNotFound", err)
+	}
+}
+
+func testLoanDB(t *testing.T, db interface {
+	BookDatabase
+	UserDatabase
+	CopyDatabase
+	LoanDatabase
+}) {
+	t.Helper()
+
+	bookID, err := db.AddBook(&Book{Title: "lent"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.DeleteBook(bookID)
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	userID, err := db.UpsertUser(&User{Issuer: "https://issuer", Subject: "borrower-" + suffix, Role: RoleViewer, CreatedAt: time.Now().UTC()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var copyIDs []uint
+	for _, barcode := range []string{"l1-", "l2-", "lost-"} {
+		c := &Copy{BookID: bookID, Barcode: barcode + suffix, Condition: conditionGood}
+		if barcode == "lost-" {
+			c.Condition = conditionLost
+		}
+		id, err := db.AddCopy(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		copyIDs = append(copyIDs, id)
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	due := now.Truncate(24 * time.Hour).Add(loanPeriod)
+
+	// However many check out a copy at once, one gets it.
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	lent, unavailable := 0, 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := db.CheckOut(&Loan{CopyID: copyIDs[0], UserID: userID, CheckedOut: now, Due: due})
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				lent++
+			case errors.Is(err, errUnavailable):
+				unavailable++
+			default:
+				t.Errorf("CheckOut: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if lent != 1 || unavailable != 7 {
+		t.Errorf("concurrent CheckOut: lent %d times, %d unavailable, want 1 and 7", lent, unavailable)
+	}
+	if _, err := db.CheckOut(&Loan{CopyID: copyIDs[2], UserID: userID, CheckedOut: now, Due: due}); !errors.Is(err, errUnavailable) {
+		t.Errorf("CheckOut of a lost copy: got %v, want errUnavailable", err)
+	}
+	if err := db.DeleteCopy(copyIDs[0]); !errors.Is(err, errBadCopy) {
+		t.Errorf("DeleteCopy of a copy on loan: got %v, want errBadCopy", err)
+	}
+	if err := db.DeleteBook(bookID); !errors.Is(err, errBadCopy) {
+		t.Errorf("DeleteBook with a copy on loan: got %v, want errBadCopy", err)
+	}
+	counts, err := db.CopyCounts([]uint{bookID})
+	if err != nil || counts[bookID] != (CopyCount{Total: 3, Available: 1}) {
+		t.Errorf("CopyCounts with a copy on loan: got %+v, %v", counts, err)
+	}
+
+	returned := now.Add(time.Hour)
+	l, err := db.CheckIn(copyIDs[0], returned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.CopyID != copyIDs[0] || l.BookID != bookID || l.Returned == nil || !l.Returned.Equal(returned) {
+		t.Errorf("CheckIn: got %+v", l)
+	}
+	if _, err := db.CheckIn(copyIDs[0], returned); !errors.Is(err, errNotFound) {
+		t.Errorf("CheckIn of a returned copy: got %v, want errNotFound", err)
+	}
+	id, err := db.CheckOut(&Loan{CopyID: copyIDs[0], UserID: userID, CheckedOut: returned, Due: due})
+	if err != nil {
+		t.Fatalf("CheckOut of a returned copy: %v", err)
+	}
+
+	loans, err := db.ListLoans(LoanFilter{BookID: bookID})
+	if err != nil || len(loans) != 2 || loans[0].ID != id || loans[1].ID != l.ID {
+		t.Errorf("ListLoans of the book: got %+v, %v, want the newest first", loans, err)
+	}
+	loans, err = db.ListLoans(LoanFilter{UserID: userID, Active: true})
+	if err != nil || len(loans) != 1 || loans[0].ID != id || !loans[0].Due.Equal(due) {
+		t.Errorf("ListLoans of active loans: got %+v, %v", loans, err)
+	}
+	if loans, err := db.ListLoans(LoanFilter{CopyID: copyIDs[1]}); err != nil || len(loans) != 0 {
+		t.Errorf("ListLoans of a copy never lent: got %+v, %v", loans, err)
+	}
+	if loans, err := db.ListLoans(LoanFilter{BookID: bookID, DueBefore: due}); err != nil || len(loans) != 0 {
+		t.Errorf("ListLoans due before %v: got %+v, %v", due, loans, err)
+	}
+	if loans, err := db.ListLoans(LoanFilter{BookID: bookID, DueBefore: due.Add(time.Second)}); err != nil || len(loans) != 2 {
+		t.Errorf("ListLoans due before %v: got %+v, %v", due.Add(time.Second), loans, err)
+	}
+	if got, err := db.GetLoan(id); err != nil || got.ID != id || got.CopyID != copyIDs[0] || !got.Due.Equal(due) {
+		t.Errorf("GetLoan: got %+v, %v", got, err)
+	}
+	if _, err := db.GetLoan(0); !errors.Is(err, errNotFound) {
+		t.Errorf("GetLoan of a missing loan: got %v, want errNotFound", err)
+	}
+	if _, err := db.CheckIn(copyIDs[0], returned); err != nil {
+		t.Fatal(err)
+	}
+
+	// Loans outlive their copies and books.
+	if err := db.DeleteCopy(copyIDs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if loans, err := db.ListLoans(LoanFilter{BookID: bookID}); err != nil || len(loans) != 2 {
+		t.Errorf("ListLoans after deleting the copy: got %+v, %v", loans, err)
+	}
+	if err := db.DeleteBook(bookID); err != nil {
+		t.Fatal(err)
+	}
+	if loans, err := db.ListLoans(LoanFilter{UserID: userID}); err != nil || len(loans) != 2 {
+		t.Errorf("ListLoans after deleting the book: got %+v, %v", loans, err)
+	}
+
+	// Restores add the loans of deleted copies as they are.
+	if _, err := db.AddLoanRecord(&Loan{UserID: userID, CheckedOut: now, Due: due}); !errors.Is(err, errBadLoan) {
+		t.Errorf("AddLoanRecord of an active loan: got %v, want errBadLoan", err)
+	}
+	record := &Loan{UserID: userID, CheckedOut: now, Due: due, Returned: &returned}
+	if id, err := db.AddLoanRecord(record); err != nil || id == 0 || record.ID != id {
+		t.Fatalf("AddLoanRecord: got %d, %v", id, err)
+	}
+	if got, err := db.GetLoan(record.ID); err != nil || got.CopyID != 0 || got.Returned == nil || !got.Returned.Equal(returned) {
+		t.Errorf("GetLoan of the record: got %+v, %v", got, err)
+	}
+}
+
+// testDeleteLentCopy races check-outs against deleting the copy and its
+// book: either the delete is refused or the check-out fails, no loan is
+// left on a copy which is gone.
+func testDeleteLentCopy(t *testing.T, db interface {
+	BookDatabase
+	UserDatabase
+	CopyDatabase
+	LoanDatabase
+}) {
+	t.Helper()
+
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	userID, err := db.UpsertUser(&User{Issuer: "https://issuer", Subject: "racer-" + suffix, Role: RoleViewer, CreatedAt: time.Now().UTC()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	due := now.Truncate(24 * time.Hour).Add(loanPeriod)
+	for i := 0; i < 10; i++ {
+		bookID, err := db.AddBook(&Book{Title: "raced"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		copyID, err := db.AddCopy(&Copy{BookID: bookID, Barcode: fmt.Sprintf("race-%d-%s", i, suffix), Condition: conditionGood})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			db.CheckOut(&Loan{CopyID: copyID, UserID: userID, CheckedOut: now, Due: due})
+		}()
+		go func() {
+			defer wg.Done()
+			if i%2 == 0 {
+				db.DeleteCopy(copyID)
+			} else {
+				db.DeleteBook(bookID)
+			}
+		}()
+		wg.Wait()
+
+		loans, err := db.ListLoans(LoanFilter{CopyID: copyID, Active: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.GetCopy(copyID)
+		if gone := errors.Is(err, errNotFound); gone && len(loans) != 0 {
+			t.Errorf("round %d: got an active loan %+v of a deleted copy", i, loans[0])
+		} else if !gone && err != nil {
+			t.Fatal(err)
+		}
+		if len(loans) != 0 {
+			if _, err := db.CheckIn(copyID, now); err != nil {
+				t.Fatal(err)
+			}
+		}
+		db.DeleteBook(bookID)
+	}
+}
+
+func testHoldDB(t *testing.T, db interface {
+	BookDatabase
+	UserDatabase
+	CopyDatabase
+	LoanDatabase
+	HoldDatabase
+}) {
+	t.Helper()
+
+	bookID, err := db.AddBook(&Book{Title: "held"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.DeleteBook(bookID)
+	bareID, err := db.AddBook(&Book{Title: "without copies"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.DeleteBook(bareID)
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	copyID, err := db.AddCopy(&Copy{BookID: bookID, Barcode: "h1-" + suffix, Condition: conditionGood})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var users []uint
+	for _, name := range []string{"ann-", "ben-", "cat-"} {
+		id, err := db.UpsertUser(&User{Issuer: "https://issuer", Subject: name + suffix, Role: RoleViewer, CreatedAt: time.Now().UTC()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, id)
+	}
+	ann, ben, cat := users[0], users[1], users[2]
+
+	now := time.Now().UTC().Truncate(time.Second)
+	due := now.Truncate(24 * time.Hour).Add(loanPeriod)
+	if _, err := db.PlaceHold(&Hold{BookID: bareID, UserID: ben, Placed: now}); !errors.Is(err, errBadHold) {
+		t.Errorf("PlaceHold on a book without copies: got %v, want errBadHold", err)
+	}
+	if _, err := db.CheckOut(&Loan{CopyID: copyID, UserID: ann, CheckedOut: now, Due: due}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.PlaceHold(&Hold{BookID: bookID, UserID: ann, Placed: now}); !errors.Is(err, errBadHold) {
+		t.Errorf("PlaceHold on a borrowed book: got %v, want errBadHold", err)
+	}
+	benHold := &Hold{BookID: bookID, UserID: ben, Placed: now.Add(time.Second)}
+	if _, err := db.PlaceHold(benHold); err != nil || benHold.Status != holdWaiting {
+		t.Fatalf("PlaceHold: got %+v, %v, want a waiting hold", benHold, err)
+	}
+	if _, err := db.PlaceHold(&Hold{BookID: bookID, UserID: ben, Placed: now}); !errors.Is(err, errBadHold) {
+		t.Errorf("PlaceHold twice: got %v, want errBadHold", err)
+	}
+	catHold := &Hold{BookID: bookID, UserID: cat, Placed: now.Add(2 * time.Second)}
+	if _, err := db.PlaceHold(catHold); err != nil {
+		t.Fatal(err)
+	}
+
+	// Checking in keeps the copy for the first in line.
+	returned := now.Add(time.Hour)
+	if _, err := db.CheckIn(copyID, returned); err != nil {
+		t.Fatal(err)
+	}
+	h, err := db.GetHold(benHold.ID)
+	if err != nil || !h.Ready() || h.CopyID != copyID || h.Expires == nil || !h.Expires.Equal(returned.Add(holdPickupWindow)) {
+		t.Fatalf("GetHold after CheckIn: got %+v, %v, want it ready", h, err)
+	}
+	if _, err := db.CheckOut(&Loan{CopyID: copyID, UserID: cat, CheckedOut: returned, Due: due}); !errors.Is(err, errUnavailable) {
+		t.Errorf("CheckOut of a copy held for another: got %v, want errUnavailable", err)
+	}
+	if err := db.DeleteCopy(copyID); !errors.Is(err, errBadCopy) {
+		t.Errorf("DeleteCopy of a held copy: got %v, want errBadCopy", err)
+	}
+	if err := db.DeleteBook(bookID); !errors.Is(err, errBadCopy) {
+		t.Errorf("DeleteBook with a held copy: got %v, want errBadCopy", err)
+	}
+	counts, err := db.CopyCounts([]uint{bookID})
+	if err != nil || counts[bookID] != (CopyCount{Total: 1}) {
+		t.Errorf("CopyCounts with a held copy: got %+v, %v", counts, err)
+	}
+
+	// Once the pickup window passes, the copy goes to the next in line.
+	if expired, err := db.ExpireHolds(h.Expires.Add(-time.Second)); err != nil || len(expired) != 0 {
+		t.Errorf("ExpireHolds before the window passed: got %+v, %v", expired, err)
+	}
+	expired, err := db.ExpireHolds(*h.Expires)
+	if err != nil || len(expired) != 1 || expired[0].ID != benHold.ID || expired[0].Status != holdExpired {
+		t.Errorf("ExpireHolds: got %+v, %v", expired, err)
+	}
+	if h, err := db.GetHold(catHold.ID); err != nil || !h.Ready() || h.CopyID != copyID {
+		t.Errorf("GetHold of the next in line: got %+v, %v, want it ready", h, err)
+	}
+
+	// Cancelling releases the copy, and with nobody waiting it is free.
+	if err := db.CancelHold(catHold.ID, returned); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CancelHold(catHold.ID, returned); !errors.Is(err, errBadHold) {
+		t.Errorf("CancelHold twice: got %v, want errBadHold", err)
+	}
+	if err := db.CancelHold(0, returned); !errors.Is(err, errNotFound) {
+		t.Errorf("CancelHold of a missing hold: got %v, want errNotFound", err)
+	}
+	counts, err = db.CopyCounts([]uint{bookID})
+	if err != nil || counts[bookID] != (CopyCount{Total: 1, Available: 1}) {
+		t.Errorf("CopyCounts after cancelling: got %+v, %v", counts, err)
+	}
+
+	// A hold placed while a copy is free is ready at once, and borrowing
+	// fulfills it.
+	again := &Hold{BookID: bookID, UserID: ben, Placed: returned}
+	if _, err := db.PlaceHold(again); err != nil || !again.Ready() || again.CopyID != copyID {
+		t.Fatalf("PlaceHold with a free copy: got %+v, %v, want it ready", again, err)
+	}
+	if _, err := db.CheckOut(&Loan{CopyID: copyID, UserID: ben, CheckedOut: returned, Due: due}); err != nil {
+		t.Fatalf("CheckOut by the holder: %v", err)
+	}
+	holds, err := db.ListHolds(HoldFilter{BookID: bookID})
+	if err != nil || len(holds) != 3 {
+		t.Fatalf("ListHolds: got %+v, %v", holds, err)
+	}
+	for i, want := range []struct {
+		id     uint
+		status string
+	}{
+		{benHold.ID, holdExpired},
+		{catHold.ID, holdCancelled},
+		{again.ID, holdFulfilled},
+	} {
+		if holds[i].ID != want.id || holds[i].Status != want.status || holds[i].Closed == nil {
+			t.Errorf("ListHolds: got hold %+v at %d, want %d %s", holds[i], i, want.id, want.status)
+		}
+	}
+	if holds, err := db.ListHolds(HoldFilter{UserID: ben, Active: true}); err != nil || len(holds) != 0 {
+		t.Errorf("ListHolds of active holds: got %+v, %v", holds, err)
+	}
+	if _, err := db.CheckIn(copyID, returned); err != nil {
+		t.Fatal(err)
+	}
+
+	// Deleting the book cancels the holds waiting for it, and keeps them.
+	// The hold waits for good, once its only copy comes back lost.
+	if _, err := db.CheckOut(&Loan{CopyID: copyID, UserID: ann, CheckedOut: returned, Due: due}); err != nil {
+		t.Fatal(err)
+	}
+	last := &Hold{BookID: bookID, UserID: cat, Placed: returned}
+	if _, err := db.PlaceHold(last); err != nil || last.Status != holdWaiting {
+		t.Fatalf("PlaceHold: got %+v, %v, want a waiting hold", last, err)
+	}
+	c, err := db.GetCopy(copyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Condition = conditionLost
+	if err := db.UpdateCopy(c); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CheckIn(copyID, returned); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteBook(bookID); err != nil {
+		t.Fatal(err)
+	}
+	if h, err := db.GetHold(last.ID); err != nil || h.Status != holdCancelled || h.Closed == nil {
+		t.Errorf("GetHold after deleting the book: got %+v, %v, want it cancelled", h, err)
+	}
+	if holds, err := db.ListHolds(HoldFilter{BookID: bookID}); err != nil || len(holds) != 4 {
+		t.Errorf("ListHolds after deleting the book: got %+v, %v", holds, err)
+	}
+
+	// Restores add the holds of deleted books as they are.
+	if _, err := db.AddHoldRecord(&Hold{UserID: ann, Status: holdWaiting, Placed: returned}); !errors.Is(err, errBadHold) {
+		t.Errorf("AddHoldRecord of an active hold: got %v, want errBadHold", err)
+	}
+	record := &Hold{UserID: ann, Status: holdExpired, Placed: now, Closed: &returned}
+	if id, err := db.AddHoldRecord(record); err != nil || id == 0 || record.ID != id {
+		t.Fatalf("AddHoldRecord: got %d, %v", id, err)
+	}
+	if h, err := db.GetHold(record.ID); err != nil || h.Status != holdExpired || h.BookID != 0 {
+		t.Errorf("GetHold of the record: got %+v, %v", h, err)
+	}
+}
+
+func testReminderDB(t *testing.T, db interface {
+	UserDatabase
+	ReminderDatabase
+}) {
+	t.Helper()
+
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	userID, err := db.UpsertUser(&User{Issuer: "https://issuer", Subject: "reminded-" + suffix, Role: RoleViewer, CreatedAt: time.Now().UTC()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	// Loan IDs are not checked, so made up ones stay clear of real loans.
+	loanID := uint(time.Now().UnixNano()%1000000) + 1000000
+	r := &Reminder{LoanID: loanID, UserID: userID, Kind: reminderDueSoon, Status: reminderPending, Queued: now, NextAttempt: now}
+	if queued, err := db.QueueReminder(r); err != nil || !queued || r.ID == 0 {
+		t.Fatalf("QueueReminder: got %v, %v, ID %d", queued, err, r.ID)
+	}
+	again := &Reminder{LoanID: loanID, UserID: userID, Kind: reminderDueSoon, Status: reminderPending, Queued: now, NextAttempt: now}
+	if queued, err := db.QueueReminder(again); err != nil || queued {
+		t.Errorf("QueueReminder of the same kind again: got %v, %v, want false", queued, err)
+	}
+	overdue := &Reminder{LoanID: loanID, UserID: userID, Kind: reminderOverdue, Status: reminderPending, Queued: now, NextAttempt: now.Add(time.Hour)}
+	if queued, err := db.QueueReminder(overdue); err != nil || !queued {
+		t.Fatalf("QueueReminder of another kind: got %v, %v", queued, err)
+	}
+
+	due, err := db.ListReminders(ReminderFilter{UserID: userID, AttemptBy: now})
+	if err != nil || len(due) != 1 || due[0].ID != r.ID {
+		t.Errorf("ListReminders due now: got %+v, %v", due, err)
+	}
+	if claimed, err := db.ClaimReminder(overdue.ID, now, now.Add(time.Minute)); err != nil || claimed {
+		t.Errorf("ClaimReminder of a reminder not due: got %v, %v, want false", claimed, err)
+	}
+	if claimed, err := db.ClaimReminder(r.ID, now, now.Add(time.Minute)); err != nil || !claimed {
+		t.Errorf("ClaimReminder: got %v, %v, want true", claimed, err)
+	}
+	if claimed, err := db.ClaimReminder(r.ID, now, now.Add(time.Minute)); err != nil || claimed {
+		t.Errorf("ClaimReminder twice: got %v, %v, want false", claimed, err)
+	}
+	if due, err := db.ListReminders(ReminderFilter{UserID: userID, AttemptBy: now}); err != nil || len(due) != 0 {
+		t.Errorf("ListReminders due now after claiming: got %+v, %v", due, err)
+	}
+	sent := now.Add(time.Minute)
+	r.Status, r.Attempts, r.To, r.Sent = reminderSent, 1, "reminded@example.com", &sent
+	if err := db.UpdateReminder(r); err != nil {
+		t.Fatal(err)
+	}
+	all, err := db.ListReminders(ReminderFilter{UserID: userID})
+	if err != nil || len(all) != 2 || all[0].ID != overdue.ID || all[1].Status != reminderSent || all[1].To != r.To || all[1].Sent == nil {
+		t.Errorf("ListReminders: got %+v, %v, want the newest first", all, err)
+	}
+	if got, err := db.ListReminders(ReminderFilter{UserID: userID, Status: reminderSent, Limit: 5}); err != nil || len(got) != 1 {
+		t.Errorf("ListReminders of sent reminders: got %+v, %v", got, err)
+	}
+	if got, err := db.ListReminders(ReminderFilter{UserID: userID, Limit: 1}); err != nil || len(got) != 1 {
+		t.Errorf("ListReminders with a limit: got %+v, %v", got, err)
+	}
+
+	if out, err := db.OptedOut(userID); err != nil || out {
+		t.Errorf("OptedOut by default: got %v, %v", out, err)
+	}
+	for _, out := range []bool{true, true, false} {
+		if err := db.SetOptOut(userID, out); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := db.OptedOut(userID); err != nil || got != out {
+			t.Errorf("OptedOut after SetOptOut(%v): got %v, %v", out, got, err)
+		}
+	}
+	if err := db.SetOptOut(userID, true); err != nil {
+		t.Fatal(err)
+	}
+	ids, err := db.ListOptOuts()
+	if err != nil || len(ids) == 0 || ids[len(ids)-1] != userID {
+		t.Errorf("ListOptOuts: got %v, %v", ids, err)
+	}
+	if err := db.SetOptOut(0, true); !errors.Is(err, errNotFound) {
+		t.Errorf("SetOptOut of a missing user: got %v, want errNotFound", err)
+	}
+}
+
+func testReviewDB(t *testing.T, db interface {
+	BookDatabase
+	UserDatabase
+	ReviewDatabase
+}) {
+	t.Helper()
+
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	var users []uint
+	for _, name := range []string{"ann", "bob"} {
+		id, err := db.UpsertUser(&User{Issuer: "https://issuer", Subject: name + "-" + suffix, Role: RoleViewer, CreatedAt: time.Now().UTC()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, id)
+	}
+	var books []uint
+	for _, title := range []string{"r-good-" + suffix, "r-best-" + suffix, "r-none-" + suffix} {
+		id, err := db.AddBook(&Book{Title: title})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.DeleteBook(id)
+		books = append(books, id)
+	}
+	good, best, none := books[0], books[1], books[2]
+
+	now := time.Now().UTC().Truncate(time.Second)
+	first := &Review{BookID: good, UserID: users[0], Rating: 3, Body: "  Fine.\r\n", Created: now, Updated: now}
+	if _, err := db.SaveReview(first); err != nil || first.ID == 0 || first.Body != "Fine." {
+		t.Fatalf("SaveReview: got %+v, %v", first, err)
+	}
+	later := now.Add(time.Hour)
+	edited := &Review{BookID: good, UserID: users[0], Rating: 4, Body: "Better on rereading.", Created: later, Updated: later}
+	if _, err := db.SaveReview(edited); err != nil || edited.ID != first.ID || !edited.Created.Equal(now) {
+		t.Errorf("SaveReview of the same book again: got %+v, %v, want the first review replaced", edited, err)
+	}
+	got, err := db.FindReview(good, users[0])
+	if err != nil || got.ID != first.ID || got.Rating != 4 || got.Body != edited.Body || !got.Edited() {
+		t.Errorf("FindReview: got %+v, %v", got, err)
+	}
+	for _, r := range []*Review{
+		{BookID: good, UserID: users[1], Rating: 5},
+		{BookID: best, UserID: users[0], Rating: 5},
+	} {
+		r.Created, r.Updated = now, now
+		if _, err := db.SaveReview(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, r := range []*Review{
+		{BookID: good, UserID: users[1], Rating: 6},
+		{BookID: good, UserID: users[1], Rating: 0},
+		{BookID: good, UserID: users[1], Rating: 3, Body: strings.Repeat("x", maxReviewBody+1)},
+	} {
+		if _, err := db.SaveReview(r); !errors.Is(err, errBadReview) {
+			t.Errorf("SaveReview(%d stars, %d characters): got %v, want errBadReview", r.Rating, len(r.Body), err)
+		}
+	}
+	if _, err := db.SaveReview(&Review{BookID: 0, UserID: users[0], Rating: 3}); !errors.Is(err, errNotFound) {
+		t.Errorf("SaveReview of a missing book: got %v, want errNotFound", err)
+	}
+
+	ratings, err := db.Ratings([]uint{good, best, none})
+	if err != nil || len(ratings) != 2 || ratings[good] != (RatingSummary{Count: 2, Average: 4.5}) || ratings[best] != (RatingSummary{Count: 1, Average: 5}) {
+		t.Errorf("Ratings: got %+v, %v", ratings, err)
+	}
+	sorted := func() string {
+		t.Helper()
+		books, err := db.QueryBooks(BookQuery{Sort: sortRating})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var titles []string
+		for _, b := range books {
+			if strings.HasPrefix(b.Title, "r-") && strings.HasSuffix(b.Title, suffix) {
+				titles = append(titles, strings.TrimSuffix(b.Title, "-"+suffix))
+			}
+		}
+		return strings.Join(titles, ",")
+	}
+	if got := sorted(); got != "r-best,r-good,r-none" {
+		t.Errorf("QueryBooks by rating: got %s", got)
+	}
+
+	// Hidden reviews are listed, but not counted.
+	best5, err := db.FindReview(best, users[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.HideReview(best5.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if ratings, err := db.Ratings([]uint{best}); err != nil || len(ratings) != 0 {
+		t.Errorf("Ratings after hiding: got %+v, %v", ratings, err)
+	}
+	if got := sorted(); got != "r-good,r-best,r-none" {
+		t.Errorf("QueryBooks by rating after hiding: got %s", got)
+	}
+	if reviews, err := db.ListReviews(ReviewFilter{UserID: users[0]}); err != nil || len(reviews) != 2 || reviews[0].ID != best5.ID || !reviews[0].Hidden {
+		t.Errorf("ListReviews: got %+v, %v, want the newest first", reviews, err)
+	}
+	if reviews, err := db.ListReviews(ReviewFilter{UserID: users[0], Visible: true}); err != nil || len(reviews) != 1 {
+		t.Errorf("ListReviews of visible reviews: got %+v, %v", reviews, err)
+	}
+	if reviews, err := db.ListReviews(ReviewFilter{BookID: good, Limit: 1}); err != nil || len(reviews) != 1 {
+		t.Errorf("ListReviews with a limit: got %+v, %v", reviews, err)
+	}
+	// Editing a hidden review keeps it hidden.
+	again := &Review{BookID: best, UserID: users[0], Rating: 1, Created: later, Updated: later}
+	if _, err := db.SaveReview(again); err != nil || !again.Hidden {
+		t.Errorf("SaveReview of a hidden review: got %+v, %v", again, err)
+	}
+	if err := db.HideReview(0, true); !errors.Is(err, errNotFound) {
+		t.Errorf("HideReview of a missing review: got %v, want errNotFound", err)
+	}
+
+	if err := db.DeleteReview(first.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetReview(first.ID); !errors.Is(err, errNotFound) {
+		t.Errorf("GetReview after DeleteReview: got %v, want errNotFound", err)
+	}
+	if err := db.DeleteReview(first.ID); !errors.Is(err, errNotFound) {
+		t.Errorf("DeleteReview twice: got %v, want errNotFound", err)
+	}
+	// Reviews go with their book.
+	if err := db.DeleteBook(good); err != nil {
+		t.Fatal(err)
+	}
+	if reviews, err := db.ListReviews(ReviewFilter{BookID: good}); err != nil || len(reviews) != 0 {
+		t.Errorf("ListReviews of a deleted book: got %+v, %v", reviews, err)
 	}
 }
 
 func TestMemoryDB(t *testing.T) {
-	testDB(t, newMemoryDB())
+	db := newMemoryDB()
+	testDB(t, db)
+	testQueryBooks(t, db)
+	testUserDB(t, db)
+	testAuditLog(t, db)
+	testAuthorDB(t, db)
+	testLabels(t, db)
+	testSeriesDB(t, db)
+	testCollectionDB(t, db)
+	testCopyDB(t, db)
+	testLoanDB(t, db)
+	testDeleteLentCopy(t, db)
+	testHoldDB(t, db)
+	testReminderDB(t, db)
+	testReviewDB(t, db)
+}
+
+func TestCachedDB(t *testing.T) {
+	db := newCachedDB(newMemoryDB(), 10, time.Minute)
+	// Read through the cache first, so that testDB sees invalidation work.
+	db.ListBooks()
+	testDB(t, db)
+	testQueryBooks(t, db)
+	testLabels(t, db)
 }
 
 func TestMysqlDB(t *testing.T) {
@@ -103,4 +1347,17 @@ func TestMysqlDB(t *testing.T) {
 	}
 
 	testDB(t, db)
+	testQueryBooks(t, db)
+	testUserDB(t, db)
+	testAuditLog(t, db)
+	testAuthorDB(t, db)
+	testLabels(t, db)
+	testSeriesDB(t, db)
+	testCollectionDB(t, db)
+	testCopyDB(t, db)
+	testLoanDB(t, db)
+	testDeleteLentCopy(t, db)
+	testHoldDB(t, db)
+	testReminderDB(t, db)
+	testReviewDB(t, db)
 }
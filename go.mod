@@ -1,6 +1,6 @@
 module bookshelf
 
-go 1.14
+go 1.16
 
 require (
 	cloud.google.com/go v0.56.0
@@ -11,5 +11,6 @@ require (
 	github.com/gorilla/handlers v1.4.2
 	github.com/gorilla/mux v1.7.4
 	github.com/jinzhu/gorm v1.9.12
+	golang.org/x/image v0.0.0-20200430140353-33d19683fad8
 	google.golang.org/api v0.22.0
 )
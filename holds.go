@@ -0,0 +1,304 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// holdPickupWindow is how long a copy is kept for the user whose hold it
+// was allocated to.
+const holdPickupWindow = 3 * 24 * time.Hour
+
+// Statuses of holds. Holds wait in line until a copy is allocated to them,
+// which makes them ready, and are closed by the loan of the copy, by the
+// user cancelling them or by the pickup window passing.
+const (
+	holdWaiting   = "waiting"
+	holdReady     = "ready"
+	holdFulfilled = "fulfilled"
+	holdCancelled = "cancelled"
+	holdExpired   = "expired"
+)
+
+// Hold puts a user in the queue for a book which is out.
+type Hold struct {
+	ID     uint      `gorm:"column:id;primary_key" json:"id"`
+	BookID uint      `gorm:"column:book_id" json:"book_id"`
+	UserID uint      `gorm:"column:user_id" json:"user_id"`
+	Status string    `gorm:"column:status" json:"status"`
+	Placed time.Time `gorm:"column:placed_at" json:"placed"`
+	// CopyID is the copy kept for the user while the hold is ready.
+	CopyID uint `gorm:"column:copy_id" json:"copy_id,omitempty"`
+	// Expires is when a ready hold lapses unless the copy is picked up.
+	Expires *time.Time `gorm:"column:expires_at" json:"expires,omitempty"`
+	// Closed is when the hold was fulfilled, cancelled or expired.
+	Closed *time.Time `gorm:"column:closed_at" json:"closed,omitempty"`
+}
+
+// TableName tells gorm where holds live.
+func (Hold) TableName() string {
+	return "holds"
+}
+
+// Active reports whether the hold is waiting or ready.
+func (h *Hold) Active() bool {
+	return h.Status == holdWaiting || h.Status == holdReady
+}
+
+// Ready reports whether a copy is kept for the user.
+func (h *Hold) Ready() bool {
+	return h.Status == holdReady
+}
+
+// HoldFilter selects holds. Zero fields match all holds.
+type HoldFilter struct {
+	BookID uint
+	UserID uint
+	// Active only selects waiting and ready holds.
+	Active bool
+}
+
+func (f HoldFilter) match(h *Hold) bool {
+	return (f.BookID == 0 || h.BookID == f.BookID) &&
+		(f.UserID == 0 || h.UserID == f.UserID) &&
+		(!f.Active || h.Active())
+}
+
+// HoldDatabase provides thread-safe access to the holds on books. Copies
+// are allocated to the holds of their book first come, first served: when
+// checked in, when a hold is placed while a copy is free, and when the
+// hold a copy was kept for is cancelled or expires. Ready holds keep their
+// copy from being lent to others, see LoanDatabase.CheckOut, and are
+// fulfilled by lending any copy of the book to their user.
+type HoldDatabase interface {
+	// GetHold retrieves a hold by its ID.
+	GetHold(id uint) (*Hold, error)
+
+	// PlaceHold queues a user for a book, setting the ID and Status of
+	// h. It fails with errBadHold when the user holds or borrowed the
+	// book already, or the book has no copies which could be lent.
+	PlaceHold(h *Hold) (id uint, err error)
+
+	// AddHoldRecord adds a closed hold as it is, setting its ID. It
+	// restores the history of books which were deleted.
+	AddHoldRecord(h *Hold) (id uint, err error)
+
+	// CancelHold closes an active hold at the given time.
+	CancelHold(id uint, at time.Time) error
+
+	// ListHolds returns the holds selected by f, oldest first.
+	ListHolds(f HoldFilter) ([]*Hold, error)
+
+	// ExpireHolds closes the ready holds whose pickup window passed by
+	// now, returning them.
+	ExpireHolds(now time.Time) ([]*Hold, error)
+}
+
+var errNoHolds = errors.New("the configured database does not keep holds")
+
+// errBadHold is returned for holds which cannot be placed or cancelled.
+var errBadHold = errors.New("bad hold")
+
+// holdView is a hold with what it refers to, for templates.
+type holdView struct {
+	*Hold
+	Book *Book
+	User *User
+	// Position is the place of a waiting hold in the queue, from 1.
+	Position int
+}
+
+// holdViews looks up the books and users of holds and the positions of
+// those waiting.
+func (b *Bookshelf) holdViews(holds []*Hold) ([]holdView, error) {
+	views := make([]holdView, len(holds))
+	queues := make(map[uint][]*Hold)
+	for i, h := range holds {
+		v := holdView{Hold: h}
+		var err error
+		if v.Book, err = b.DB.GetBook(h.BookID); err != nil && !errors.Is(err, errNotFound) {
+			return nil, err
+		}
+		if b.Users != nil {
+			if v.User, err = b.Users.GetUser(h.UserID); err != nil && !errors.Is(err, errNotFound) {
+				return nil, err
+			}
+		}
+		if h.Status == holdWaiting {
+			queue, ok := queues[h.BookID]
+			if !ok {
+				if queue, err = b.Holds.ListHolds(HoldFilter{BookID: h.BookID, Active: true}); err != nil {
+					return nil, err
+				}
+				queues[h.BookID] = queue
+			}
+			v.Position = queuePosition(queue, h.ID)
+		}
+		views[i] = v
+	}
+	return views, nil
+}
+
+// queuePosition returns the place of the hold id among the waiting holds
+// of queue, from 1, or 0 when it is not waiting.
+func queuePosition(queue []*Hold, id uint) int {
+	n := 0
+	for _, h := range queue {
+		if h.Status != holdWaiting {
+			continue
+		}
+		n++
+		if h.ID == id {
+			return n
+		}
+	}
+	return 0
+}
+
+// bookHolds is what the page of a book shows about its holds.
+type bookHolds struct {
+	// Waiting is the length of the queue.
+	Waiting int
+	// Mine is the active hold of the signed-in user, if any.
+	Mine *holdView
+	// CanPlace is set when the user may place a hold.
+	CanPlace bool
+}
+
+// holdsOf returns the holds of a book for its page, or nil when the
+// database does not keep holds.
+func (b *Bookshelf) holdsOf(r *http.Request, book *Book) (*bookHolds, error) {
+	if b.Holds == nil {
+		return nil, nil
+	}
+	queue, err := b.Holds.ListHolds(HoldFilter{BookID: book.ID, Active: true})
+	if err != nil {
+		return nil, fmt.Errorf("could not list holds: %v", err)
+	}
+	bh := &bookHolds{}
+	u := currentUser(r)
+	for _, h := range queue {
+		if h.Status == holdWaiting {
+			bh.Waiting++
+		}
+		if u != nil && h.UserID == u.ID {
+			bh.Mine = &holdView{Hold: h, Book: book, User: u, Position: queuePosition(queue, h.ID)}
+		}
+	}
+	bh.CanPlace = bh.Mine == nil && (u != nil || (b.Users != nil && b.hasRole(r, RoleStaff)))
+	return bh, nil
+}
+
+// holdErrorf reports err, telling clients asking for missing books, holds
+// and users and placing holds which cannot be placed so.
+func (b *Bookshelf) holdErrorf(r *http.Request, err error) *appError {
+	e := b.appErrorf(r, err, "%v", err)
+	switch {
+	case errors.Is(err, errNotFound):
+		e.code = http.StatusNotFound
+	case errors.Is(err, errBadHold):
+		e.code = http.StatusConflict
+	case errors.Is(err, errBadLoan):
+		e.code = http.StatusBadRequest
+	}
+	return e
+}
+
+// placeHoldHandler queues the signed-in user for the book in the URL's
+// path. Staff may place holds for any user.
+func (b *Bookshelf) placeHoldHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if b.Holds == nil {
+		return b.appErrorf(r, errNoHolds, "%v", errNoHolds)
+	}
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil || id == 0 {
+		return b.holdErrorf(r, fmt.Errorf("%w: bad book ID %q", errBadLoan, mux.Vars(r)["id"]))
+	}
+	userID, err := b.borrowerFromForm(r)
+	if err != nil {
+		return b.holdErrorf(r, err)
+	}
+	h := &Hold{BookID: uint(id), UserID: userID, Placed: time.Now().UTC()}
+	if _, err := b.Holds.PlaceHold(h); err != nil {
+		return b.holdErrorf(r, err)
+	}
+	http.Redirect(w, r, fmt.Sprintf("/books/%d", h.BookID), http.StatusFound)
+	return nil
+}
+
+// cancelHoldHandler cancels the hold in the URL's path. Users cancel their
+// own holds, staff any.
+func (b *Bookshelf) cancelHoldHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if b.Holds == nil {
+		return b.appErrorf(r, errNoHolds, "%v", errNoHolds)
+	}
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil || id == 0 {
+		return b.holdErrorf(r, fmt.Errorf("%w: bad hold ID %q", errBadLoan, mux.Vars(r)["id"]))
+	}
+	h, err := b.Holds.GetHold(uint(id))
+	if err != nil {
+		return b.holdErrorf(r, err)
+	}
+	if u := currentUser(r); !b.hasRole(r, RoleStaff) && (u == nil || u.ID != h.UserID) {
+		return b.holdErrorf(r, fmt.Errorf("hold with ID %d %w", id, errNotFound))
+	}
+	if err := b.Holds.CancelHold(h.ID, time.Now().UTC()); err != nil {
+		return b.holdErrorf(r, err)
+	}
+	next := fmt.Sprintf("/books/%d", h.BookID)
+	if r.FormValue("next") == "loans" {
+		next = "/loans"
+	}
+	http.Redirect(w, r, next, http.StatusFound)
+	return nil
+}
+
+// holdExpiryInterval is how often expireHolds looks for lapsed holds.
+const holdExpiryInterval = 10 * time.Minute
+
+// expireHolds closes lapsed holds every interval until ctx is done, so
+// that their copies go to the next in line.
+func (b *Bookshelf) expireHolds(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			// Not a request, so holdWrites does not keep it from
+			// changing holds during a backup.
+			b.writes.RLock()
+			expired, err := b.Holds.ExpireHolds(now.UTC())
+			b.writes.RUnlock()
+			if err != nil {
+				log.Printf("holds: %v", err)
+				continue
+			}
+			for _, h := range expired {
+				log.Printf("holds: hold %d of user %d on book %d expired", h.ID, h.UserID, h.BookID)
+			}
+		}
+	}
+}
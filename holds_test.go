@@ -0,0 +1,174 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestHoldQueue(t *testing.T) {
+	m := newMockIssuer(t)
+	bs, srv := newOIDCBookshelf(t, m)
+
+	bookID, err := bs.DB.AddBook(&Book{Title: "Dune"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyID, err := bs.Copies.AddCopy(&Copy{BookID: bookID, Barcode: "0001", Condition: conditionGood})
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := fmt.Sprintf("%s/books/%d", srv.URL, bookID)
+	copyPage := fmt.Sprintf("%s/copies/%d", srv.URL, copyID)
+
+	signIn := func(sub string, groups ...interface{}) *http.Client {
+		t.Helper()
+		m.setClaims(map[string]interface{}{"sub": sub, "name": sub, "groups": groups})
+		c := newBrowser(t)
+		resp, err := c.Get(srv.URL + "/loans")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: GET /loans: got status %d", sub, resp.StatusCode)
+		}
+		return c
+	}
+	get := func(c *http.Client, url string) string {
+		t.Helper()
+		resp, err := c.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body)
+	}
+	post := func(c *http.Client, url string, form url.Values) int {
+		t.Helper()
+		resp, err := c.PostForm(url, form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	alice, bob, carol := signIn("alice"), signIn("bob"), signIn("carol")
+	staff := signIn("dave", "library-staff")
+
+	if code := post(alice, copyPage+":checkout", nil); code != http.StatusOK {
+		t.Fatalf("alice borrowing: got status %d", code)
+	}
+	if code := post(alice, page+"/holds", nil); code != http.StatusConflict {
+		t.Errorf("alice holding what she borrowed: got status %d, want 409", code)
+	}
+	for _, c := range []*http.Client{bob, carol} {
+		if code := post(c, page+"/holds", nil); code != http.StatusOK {
+			t.Fatalf("placing a hold: got status %d", code)
+		}
+	}
+	if code := post(bob, page+"/holds", nil); code != http.StatusConflict {
+		t.Errorf("bob holding twice: got status %d, want 409", code)
+	}
+	if body := get(carol, page); !strings.Contains(body, "You are number 2 in line.") {
+		t.Errorf("book page of carol does not show her place in line:\n%s", body)
+	}
+	if body := get(alice, page); !strings.Contains(body, "2 waiting in line.") {
+		t.Errorf("book page of alice does not show the queue:\n%s", body)
+	}
+	holds, _ := bs.Holds.ListHolds(HoldFilter{Active: true})
+	if len(holds) != 2 {
+		t.Fatalf("got holds %+v, want those of bob and carol", holds)
+	}
+	bobHold := fmt.Sprintf("%s/holds/%d", srv.URL, holds[0].ID)
+	if code := post(carol, bobHold+":cancel", nil); code != http.StatusNotFound {
+		t.Errorf("carol cancelling the hold of bob: got status %d, want 404", code)
+	}
+
+	// Returning the copy keeps it for bob, and only him.
+	if code := post(alice, copyPage+":checkin", nil); code != http.StatusOK {
+		t.Fatalf("alice returning: got status %d", code)
+	}
+	if body := get(bob, page); !strings.Contains(body, "A copy is kept for you until") {
+		t.Errorf("book page of bob does not show the copy kept for him:\n%s", body)
+	}
+	if body := get(bob, srv.URL+"/loans"); !strings.Contains(body, "ready for pickup until") {
+		t.Errorf("my loans of bob do not show the ready hold:\n%s", body)
+	}
+	if code := post(carol, copyPage+":checkout", nil); code != http.StatusConflict {
+		t.Errorf("carol borrowing the copy kept for bob: got status %d, want 409", code)
+	}
+	if body := get(staff, fmt.Sprintf("%s/books/%d/loans", srv.URL, bookID)); !strings.Contains(body, "number 1 in line") {
+		t.Errorf("loan history does not show the queue:\n%s", body)
+	}
+
+	// Cancelling passes the copy on.
+	if code := post(bob, bobHold+":cancel", nil); code != http.StatusOK {
+		t.Fatalf("bob cancelling: got status %d", code)
+	}
+	if code := post(bob, bobHold+":cancel", nil); code != http.StatusConflict {
+		t.Errorf("bob cancelling twice: got status %d, want 409", code)
+	}
+	if code := post(carol, copyPage+":checkout", nil); code != http.StatusOK {
+		t.Errorf("carol borrowing the copy kept for her: got status %d", code)
+	}
+	holds, _ = bs.Holds.ListHolds(HoldFilter{BookID: bookID})
+	if len(holds) != 2 || holds[0].Status != holdCancelled || holds[1].Status != holdFulfilled {
+		t.Errorf("got holds %+v, want the cancelled one of bob and the fulfilled one of carol", holds)
+	}
+}
+
+func TestCLIHolds(t *testing.T) {
+	c := newCLI(t)
+	c.mustRun("books", "add", "-title", "Dune")
+	c.mustRun("copies", "add", "-barcode", "0001", "1")
+	c.mustRun("users", "create", "-subject", "alice", "-role", "viewer")
+	c.mustRun("users", "create", "-subject", "bob", "-role", "viewer")
+	c.mustRun("loans", "checkout", "-user", "1", "0001")
+
+	if code, _, _ := c.run("holds", "place", "1"); code != exitUsage {
+		t.Errorf("holds place without -user: got exit code %d, want %d", code, exitUsage)
+	}
+	if code, _, _ := c.run("holds", "place", "-user", "2", "9"); code != exitNotFound {
+		t.Errorf("holds place on a missing book: got exit code %d, want %d", code, exitNotFound)
+	}
+	var h Hold
+	if err := json.Unmarshal([]byte(c.mustRun("holds", "place", "-user", "2", "1")), &h); err != nil {
+		t.Fatal(err)
+	}
+	if h.BookID != 1 || h.UserID != 2 || h.Status != holdWaiting {
+		t.Errorf("holds place: got %+v", h)
+	}
+	c.mustRun("loans", "checkin", "0001")
+	if out := c.mustRun("holds", "list", "-active"); !strings.Contains(out, `"status":"ready"`) {
+		t.Errorf("holds list after checkin: got %q", out)
+	}
+	if out := c.mustRun("holds", "expire"); out != "" {
+		t.Errorf("holds expire within the pickup window: got %q", out)
+	}
+	c.mustRun("holds", "cancel", "1")
+	if code, _, _ := c.run("holds", "cancel", "1"); code != exitError {
+		t.Errorf("holds cancel twice: got exit code %d, want %d", code, exitError)
+	}
+	if out := c.mustRun("holds", "list", "-user", "2"); !strings.Contains(out, `"status":"cancelled"`) {
+		t.Errorf("holds list -user: got %q", out)
+	}
+}
@@ -0,0 +1,355 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif" // Register GIF for image.Decode.
+	"image/jpeg"
+	_ "image/png" // Register PNG for image.Decode.
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	_ "golang.org/x/image/webp" // Register WebP for image.Decode.
+)
+
+// imageFormat describes a cover image format accepted for upload.
+type imageFormat struct {
+	Name        string // as reported by image.DecodeConfig.
+	ContentType string // as reported by http.DetectContentType.
+	Ext         string
+}
+
+// allowedImageFormats is the allow-list of cover image formats, keyed by name.
+var allowedImageFormats = map[string]imageFormat{
+	"jpeg": {Name: "jpeg", ContentType: "image/jpeg", Ext: ".jpg"},
+	"png":  {Name: "png", ContentType: "image/png", Ext: ".png"},
+	"gif":  {Name: "gif", ContentType: "image/gif", Ext: ".gif"},
+	"webp": {Name: "webp", ContentType: "image/webp", Ext: ".webp"},
+}
+
+// ImageLimits bounds the cover images accepted for upload.
+type ImageLimits struct {
+	MaxBytes  int64
+	MaxWidth  int
+	MaxHeight int
+}
+
+var defaultImageLimits = ImageLimits{
+	MaxBytes:  8 << 20,
+	MaxWidth:  4096,
+	MaxHeight: 4096,
+}
+
+var (
+	// errBadImage is wrapped by errors about unacceptable uploads.
+	errBadImage = errors.New("invalid cover image")
+	// errImageTooLarge is returned for images above ImageLimits.MaxBytes.
+	errImageTooLarge = errors.New("cover image too large")
+)
+
+// coverImage is an image which passed sanitizeImage.
+type coverImage struct {
+	Data   []byte
+	Format imageFormat
+	Width  int
+	Height int
+
+	img image.Image // decoded, for resizing.
+}
+
+// sanitizeImage reads an uploaded image and makes sure it is one of the
+// allowed formats, within limits and decodable. Whatever the client claims
+// about the file is ignored. Metadata such as EXIF is stripped from the
+// returned bytes.
+func sanitizeImage(r io.Reader, limits ImageLimits) (*coverImage, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, limits.MaxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limits.MaxBytes {
+		return nil, fmt.Errorf("%w: more than %d bytes", errImageTooLarge, limits.MaxBytes)
+	}
+
+	// Sniff the content, and make sure the decoder agrees with the sniffer
+	// so that polyglot files cannot slip through.
+	sniffed := http.DetectContentType(data)
+	var format imageFormat
+	for _, f := range allowedImageFormats {
+		if f.ContentType == sniffed {
+			format = f
+		}
+	}
+	if format.Name == "" {
+		return nil, fmt.Errorf("%w: %s is not an allowed image format", errBadImage, sniffed)
+	}
+
+	orientation := 0
+	switch format.Name {
+	case "jpeg":
+		// Stripping EXIF loses the orientation, so it is applied below.
+		orientation = jpegOrientation(data)
+		data, err = stripJPEG(data)
+	case "png":
+		data, err = stripPNG(data)
+	case "webp":
+		data, err = stripWebP(data)
+	case "gif":
+		// GIF cannot carry EXIF.
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadImage, err)
+	}
+
+	cfg, name, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || name != format.Name {
+		return nil, fmt.Errorf("%w: %s does not decode", errBadImage, sniffed)
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width > limits.MaxWidth || cfg.Height > limits.MaxHeight {
+		return nil, fmt.Errorf("%w: %dx%d exceeds %dx%d", errBadImage, cfg.Width, cfg.Height, limits.MaxWidth, limits.MaxHeight)
+	}
+
+	// The dimensions are known to be sane, so decoding is safe now.
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadImage, err)
+	}
+
+	c := &coverImage{Data: data, Format: format, Width: cfg.Width, Height: cfg.Height, img: img}
+	if orientation > 1 {
+		img = orient(img, orientation)
+		c.img = img
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
+			return nil, err
+		}
+		c.Data = buf.Bytes()
+		c.Width, c.Height = img.Bounds().Dx(), img.Bounds().Dy()
+	}
+	return c, nil
+}
+
+// stripJPEG removes metadata segments (EXIF, XMP, comments, ...) from a JPEG,
+// keeping those which affect how it renders.
+func stripJPEG(data []byte) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, errors.New("jpeg: missing SOI marker")
+	}
+	out := []byte{0xFF, 0xD8}
+	i := 2
+	for {
+		if i+4 > len(data) || data[i] != 0xFF {
+			return nil, errors.New("jpeg: malformed segment")
+		}
+		marker := data[i+1]
+		if marker == 0xFF { // Fill byte.
+			i++
+			continue
+		}
+		if marker == 0xDA { // Start of scan: entropy coded data follows.
+			return append(out, data[i:]...), nil
+		}
+		n := int(binary.BigEndian.Uint16(data[i+2:]))
+		end := i + 2 + n
+		if n < 2 || end > len(data) {
+			return nil, errors.New("jpeg: truncated segment")
+		}
+		seg := data[i:end]
+		keep := true
+		switch {
+		case marker == 0xFE: // COM
+			keep = false
+		case marker >= 0xE0 && marker <= 0xEF: // APPn
+			switch {
+			case marker == 0xE0: // JFIF
+			case marker == 0xEE: // Adobe, needed for the color transform.
+			case marker == 0xE2 && bytes.HasPrefix(seg[4:], []byte("ICC_PROFILE\x00")):
+			default:
+				keep = false
+			}
+		}
+		if keep {
+			out = append(out, seg...)
+		}
+		i = end
+	}
+}
+
+// jpegOrientation returns the EXIF orientation (1-8) of a JPEG, or 0.
+func jpegOrientation(data []byte) int {
+	i := 2
+	for i+4 <= len(data) && data[i] == 0xFF {
+		marker := data[i+1]
+		n := int(binary.BigEndian.Uint16(data[i+2:]))
+		end := i + 2 + n
+		if marker == 0xDA || n < 2 || end > len(data) {
+			return 0
+		}
+		if marker == 0xE1 && bytes.HasPrefix(data[i+4:end], []byte("Exif\x00\x00")) {
+			return exifOrientation(data[i+10 : end])
+		}
+		i = end
+	}
+	return 0
+}
+
+// exifOrientation reads the orientation tag from IFD0 of a TIFF structure.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+	var bo binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		bo = binary.LittleEndian
+	case "MM":
+		bo = binary.BigEndian
+	default:
+		return 0
+	}
+	ifd := int(bo.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 0
+	}
+	count := int(bo.Uint16(tiff[ifd:]))
+	for k := 0; k < count; k++ {
+		e := ifd + 2 + 12*k
+		if e+12 > len(tiff) {
+			return 0
+		}
+		if bo.Uint16(tiff[e:]) == 0x0112 {
+			o := int(bo.Uint16(tiff[e+8:]))
+			if o < 1 || o > 8 {
+				return 0
+			}
+			return o
+		}
+	}
+	return 0
+}
+
+// orient applies an EXIF orientation to img.
+func orient(img image.Image, o int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	// Orientations 5-8 swap width and height.
+	dw, dh := w, h
+	if o >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	src := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch o {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			default:
+				dx, dy = x, y
+			}
+			dst.Set(dx, dy, src.At(x, y))
+		}
+	}
+	return dst
+}
+
+// pngKeep lists the PNG chunks kept by stripPNG. Everything else, notably
+// text, time and EXIF chunks, is dropped.
+var pngKeep = map[string]bool{
+	"IHDR": true, "PLTE": true, "IDAT": true, "IEND": true,
+	"tRNS": true, "gAMA": true, "cHRM": true, "sRGB": true, "iCCP": true,
+	"sBIT": true, "bKGD": true, "pHYs": true,
+}
+
+// stripPNG removes metadata chunks from a PNG.
+func stripPNG(data []byte) ([]byte, error) {
+	const sig = "\x89PNG\r\n\x1a\n"
+	if !bytes.HasPrefix(data, []byte(sig)) {
+		return nil, errors.New("png: missing signature")
+	}
+	out := []byte(sig)
+	for i := len(sig); i < len(data); {
+		if i+12 > len(data) {
+			return nil, errors.New("png: truncated chunk")
+		}
+		n := int(binary.BigEndian.Uint32(data[i:]))
+		end := i + 12 + n
+		if n < 0 || end > len(data) {
+			return nil, errors.New("png: truncated chunk")
+		}
+		if pngKeep[string(data[i+4:i+8])] {
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+	return out, nil
+}
+
+// stripWebP removes the EXIF and XMP chunks from a WebP and clears the
+// matching flags of its VP8X header. A VP8X header left without any flags is
+// dropped, turning the file into a simple WebP.
+func stripWebP(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errors.New("webp: missing RIFF header")
+	}
+	out := append([]byte(nil), data[:12]...)
+	for i := 12; i < len(data); {
+		if i+8 > len(data) {
+			return nil, errors.New("webp: truncated chunk")
+		}
+		fourcc := string(data[i : i+4])
+		n := int(binary.LittleEndian.Uint32(data[i+4:]))
+		end := i + 8 + n + n&1 // Chunks are padded to an even size.
+		if n < 0 || end > len(data) {
+			return nil, errors.New("webp: truncated chunk")
+		}
+		switch fourcc {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			chunk := append([]byte(nil), data[i:end]...)
+			if len(chunk) < 9 {
+				return nil, errors.New("webp: truncated VP8X chunk")
+			}
+			chunk[8] &^= 0x08 | 0x04 // EXIF and XMP flags.
+			if chunk[8] != 0 {
+				out = append(out, chunk...)
+			}
+		default:
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out, nil
+}
@@ -0,0 +1,207 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"testing"
+)
+
+// tinyWebP is a 1x1 lossless WebP.
+const tinyWebP = "UklGRhoAAABXRUJQVlA4TA0AAAAvAAAAEAcQERGIiP4HAA=="
+
+func testImage(w, h int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 10), uint8(y * 10), 200, 255})
+		}
+	}
+	return img
+}
+
+func encodePNG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage(w, h)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func encodeJPEG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testImage(w, h), nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// withEXIF inserts an APP1 EXIF segment with the given orientation and a
+// comment segment right after the SOI marker of a JPEG.
+func withEXIF(jpg []byte, orientation uint16) []byte {
+	var tiff bytes.Buffer
+	tiff.WriteString("MM\x00\x2a")
+	binary.Write(&tiff, binary.BigEndian, uint32(8)) // IFD0 offset.
+	binary.Write(&tiff, binary.BigEndian, uint16(1)) // One entry.
+	binary.Write(&tiff, binary.BigEndian, []uint16{0x0112, 3})
+	binary.Write(&tiff, binary.BigEndian, uint32(1))
+	binary.Write(&tiff, binary.BigEndian, []uint16{orientation, 0})
+	binary.Write(&tiff, binary.BigEndian, uint32(0))
+	tiff.WriteString("GPS 35.6586N 139.7454E")
+
+	app1 := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	com := []byte("secret comment")
+
+	var out bytes.Buffer
+	out.Write(jpg[:2])
+	out.Write([]byte{0xFF, 0xE1})
+	binary.Write(&out, binary.BigEndian, uint16(len(app1)+2))
+	out.Write(app1)
+	out.Write([]byte{0xFF, 0xFE})
+	binary.Write(&out, binary.BigEndian, uint16(len(com)+2))
+	out.Write(com)
+	out.Write(jpg[2:])
+	return out.Bytes()
+}
+
+func pngChunk(typ string, data []byte) []byte {
+	var c bytes.Buffer
+	binary.Write(&c, binary.BigEndian, uint32(len(data)))
+	c.WriteString(typ)
+	c.Write(data)
+	binary.Write(&c, binary.BigEndian, crc32.ChecksumIEEE(append([]byte(typ), data...)))
+	return c.Bytes()
+}
+
+func riffChunk(fourcc string, data []byte) []byte {
+	var c bytes.Buffer
+	c.WriteString(fourcc)
+	binary.Write(&c, binary.LittleEndian, uint32(len(data)))
+	c.Write(data)
+	if len(data)%2 == 1 {
+		c.WriteByte(0)
+	}
+	return c.Bytes()
+}
+
+func TestSanitizeImageStripsMetadata(t *testing.T) {
+	webp, err := base64.StdEncoding.DecodeString(tinyWebP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Wrap the bitstream in an extended WebP carrying EXIF.
+	vp8x := []byte{0x08, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	ext := riffChunk("VP8X", vp8x)
+	ext = append(ext, riffChunk("EXIF", []byte("secret exif"))...)
+	ext = append(ext, webp[12:]...)
+	extWebP := append([]byte("RIFF\x00\x00\x00\x00WEBP"), ext...)
+	binary.LittleEndian.PutUint32(extWebP[4:], uint32(len(extWebP)-8))
+
+	pngData := encodePNG(t, 4, 3)
+	iend := len(pngData) - 12
+	textPNG := append(append(append([]byte(nil), pngData[:iend]...),
+		pngChunk("tEXt", []byte("Comment\x00secret text"))...), pngData[iend:]...)
+
+	tests := []struct {
+		name   string
+		data   []byte
+		format string
+		w, h   int
+	}{
+		{"jpeg", withEXIF(encodeJPEG(t, 4, 3), 1), "jpeg", 4, 3},
+		{"jpeg rotated", withEXIF(encodeJPEG(t, 4, 3), 6), "jpeg", 3, 4},
+		{"png", textPNG, "png", 4, 3},
+		{"webp", webp, "webp", 1, 1},
+		{"webp with exif", extWebP, "webp", 1, 1},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			img, err := sanitizeImage(bytes.NewReader(tc.data), defaultImageLimits)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if img.Format.Name != tc.format {
+				t.Errorf("got format %q, want %q", img.Format.Name, tc.format)
+			}
+			if img.Width != tc.w || img.Height != tc.h {
+				t.Errorf("got %dx%d, want %dx%d", img.Width, img.Height, tc.w, tc.h)
+			}
+			if bytes.Contains(img.Data, []byte("secret")) || bytes.Contains(img.Data, []byte("GPS")) {
+				t.Error("metadata was not stripped")
+			}
+			cfg, _, err := image.DecodeConfig(bytes.NewReader(img.Data))
+			if err != nil {
+				t.Fatalf("sanitized image does not decode: %v", err)
+			}
+			if cfg.Width != tc.w || cfg.Height != tc.h {
+				t.Errorf("sanitized image is %dx%d, want %dx%d", cfg.Width, cfg.Height, tc.w, tc.h)
+			}
+		})
+	}
+}
+
+func TestSanitizeImageRejects(t *testing.T) {
+	pngData := encodePNG(t, 40, 30)
+	tests := []struct {
+		name   string
+		data   []byte
+		limits ImageLimits
+		want   error
+	}{
+		{"html", []byte("<html><script>alert(1)</script></html>"), defaultImageLimits, errBadImage},
+		{"svg", []byte(`<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`), defaultImageLimits, errBadImage},
+		{"exe", append([]byte("MZ\x90\x00"), make([]byte, 64)...), defaultImageLimits, errBadImage},
+		{"truncated", pngData[:len(pngData)/2], defaultImageLimits, errBadImage},
+		{"too wide", pngData, ImageLimits{MaxBytes: 1 << 20, MaxWidth: 39, MaxHeight: 100}, errBadImage},
+		{"too large", pngData, ImageLimits{MaxBytes: 10, MaxWidth: 100, MaxHeight: 100}, errImageTooLarge},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := sanitizeImage(bytes.NewReader(tc.data), tc.limits)
+			if !errors.Is(err, tc.want) {
+				t.Errorf("got err %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestUploadRejectsNonImage(t *testing.T) {
+	var body bytes.Buffer
+	m := multipart.NewWriter(&body)
+	m.WriteField("title", "evil")
+	fw, _ := m.CreateFormFile("image", "cover.png")
+	fw.Write([]byte("<html><script>alert(1)</script></html>"))
+	m.Close()
+
+	resp, err := wt.Post("/books", m.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusBadRequest; got != want {
+		t.Errorf("got status %d, want %d", got, want)
+	}
+}
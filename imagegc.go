@@ -0,0 +1,157 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+// defaultImageGCGrace protects images which were uploaded but whose book
+// has not been saved yet.
+const defaultImageGCGrace = 24 * time.Hour
+
+// imageGCReport describes what a run of collectImages found and did.
+type imageGCReport struct {
+	DryRun     bool
+	Scanned    int
+	Referenced int
+	// Young are unreferenced objects still within the grace period.
+	Young []ImageObject
+	// Deleted are the unreferenced objects which were deleted, or would
+	// have been in a dry run.
+	Deleted []ImageObject
+	// Failed maps from object name to the error deleting it.
+	Failed map[string]error
+}
+
+// Write prints the report in a human readable form.
+func (r *imageGCReport) Write(w io.Writer) {
+	verb := "deleted"
+	if r.DryRun {
+		verb = "would delete"
+	}
+	for _, o := range r.Deleted {
+		if err, ok := r.Failed[o.Name]; ok {
+			fmt.Fprintf(w, "failed  %s: %v\n", o.Name, err)
+			continue
+		}
+		fmt.Fprintf(w, "%s %s (%d bytes, created %s)\n", verb, o.Name, o.Size, o.Created.Format(time.RFC3339))
+	}
+	for _, o := range r.Young {
+		fmt.Fprintf(w, "kept    %s (unreferenced, created %s)\n", o.Name, o.Created.Format(time.RFC3339))
+	}
+	var bytes int64
+	for _, o := range r.Deleted {
+		bytes += o.Size
+	}
+	fmt.Fprintf(w, "%d objects scanned, %d referenced, %d in grace period, %d %s (%d bytes), %d failed\n",
+		r.Scanned, r.Referenced, len(r.Young), len(r.Deleted)-len(r.Failed), verb, bytes, len(r.Failed))
+}
+
+// referencedImages returns the names of the objects used by the books of
+// the database: their covers and the resized variants of those.
+func (b *Bookshelf) referencedImages() (map[string]bool, error) {
+	books, err := b.DB.ListBooks()
+	if err != nil {
+		return nil, fmt.Errorf("could not list books: %v", err)
+	}
+	refs := make(map[string]bool)
+	for _, book := range books {
+		name, ok := b.Images.Name(book.ImageURL)
+		if !ok {
+			continue
+		}
+		refs[name] = true
+		for _, size := range b.imageSizes {
+			refs[variantName(name, size.Name)] = true
+		}
+	}
+	return refs, nil
+}
+
+// collectImages deletes the objects of the image store which no book refers
+// to and which are older than grace. With dryRun nothing is deleted. Covers
+// dropped by their book are only ever deleted here: objects are shared
+// between books uploading the same cover, so their references are counted
+// again before deleting them. The grace period covers covers uploaded for
+// books not saved yet.
+func (b *Bookshelf) collectImages(ctx context.Context, grace time.Duration, dryRun bool) (*imageGCReport, error) {
+	if b.Images == nil {
+		return nil, errNoImageStore
+	}
+	// List the objects first: anything uploaded afterwards is young anyway,
+	// and books saved meanwhile are seen by referencedImages.
+	objects, err := b.Images.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not list images: %v", err)
+	}
+	refs, err := b.referencedImages()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &imageGCReport{
+		DryRun:  dryRun,
+		Scanned: len(objects),
+		Failed:  make(map[string]error),
+	}
+	cutoff := time.Now().Add(-grace)
+	var unused []ImageObject
+	for _, o := range objects {
+		switch {
+		case refs[o.Name]:
+			report.Referenced++
+		case o.Created.After(cutoff):
+			report.Young = append(report.Young, o)
+		default:
+			unused = append(unused, o)
+		}
+	}
+	if dryRun {
+		report.Deleted = unused
+		return report, nil
+	}
+	if len(unused) == 0 {
+		return report, nil
+	}
+
+	// Books are saved with their cover while holding writes, so with
+	// writes held here a cover is either in use by now or uploaded again
+	// only after it was deleted.
+	b.writes.Lock()
+	defer b.writes.Unlock()
+	if refs, err = b.referencedImages(); err != nil {
+		return report, err
+	}
+	for _, o := range unused {
+		if refs[o.Name] {
+			report.Referenced++
+			continue
+		}
+		// A cover uploaded again since the listing was written anew,
+		// for a book which may not be saved yet.
+		if cur, err := b.Images.Stat(ctx, o.Name); err == nil && cur.Created.After(cutoff) {
+			report.Young = append(report.Young, cur)
+			continue
+		}
+		report.Deleted = append(report.Deleted, o)
+		if err := b.Images.Delete(ctx, o.Name); err != nil {
+			report.Failed[o.Name] = err
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,229 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCollectImages(t *testing.T) {
+	bs, _ := newTestBookshelf(t)
+	ctx := context.Background()
+	store := bs.Images.(*memoryImageStore)
+
+	put := func(name string, age time.Duration) string {
+		url, err := store.Put(ctx, name, "image/jpeg", []byte("x"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		store.objects[name].created = time.Now().Add(-age)
+		return url
+	}
+	url := put("kept.jpg", 48*time.Hour)
+	put("kept_thumb.jpg", 48*time.Hour)
+	put("kept_detail.jpg", 48*time.Hour)
+	put("orphan.jpg", 48*time.Hour)
+	put("orphan_thumb.jpg", 48*time.Hour)
+	put("fresh.jpg", time.Minute)
+	if _, err := bs.DB.AddBook(&Book{Title: "kept", ImageURL: url}); err != nil {
+		t.Fatal(err)
+	}
+
+	names := func() string {
+		objects, _ := store.List(ctx)
+		var n []string
+		for _, o := range objects {
+			n = append(n, o.Name)
+		}
+		return strings.Join(n, ",")
+	}
+	const all = "fresh.jpg,kept.jpg,kept_detail.jpg,kept_thumb.jpg,orphan.jpg,orphan_thumb.jpg"
+
+	report, err := bs.collectImages(ctx, defaultImageGCGrace, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(); got != all {
+		t.Errorf("dry run deleted objects: got %s", got)
+	}
+	var out bytes.Buffer
+	report.Write(&out)
+	if !strings.Contains(out.String(), "would delete orphan.jpg") ||
+		!strings.Contains(out.String(), "6 objects scanned, 3 referenced, 1 in grace period, 2 would delete") {
+		t.Errorf("unexpected report:\n%s", out.String())
+	}
+
+	if _, err := bs.collectImages(ctx, defaultImageGCGrace, false); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := names(), "fresh.jpg,kept.jpg,kept_detail.jpg,kept_thumb.jpg"; got != want {
+		t.Errorf("after collection: got %s, want %s", got, want)
+	}
+}
+
+func TestContentAddressedCovers(t *testing.T) {
+	bs, srv := newTestBookshelf(t)
+	ctx := context.Background()
+	cover := encodePNG(t, 300, 200)
+
+	for _, title := range []string{"first", "second"} {
+		resp := postBook(t, srv.URL, title, "cover.png", cover)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: got status %d, want 200", title, resp.StatusCode)
+		}
+	}
+	books, err := bs.DB.ListBooks()
+	if err != nil || len(books) != 2 {
+		t.Fatalf("ListBooks: got %d books, %v", len(books), err)
+	}
+	if books[0].ImageURL != books[1].ImageURL {
+		t.Fatalf("same cover stored twice: %s and %s", books[0].ImageURL, books[1].ImageURL)
+	}
+	name, _ := bs.Images.Name(books[0].ImageURL)
+	if len(strings.TrimSuffix(name, ".png")) != 64 {
+		t.Errorf("cover name %q is not a SHA-256", name)
+	}
+	if objects, _ := bs.Images.List(ctx); len(objects) != 1+len(defaultImageSizes) {
+		t.Errorf("got %d objects, want the cover and its variants", len(objects))
+	}
+
+	resp, err := http.Get(srv.URL + books[0].ImageURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get("Cache-Control"); !strings.Contains(got, "immutable") {
+		t.Errorf("got Cache-Control %q, want immutable", got)
+	}
+
+	del := func(id uint) {
+		resp, err := http.Post(fmt.Sprintf("%s/books/%d:delete", srv.URL, id), "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	del(books[0].ID)
+	if _, err := bs.Images.Stat(ctx, name); err != nil {
+		t.Errorf("cover still in use was deleted: %v", err)
+	}
+	del(books[1].ID)
+	// Unused covers are left to collectImages.
+	if _, err := bs.Images.Stat(ctx, name); err != nil {
+		t.Errorf("cover was deleted before its grace period: %v", err)
+	}
+	if _, err := bs.collectImages(ctx, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	if objects, _ := bs.Images.List(ctx); len(objects) != 0 {
+		t.Errorf("unused cover was kept: %+v", objects)
+	}
+}
+
+func TestStoreCoverRestartsGrace(t *testing.T) {
+	bs, _ := newTestBookshelf(t)
+	ctx := context.Background()
+	store := bs.Images.(*memoryImageStore)
+	cover := encodePNG(t, 300, 200)
+
+	if _, err := bs.storeCover(ctx, bytes.NewReader(cover)); err != nil {
+		t.Fatal(err)
+	}
+	for _, o := range store.objects {
+		o.created = time.Now().Add(-2 * time.Hour)
+	}
+	// The same cover uploaded for a book not saved yet must outlive a
+	// collection with a grace period shorter than the age of the object.
+	url, err := bs.storeCover(ctx, bytes.NewReader(cover))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := bs.collectImages(ctx, time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Deleted) != 0 {
+		t.Errorf("collected the cover uploaded again: %+v", report.Deleted)
+	}
+	name, _ := bs.Images.Name(url)
+	if _, err := bs.Images.Stat(ctx, name); err != nil {
+		t.Errorf("cover uploaded again: %v", err)
+	}
+}
+
+// statHookStore calls afterStat once, after the first Stat.
+type statHookStore struct {
+	ImageStore
+	once      sync.Once
+	afterStat func()
+}
+
+func (s *statHookStore) Stat(ctx context.Context, name string) (ImageObject, error) {
+	o, err := s.ImageStore.Stat(ctx, name)
+	s.once.Do(s.afterStat)
+	return o, err
+}
+
+func TestCollectImagesRace(t *testing.T) {
+	bs, srv := newTestBookshelf(t)
+	ctx := context.Background()
+	store := bs.Images.(*memoryImageStore)
+	cover := encodePNG(t, 300, 200)
+
+	url, err := bs.storeCover(ctx, bytes.NewReader(cover))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, o := range store.objects {
+		o.created = time.Now().Add(-48 * time.Hour)
+	}
+
+	// A book is saved with the unused cover while it is being collected.
+	saved := make(chan int, 1)
+	bs.Images = &statHookStore{ImageStore: store, afterStat: func() {
+		go func() {
+			resp := postBook(t, srv.URL, "again", "cover.png", cover)
+			resp.Body.Close()
+			saved <- resp.StatusCode
+		}()
+		select {
+		case code := <-saved:
+			saved <- code
+		case <-time.After(200 * time.Millisecond):
+		}
+	}}
+	if _, err := bs.collectImages(ctx, time.Hour, false); err != nil {
+		t.Fatal(err)
+	}
+	if code := <-saved; code != http.StatusOK {
+		t.Fatalf("saving the book: got status %d, want 200", code)
+	}
+
+	books, err := bs.DB.ListBooks()
+	if err != nil || len(books) != 1 || books[0].ImageURL != url {
+		t.Fatalf("ListBooks: got %+v, %v", books, err)
+	}
+	name, _ := bs.Images.Name(url)
+	if _, err := bs.Images.Stat(ctx, name); err != nil {
+		t.Errorf("cover in use was collected: %v", err)
+	}
+}
@@ -0,0 +1,329 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// ImageStore stores cover images and serves them to browsers.
+type ImageStore interface {
+	// Put stores data under name and returns its public URL.
+	Put(ctx context.Context, name, contentType string, data []byte) (url string, err error)
+
+	// Get returns the content of the object with the given name.
+	Get(ctx context.Context, name string) ([]byte, error)
+
+	// Delete removes the object with the given name.
+	Delete(ctx context.Context, name string) error
+
+	// Stat describes the object with the given name. It returns
+	// errImageNotFound if there is none.
+	Stat(ctx context.Context, name string) (ImageObject, error)
+
+	// List returns all objects of the store.
+	List(ctx context.Context) ([]ImageObject, error)
+
+	// Name returns the name of the object served at url, and false if url
+	// does not point into the store.
+	Name(url string) (string, bool)
+
+	// URL returns the public URL of the object with the given name.
+	URL(name string) string
+}
+
+// ImageObject describes an object of an ImageStore.
+type ImageObject struct {
+	Name    string
+	Size    int64
+	Created time.Time
+}
+
+// immutableCacheControl is sent with every object: names are derived from
+// the content, so an object never changes once stored.
+const immutableCacheControl = "public, max-age=31536000, immutable"
+
+var errImageNotFound = errors.New("image not found")
+
+// contentName returns the name of an object holding data: the SHA-256 of
+// the bytes, with the extension ext.
+func contentName(data []byte, ext string) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]) + ext
+}
+
+// gcsImageStore keeps images in a Cloud Storage bucket.
+type gcsImageStore struct {
+	bucket     *storage.BucketHandle
+	bucketName string
+}
+
+var _ ImageStore = &gcsImageStore{}
+
+// newGCSImageStore creates an ImageStore backed by the named bucket.
+func newGCSImageStore(ctx context.Context, bucketName string) (*gcsImageStore, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("gcs: %v", err)
+	}
+	return &gcsImageStore{
+		bucket:     client.Bucket(bucketName),
+		bucketName: bucketName,
+	}, nil
+}
+
+// [START getting_started_bookshelf_storage]
+
+// Put stores data under name and returns its public URL.
+func (s *gcsImageStore) Put(ctx context.Context, name, contentType string, data []byte) (string, error) {
+	if _, err := s.bucket.Attrs(ctx); err != nil {
+		if err == storage.ErrBucketNotExist {
+			return "", fmt.Errorf("bucket %q does not exist", s.bucketName)
+		}
+		return "", fmt.Errorf("could not get bucket: %v", err)
+	}
+
+	w := s.bucket.Object(name).NewWriter(ctx)
+
+	// Warning: storage.AllUsers gives public read access to anyone.
+	w.ACL = []storage.ACLRule{{Entity: storage.AllUsers, Role: storage.RoleReader}}
+	w.ContentType = contentType
+
+	w.CacheControl = immutableCacheControl
+
+	if _, err := w.Write(data); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return s.URL(name), nil
+}
+
+// [END getting_started_bookshelf_storage]
+
+// Get returns the content of the object with the given name.
+func (s *gcsImageStore) Get(ctx context.Context, name string) ([]byte, error) {
+	r, err := s.bucket.Object(name).NewReader(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("gcs: %v", err)
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// Delete removes the object with the given name.
+func (s *gcsImageStore) Delete(ctx context.Context, name string) error {
+	err := s.bucket.Object(name).Delete(ctx)
+	if err == storage.ErrObjectNotExist {
+		return errImageNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("gcs: %v", err)
+	}
+	return nil
+}
+
+// Stat describes the object with the given name.
+func (s *gcsImageStore) Stat(ctx context.Context, name string) (ImageObject, error) {
+	attrs, err := s.bucket.Object(name).Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		return ImageObject{}, errImageNotFound
+	}
+	if err != nil {
+		return ImageObject{}, fmt.Errorf("gcs: %v", err)
+	}
+	return ImageObject{Name: attrs.Name, Size: attrs.Size, Created: attrs.Created}, nil
+}
+
+// List returns all objects of the bucket.
+func (s *gcsImageStore) List(ctx context.Context) ([]ImageObject, error) {
+	var objects []ImageObject
+	it := s.bucket.Objects(ctx, nil)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return objects, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("gcs: %v", err)
+		}
+		objects = append(objects, ImageObject{
+			Name:    attrs.Name,
+			Size:    attrs.Size,
+			Created: attrs.Created,
+		})
+	}
+}
+
+const gcsPublicURL = "https://storage.googleapis.com/%s/%s"
+
+// URL returns the public URL of the object with the given name.
+func (s *gcsImageStore) URL(name string) string {
+	return fmt.Sprintf(gcsPublicURL, s.bucketName, name)
+}
+
+// Name returns the name of the object served at url.
+func (s *gcsImageStore) Name(url string) (string, bool) {
+	prefix := s.URL("")
+	if !strings.HasPrefix(url, prefix) || url == prefix {
+		return "", false
+	}
+	return strings.TrimPrefix(url, prefix), true
+}
+
+// memoryImageStore keeps images in memory and serves them itself under
+// /images/. It is meant for tests and trying out the bookshelf.
+type memoryImageStore struct {
+	mu      sync.Mutex
+	objects map[string]*memoryObject // maps from name to object.
+}
+
+type memoryObject struct {
+	data        []byte
+	contentType string
+	created     time.Time
+}
+
+var _ ImageStore = &memoryImageStore{}
+
+func newMemoryImageStore() *memoryImageStore {
+	return &memoryImageStore{
+		objects: make(map[string]*memoryObject),
+	}
+}
+
+const memoryImagePrefix = "/images/"
+
+// Put stores data under name and returns its public URL.
+func (s *memoryImageStore) Put(ctx context.Context, name, contentType string, data []byte) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.objects[name] = &memoryObject{
+		data:        append([]byte(nil), data...),
+		contentType: contentType,
+		created:     time.Now(),
+	}
+	return s.URL(name), nil
+}
+
+// Get returns the content of the object with the given name.
+func (s *memoryImageStore) Get(ctx context.Context, name string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, ok := s.objects[name]
+	if !ok {
+		return nil, fmt.Errorf("memorystore: no object %q", name)
+	}
+	return append([]byte(nil), o.data...), nil
+}
+
+// Delete removes the object with the given name.
+func (s *memoryImageStore) Delete(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.objects[name]; !ok {
+		return errImageNotFound
+	}
+	delete(s.objects, name)
+	return nil
+}
+
+// Stat describes the object with the given name.
+func (s *memoryImageStore) Stat(ctx context.Context, name string) (ImageObject, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, ok := s.objects[name]
+	if !ok {
+		return ImageObject{}, errImageNotFound
+	}
+	return ImageObject{Name: name, Size: int64(len(o.data)), Created: o.created}, nil
+}
+
+// List returns all objects of the store, ordered by name.
+func (s *memoryImageStore) List(ctx context.Context) ([]ImageObject, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var objects []ImageObject
+	for name, o := range s.objects {
+		objects = append(objects, ImageObject{
+			Name:    name,
+			Size:    int64(len(o.data)),
+			Created: o.created,
+		})
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Name < objects[j].Name
+	})
+	return objects, nil
+}
+
+// URL returns the public URL of the object with the given name.
+func (s *memoryImageStore) URL(name string) string {
+	return memoryImagePrefix + name
+}
+
+// Name returns the name of the object served at url.
+func (s *memoryImageStore) Name(url string) (string, bool) {
+	if !strings.HasPrefix(url, memoryImagePrefix) || url == memoryImagePrefix {
+		return "", false
+	}
+	return strings.TrimPrefix(url, memoryImagePrefix), true
+}
+
+// ServeHTTP serves the objects of the store.
+func (s *memoryImageStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name, _ := s.Name(r.URL.Path)
+	s.mu.Lock()
+	o, ok := s.objects[name]
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", o.contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", immutableCacheControl)
+	w.Write(o.data)
+}
+
+// imagesHandler serves /images/ when the image store serves its own objects.
+func (b *Bookshelf) imagesHandler(w http.ResponseWriter, r *http.Request) {
+	h, ok := b.Images.(http.Handler)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	h.ServeHTTP(w, r)
+}
+
+var errNoImageStore = errors.New("image store is missing: set GCS_BUCKET or IMAGE_STORE")
@@ -0,0 +1,356 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultGenres is the genre vocabulary a new database starts with. The
+// migration creating the genres table inserts the same names; more are
+// added with "bookshelf genres add".
+var defaultGenres = []string{
+	"Fiction",
+	"Fantasy",
+	"Science fiction",
+	"Mystery",
+	"Thriller",
+	"Romance",
+	"Horror",
+	"Historical fiction",
+	"Poetry",
+	"Drama",
+	"Comics",
+	"Children's",
+	"Young adult",
+	"Biography",
+	"History",
+	"Science",
+	"Philosophy",
+	"Religion",
+	"Travel",
+	"Cooking",
+	"Art",
+	"Reference",
+}
+
+// genre is a name of the genre vocabulary.
+type genre struct {
+	ID   uint   `gorm:"column:id;primary_key"`
+	Name string `gorm:"column:name"`
+}
+
+// TableName tells gorm where the genre vocabulary lives.
+func (genre) TableName() string {
+	return "genres"
+}
+
+// bookGenre links a book to a genre.
+type bookGenre struct {
+	BookID  uint `gorm:"column:book_id;primary_key"`
+	GenreID uint `gorm:"column:genre_id;primary_key"`
+}
+
+// TableName tells gorm where the genres of books live.
+func (bookGenre) TableName() string {
+	return "book_genres"
+}
+
+// bookTag is a tag of a book.
+type bookTag struct {
+	BookID uint   `gorm:"column:book_id;primary_key"`
+	Tag    string `gorm:"column:tag;primary_key"`
+}
+
+// TableName tells gorm where the tags of books live.
+func (bookTag) TableName() string {
+	return "book_tags"
+}
+
+const (
+	// maxLabel is the size of the name and tag columns.
+	maxLabel = 64
+	// maxTags bounds the tags of a book.
+	maxTags = 32
+)
+
+var (
+	// errUnknownGenre is returned for genres outside the vocabulary.
+	errUnknownGenre = errors.New("unknown genre")
+	// errBadTag is wrapped by the errors of normalizeTags.
+	errBadTag = errors.New("bad tag")
+)
+
+// normalizeLabel trims s and collapses its spaces.
+func normalizeLabel(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// normalizeTags lowercases tags, drops a leading # and empty tags and
+// duplicates, and sorts them.
+func normalizeTags(tags []string) ([]string, error) {
+	var out []string
+	seen := make(map[string]bool)
+	for _, t := range tags {
+		t = strings.ToLower(normalizeLabel(strings.TrimPrefix(strings.TrimSpace(t), "#")))
+		if t == "" || seen[t] {
+			continue
+		}
+		if len(t) > maxLabel {
+			return nil, fmt.Errorf("%w: %q longer than %d bytes", errBadTag, t, maxLabel)
+		}
+		seen[t] = true
+		out = append(out, t)
+	}
+	if len(out) > maxTags {
+		return nil, fmt.Errorf("%w: more than %d tags", errBadTag, maxTags)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// splitTags splits the comma-separated tags of the edit form.
+func splitTags(s string) []string {
+	return strings.Split(s, ",")
+}
+
+// normalizeGenres matches genres to the vocabulary, ignoring case, and
+// returns them spelled and ordered as in it.
+func normalizeGenres(genres, vocabulary []string) ([]string, error) {
+	want := make(map[string]bool)
+	for _, g := range genres {
+		if g = normalizeLabel(g); g != "" {
+			want[strings.ToLower(g)] = true
+		}
+	}
+	var out []string
+	for _, v := range vocabulary {
+		if want[strings.ToLower(v)] {
+			out = append(out, v)
+			delete(want, strings.ToLower(v))
+		}
+	}
+	for _, g := range genres {
+		if want[strings.ToLower(normalizeLabel(g))] {
+			return nil, fmt.Errorf("%w %q", errUnknownGenre, normalizeLabel(g))
+		}
+	}
+	return out, nil
+}
+
+// prepareLabels normalizes the genres and tags of book against the genre
+// vocabulary of the database.
+func (b *Bookshelf) prepareLabels(book *Book) error {
+	tags, err := normalizeTags(book.Tags)
+	if err != nil {
+		return err
+	}
+	book.Tags = tags
+	if len(book.Genres) == 0 {
+		book.Genres = nil
+		return nil
+	}
+	vocabulary, err := b.DB.ListGenres()
+	if err != nil {
+		return fmt.Errorf("could not list genres: %v", err)
+	}
+	book.Genres, err = normalizeGenres(book.Genres, vocabulary)
+	return err
+}
+
+// Facet is a value books can be filtered by, with the number of books
+// having it.
+type Facet struct {
+	// Value is the value of the filter, e.g. a tag or the ID of an author.
+	Value string `json:"value"`
+	// Label shows the value to people.
+	Label string `json:"label"`
+	Count int    `json:"count"`
+}
+
+// Facets are the values the books selected by a BookQuery have, by
+// filter. Genres, Tags and Authors are ordered by descending count, then
+// label; Decades chronologically.
+type Facets struct {
+	Genres  []Facet `json:"genres"`
+	Tags    []Facet `json:"tags"`
+	Authors []Facet `json:"authors"`
+	Decades []Facet `json:"decades"`
+}
+
+// facetCounter counts the facets of books one at a time, for databases
+// which cannot count them themselves.
+type facetCounter struct {
+	counts [4]map[Facet]int
+}
+
+const (
+	facetGenre = iota
+	facetTag
+	facetAuthor
+	facetDecade
+)
+
+func newFacetCounter() *facetCounter {
+	c := &facetCounter{}
+	for i := range c.counts {
+		c.counts[i] = make(map[Facet]int)
+	}
+	return c
+}
+
+func (c *facetCounter) add(kind int, value, label string) {
+	c.counts[kind][Facet{Value: value, Label: label}]++
+}
+
+// addBook counts the labels, credited authors and decade of book.
+func (c *facetCounter) addBook(book *Book, authors []*Author) {
+	for _, g := range book.Genres {
+		c.add(facetGenre, g, g)
+	}
+	for _, t := range book.Tags {
+		c.add(facetTag, t, t)
+	}
+	for _, a := range authors {
+		c.add(facetAuthor, strconv.FormatUint(uint64(a.ID), 10), a.Name)
+	}
+	if y := book.PublishedDate.Year; y != 0 {
+		d := decadeOf(y)
+		c.add(facetDecade, strconv.Itoa(d), decadeLabel(d))
+	}
+}
+
+func (c *facetCounter) facets() *Facets {
+	list := func(kind int) []Facet {
+		facets := []Facet{}
+		for f, n := range c.counts[kind] {
+			f.Count = n
+			facets = append(facets, f)
+		}
+		return facets
+	}
+	f := &Facets{
+		Genres:  list(facetGenre),
+		Tags:    list(facetTag),
+		Authors: list(facetAuthor),
+		Decades: list(facetDecade),
+	}
+	f.sort()
+	return f
+}
+
+// sort puts the facets in their documented order.
+func (f *Facets) sort() {
+	for _, facets := range [][]Facet{f.Genres, f.Tags, f.Authors} {
+		sort.Slice(facets, func(i, j int) bool {
+			if facets[i].Count != facets[j].Count {
+				return facets[i].Count > facets[j].Count
+			}
+			return facets[i].Label < facets[j].Label
+		})
+	}
+	sort.Slice(f.Decades, func(i, j int) bool {
+		a, _ := strconv.Atoi(f.Decades[i].Value)
+		b, _ := strconv.Atoi(f.Decades[j].Value)
+		return a < b
+	})
+}
+
+// copy keeps callers from changing cached facets.
+func (f *Facets) copy() *Facets {
+	return &Facets{
+		Genres:  append([]Facet(nil), f.Genres...),
+		Tags:    append([]Facet(nil), f.Tags...),
+		Authors: append([]Facet(nil), f.Authors...),
+		Decades: append([]Facet(nil), f.Decades...),
+	}
+}
+
+// decadeOf returns the first year of the decade of year.
+func decadeOf(year int) int {
+	return year / 10 * 10
+}
+
+func decadeLabel(decade int) string {
+	return fmt.Sprintf("%ds", decade)
+}
+
+// maxFacets bounds the facets the list page shows by filter.
+const maxFacets = 20
+
+// facetLink is a facet of the list page, linking to the list filtered by
+// it, or unfiltered when Active.
+type facetLink struct {
+	Facet
+	URL    string
+	Active bool
+}
+
+// facetGroup is the facets of the list page for one filter.
+type facetGroup struct {
+	Name  string
+	Links []facetLink
+}
+
+// facetGroups builds the facets of the list page showing the books
+// selected by query.
+func facetGroups(f *Facets, query url.Values) []facetGroup {
+	link := func(fc Facet, set map[string]string) facetLink {
+		v := url.Values{}
+		for k, vs := range query {
+			v[k] = vs
+		}
+		active := true
+		for k, s := range set {
+			active = active && query.Get(k) == s
+		}
+		for k, s := range set {
+			if active {
+				v.Del(k)
+			} else {
+				v.Set(k, s)
+			}
+		}
+		return facetLink{Facet: fc, URL: "/books?" + v.Encode(), Active: active}
+	}
+	group := func(name, param string, facets []Facet) facetGroup {
+		g := facetGroup{Name: name}
+		for i, fc := range facets {
+			if i == maxFacets {
+				break
+			}
+			g.Links = append(g.Links, link(fc, map[string]string{param: fc.Value}))
+		}
+		return g
+	}
+	groups := []facetGroup{
+		group("Genre", "genre", f.Genres),
+		group("Tag", "tag", f.Tags),
+		group("Author", "author", f.Authors),
+	}
+	decades := facetGroup{Name: "Decade"}
+	for _, fc := range f.Decades {
+		d, _ := strconv.Atoi(fc.Value)
+		decades.Links = append(decades.Links, link(fc, map[string]string{
+			"from": strconv.Itoa(d),
+			"to":   strconv.Itoa(d + 9),
+		}))
+	}
+	return append(groups, decades)
+}
@@ -0,0 +1,170 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeLabels(t *testing.T) {
+	tags, err := normalizeTags(splitTags(" Space Opera,#classic, ,space   opera,Hugo"))
+	if err != nil || strings.Join(tags, "|") != "classic|hugo|space opera" {
+		t.Errorf("normalizeTags: got %q, %v", tags, err)
+	}
+	if _, err := normalizeTags([]string{strings.Repeat("x", maxLabel+1)}); !errors.Is(err, errBadTag) {
+		t.Errorf("normalizeTags of a long tag: got %v, want errBadTag", err)
+	}
+
+	genres, err := normalizeGenres([]string{"science  FICTION", "fiction", "Fiction"}, defaultGenres)
+	if err != nil || strings.Join(genres, "|") != "Fiction|Science fiction" {
+		t.Errorf("normalizeGenres: got %q, %v", genres, err)
+	}
+	if _, err := normalizeGenres([]string{"Fiction", "Cyberpunk"}, defaultGenres); !errors.Is(err, errUnknownGenre) {
+		t.Errorf("normalizeGenres of an unknown genre: got %v, want errUnknownGenre", err)
+	}
+}
+
+// TestGenresMigration checks the migration seeds the vocabulary memoryDB
+// starts with.
+func TestGenresMigration(t *testing.T) {
+	data, err := migrationFiles.ReadFile("migrations/6_create_table_genres_tags.up.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sql := string(data)
+	last := -1
+	for _, g := range defaultGenres {
+		i := strings.Index(sql, "('"+strings.ReplaceAll(g, "'", "''")+"')")
+		if i < 0 || i < last {
+			t.Errorf("genre %q missing from the migration or out of order", g)
+		}
+		last = i
+	}
+}
+
+func TestListFacets(t *testing.T) {
+	bs, srv := newTestBookshelf(t)
+
+	get := func(path string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, html.UnescapeString(string(body))
+	}
+	post := func(form url.Values) int {
+		t.Helper()
+		resp, err := http.PostForm(srv.URL+"/books", form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for _, form := range []url.Values{
+		{"title": {"Dune"}, "author": {"Frank Herbert"}, "genre": {"science fiction"}, "tags": {"Classic, desert"}, "publishedDate": {"1965"}},
+		{"title": {"Hyperion"}, "author": {"Dan Simmons"}, "genre": {"Science fiction", "Fantasy"}, "tags": {"classic"}, "publishedDate": {"1989"}},
+		{"title": {"Emma"}, "author": {"Jane Austen"}, "genre": {"Romance"}, "publishedDate": {"1815"}},
+	} {
+		if code := post(form); code != http.StatusOK {
+			t.Fatalf("adding %s: got status %d", form.Get("title"), code)
+		}
+	}
+	if code := post(url.Values{"title": {"Bad"}, "genre": {"Cyberpunk"}}); code != http.StatusBadRequest {
+		t.Errorf("unknown genre: got status %d, want 400", code)
+	}
+
+	book, _ := bs.DB.GetBook(2)
+	if strings.Join(book.Genres, "|") != "Fantasy|Science fiction" || strings.Join(book.Tags, "|") != "classic" {
+		t.Errorf("got genres %q and tags %q", book.Genres, book.Tags)
+	}
+	_, body := get("/books/2")
+	if !strings.Contains(body, `href="/books?genre=Science%20fiction"`) || !strings.Contains(body, `href="/books?tag=classic"`) {
+		t.Errorf("detail page does not link to the genres and tags:\n%s", body)
+	}
+	_, body = get("/books/1/edit")
+	if !strings.Contains(body, `value="Science fiction" checked`) || !strings.Contains(body, `value="classic, desert"`) {
+		t.Errorf("edit form does not show the genres and tags:\n%s", body)
+	}
+
+	code, body := get("/books")
+	for _, want := range []string{
+		`<a href="/books?genre=Science+fiction">Science fiction</a> <span class="count">2</span>`,
+		`<a href="/books?tag=classic">classic</a> <span class="count">2</span>`,
+		`<a href="/books?from=1960&to=1969">1960s</a> <span class="count">1</span>`,
+		`<a href="/books?author=1">Frank Herbert</a> <span class="count">1</span>`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("list page: want facet %s", want)
+		}
+	}
+	if code != http.StatusOK {
+		t.Errorf("list page: got status %d", code)
+	}
+
+	// Facets count the books selected, and the active one unselects.
+	_, body = get("/books?genre=Science+fiction&tag=classic")
+	if strings.Contains(body, ">Emma</a>") || !strings.Contains(body, ">Dune</a>") {
+		t.Errorf("list page filtered by genre lists the wrong books:\n%s", body)
+	}
+	if want := `<li class="active"><a href="/books?tag=classic">Science fiction</a>`; !strings.Contains(body, want) {
+		t.Errorf("list page filtered by genre: want active facet %s", want)
+	}
+	if strings.Contains(body, ">Romance</a>") {
+		t.Error("list page filtered by genre: got a facet of a book not selected")
+	}
+	if code, _ := get("/books?author=x"); code != http.StatusBadRequest {
+		t.Errorf("bad author: got status %d, want 400", code)
+	}
+}
+
+func TestCLILabels(t *testing.T) {
+	c := newCLI(t)
+	c.mustRun("genres", "add", "Cyberpunk")
+	c.mustRun("books", "add", "-title", "Neuromancer", "-genre", "cyberpunk", "-genre", "Science fiction", "-tag", "Sprawl")
+	c.mustRun("books", "add", "-title", "Dune", "-genre", "Science fiction", "-published", "1965")
+	if code, _, _ := c.run("books", "add", "-title", "Bad", "-genre", "Solarpunk"); code != exitUsage {
+		t.Errorf("books add with an unknown genre: got exit code %d, want %d", code, exitUsage)
+	}
+
+	if out := c.mustRun("books", "list", "-genre", "cyberpunk"); strings.Count(out, "\n") != 1 || !strings.Contains(out, `"Tags":["sprawl"]`) {
+		t.Errorf("books list -genre: got %q", out)
+	}
+	var f Facets
+	out := c.mustRun("books", "facets")
+	if err := json.Unmarshal([]byte(out), &f); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(f.Genres); got != "[{Science fiction Science fiction 2} {Cyberpunk Cyberpunk 1}]" {
+		t.Errorf("books facets: got genres %s", got)
+	}
+	if out := c.mustRun("genres", "list"); !strings.HasSuffix(out, "\"Cyberpunk\"\n") {
+		t.Errorf("genres list: got %q", out)
+	}
+	if code, _, _ := c.run("genres", "add", " "); code != exitUsage {
+		t.Errorf("genres add of a blank name: got exit code %d, want %d", code, exitUsage)
+	}
+}
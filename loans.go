@@ -0,0 +1,448 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// loanPeriod is how long copies are lent unless staff set a due date.
+const loanPeriod = 14 * 24 * time.Hour
+
+// Loan records that a copy was lent to a user.
+type Loan struct {
+	ID     uint `gorm:"column:id;primary_key" json:"id"`
+	CopyID uint `gorm:"column:copy_id" json:"copy_id"`
+	// BookID is the book of the copy, kept for the history of the book.
+	BookID     uint      `gorm:"column:book_id" json:"book_id"`
+	UserID     uint      `gorm:"column:user_id" json:"user_id"`
+	CheckedOut time.Time `gorm:"column:checked_out_at" json:"checked_out"`
+	// Due is the day the copy is due back, at midnight UTC. Copies are
+	// overdue the day after.
+	Due time.Time `gorm:"column:due_at" json:"due"`
+	// Returned is nil while the copy is on loan.
+	Returned *time.Time `gorm:"column:returned_at" json:"returned,omitempty"`
+}
+
+// TableName tells gorm where loans live.
+func (Loan) TableName() string {
+	return "loans"
+}
+
+// Active reports whether the copy is still on loan.
+func (l *Loan) Active() bool {
+	return l.Returned == nil
+}
+
+// Overdue reports whether the copy should have been returned by now.
+func (l *Loan) Overdue(now time.Time) bool {
+	return l.Active() && !now.Before(l.Due.Add(24*time.Hour))
+}
+
+// LoanFilter selects loans. Zero fields match all loans.
+type LoanFilter struct {
+	CopyID uint
+	BookID uint
+	UserID uint
+	// Active only selects the loans of copies not returned yet.
+	Active bool
+	// DueBefore only selects the loans due before it, unless zero.
+	DueBefore time.Time
+}
+
+func (f LoanFilter) match(l *Loan) bool {
+	return (f.CopyID == 0 || l.CopyID == f.CopyID) &&
+		(f.BookID == 0 || l.BookID == f.BookID) &&
+		(f.UserID == 0 || l.UserID == f.UserID) &&
+		(!f.Active || l.Active()) &&
+		(f.DueBefore.IsZero() || l.Due.Before(f.DueBefore))
+}
+
+// LoanDatabase provides thread-safe access to the loans of copies.
+type LoanDatabase interface {
+	// CheckOut lends a copy, setting the ID and BookID of l. A copy has
+	// one active loan at most, however many requests try to lend it at
+	// once: the others fail with errUnavailable, as do lost copies.
+	CheckOut(l *Loan) (id uint, err error)
+
+	// CheckIn ends the active loan of a copy, returned at the given time.
+	// It fails with errNotFound when the copy is not on loan.
+	CheckIn(copyID uint, at time.Time) (*Loan, error)
+
+	// AddLoanRecord adds a returned loan as it is, setting its ID. It
+	// restores the history of copies which were deleted.
+	AddLoanRecord(l *Loan) (id uint, err error)
+
+	// GetLoan retrieves a loan by its ID.
+	GetLoan(id uint) (*Loan, error)
+
+	// ListLoans returns the loans selected by f, newest first.
+	ListLoans(f LoanFilter) ([]*Loan, error)
+}
+
+var errNoLoans = errors.New("the configured database does not keep loans")
+
+// errUnavailable is returned for copies which cannot be lent.
+var errUnavailable = errors.New("copy not available")
+
+// dueDate returns the day a copy lent at t is due, or the day parsed from
+// s, formatted as 2006-01-02, when it is not empty.
+func dueDate(t time.Time, s string) (time.Time, error) {
+	today := t.UTC().Truncate(24 * time.Hour)
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return today.Add(loanPeriod), nil
+	}
+	d, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: due date %q", errBadDate, s)
+	}
+	if d.Before(today) {
+		return time.Time{}, fmt.Errorf("%w: due date %s has passed", errBadDate, s)
+	}
+	return d, nil
+}
+
+// hasRole reports whether the user of r holds at least role, as
+// requireRole checks it.
+func (b *Bookshelf) hasRole(r *http.Request, role Role) bool {
+	if !b.authEnabled() {
+		return true
+	}
+	u := currentUser(r)
+	return u != nil && u.Role.AtLeast(role)
+}
+
+// loanView is a loan with what it refers to, for templates.
+type loanView struct {
+	*Loan
+	Book    *Book
+	Copy    *Copy
+	User    *User
+	Overdue bool
+}
+
+// loanViews looks up the books, copies and users of loans. Those deleted
+// meanwhile are left nil.
+func (b *Bookshelf) loanViews(loans []*Loan) ([]loanView, error) {
+	books := make(map[uint]*Book)
+	users := make(map[uint]*User)
+	now := time.Now()
+	views := make([]loanView, len(loans))
+	for i, l := range loans {
+		v := loanView{Loan: l, Overdue: l.Overdue(now)}
+		book, ok := books[l.BookID]
+		if !ok {
+			var err error
+			if book, err = b.DB.GetBook(l.BookID); err != nil && !errors.Is(err, errNotFound) {
+				return nil, err
+			}
+			books[l.BookID] = book
+		}
+		v.Book = book
+		if c, err := b.Copies.GetCopy(l.CopyID); err == nil {
+			v.Copy = c
+		} else if !errors.Is(err, errNotFound) {
+			return nil, err
+		}
+		if b.Users != nil {
+			u, ok := users[l.UserID]
+			if !ok {
+				var err error
+				if u, err = b.Users.GetUser(l.UserID); err != nil && !errors.Is(err, errNotFound) {
+					return nil, err
+				}
+				users[l.UserID] = u
+			}
+			v.User = u
+		}
+		views[i] = v
+	}
+	return views, nil
+}
+
+// loanErrorf reports err, telling clients asking for missing copies, loans
+// and users, lending copies which are not available and sending bad input
+// so.
+func (b *Bookshelf) loanErrorf(r *http.Request, err error) *appError {
+	e := b.appErrorf(r, err, "%v", err)
+	switch {
+	case errors.Is(err, errNotFound):
+		e.code = http.StatusNotFound
+	case errors.Is(err, errUnavailable):
+		e.code = http.StatusConflict
+	case errors.Is(err, errBadDate), errors.Is(err, errBadLoan):
+		e.code = http.StatusBadRequest
+	}
+	return e
+}
+
+// errBadLoan is returned for check-outs naming no or bad borrowers.
+var errBadLoan = errors.New("bad loan")
+
+// borrowerFromForm returns the ID of the user a copy is lent to: the one
+// of the user form value for staff, otherwise the signed-in user.
+func (b *Bookshelf) borrowerFromForm(r *http.Request) (uint, error) {
+	s := r.FormValue("user")
+	if s == "" || !b.hasRole(r, RoleStaff) {
+		if u := currentUser(r); u != nil {
+			return u.ID, nil
+		}
+		return 0, fmt.Errorf("%w: no borrower", errBadLoan)
+	}
+	id, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || id == 0 {
+		return 0, fmt.Errorf("%w: bad user ID %q", errBadLoan, s)
+	}
+	if b.Users == nil {
+		return 0, errNoUsers
+	}
+	if _, err := b.Users.GetUser(uint(id)); err != nil {
+		return 0, err
+	}
+	return uint(id), nil
+}
+
+// checkOutHandler lends the copy in the URL's path. Staff lend to any user
+// and may set the due date; others borrow for themselves.
+func (b *Bookshelf) checkOutHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if b.Loans == nil {
+		return b.appErrorf(r, errNoLoans, "%v", errNoLoans)
+	}
+	c, err := b.copyFromRequest(r)
+	if err != nil {
+		return b.loanErrorf(r, err)
+	}
+	userID, err := b.borrowerFromForm(r)
+	if err != nil {
+		return b.loanErrorf(r, err)
+	}
+	now := time.Now().UTC()
+	due := ""
+	if b.hasRole(r, RoleStaff) {
+		due = r.FormValue("due")
+	}
+	l := &Loan{CopyID: c.ID, UserID: userID, CheckedOut: now}
+	if l.Due, err = dueDate(now, due); err != nil {
+		return b.loanErrorf(r, err)
+	}
+	if _, err := b.Loans.CheckOut(l); err != nil {
+		return b.loanErrorf(r, err)
+	}
+	http.Redirect(w, r, fmt.Sprintf("/books/%d#copies", c.BookID), http.StatusFound)
+	return nil
+}
+
+// checkInHandler ends the loan of the copy in the URL's path. Borrowers
+// may return what they borrowed, staff anything.
+func (b *Bookshelf) checkInHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if b.Loans == nil {
+		return b.appErrorf(r, errNoLoans, "%v", errNoLoans)
+	}
+	c, err := b.copyFromRequest(r)
+	if err != nil {
+		return b.loanErrorf(r, err)
+	}
+	if !b.hasRole(r, RoleStaff) {
+		loans, err := b.Loans.ListLoans(LoanFilter{CopyID: c.ID, Active: true})
+		if err != nil {
+			return b.appErrorf(r, err, "could not list loans: %v", err)
+		}
+		if u := currentUser(r); len(loans) == 0 || u == nil || loans[0].UserID != u.ID {
+			return b.loanErrorf(r, fmt.Errorf("loan of copy %d %w", c.ID, errNotFound))
+		}
+	}
+	if _, err := b.Loans.CheckIn(c.ID, time.Now().UTC()); err != nil {
+		return b.loanErrorf(r, err)
+	}
+	http.Redirect(w, r, fmt.Sprintf("/books/%d#copies", c.BookID), http.StatusFound)
+	return nil
+}
+
+// loansView is the data of templates/loans.html.
+type loansView struct {
+	Title string
+	Loans []loanView
+	// Holds are the active holds of the same user or book.
+	Holds []holdView
+	// Mine is set for the loans of the signed-in user.
+	Mine bool
+	// Reminders is set when the signed-in user may choose whether to get
+	// reminder emails, OptedOut when they chose not to.
+	Reminders bool
+	OptedOut  bool
+}
+
+// myLoansHandler lists the loans of the signed-in user. Staff may see
+// those of others by the user form value; without sign-in, it lists all
+// loans.
+func (b *Bookshelf) myLoansHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if b.Loans == nil {
+		return b.appErrorf(r, errNoLoans, "%v", errNoLoans)
+	}
+	v := loansView{Title: "Loans"}
+	f := LoanFilter{}
+	if u := currentUser(r); u != nil {
+		f.UserID = u.ID
+		v.Title, v.Mine = "My loans", true
+	}
+	if s := r.FormValue("user"); s != "" && b.hasRole(r, RoleStaff) {
+		id, err := strconv.ParseUint(s, 10, 32)
+		if err != nil || id == 0 {
+			return b.loanErrorf(r, fmt.Errorf("%w: bad user ID %q", errBadLoan, s))
+		}
+		if b.Users == nil {
+			return b.appErrorf(r, errNoUsers, "%v", errNoUsers)
+		}
+		u, err := b.Users.GetUser(uint(id))
+		if err != nil {
+			return b.loanErrorf(r, err)
+		}
+		f.UserID = u.ID
+		v.Title, v.Mine = "Loans of "+u.DisplayName(), false
+	}
+	loans, err := b.Loans.ListLoans(f)
+	if err != nil {
+		return b.appErrorf(r, err, "could not list loans: %v", err)
+	}
+	if v.Loans, err = b.loanViews(loans); err != nil {
+		return b.appErrorf(r, err, "%v", err)
+	}
+	if err := b.loadHolds(&v, HoldFilter{UserID: f.UserID, Active: true}); err != nil {
+		return b.appErrorf(r, err, "%v", err)
+	}
+	if v.Mine && b.Reminders != nil {
+		v.Reminders = true
+		if v.OptedOut, err = b.Reminders.OptedOut(f.UserID); err != nil {
+			return b.appErrorf(r, err, "%v", err)
+		}
+	}
+	return loansTmpl.Execute(b, w, r, v)
+}
+
+// loadHolds adds the holds selected by f to v, if the database keeps
+// holds.
+func (b *Bookshelf) loadHolds(v *loansView, f HoldFilter) error {
+	if b.Holds == nil {
+		return nil
+	}
+	holds, err := b.Holds.ListHolds(f)
+	if err != nil {
+		return fmt.Errorf("could not list holds: %v", err)
+	}
+	v.Holds, err = b.holdViews(holds)
+	return err
+}
+
+// bookLoansHandler lists the loans of the copies of a book.
+func (b *Bookshelf) bookLoansHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if b.Loans == nil {
+		return b.appErrorf(r, errNoLoans, "%v", errNoLoans)
+	}
+	book, err := b.bookFromRequest(r)
+	if err != nil {
+		return b.appErrorf(r, err, "%v", err)
+	}
+	loans, err := b.Loans.ListLoans(LoanFilter{BookID: book.ID})
+	if err != nil {
+		return b.appErrorf(r, err, "could not list loans: %v", err)
+	}
+	v := loansView{Title: "Loans of " + book.Title}
+	if v.Loans, err = b.loanViews(loans); err != nil {
+		return b.appErrorf(r, err, "%v", err)
+	}
+	if err := b.loadHolds(&v, HoldFilter{BookID: book.ID, Active: true}); err != nil {
+		return b.appErrorf(r, err, "%v", err)
+	}
+	return loansTmpl.Execute(b, w, r, v)
+}
+
+// copyStatus is a copy with its active loan or the hold it is kept for,
+// if any, for the book page.
+type copyStatus struct {
+	*Copy
+	Loan *loanView
+	Hold *holdView
+	// Mine is set when the signed-in user borrowed the copy or it is kept
+	// for them.
+	Mine bool
+}
+
+// copyViews lists the copies of a book with their loans and holds. The
+// borrowers and holders are only shown to staff and themselves.
+func (b *Bookshelf) copyViews(r *http.Request, book *Book) ([]copyStatus, error) {
+	if b.Copies == nil {
+		return nil, nil
+	}
+	copies, err := b.Copies.ListCopies(book.ID)
+	if err != nil {
+		return nil, fmt.Errorf("could not list copies: %v", err)
+	}
+	loans := make(map[uint]*Loan)
+	if b.Loans != nil {
+		active, err := b.Loans.ListLoans(LoanFilter{BookID: book.ID, Active: true})
+		if err != nil {
+			return nil, fmt.Errorf("could not list loans: %v", err)
+		}
+		for _, l := range active {
+			loans[l.CopyID] = l
+		}
+	}
+	holds := make(map[uint]*Hold)
+	if b.Holds != nil {
+		active, err := b.Holds.ListHolds(HoldFilter{BookID: book.ID, Active: true})
+		if err != nil {
+			return nil, fmt.Errorf("could not list holds: %v", err)
+		}
+		for _, h := range active {
+			if h.Ready() {
+				holds[h.CopyID] = h
+			}
+		}
+	}
+	u := currentUser(r)
+	staff := b.hasRole(r, RoleStaff)
+	views := make([]copyStatus, len(copies))
+	for i, c := range copies {
+		views[i].Copy = c
+		if h, ok := holds[c.ID]; ok {
+			views[i].Mine = u != nil && h.UserID == u.ID
+			hv := holdView{Hold: h, Book: book}
+			if b.Users != nil && (staff || views[i].Mine) {
+				if hv.User, err = b.Users.GetUser(h.UserID); err != nil && !errors.Is(err, errNotFound) {
+					return nil, err
+				}
+			}
+			views[i].Hold = &hv
+		}
+		l, ok := loans[c.ID]
+		if !ok {
+			continue
+		}
+		views[i].Mine = u != nil && l.UserID == u.ID
+		lv := loanView{Loan: l, Overdue: l.Overdue(time.Now())}
+		if b.Users != nil && (staff || views[i].Mine) {
+			if lv.User, err = b.Users.GetUser(l.UserID); err != nil && !errors.Is(err, errNotFound) {
+				return nil, err
+			}
+		}
+		views[i].Loan = &lv
+	}
+	return views, nil
+}
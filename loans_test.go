@@ -0,0 +1,293 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDueDate(t *testing.T) {
+	now := time.Date(2020, 3, 1, 15, 4, 5, 0, time.UTC)
+	if got, _ := dueDate(now, ""); !got.Equal(time.Date(2020, 3, 15, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("default due date: got %v, want March 15", got)
+	}
+	if got, err := dueDate(now, "2020-03-01"); err != nil || !got.Equal(time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("due today: got %v, %v", got, err)
+	}
+	for _, s := range []string{"2020-02-29", "next week", "03/20/2020"} {
+		if _, err := dueDate(now, s); !errors.Is(err, errBadDate) {
+			t.Errorf("dueDate(%q): got %v, want errBadDate", s, err)
+		}
+	}
+
+	l := &Loan{Due: time.Date(2020, 3, 15, 0, 0, 0, 0, time.UTC)}
+	if l.Overdue(time.Date(2020, 3, 15, 23, 59, 0, 0, time.UTC)) {
+		t.Error("overdue on the day it is due")
+	}
+	if !l.Overdue(time.Date(2020, 3, 16, 0, 0, 0, 0, time.UTC)) {
+		t.Error("not overdue the day after it was due")
+	}
+	returned := l.Due.Add(48 * time.Hour)
+	l.Returned = &returned
+	if l.Overdue(returned.Add(time.Hour)) {
+		t.Error("overdue after it was returned")
+	}
+}
+
+func TestLoanPages(t *testing.T) {
+	bs, srv := newTestBookshelf(t)
+
+	get := func(path string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	post := func(path string, form url.Values) int {
+		t.Helper()
+		resp, err := http.PostForm(srv.URL+path, form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	bookID, err := bs.DB.AddBook(&Book{Title: "Dune"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyID, err := bs.Copies.AddCopy(&Copy{BookID: bookID, Barcode: "0001", Condition: conditionGood})
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID, err := bs.Users.UpsertUser(&User{Issuer: "https://issuer", Subject: "alice", Name: "Alice", Role: RoleViewer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := fmt.Sprintf("/books/%d", bookID)
+	copyPage := fmt.Sprintf("/copies/%d", copyID)
+
+	// Without sign-in, everyone is staff and lends to the users chosen.
+	if _, body := get(page); !strings.Contains(body, `<option value="1">Alice</option>`) {
+		t.Errorf("book page does not offer the borrowers:\n%s", body)
+	}
+	for _, form := range []url.Values{
+		{},
+		{"user": {"nobody"}},
+		{"user": {fmt.Sprint(userID)}, "due": {"2001-01-01"}},
+	} {
+		if code := post(copyPage+":checkout", form); code != http.StatusBadRequest {
+			t.Errorf("checking out with %v: got status %d, want 400", form, code)
+		}
+	}
+	if code := post(copyPage+":checkout", url.Values{"user": {"99"}}); code != http.StatusNotFound {
+		t.Errorf("checking out to a missing user: got status %d, want 404", code)
+	}
+	due := time.Now().UTC().Add(72 * time.Hour).Format("2006-01-02")
+	if code := post(copyPage+":checkout", url.Values{"user": {fmt.Sprint(userID)}, "due": {due}}); code != http.StatusOK {
+		t.Fatalf("checking out: got status %d", code)
+	}
+	if code := post(copyPage+":checkout", url.Values{"user": {fmt.Sprint(userID)}}); code != http.StatusConflict {
+		t.Errorf("checking out a copy on loan: got status %d, want 409", code)
+	}
+
+	wantDue, _ := time.Parse("2006-01-02", due)
+	if _, body := get(page); !strings.Contains(body, "On loan to Alice, due "+wantDue.Format("Jan 2, 2006")) {
+		t.Errorf("book page does not show the loan:\n%s", body)
+	}
+	if _, body := get("/books"); !strings.Contains(body, "0 of 1 copy available") {
+		t.Errorf("book list does not count the loan:\n%s", body)
+	}
+	if code := post(copyPage+":delete", nil); code != http.StatusConflict {
+		t.Errorf("deleting a copy on loan: got status %d, want 409", code)
+	}
+	if code := post(page+":delete", nil); code != http.StatusConflict {
+		t.Errorf("deleting a book with a copy on loan: got status %d, want 409", code)
+	}
+
+	if code := post(copyPage+":checkin", nil); code != http.StatusOK {
+		t.Errorf("checking in: got status %d", code)
+	}
+	if code := post(copyPage+":checkin", nil); code != http.StatusNotFound {
+		t.Errorf("checking in a copy not on loan: got status %d, want 404", code)
+	}
+
+	code, body := get(page + "/loans")
+	if code != http.StatusOK || !strings.Contains(body, "Alice") || !strings.Contains(body, time.Now().UTC().Format("Jan 2, 2006")) {
+		t.Errorf("loan history of the book: got status %d:\n%s", code, body)
+	}
+	code, body = get(fmt.Sprintf("/loans?user=%d", userID))
+	if code != http.StatusOK || !strings.Contains(body, "Loans of Alice") || !strings.Contains(body, ">Dune</a>") {
+		t.Errorf("loan history of the user: got status %d:\n%s", code, body)
+	}
+
+	// The history stays once the copy and the book are gone.
+	if code := post(copyPage+":delete", nil); code != http.StatusOK {
+		t.Fatalf("deleting the returned copy: got status %d", code)
+	}
+	if code := post(page+":delete", nil); code != http.StatusOK {
+		t.Fatalf("deleting the book: got status %d", code)
+	}
+	if loans, err := bs.Loans.ListLoans(LoanFilter{UserID: userID}); err != nil || len(loans) != 1 {
+		t.Errorf("loans after deleting the book: got %+v, %v, want the loan kept", loans, err)
+	}
+	if code, body := get(fmt.Sprintf("/loans?user=%d", userID)); code != http.StatusOK || !strings.Contains(body, "Loans of Alice") {
+		t.Errorf("loan history of the user after deleting the book: got status %d:\n%s", code, body)
+	}
+}
+
+func TestLoanBorrowers(t *testing.T) {
+	m := newMockIssuer(t)
+	bs, srv := newOIDCBookshelf(t, m)
+
+	bookID, err := bs.DB.AddBook(&Book{Title: "Dune"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyID, err := bs.Copies.AddCopy(&Copy{BookID: bookID, Barcode: "0001", Condition: conditionGood})
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyPage := fmt.Sprintf("%s/copies/%d", srv.URL, copyID)
+
+	signIn := func(sub string, groups ...interface{}) *http.Client {
+		t.Helper()
+		m.setClaims(map[string]interface{}{"sub": sub, "name": sub, "groups": groups})
+		c := newBrowser(t)
+		resp, err := c.Get(srv.URL + "/loans")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: GET /loans: got status %d", sub, resp.StatusCode)
+		}
+		return c
+	}
+	post := func(c *http.Client, url string, form url.Values) int {
+		t.Helper()
+		resp, err := c.PostForm(url, form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	alice, bob := signIn("alice"), signIn("bob")
+	staff := signIn("carol", "library-staff")
+	users, _ := bs.Users.ListUsers()
+	ids := make(map[string]uint)
+	for _, u := range users {
+		ids[u.Subject] = u.ID
+	}
+
+	// Viewers borrow for themselves, whoever they name.
+	if code := post(alice, copyPage+":checkout", url.Values{"user": {fmt.Sprint(ids["bob"])}, "due": {"2999-01-01"}}); code != http.StatusOK {
+		t.Fatalf("alice borrowing: got status %d", code)
+	}
+	loans, _ := bs.Loans.ListLoans(LoanFilter{Active: true})
+	if len(loans) != 1 || loans[0].UserID != ids["alice"] || loans[0].Due.Year() == 2999 {
+		t.Fatalf("got loans %+v, want one to alice for two weeks", loans)
+	}
+
+	resp, err := alice.Get(srv.URL + "/loans")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), "My loans") || !strings.Contains(string(body), ">Dune</a>") {
+		t.Errorf("my loans of alice:\n%s", body)
+	}
+	resp, err = bob.Get(srv.URL + "/loans")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if strings.Contains(string(body), "Dune") {
+		t.Errorf("my loans of bob shows the loan of alice:\n%s", body)
+	}
+	resp, err = bob.Get(fmt.Sprintf("%s/books/%d/loans", srv.URL, bookID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("loan history of a book for a viewer: got status %d, want 403", resp.StatusCode)
+	}
+
+	if code := post(bob, copyPage+":checkin", nil); code != http.StatusNotFound {
+		t.Errorf("bob returning the copy of alice: got status %d, want 404", code)
+	}
+	if code := post(alice, copyPage+":checkin", nil); code != http.StatusOK {
+		t.Errorf("alice returning her copy: got status %d", code)
+	}
+	if code := post(staff, copyPage+":checkout", url.Values{"user": {fmt.Sprint(ids["bob"])}}); code != http.StatusOK {
+		t.Errorf("staff lending to bob: got status %d", code)
+	}
+	if code := post(staff, copyPage+":checkin", nil); code != http.StatusOK {
+		t.Errorf("staff checking in: got status %d", code)
+	}
+	if loans, _ := bs.Loans.ListLoans(LoanFilter{UserID: ids["bob"]}); len(loans) != 1 || loans[0].Active() {
+		t.Errorf("loans of bob: got %+v", loans)
+	}
+}
+
+func TestCLILoans(t *testing.T) {
+	c := newCLI(t)
+	c.mustRun("books", "add", "-title", "Dune")
+	c.mustRun("copies", "add", "-barcode", "0001", "1")
+	c.mustRun("users", "create", "-subject", "alice", "-role", "viewer")
+
+	if code, _, _ := c.run("loans", "checkout", "0001"); code != exitUsage {
+		t.Errorf("loans checkout without -user: got exit code %d, want %d", code, exitUsage)
+	}
+	if code, _, _ := c.run("loans", "checkout", "-user", "1", "0002"); code != exitNotFound {
+		t.Errorf("loans checkout of a missing copy: got exit code %d, want %d", code, exitNotFound)
+	}
+	var l Loan
+	if err := json.Unmarshal([]byte(c.mustRun("loans", "checkout", "-user", "1", "-due", "2999-12-31", "0001")), &l); err != nil {
+		t.Fatal(err)
+	}
+	if l.CopyID != 1 || l.BookID != 1 || l.UserID != 1 || l.Due.Year() != 2999 {
+		t.Errorf("loans checkout: got %+v", l)
+	}
+	if code, _, _ := c.run("loans", "checkout", "-user", "1", "0001"); code != exitError {
+		t.Errorf("loans checkout of a copy on loan: got exit code %d, want %d", code, exitError)
+	}
+	if out := c.mustRun("loans", "list", "-active", "-user", "1"); strings.Count(out, "\n") != 1 {
+		t.Errorf("loans list -active: got %q", out)
+	}
+	c.mustRun("loans", "checkin", "0001")
+	if out := c.mustRun("loans", "list", "-active"); out != "" {
+		t.Errorf("loans list -active after checkin: got %q", out)
+	}
+	if out := c.mustRun("loans", "list", "-book", "1"); strings.Count(out, "\n") != 1 || !strings.Contains(out, `"returned"`) {
+		t.Errorf("loans list -book: got %q", out)
+	}
+}
@@ -36,14 +36,13 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
-	"path"
 	"runtime/debug"
 	"strconv"
+	"strings"
+	"time"
 
-	"cloud.google.com/go/storage"
-
-	"github.com/gofrs/uuid"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/jinzhu/gorm"
@@ -54,14 +53,60 @@ var (
 	listTmpl   = parseTemplate("list.html")
 	editTmpl   = parseTemplate("edit.html")
 	detailTmpl = parseTemplate("detail.html")
+	auditTmpl  = parseTemplate("audit.html")
+
+	authorsTmpl = parseTemplate("authors.html")
+	authorTmpl  = parseTemplate("author.html")
+
+	seriesListTmpl = parseTemplate("serieslist.html")
+	seriesTmpl     = parseTemplate("series.html")
+
+	collectionsTmpl = parseTemplate("collections.html")
+	collectionTmpl  = parseTemplate("collection.html")
+
+	copyTmpl      = parseTemplate("copy.html")
+	loansTmpl     = parseTemplate("loans.html")
+	remindersTmpl = parseTemplate("reminders.html")
+	reviewsTmpl   = parseTemplate("reviews.html")
 )
 
 func main() {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	// Without arguments the web server is started, see cli.go for the
+	// other commands.
+	args := os.Args[1:]
+	if len(args) == 0 {
+		args = []string{"serve"}
+	}
+	os.Exit(runCommand(context.Background(), newBookshelfFromEnv, args, os.Stdout, os.Stderr))
+}
+
+// serve runs the web server on port.
+func (b *Bookshelf) serve(ctx context.Context, port string) error {
+	if issuer := os.Getenv("OIDC_ISSUER_URL"); issuer != "" {
+		cfg, err := oidcConfigFromEnv(issuer)
+		if err != nil {
+			return fmt.Errorf("OIDC: %v", err)
+		}
+		if err := b.configureOIDC(ctx, cfg); err != nil {
+			return fmt.Errorf("configureOIDC: %v", err)
+		}
 	}
 
+	b.registerHandlers()
+	if b.Holds != nil {
+		go b.expireHolds(ctx, holdExpiryInterval)
+	}
+	if b.mailer != nil && b.Reminders != nil && b.Loans != nil {
+		go b.remindEvery(ctx, defaultReminderInterval)
+	}
+
+	log.Printf("Listening on localhost:%s", port)
+	return http.ListenAndServe(":"+port, nil)
+}
+
+// newBookshelfFromEnv connects to the database and the image store
+// configured through the environment.
+func newBookshelfFromEnv(ctx context.Context) (*Bookshelf, error) {
 	DBHost := os.Getenv("DB_HOST")
 	if DBHost == "" {
 		DBHost = "localhost"
@@ -74,48 +119,345 @@ func main() {
 		"mysql",
 		"user:password@("+DBHost+":"+DBPort+")/default?charset=utf8mb4&parseTime=True&loc=Local")
 	if err != nil {
-		log.Fatalf("gorm.open: %v", err)
+		return nil, fmt.Errorf("gorm.open: %v", err)
+	}
+	if os.Getenv("AUTO_MIGRATE") == "true" {
+		// Replicas starting together wait for each other, see migrations.go.
+		err := withMigrator(ctx, client.DB(), log.Printf, func(m *migrator) error {
+			return m.up(ctx)
+		})
+		if err != nil {
+			return nil, err
+		}
 	}
 	db, err := newDB(client)
 	if err != nil {
-		log.Fatalf("newDB: %v", err)
+		return nil, fmt.Errorf("newDB: %v", err)
 	}
 	b, err := NewBookshelf(db)
 	if err != nil {
-		log.Fatalf("NewBookshelf: %v", err)
+		return nil, fmt.Errorf("NewBookshelf: %v", err)
+	}
+	b.trustProxy = os.Getenv("TRUST_PROXY") == "true"
+	b.templateDir = os.Getenv("TEMPLATE_DIR")
+	if err := configureLimitsFromEnv(b); err != nil {
+		return nil, fmt.Errorf("limits: %v", err)
+	}
+	if err := configureImagesFromEnv(ctx, b); err != nil {
+		return nil, fmt.Errorf("images: %v", err)
+	}
+	if err := configureCacheFromEnv(b); err != nil {
+		return nil, fmt.Errorf("cache: %v", err)
 	}
+	if err := configureRemindersFromEnv(b); err != nil {
+		return nil, fmt.Errorf("reminders: %v", err)
+	}
+	return b, nil
+}
 
-	b.registerHandlers()
+// configureCacheFromEnv puts a cache in front of the database, keeping up
+// to BOOK_CACHE_SIZE books (0 disables the cache) for BOOK_CACHE_TTL.
+func configureCacheFromEnv(b *Bookshelf) error {
+	size, ttl := defaultBookCacheSize, defaultBookCacheTTL
+	if s := os.Getenv("BOOK_CACHE_SIZE"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return fmt.Errorf("bad BOOK_CACHE_SIZE %q", s)
+		}
+		size = n
+	}
+	if s := os.Getenv("BOOK_CACHE_TTL"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("bad BOOK_CACHE_TTL %q", s)
+		}
+		ttl = d
+	}
+	if size > 0 {
+		b.DB = newCachedDB(b.DB, size, ttl)
+	}
+	return nil
+}
 
-	log.Printf("Listening on localhost:%s", port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		log.Fatal(err)
+// configureImagesFromEnv sets up the image store: a Cloud Storage bucket
+// named by GCS_BUCKET, or the in-memory store with IMAGE_STORE=memory.
+// IMAGE_SIZES overrides the sizes covers are resized to.
+func configureImagesFromEnv(ctx context.Context, b *Bookshelf) error {
+	switch store := os.Getenv("IMAGE_STORE"); {
+	case store == "memory":
+		b.Images = newMemoryImageStore()
+	case store == "s3":
+		cfg, err := s3ConfigFromEnv()
+		if err != nil {
+			return err
+		}
+		s, err := newS3ImageStore(cfg)
+		if err != nil {
+			return err
+		}
+		b.Images = s
+	case store == "" || store == "gcs":
+		if bucket := os.Getenv("GCS_BUCKET"); bucket != "" {
+			s, err := newGCSImageStore(ctx, bucket)
+			if err != nil {
+				return err
+			}
+			b.Images = s
+		}
+	default:
+		return fmt.Errorf("unknown IMAGE_STORE %q", store)
+	}
+	if s := os.Getenv("IMAGE_SIZES"); s != "" {
+		sizes, err := parseImageSizes(s)
+		if err != nil {
+			return err
+		}
+		b.imageSizes = sizes
+	}
+	return nil
+}
+
+// s3ConfigFromEnv reads the S3_* environment variables.
+func s3ConfigFromEnv() (S3Config, error) {
+	cfg := S3Config{
+		Endpoint:        os.Getenv("S3_ENDPOINT"),
+		Region:          os.Getenv("S3_REGION"),
+		Bucket:          os.Getenv("S3_BUCKET"),
+		AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+		PublicURL:       strings.TrimSuffix(os.Getenv("S3_PUBLIC_URL"), "/"),
+	}
+	if s := os.Getenv("S3_PATH_STYLE"); s != "" {
+		v, err := strconv.ParseBool(s)
+		if err != nil {
+			return cfg, fmt.Errorf("bad S3_PATH_STYLE: %v", err)
+		}
+		cfg.PathStyle = v
+	}
+	if s := os.Getenv("S3_PRESIGN_EXPIRY"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return cfg, fmt.Errorf("bad S3_PRESIGN_EXPIRY: %v", err)
+		}
+		cfg.PresignExpiry = d
 	}
+	return cfg, nil
+}
+
+// oidcConfigFromEnv reads the OIDC_* environment variables.
+func oidcConfigFromEnv(issuer string) (OIDCConfig, error) {
+	cfg := OIDCConfig{
+		IssuerURL:    issuer,
+		ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+		Scopes:       []string{"email", "profile"},
+		RoleClaim:    os.Getenv("OIDC_ROLE_CLAIM"),
+	}
+	if cfg.RoleClaim == "" {
+		cfg.RoleClaim = "groups"
+	}
+	mapping, err := parseRoleMapping(os.Getenv("OIDC_ROLE_MAP"))
+	if err != nil {
+		return cfg, err
+	}
+	cfg.RoleMapping = mapping
+	if s := os.Getenv("OIDC_DEFAULT_ROLE"); s != "" {
+		if cfg.DefaultRole, err = parseRole(s); err != nil {
+			return cfg, err
+		}
+	}
+	return cfg, nil
+}
+
+// configureLimitsFromEnv applies the default rate limits, overridden by
+// RATE_LIMIT_<GROUP> (e.g. RATE_LIMIT_WRITE=1:10 or off), the
+// MAX_REQUEST_BYTES request size limit and the IMAGE_MAX_BYTES and
+// IMAGE_MAX_SIZE (e.g. 2000x3000) cover image limits.
+func configureLimitsFromEnv(b *Bookshelf) error {
+	for group, limit := range defaultRateLimits {
+		if s := os.Getenv("RATE_LIMIT_" + strings.ToUpper(group)); s != "" {
+			l, err := parseRateLimit(s)
+			if err != nil {
+				return fmt.Errorf("RATE_LIMIT_%s: %v", strings.ToUpper(group), err)
+			}
+			limit = l
+		}
+		b.setRateLimit(group, limit)
+	}
+	if s := os.Getenv("MAX_REQUEST_BYTES"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("bad MAX_REQUEST_BYTES %q", s)
+		}
+		b.maxRequestBytes = n
+	}
+	if s := os.Getenv("IMAGE_MAX_BYTES"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("bad IMAGE_MAX_BYTES %q", s)
+		}
+		b.imageLimits.MaxBytes = n
+	}
+	if s := os.Getenv("IMAGE_MAX_SIZE"); s != "" {
+		if _, err := fmt.Sscanf(s, "%dx%d", &b.imageLimits.MaxWidth, &b.imageLimits.MaxHeight); err != nil {
+			return fmt.Errorf("bad IMAGE_MAX_SIZE %q, want WIDTHxHEIGHT", s)
+		}
+	}
+	return nil
 }
 
 func (b *Bookshelf) registerHandlers() {
+	// Delegate all of the HTTP routing and serving to the gorilla/mux router.
+	// Log all requests using the standard Apache format.
+	http.Handle("/", handlers.CombinedLoggingHandler(b.logWriter, b.router()))
+}
+
+// router returns the routes of the bookshelf.
+func (b *Bookshelf) router() *mux.Router {
 	// Use gorilla/mux for rich routing.
 	// See https://www.gorillatoolkit.org/pkg/mux.
 	r := mux.NewRouter()
+	r.Use(withRequestID, b.limitBody, b.withUser)
+
+	// Handlers are grouped by who may use them, and rate limited per group
+	// (see ratelimit.go).
+	public := func(group string, h appHandler) http.Handler {
+		return b.rateLimit(group, h)
+	}
+	// staff wraps handlers that change the catalog.
+	staff := func(h appHandler) http.Handler {
+		return b.rateLimit(groupWrite, b.requireRole(RoleStaff, b.holdWrites(h)))
+	}
+	// signedIn wraps handlers that show what belongs to the signed-in
+	// user, and member those which change it.
+	signedIn := func(h appHandler) http.Handler {
+		return b.rateLimit(groupRead, b.requireRole(RoleViewer, h))
+	}
+	member := func(h appHandler) http.Handler {
+		return b.rateLimit(groupWrite, b.requireRole(RoleViewer, b.holdWrites(h)))
+	}
+	// admin wraps handlers that manage the bookshelf itself, and
+	// adminWrite those among them which change the catalog.
+	admin := func(h appHandler) http.Handler {
+		return b.rateLimit(groupAdmin, b.requireRole(RoleAdmin, h))
+	}
+	adminWrite := func(h appHandler) http.Handler {
+		return b.rateLimit(groupAdmin, b.requireRole(RoleAdmin, b.holdWrites(h)))
+	}
 
 	r.Handle("/", http.RedirectHandler("/books", http.StatusFound))
 
 	r.Methods("GET").Path("/books").
-		Handler(appHandler(b.listHandler))
+		Handler(public(groupRead, b.listHandler))
 	r.Methods("GET").Path("/books/add").
-		Handler(appHandler(b.addFormHandler))
+		Handler(staff(b.addFormHandler))
 	r.Methods("GET").Path("/books/{id:[0-9a-zA-Z_\\-]+}").
-		Handler(appHandler(b.detailHandler))
+		Handler(public(groupRead, b.detailHandler))
 	r.Methods("GET").Path("/books/{id:[0-9a-zA-Z_\\-]+}/edit").
-		Handler(appHandler(b.editFormHandler))
+		Handler(staff(b.editFormHandler))
 
 	r.Methods("POST").Path("/books").
-		Handler(appHandler(b.createHandler))
+		Handler(staff(b.createHandler))
 	r.Methods("POST", "PUT").Path("/books/{id:[0-9a-zA-Z_\\-]+}").
-		Handler(appHandler(b.updateHandler))
+		Handler(staff(b.updateHandler))
 
 	r.Methods("POST").Path("/books/{id:[0-9a-zA-Z_\\-]+}:delete").
-		Handler(appHandler(b.deleteHandler))
+		Handler(staff(b.deleteHandler))
+
+	// See authors.go.
+	r.Methods("GET").Path("/authors").
+		Handler(public(groupRead, b.authorsHandler))
+	r.Methods("GET").Path("/authors.json").
+		Handler(public(groupRead, b.authorSuggestHandler))
+	r.Methods("GET").Path("/authors/{id:[0-9]+}").
+		Handler(public(groupRead, b.authorHandler))
+
+	// See series.go.
+	r.Methods("GET").Path("/series").
+		Handler(public(groupRead, b.seriesListHandler))
+	r.Methods("GET").Path("/series/{id:[0-9]+}").
+		Handler(public(groupRead, b.seriesHandler))
+
+	// See copies.go.
+	r.Methods("POST").Path("/books/{id:[0-9]+}/copies").
+		Handler(staff(b.addCopyHandler))
+	r.Methods("GET").Path("/copies/{id:[0-9]+}/edit").
+		Handler(staff(b.editCopyHandler))
+	r.Methods("POST").Path("/copies/{id:[0-9]+}").
+		Handler(staff(b.updateCopyHandler))
+	r.Methods("POST").Path("/copies/{id:[0-9]+}:delete").
+		Handler(staff(b.deleteCopyHandler))
+
+	// See loans.go.
+	r.Methods("POST").Path("/copies/{id:[0-9]+}:checkout").
+		Handler(member(b.checkOutHandler))
+	r.Methods("POST").Path("/copies/{id:[0-9]+}:checkin").
+		Handler(member(b.checkInHandler))
+	r.Methods("GET").Path("/loans").
+		Handler(signedIn(b.myLoansHandler))
+	r.Methods("GET").Path("/books/{id:[0-9]+}/loans").
+		Handler(b.rateLimit(groupRead, b.requireRole(RoleStaff, appHandler(b.bookLoansHandler))))
+
+	// See holds.go.
+	r.Methods("POST").Path("/books/{id:[0-9]+}/holds").
+		Handler(member(b.placeHoldHandler))
+	r.Methods("POST").Path("/holds/{id:[0-9]+}:cancel").
+		Handler(member(b.cancelHoldHandler))
+
+	// See reviews.go.
+	r.Methods("POST").Path("/books/{id:[0-9]+}/review").
+		Handler(member(b.saveReviewHandler))
+	r.Methods("POST").Path("/reviews/{id:[0-9]+}:delete").
+		Handler(member(b.deleteReviewHandler))
+	r.Methods("POST").Path("/reviews/{id:[0-9]+}:hide").
+		Handler(adminWrite(b.moderateReviewHandler))
+	r.Methods("GET").Path("/admin/reviews").Handler(admin(b.reviewsModerationHandler))
+
+	// See collections.go.
+	r.Methods("GET").Path("/collections").
+		Handler(signedIn(b.collectionsHandler))
+	r.Methods("GET").Path("/collections/{id:[0-9]+}").
+		Handler(signedIn(b.collectionHandler))
+	r.Methods("POST").Path("/collections").
+		Handler(member(b.createCollectionHandler))
+	r.Methods("POST").Path("/collections/{id:[0-9]+}").
+		Handler(member(b.updateCollectionHandler))
+	r.Methods("POST").Path("/collections/{id:[0-9]+}:share").
+		Handler(member(b.shareCollectionHandler))
+	r.Methods("POST").Path("/collections/{id:[0-9]+}:delete").
+		Handler(member(b.deleteCollectionHandler))
+	r.Methods("POST").Path("/collections/{id:[0-9]+}/books").
+		Handler(member(b.addToCollectionHandler))
+	r.Methods("POST").Path("/books/{book:[0-9]+}/collections").
+		Handler(member(b.addToCollectionHandler))
+	r.Methods("POST").Path("/collections/{id:[0-9]+}/books/{book:[0-9]+}:remove").
+		Handler(member(b.removeFromCollectionHandler))
+	r.Methods("POST").Path("/collections/{id:[0-9]+}/books/{book:[0-9]+}:move").
+		Handler(member(b.moveInCollectionHandler))
+	r.Methods("POST").Path("/collections/{id:[0-9]+}:reorder").
+		Handler(member(b.moveInCollectionHandler))
+	r.Methods("GET").Path("/shared/{token:[0-9a-zA-Z_\\-]+}").
+		Handler(public(groupRead, b.collectionShareHandler))
+
+	// See audit.go.
+	r.Methods("GET").Path("/admin/audit").Handler(admin(b.auditHandler))
+	r.Methods("GET").Path("/admin/audit.jsonl").Handler(admin(b.auditExportHandler))
+
+	// See reminders.go.
+	r.Methods("POST").Path("/loans/reminders").Handler(member(b.optOutHandler))
+	r.Methods("GET").Path("/admin/reminders").Handler(admin(b.remindersHandler))
+
+	// See backup.go.
+	r.Methods("GET").Path("/admin/backup").Handler(admin(b.backupHandler))
+
+	// See db_cache.go.
+	r.Methods("GET").Path("/admin/cache").Handler(admin(b.cacheStatsHandler))
+
+	// Sign-in through OpenID Connect, see oidc.go.
+	r.Methods("GET").Path("/login").Handler(public(groupAuth, b.loginHandler))
+	r.Methods("GET").Path("/auth/callback").Handler(public(groupAuth, b.callbackHandler))
+	r.Methods("POST").Path("/logout").Handler(public(groupAuth, b.logoutHandler))
 
 	// Respond to App Engine and Compute Engine health checks.
 	// Indicate the server is healthy.
@@ -124,22 +466,91 @@ func (b *Bookshelf) registerHandlers() {
 			w.Write([]byte("ok"))
 		})
 
+	// Covers kept by an image store which does not serve them itself.
+	r.Methods("GET").PathPrefix(memoryImagePrefix).HandlerFunc(b.imagesHandler)
+	// See static.go.
+	r.Methods("GET", "HEAD").PathPrefix(staticPrefix).Handler(assets)
+
 	r.Methods("GET").Path("/logs").Handler(appHandler(b.sendLog))
 	r.Methods("GET").Path("/errors").Handler(appHandler(b.sendError))
 
-	// Delegate all of the HTTP routing and serving to the gorilla/mux router.
-	// Log all requests using the standard Apache format.
-	http.Handle("/", handlers.CombinedLoggingHandler(b.logWriter, r))
+	return r
 }
 
-// listHandler displays a list with summaries of books in the database.
+// listHandler displays a list with summaries of books in the database,
+// filtered and sorted as the query of the URL asks for, see bookQueryFromForm.
 func (b *Bookshelf) listHandler(w http.ResponseWriter, r *http.Request) *appError {
-	books, err := b.DB.ListBooks()
+	q, err := bookQueryFromForm(r)
+	if err != nil {
+		e := b.appErrorf(r, err, "%v", err)
+		e.code = http.StatusBadRequest
+		return e
+	}
+	books, err := b.DB.QueryBooks(q)
 	if err != nil {
 		return b.appErrorf(r, err, "could not list books: %v", err)
 	}
+	facets, err := b.DB.Facets(q)
+	if err != nil {
+		return b.appErrorf(r, err, "could not count facets: %v", err)
+	}
+	counts, err := b.copyCounts(books)
+	if err != nil {
+		return b.appErrorf(r, err, "%v", err)
+	}
+	ratings, err := b.ratingsOf(books)
+	if err != nil {
+		return b.appErrorf(r, err, "%v", err)
+	}
+
+	type listedBook struct {
+		bookView
+		Copies CopyCount
+		Rating RatingSummary
+	}
+	views := make([]listedBook, len(books))
+	for i, book := range books {
+		views[i] = listedBook{b.viewOf(book), counts[book.ID], ratings[book.ID]}
+	}
+	return listTmpl.Execute(b, w, r, struct {
+		Books  []listedBook
+		Query  url.Values
+		Facets []facetGroup
+	}{views, r.URL.Query(), facetGroups(facets, r.URL.Query())})
+}
 
-	return listTmpl.Execute(b, w, r, books)
+// bookQueryFromForm reads the sort and from and to years of the book list.
+func bookQueryFromForm(r *http.Request) (BookQuery, error) {
+	q := BookQuery{
+		Sort:  r.FormValue("sort"),
+		Genre: r.FormValue("genre"),
+		Tag:   r.FormValue("tag"),
+	}
+	if s := r.FormValue("author"); s != "" {
+		id, err := strconv.ParseUint(s, 10, 32)
+		if err != nil || id == 0 {
+			return q, fmt.Errorf("bad author ID %q", s)
+		}
+		q.AuthorID = uint(id)
+	}
+	for _, f := range []struct {
+		name string
+		year *int
+	}{
+		{"from", &q.PublishedFrom},
+		{"to", &q.PublishedTo},
+	} {
+		s := r.FormValue(f.name)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > 9999 {
+			return q, fmt.Errorf("bad year %q", s)
+		}
+		*f.year = n
+	}
+	return q, q.validate()
 }
 
 // bookFromRequest retrieves a book from the database given a book ID in the
@@ -170,13 +581,69 @@ func (b *Bookshelf) detailHandler(w http.ResponseWriter, r *http.Request) *appEr
 		return b.appErrorf(r, err, "%v", err)
 	}
 
-	return detailTmpl.Execute(b, w, r, book)
+	if err := b.loadCredits(book); err != nil {
+		return b.appErrorf(r, err, "%v", err)
+	}
+	if err := b.loadSeries(book); err != nil {
+		return b.appErrorf(r, err, "%v", err)
+	}
+	prev, next, err := b.seriesNeighbors(book)
+	if err != nil {
+		return b.appErrorf(r, err, "%v", err)
+	}
+	collections, err := b.userCollections(r)
+	if err != nil {
+		return b.appErrorf(r, err, "%v", err)
+	}
+	copies, err := b.copyViews(r, book)
+	if err != nil {
+		return b.appErrorf(r, err, "%v", err)
+	}
+	holds, err := b.holdsOf(r, book)
+	if err != nil {
+		return b.appErrorf(r, err, "%v", err)
+	}
+	reviews, err := b.reviewsOf(r, book)
+	if err != nil {
+		return b.appErrorf(r, err, "%v", err)
+	}
+	var borrowers []*User
+	if b.Loans != nil && b.Users != nil && b.hasRole(r, RoleStaff) {
+		if borrowers, err = b.Users.ListUsers(); err != nil {
+			return b.appErrorf(r, err, "could not list users: %v", err)
+		}
+	}
+
+	return detailTmpl.Execute(b, w, r, struct {
+		bookView
+		// Prev and Next are the books around it in its series.
+		Prev, Next *Book
+		// Collections are those the book may be added to.
+		Collections []*Collection
+		Copies      []copyStatus
+		// Conditions are offered by the form adding copies, unless the
+		// database does not keep copies.
+		Conditions []string
+		// Borrowers are offered to staff lending copies.
+		Borrowers []*User
+		Lending   bool
+		Staff     bool
+		// Holds is nil unless the database keeps holds, Reviews unless
+		// it keeps reviews.
+		Holds   *bookHolds
+		Reviews *bookReviews
+	}{b.viewOf(book), prev, next, collections, copies, conditionsOf(b.Copies),
+		borrowers, b.Loans != nil, b.hasRole(r, RoleStaff), holds, reviews})
 }
 
 // addFormHandler displays a form that captures details of a new book to add to
 // the database.
 func (b *Bookshelf) addFormHandler(w http.ResponseWriter, r *http.Request) *appError {
-	return editTmpl.Execute(b, w, r, nil)
+	v, err := b.newEditView(&Book{})
+	if err != nil {
+		return b.appErrorf(r, err, "%v", err)
+	}
+	return editTmpl.Execute(b, w, r, v)
 }
 
 // editFormHandler displays a form that allows the user to edit the details of
@@ -186,17 +653,100 @@ func (b *Bookshelf) editFormHandler(w http.ResponseWriter, r *http.Request) *app
 	if err != nil {
 		return b.appErrorf(r, err, "%v", err)
 	}
+	if err := b.loadCredits(book); err != nil {
+		return b.appErrorf(r, err, "%v", err)
+	}
+	if err := b.loadSeries(book); err != nil {
+		return b.appErrorf(r, err, "%v", err)
+	}
 
-	return editTmpl.Execute(b, w, r, book)
+	v, err := b.newEditView(book)
+	if err != nil {
+		return b.appErrorf(r, err, "%v", err)
+	}
+	return editTmpl.Execute(b, w, r, v)
+}
+
+// editView is the data of templates/edit.html.
+type editView struct {
+	*Book
+	// Rows are the credits of the author picker, with blank ones to add
+	// authors with.
+	Rows  []Credit
+	Roles []string
+	// GenreChoices is the genre vocabulary.
+	GenreChoices []string
+	// TagLine is the tags of the book, separated by commas.
+	TagLine string
+	// SeriesChoices are the series known, for completing the series name.
+	SeriesChoices []*Series
+}
+
+// blankCreditRows are added to the author picker, which works without
+// JavaScript thus.
+const blankCreditRows = 2
+
+func (b *Bookshelf) newEditView(book *Book) (editView, error) {
+	rows := append([]Credit(nil), book.Credits...)
+	for i := 0; i < blankCreditRows; i++ {
+		rows = append(rows, Credit{Role: creditAuthor})
+	}
+	genres, err := b.DB.ListGenres()
+	if err != nil {
+		return editView{}, fmt.Errorf("could not list genres: %v", err)
+	}
+	var series []*Series
+	if b.Series != nil {
+		if series, err = b.Series.ListSeries(); err != nil {
+			return editView{}, fmt.Errorf("could not list series: %v", err)
+		}
+	}
+	return editView{
+		Book:          book,
+		Rows:          rows,
+		Roles:         creditRoles,
+		GenreChoices:  genres,
+		TagLine:       strings.Join(book.Tags, ", "),
+		SeriesChoices: series,
+	}, nil
 }
 
 // bookFromForm populates the fields of a Book from form values
 // (see templates/edit.html).
 func (b *Bookshelf) bookFromForm(r *http.Request) (*Book, error) {
+	// Parse explicitly rather than through FormValue, which would hold up to
+	// 32MB of the form in memory.
+	if err := r.ParseMultipartForm(maxFormMemory); err != nil && err != http.ErrNotMultipart {
+		return nil, err
+	}
+	// Checked before storing the cover, which would be left unused.
+	published, err := parsePartialDate(r.FormValue("publishedDate"))
+	if err != nil {
+		return nil, err
+	}
+	credits, err := creditsFromForm(r)
+	if err != nil {
+		return nil, err
+	}
+	series, err := seriesFromForm(r)
+	if err != nil {
+		return nil, err
+	}
+	labels := &Book{Genres: r.Form["genre"], Tags: splitTags(r.FormValue("tags"))}
+	if err := b.prepareLabels(labels); err != nil {
+		return nil, err
+	}
+
 	ctx := r.Context()
 	imageURL, err := b.uploadFileFromForm(ctx, r)
 	if err != nil {
-		return nil, fmt.Errorf("could not upload file: %v", err)
+		return nil, fmt.Errorf("could not upload file: %w", err)
+	}
+	if imageURL == "" && r.FormValue("coverURL") != "" {
+		imageURL, err = b.importCover(ctx, r.FormValue("coverURL"))
+		if err != nil {
+			return nil, fmt.Errorf("could not import cover: %w", err)
+		}
 	}
 	if imageURL == "" {
 		imageURL = r.FormValue("imageURL")
@@ -204,72 +754,82 @@ func (b *Bookshelf) bookFromForm(r *http.Request) (*Book, error) {
 
 	book := &Book{
 		Title:         r.FormValue("title"),
-		Author:        r.FormValue("author"),
-		PublishedDate: r.FormValue("publishedDate"),
+		Author:        creditLine(credits),
+		Credits:       credits,
+		PublishedDate: published,
 		ImageURL:      imageURL,
 		Description:   r.FormValue("description"),
+		Genres:        labels.Genres,
+		Tags:          labels.Tags,
+		Series:        series,
 	}
 
 	return book, nil
 }
 
-// [START getting_started_bookshelf_storage]
-
 // uploadFileFromForm uploads a file if it's present in the "image" form field.
+// The file must be an acceptable image, see sanitizeImage. Resized variants
+// are stored next to it, see thumbnail.go.
 func (b *Bookshelf) uploadFileFromForm(ctx context.Context, r *http.Request) (url string, err error) {
 	f, fh, err := r.FormFile("image")
-	if err == http.ErrMissingFile {
+	if err == http.ErrMissingFile || err == http.ErrNotMultipart {
 		return "", nil
 	}
 	if err != nil {
 		return "", err
 	}
+	defer f.Close()
 
-	if b.StorageBucket == nil {
-		return "", errors.New("storage bucket is missing: check bookshelf.go")
-	}
-	if _, err := b.StorageBucket.Attrs(ctx); err != nil {
-		if err == storage.ErrBucketNotExist {
-			return "", fmt.Errorf("bucket %q does not exist: check bookshelf.go", b.StorageBucketName)
-		}
-		return "", fmt.Errorf("could not get bucket: %v", err)
+	if fh.Size > b.imageLimits.MaxBytes {
+		return "", fmt.Errorf("%w: more than %d bytes", errImageTooLarge, b.imageLimits.MaxBytes)
 	}
+	return b.storeCover(ctx, f)
+}
 
-	// random filename, retaining existing extension.
-	name := uuid.Must(uuid.NewV4()).String() + path.Ext(fh.Filename)
-
-	w := b.StorageBucket.Object(name).NewWriter(ctx)
+// storeCover sanitizes the cover read from r and stores it together with
+// its resized variants, returning its URL.
+func (b *Bookshelf) storeCover(ctx context.Context, r io.Reader) (string, error) {
+	img, err := sanitizeImage(r, b.imageLimits)
+	if err != nil {
+		return "", err
+	}
 
-	// Warning: storage.AllUsers gives public read access to anyone.
-	w.ACL = []storage.ACLRule{{Entity: storage.AllUsers, Role: storage.RoleReader}}
-	w.ContentType = fh.Header.Get("Content-Type")
+	if b.Images == nil {
+		return "", errNoImageStore
+	}
 
-	// Entries are immutable, be aggressive about caching (1 day).
-	w.CacheControl = "public, max-age=86400"
+	// Objects are named after their content, so a cover uploaded again is
+	// stored only once. It is written again all the same: that restarts
+	// the grace period of an unreferenced cover, which collectImages might
+	// be about to delete, and brings back one deleted meanwhile.
+	name := contentName(img.Data, img.Format.Ext)
 
-	if _, err := io.Copy(w, f); err != nil {
-		return "", err
-	}
-	if err := w.Close(); err != nil {
+	// Store the variants first, so that the original never shows up
+	// without them.
+	if err := b.putVariants(ctx, name, img.img); err != nil {
 		return "", err
 	}
-
-	const publicURL = "https://storage.googleapis.com/%s/%s"
-	return fmt.Sprintf(publicURL, b.StorageBucketName, name), nil
+	return b.Images.Put(ctx, name, img.Format.ContentType, img.Data)
 }
 
-// [END getting_started_bookshelf_storage]
-
 // createHandler adds a book to the database.
 func (b *Bookshelf) createHandler(w http.ResponseWriter, r *http.Request) *appError {
 	book, err := b.bookFromForm(r)
 	if err != nil {
-		return b.appErrorf(r, err, "could not parse book from form: %v", err)
+		return b.formErrorf(r, err)
 	}
 	id, err := b.DB.AddBook(book)
 	if err != nil {
 		return b.appErrorf(r, err, "could not save book: %v", err)
 	}
+	book.ID = id
+	if err := b.saveCredits(book); err != nil {
+		return b.appErrorf(r, err, "%v", err)
+	}
+	if err := b.saveSeries(book); err != nil {
+		return b.appErrorf(r, err, "%v", err)
+	}
+	b.audit(r, AuditCreate, id, nil, book)
 	http.Redirect(w, r, fmt.Sprintf("/books/%d", id), http.StatusFound)
 	return nil
 }
@@ -290,14 +850,35 @@ func (b *Bookshelf) updateHandler(w http.ResponseWriter, r *http.Request) *appEr
 
 	book, err := b.bookFromForm(r)
 	if err != nil {
-		return b.appErrorf(r, err, "could not parse book from form: %v", err)
+		return b.formErrorf(r, err)
 	}
 
 	book.ID = uint(id)
 
+	before, err := b.DB.GetBook(book.ID)
+	if err != nil {
+		return b.appErrorf(r, err, "could not find book: %v", err)
+	}
+	// The snapshot is taken now, since the database may hand out the very
+	// value it is about to replace.
+	beforeSnapshot := *before
+	if err := b.loadCredits(&beforeSnapshot); err != nil {
+		return b.appErrorf(r, err, "%v", err)
+	}
+	if err := b.loadSeries(&beforeSnapshot); err != nil {
+		return b.appErrorf(r, err, "%v", err)
+	}
+
 	if err := b.DB.UpdateBook(book); err != nil {
 		return b.appErrorf(r, err, "UpdateBook: %v", err)
 	}
+	if err := b.saveCredits(book); err != nil {
+		return b.appErrorf(r, err, "%v", err)
+	}
+	if err := b.saveSeries(book); err != nil {
+		return b.appErrorf(r, err, "%v", err)
+	}
+	b.audit(r, AuditUpdate, book.ID, &beforeSnapshot, book)
 	http.Redirect(w, r, fmt.Sprintf("/books/%d", book.ID), http.StatusFound)
 	return nil
 }
@@ -315,9 +896,21 @@ func (b *Bookshelf) deleteHandler(w http.ResponseWriter, r *http.Request) *appEr
 	if id == 0 {
 		return b.appErrorf(r, errors.New("invalid ID(0)"), "invalid ID(0)")
 	}
+	before, err := b.DB.GetBook(uint(id))
+	if err != nil {
+		return b.appErrorf(r, err, "could not find book: %v", err)
+	}
+	beforeSnapshot := *before
+
 	if err := b.DB.DeleteBook(uint(id)); err != nil {
-		return b.appErrorf(r, err, "DeleteBook: %v", err)
+		e := b.appErrorf(r, err, "DeleteBook: %v", err)
+		// A copy of the book is on loan or kept for a hold.
+		if errors.Is(err, errBadCopy) {
+			e.code = http.StatusConflict
+		}
+		return e
 	}
+	b.audit(r, AuditDelete, uint(id), &beforeSnapshot, nil)
 	http.Redirect(w, r, "/books", http.StatusFound)
 	return nil
 }
@@ -362,6 +955,22 @@ func (fn appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// formErrorf reports an error of bookFromForm, telling clients whose
+// request was too large apart from other failures.
+func (b *Bookshelf) formErrorf(r *http.Request, err error) *appError {
+	e := b.appErrorf(r, err, "could not parse book from form: %v", err)
+	switch {
+	case errors.Is(err, errBodyTooLarge), errors.Is(err, errImageTooLarge):
+		e.code = http.StatusRequestEntityTooLarge
+	case errors.Is(err, errBadImage), errors.Is(err, errCoverFetch),
+		errors.Is(err, errBadDate), errors.Is(err, errBadCredit),
+		errors.Is(err, errUnknownGenre), errors.Is(err, errBadTag),
+		errors.Is(err, errBadSeries):
+		e.code = http.StatusBadRequest
+	}
+	return e
+}
+
 func (b *Bookshelf) appErrorf(r *http.Request, err error, format string, v ...interface{}) *appError {
 	return &appError{
 		err:     err,
@@ -16,10 +16,13 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"mime/multipart"
+	"net/http"
 	"net/http/httptest"
 	"os"
 	"strings"
@@ -171,6 +174,78 @@ func TestAddAndDelete(t *testing.T) {
 	}
 }
 
+func TestAuditLog(t *testing.T) {
+	var body bytes.Buffer
+	m := multipart.NewWriter(&body)
+	m.WriteField("title", "audited")
+	m.Close()
+
+	req := wt.NewRequest("POST", "/books", &body)
+	req.Header.Set("Content-Type", "multipart/form-data; boundary="+m.Boundary())
+	req.Header.Set("X-Request-ID", "req-audit-1")
+	resp, err := wt.Client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	bookPath := resp.Request.URL.Path
+
+	if _, err := wt.Post(bookPath+":delete", "", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	bodyContains(t, wt, "/admin/audit?action=create", "req-audit-1")
+
+	export, _, err := wt.GetBody("/admin/audit.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for _, line := range strings.Split(strings.TrimSpace(export), "\n") {
+		var e AuditEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("bad JSON line %q: %v", line, err)
+		}
+		if fmt.Sprintf("/books/%d", e.BookID) == bookPath {
+			actions = append(actions, e.Action)
+			if e.Actor != "anonymous" || e.IP != "127.0.0.1" {
+				t.Errorf("got actor %q from %q, want anonymous from 127.0.0.1", e.Actor, e.IP)
+			}
+		}
+	}
+	if got, want := strings.Join(actions, ","), "delete,create"; got != want {
+		t.Errorf("audit actions: got %q, want %q", got, want)
+	}
+}
+
+// failingAuditLog refuses every entry.
+type failingAuditLog struct{ AuditLog }
+
+func (failingAuditLog) AppendAudit(*AuditEntry) error {
+	return errors.New("disk full")
+}
+
+func TestAuditFailureIsLogged(t *testing.T) {
+	bs, srv := newTestBookshelf(t)
+	bs.Audit = failingAuditLog{bs.Audit}
+	var logs bytes.Buffer
+	bs.logWriter = &logs
+
+	// The book is saved whether or not the audit log takes the entry, so
+	// the request succeeds and the entry goes to the log.
+	resp := postBook(t, srv.URL, "unaudited", "", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d, want 200", resp.StatusCode)
+	}
+	if books, _ := bs.DB.ListBooks(); len(books) != 1 {
+		t.Errorf("got %d books, want the book saved", len(books))
+	}
+	if got := logs.String(); !strings.Contains(got, "AUDIT LOG WRITE FAILED") || !strings.Contains(got, "disk full") || !strings.Contains(got, `"action":"create"`) {
+		t.Errorf("got log %q, want the failure and the entry", got)
+	}
+}
+
 func TestSendLog(t *testing.T) {
 	buf := &bytes.Buffer{}
 	oldLogger := b.logWriter
@@ -199,6 +274,22 @@ func TestSendError(t *testing.T) {
 	}
 }
 
+// newTestBookshelf starts a bookshelf of its own, backed by memory, for tests
+// which need to configure it.
+func newTestBookshelf(t *testing.T) (*Bookshelf, *httptest.Server) {
+	t.Helper()
+
+	bs, err := NewBookshelf(newMemoryDB())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs.logWriter = ioutil.Discard
+	bs.Images = newMemoryImageStore()
+	srv := httptest.NewServer(bs.router())
+	t.Cleanup(srv.Close)
+	return bs, srv
+}
+
 func bodyContains(t *testing.T, wt *webtest.W, path, contains string) bool {
 	t.Helper()
 
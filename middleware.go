@@ -0,0 +1,80 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gofrs/uuid"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+type requestIDContextKey struct{}
+
+// withRequestID tags every request with an ID, reusing the one set by a
+// proxy in front of the bookshelf if it looks sane, and echoes it back.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.Must(uuid.NewV4()).String()
+		}
+		w.Header().Set(requestIDHeader, id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDContextKey{}, id))
+		next.ServeHTTP(w, r)
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if !(c == '-' || c == '_' || c == '.' ||
+			'0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// requestID returns the ID assigned to r by withRequestID.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// clientIP returns the address of the client of r. X-Forwarded-For is only
+// honored when the bookshelf runs behind a trusted proxy, otherwise anyone
+// could claim any address.
+func (b *Bookshelf) clientIP(r *http.Request) string {
+	if b.trustProxy {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			// The last entry was added by our proxy.
+			parts := strings.Split(fwd, ",")
+			if ip := strings.TrimSpace(parts[len(parts)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
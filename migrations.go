@@ -0,0 +1,438 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrationFiles are the SQL migrations of the MySQL schema, in the format
+// of github.com/golang-migrate/migrate: N_name.up.sql and N_name.down.sql.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// writeMigrations copies the embedded migrations to dir, for running them
+// with the migrate tool without a checkout of the sources.
+func writeMigrations(dir string) ([]string, error) {
+	names, err := fs.Glob(migrationFiles, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	var written []string
+	for _, name := range names {
+		data, err := migrationFiles.ReadFile(name)
+		if err != nil {
+			return written, err
+		}
+		dst := filepath.Join(dir, filepath.Base(name))
+		if err := ioutil.WriteFile(dst, data, 0644); err != nil {
+			return written, fmt.Errorf("could not write migration: %v", err)
+		}
+		written = append(written, dst)
+	}
+	return written, nil
+}
+
+// migration is a version of the schema, reached by running Up on the
+// previous version and left by running Down.
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+var migrationFile = regexp.MustCompile(`^([0-9]+)_(.+)\.(up|down)\.sql$`)
+
+// loadMigrations reads the migrations of dir in files, ordered by version.
+func loadMigrations(files fs.FS, dir string) ([]migration, error) {
+	entries, err := fs.ReadDir(files, dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*migration)
+	for _, e := range entries {
+		m := migrationFile.FindStringSubmatch(e.Name())
+		if m == nil {
+			continue
+		}
+		version, err := strconv.Atoi(m[1])
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migrations: bad version in %s", e.Name())
+		}
+		data, err := fs.ReadFile(files, path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		}
+		if mig.Name != m[2] {
+			return nil, fmt.Errorf("migrations: version %d is both %s and %s", version, mig.Name, m[2])
+		}
+		if m[3] == "up" {
+			mig.Up = string(data)
+		} else {
+			mig.Down = string(data)
+		}
+	}
+	var migrations []migration
+	for _, mig := range byVersion {
+		if mig.Up == "" || mig.Down == "" {
+			return nil, fmt.Errorf("migrations: version %d lacks an up or down file", mig.Version)
+		}
+		migrations = append(migrations, *mig)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// splitStatements splits a migration into statements, which end with a
+// semicolon at the end of a line. Parts holding nothing but comments are
+// dropped.
+func splitStatements(script string) []string {
+	var stmts []string
+	var cur strings.Builder
+	flush := func() {
+		stmt := strings.TrimSpace(cur.String())
+		cur.Reset()
+		for _, line := range strings.Split(stmt, "\n") {
+			if l := strings.TrimSpace(line); l != "" && !strings.HasPrefix(l, "--") {
+				stmts = append(stmts, strings.TrimSuffix(stmt, ";"))
+				return
+			}
+		}
+	}
+	for _, line := range strings.Split(script, "\n") {
+		cur.WriteString(line + "\n")
+		if strings.HasSuffix(strings.TrimSpace(line), ";") {
+			flush()
+		}
+	}
+	flush()
+	return stmts
+}
+
+// migrationStore is a database migrations are applied to.
+type migrationStore interface {
+	// lock waits until no other process is migrating the database and
+	// keeps others out until unlock is called.
+	lock(ctx context.Context) (unlock func() error, err error)
+
+	// version returns the current version, 0 if no migration was applied.
+	// dirty means that migrating to the version failed halfway.
+	version(ctx context.Context) (version int, dirty bool, err error)
+
+	// setVersion records the current version.
+	setVersion(ctx context.Context, version int, dirty bool) error
+
+	// exec runs a statement of a migration.
+	exec(ctx context.Context, stmt string) error
+}
+
+// migrator applies migrations to a store.
+type migrator struct {
+	store      migrationStore
+	migrations []migration
+	logf       func(format string, v ...interface{})
+}
+
+// newMigrator creates a migrator applying the embedded migrations.
+func newMigrator(store migrationStore, logf func(format string, v ...interface{})) (*migrator, error) {
+	migrations, err := loadMigrations(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	return &migrator{store: store, migrations: migrations, logf: logf}, nil
+}
+
+// latest returns the version of the last migration.
+func (m *migrator) latest() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// index returns the position of version in m.migrations, -1 for version 0.
+func (m *migrator) index(version int) (int, error) {
+	if version == 0 {
+		return -1, nil
+	}
+	for i, mig := range m.migrations {
+		if mig.Version == version {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("migrate: unknown version %d", version)
+}
+
+// migrationStatus describes the state of the database.
+type migrationStatus struct {
+	Version int
+	Dirty   bool
+	Pending []migration
+}
+
+// status returns the current version and the migrations not applied yet.
+func (m *migrator) status(ctx context.Context) (migrationStatus, error) {
+	version, dirty, err := m.store.version(ctx)
+	if err != nil {
+		return migrationStatus{}, err
+	}
+	s := migrationStatus{Version: version, Dirty: dirty}
+	for _, mig := range m.migrations {
+		if mig.Version > version {
+			s.Pending = append(s.Pending, mig)
+		}
+	}
+	return s, nil
+}
+
+// up applies all pending migrations.
+func (m *migrator) up(ctx context.Context) error {
+	return m.migrate(ctx, func(int) (int, error) { return m.latest(), nil })
+}
+
+// down reverts the last n migrations.
+func (m *migrator) down(ctx context.Context, n int) error {
+	return m.migrate(ctx, func(current int) (int, error) {
+		i, err := m.index(current)
+		if err != nil {
+			return 0, err
+		}
+		if i-n < 0 {
+			return 0, nil
+		}
+		return m.migrations[i-n].Version, nil
+	})
+}
+
+// gotoVersion migrates up or down to version.
+func (m *migrator) gotoVersion(ctx context.Context, version int) error {
+	return m.migrate(ctx, func(int) (int, error) { return version, nil })
+}
+
+// force records version as the current one without running anything, to
+// recover from a dirty state once the database was repaired by hand.
+func (m *migrator) force(ctx context.Context, version int) error {
+	if _, err := m.index(version); err != nil {
+		return err
+	}
+	unlock, err := m.store.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return m.store.setVersion(ctx, version, false)
+}
+
+// migrate runs the migrations from the current version to the one returned
+// by target, holding the lock of the store throughout.
+func (m *migrator) migrate(ctx context.Context, target func(current int) (int, error)) error {
+	unlock, err := m.store.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	current, dirty, err := m.store.version(ctx)
+	if err != nil {
+		return err
+	}
+	if dirty {
+		return fmt.Errorf("migrate: version %d is dirty: repair the database and run \"migrate force N\"", current)
+	}
+	from, err := m.index(current)
+	if err != nil {
+		return err
+	}
+	version, err := target(current)
+	if err != nil {
+		return err
+	}
+	to, err := m.index(version)
+	if err != nil {
+		return err
+	}
+
+	for i := from + 1; i <= to; i++ {
+		mig := m.migrations[i]
+		if err := m.run(ctx, mig, mig.Up, mig.Version, mig.Version); err != nil {
+			return err
+		}
+	}
+	for i := from; i > to; i-- {
+		mig := m.migrations[i]
+		prev := 0
+		if i > 0 {
+			prev = m.migrations[i-1].Version
+		}
+		if err := m.run(ctx, mig, mig.Down, mig.Version, prev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// run executes script, marking the database dirty at version while doing so
+// and recording done once it succeeded. On failure the database stays dirty.
+func (m *migrator) run(ctx context.Context, mig migration, script string, version, done int) error {
+	direction := "up"
+	if done < version {
+		direction = "down"
+	}
+	if err := m.store.setVersion(ctx, version, true); err != nil {
+		return err
+	}
+	start := time.Now()
+	for _, stmt := range splitStatements(script) {
+		if err := m.store.exec(ctx, stmt); err != nil {
+			return fmt.Errorf("migrate: %d_%s %s: %v", mig.Version, mig.Name, direction, err)
+		}
+	}
+	if err := m.store.setVersion(ctx, done, false); err != nil {
+		return err
+	}
+	m.logf("%d_%s %s (%v)", mig.Version, mig.Name, direction, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// withMigrator runs f with a migrator for the MySQL database db.
+func withMigrator(ctx context.Context, db *sql.DB, logf func(format string, v ...interface{}), f func(*migrator) error) error {
+	store, err := newMySQLMigrationStore(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	m, err := newMigrator(store, logf)
+	if err != nil {
+		return err
+	}
+	return f(m)
+}
+
+// mysqlMigrationStore records the version in the schema_migrations table
+// of github.com/golang-migrate/migrate, so that databases migrated with
+// that tool carry on where it stopped.
+type mysqlMigrationStore struct {
+	// conn is a single connection: the lock belongs to the session.
+	conn *sql.Conn
+}
+
+var _ migrationStore = &mysqlMigrationStore{}
+
+const (
+	migrationLockName    = "bookshelf_migrate"
+	migrationLockTimeout = 5 * time.Minute
+)
+
+func newMySQLMigrationStore(ctx context.Context, db *sql.DB) (*mysqlMigrationStore, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("migrate: %v", err)
+	}
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+  version BIGINT NOT NULL,
+  dirty BOOLEAN NOT NULL,
+  PRIMARY KEY (version)
+)`)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("migrate: could not create schema_migrations: %v", err)
+	}
+	return &mysqlMigrationStore{conn: conn}, nil
+}
+
+// Close releases the connection.
+func (s *mysqlMigrationStore) Close() error {
+	return s.conn.Close()
+}
+
+func (s *mysqlMigrationStore) lock(ctx context.Context) (func() error, error) {
+	var ok sql.NullInt64
+	err := s.conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)",
+		migrationLockName, int(migrationLockTimeout.Seconds())).Scan(&ok)
+	if err != nil {
+		return nil, fmt.Errorf("migrate: could not lock: %v", err)
+	}
+	if !ok.Valid || ok.Int64 != 1 {
+		return nil, fmt.Errorf("migrate: another process has been migrating for %v", migrationLockTimeout)
+	}
+	return func() error {
+		_, err := s.conn.ExecContext(context.Background(), "DO RELEASE_LOCK(?)", migrationLockName)
+		return err
+	}, nil
+}
+
+func (s *mysqlMigrationStore) version(ctx context.Context) (int, bool, error) {
+	var version int
+	var dirty bool
+	err := s.conn.QueryRowContext(ctx, "SELECT version, dirty FROM schema_migrations LIMIT 1").Scan(&version, &dirty)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("migrate: could not read version: %v", err)
+	}
+	return version, dirty, nil
+}
+
+func (s *mysqlMigrationStore) setVersion(ctx context.Context, version int, dirty bool) error {
+	tx, err := s.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("migrate: %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM schema_migrations"); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("migrate: could not record version: %v", err)
+	}
+	if version > 0 {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, dirty) VALUES (?, ?)", version, dirty); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migrate: could not record version: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("migrate: could not record version: %v", err)
+	}
+	return nil
+}
+
+func (s *mysqlMigrationStore) exec(ctx context.Context, stmt string) error {
+	_, err := s.conn.ExecContext(ctx, stmt)
+	return err
+}
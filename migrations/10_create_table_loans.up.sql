@@ -0,0 +1,20 @@
+-- returned_at is NULL while the copy is on loan. active_copy_id backs up
+-- the locking of CheckOut: a copy has one active loan at most.
+CREATE TABLE IF NOT EXISTS default.loans (
+  id MEDIUMINT NOT NULL AUTO_INCREMENT,
+  copy_id MEDIUMINT NOT NULL,
+  book_id MEDIUMINT NOT NULL,
+  user_id MEDIUMINT NOT NULL,
+  checked_out_at DATETIME NOT NULL,
+  due_at DATETIME NOT NULL,
+  returned_at DATETIME NULL,
+  active_copy_id MEDIUMINT AS (IF(returned_at IS NULL, copy_id, NULL)) STORED,
+  PRIMARY KEY (id),
+  UNIQUE KEY loans_active_copy (active_copy_id),
+  KEY loans_copy (copy_id),
+  KEY loans_book (book_id),
+  KEY loans_user (user_id, returned_at),
+  KEY loans_due (returned_at, due_at),
+  CONSTRAINT loans_copy FOREIGN KEY (copy_id) REFERENCES default.copies (id) ON DELETE CASCADE,
+  CONSTRAINT loans_user FOREIGN KEY (user_id) REFERENCES default.users (id)
+);
@@ -0,0 +1,19 @@
+-- status is one of waiting, ready, fulfilled, cancelled and expired.
+-- copy_id is the copy kept for a ready hold, and 0 before one is.
+CREATE TABLE IF NOT EXISTS default.holds (
+  id MEDIUMINT NOT NULL AUTO_INCREMENT,
+  book_id MEDIUMINT NOT NULL,
+  user_id MEDIUMINT NOT NULL,
+  status VARCHAR(16) NOT NULL,
+  placed_at DATETIME NOT NULL,
+  copy_id MEDIUMINT NOT NULL DEFAULT 0,
+  expires_at DATETIME NULL,
+  closed_at DATETIME NULL,
+  PRIMARY KEY (id),
+  KEY holds_queue (book_id, status, placed_at),
+  KEY holds_user (user_id, status),
+  KEY holds_copy (copy_id, status),
+  KEY holds_expiry (status, expires_at),
+  CONSTRAINT holds_book FOREIGN KEY (book_id) REFERENCES default.books (id) ON DELETE CASCADE,
+  CONSTRAINT holds_user FOREIGN KEY (user_id) REFERENCES default.users (id)
+);
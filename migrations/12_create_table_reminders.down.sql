@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS default.reminder_opt_outs;
+DROP TABLE IF EXISTS default.reminders;
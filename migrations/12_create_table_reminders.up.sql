@@ -0,0 +1,25 @@
+-- reminders is the delivery log of reminder emails. A loan gets one
+-- reminder of each kind at most.
+CREATE TABLE IF NOT EXISTS default.reminders (
+  id MEDIUMINT NOT NULL AUTO_INCREMENT,
+  loan_id MEDIUMINT NOT NULL,
+  user_id MEDIUMINT NOT NULL,
+  kind VARCHAR(16) NOT NULL,
+  status VARCHAR(16) NOT NULL,
+  recipient VARCHAR(255) NOT NULL DEFAULT '',
+  queued_at DATETIME NOT NULL,
+  attempts INT NOT NULL DEFAULT 0,
+  next_attempt_at DATETIME NOT NULL,
+  last_error TEXT NULL,
+  sent_at DATETIME NULL,
+  PRIMARY KEY (id),
+  UNIQUE KEY reminders_loan_kind (loan_id, kind),
+  KEY reminders_pending (status, next_attempt_at),
+  KEY reminders_user (user_id)
+);
+
+CREATE TABLE IF NOT EXISTS default.reminder_opt_outs (
+  user_id MEDIUMINT NOT NULL,
+  PRIMARY KEY (user_id),
+  CONSTRAINT reminder_opt_outs_user FOREIGN KEY (user_id) REFERENCES default.users (id) ON DELETE CASCADE
+);
@@ -0,0 +1,17 @@
+-- A user reviews a book once at most. Hidden reviews were taken down by a
+-- moderator and do not count towards ratings.
+CREATE TABLE IF NOT EXISTS default.reviews (
+  id MEDIUMINT NOT NULL AUTO_INCREMENT,
+  book_id MEDIUMINT NOT NULL,
+  user_id MEDIUMINT NOT NULL,
+  rating TINYINT NOT NULL,
+  body TEXT NOT NULL,
+  created_at DATETIME NOT NULL,
+  updated_at DATETIME NOT NULL,
+  hidden BOOLEAN NOT NULL DEFAULT FALSE,
+  PRIMARY KEY (id),
+  UNIQUE KEY reviews_book_user (book_id, user_id),
+  KEY reviews_user (user_id),
+  CONSTRAINT reviews_book FOREIGN KEY (book_id) REFERENCES default.books (id) ON DELETE CASCADE,
+  CONSTRAINT reviews_user FOREIGN KEY (user_id) REFERENCES default.users (id)
+);
@@ -0,0 +1,5 @@
+-- The loans of the copies deleted since are dropped again.
+DELETE FROM default.loans WHERE copy_id NOT IN (SELECT id FROM default.copies);
+
+ALTER TABLE default.loans
+  ADD CONSTRAINT loans_copy FOREIGN KEY (copy_id) REFERENCES default.copies (id) ON DELETE CASCADE;
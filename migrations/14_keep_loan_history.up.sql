@@ -0,0 +1,4 @@
+-- Loans outlive the copies they are of, keeping copy_id and book_id as the
+-- record of what was borrowed. DeleteBook and DeleteCopy refuse to delete
+-- copies on loan.
+ALTER TABLE default.loans DROP FOREIGN KEY loans_copy;
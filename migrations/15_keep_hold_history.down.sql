@@ -0,0 +1,5 @@
+-- The holds of the books deleted since are dropped again.
+DELETE FROM default.holds WHERE book_id NOT IN (SELECT id FROM default.books);
+
+ALTER TABLE default.holds
+  ADD CONSTRAINT holds_book FOREIGN KEY (book_id) REFERENCES default.books (id) ON DELETE CASCADE;
@@ -0,0 +1,3 @@
+-- Holds outlive the books they are on, keeping book_id as the record of
+-- what was held. DeleteBook cancels the holds still waiting.
+ALTER TABLE default.holds DROP FOREIGN KEY holds_book;
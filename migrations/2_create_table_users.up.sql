@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS default.users (
+  id MEDIUMINT NOT NULL AUTO_INCREMENT,
+  issuer VARCHAR(255) NOT NULL,
+  subject VARCHAR(255) NOT NULL,
+  email VARCHAR(255),
+  name VARCHAR(255),
+  role VARCHAR(32) NOT NULL,
+  created_at DATETIME NOT NULL,
+  last_login_at DATETIME,
+  PRIMARY KEY (id),
+  UNIQUE KEY users_issuer_subject (issuer, subject)
+);
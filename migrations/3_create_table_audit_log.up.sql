@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS default.audit_log (
+  id BIGINT NOT NULL AUTO_INCREMENT,
+  time DATETIME(6) NOT NULL,
+  actor VARCHAR(255) NOT NULL,
+  ip VARCHAR(64),
+  request_id VARCHAR(128),
+  action VARCHAR(32) NOT NULL,
+  book_id MEDIUMINT NOT NULL,
+  before_json TEXT,
+  after_json TEXT,
+  PRIMARY KEY (id),
+  KEY audit_log_time (time),
+  KEY audit_log_book (book_id)
+);
+
+-- The audit log is append-only: revoke UPDATE and DELETE on it from the
+-- application user where the database permits it.
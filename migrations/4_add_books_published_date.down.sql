@@ -0,0 +1,14 @@
+-- Write the structured dates back, so that dates entered since the
+-- upgrade are not lost.
+UPDATE default.books
+  SET published_at = CONCAT_WS('-',
+    LPAD(published_year, 4, '0'),
+    IF(published_month = 0, NULL, LPAD(published_month, 2, '0')),
+    IF(published_day = 0, NULL, LPAD(published_day, 2, '0')))
+  WHERE published_year <> 0;
+
+ALTER TABLE default.books
+  DROP KEY books_published,
+  DROP COLUMN published_year,
+  DROP COLUMN published_month,
+  DROP COLUMN published_day;
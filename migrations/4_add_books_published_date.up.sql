@@ -0,0 +1,29 @@
+ALTER TABLE default.books
+  ADD COLUMN published_year SMALLINT NOT NULL DEFAULT 0,
+  ADD COLUMN published_month TINYINT NOT NULL DEFAULT 0,
+  ADD COLUMN published_day TINYINT NOT NULL DEFAULT 0,
+  ADD KEY books_published (published_year, published_month, published_day);
+
+-- published_at keeps the free-text dates entered so far. Dates in the
+-- form 1965, 1965-08 and 1965-08-01 are converted here; run
+-- "bookshelf convert-dates" afterwards for the other formats and a report
+-- of the dates which cannot be parsed.
+UPDATE default.books
+  SET published_year = CAST(TRIM(published_at) AS UNSIGNED)
+  WHERE TRIM(published_at) REGEXP '^[0-9]{4}$'
+    AND CAST(TRIM(published_at) AS UNSIGNED) > 0;
+
+UPDATE default.books
+  SET published_year = CAST(SUBSTRING(TRIM(published_at), 1, 4) AS UNSIGNED),
+    published_month = CAST(SUBSTRING(TRIM(published_at), 6, 2) AS UNSIGNED)
+  WHERE TRIM(published_at) REGEXP '^[0-9]{4}-(0[1-9]|1[0-2])$'
+    AND CAST(SUBSTRING(TRIM(published_at), 1, 4) AS UNSIGNED) > 0;
+
+UPDATE default.books
+  SET published_year = CAST(SUBSTRING(TRIM(published_at), 1, 4) AS UNSIGNED),
+    published_month = CAST(SUBSTRING(TRIM(published_at), 6, 2) AS UNSIGNED),
+    published_day = CAST(SUBSTRING(TRIM(published_at), 9, 2) AS UNSIGNED)
+  WHERE TRIM(published_at) REGEXP '^[0-9]{4}-(0[1-9]|1[0-2])-(0[1-9]|[12][0-9]|3[01])$'
+    AND CAST(SUBSTRING(TRIM(published_at), 1, 4) AS UNSIGNED) > 0
+    AND CAST(SUBSTRING(TRIM(published_at), 9, 2) AS UNSIGNED) <=
+      DAY(LAST_DAY(CONCAT(SUBSTRING(TRIM(published_at), 1, 7), '-01')));
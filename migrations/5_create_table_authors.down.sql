@@ -0,0 +1,3 @@
+-- books.author keeps the credits formatted as text.
+DROP TABLE IF EXISTS default.book_authors;
+DROP TABLE IF EXISTS default.authors;
@@ -0,0 +1,28 @@
+CREATE TABLE IF NOT EXISTS default.authors (
+  id MEDIUMINT NOT NULL AUTO_INCREMENT,
+  name VARCHAR(255) NOT NULL,
+  PRIMARY KEY (id),
+  UNIQUE KEY authors_name (name)
+);
+
+CREATE TABLE IF NOT EXISTS default.book_authors (
+  book_id MEDIUMINT NOT NULL,
+  author_id MEDIUMINT NOT NULL,
+  role VARCHAR(32) NOT NULL,
+  position SMALLINT NOT NULL DEFAULT 0,
+  PRIMARY KEY (book_id, author_id, role),
+  KEY book_authors_author (author_id),
+  CONSTRAINT book_authors_book FOREIGN KEY (book_id) REFERENCES default.books (id) ON DELETE CASCADE,
+  CONSTRAINT book_authors_author FOREIGN KEY (author_id) REFERENCES default.authors (id)
+);
+
+-- Each distinct author string becomes an author credited for its books.
+-- Strings naming several people, e.g. "A and B", are kept whole: split
+-- them in the edit form, or merge variants with "bookshelf authors merge".
+INSERT IGNORE INTO default.authors (name)
+  SELECT DISTINCT TRIM(author) FROM default.books
+  WHERE TRIM(COALESCE(author, '')) <> '';
+
+INSERT IGNORE INTO default.book_authors (book_id, author_id, role, position)
+  SELECT b.id, a.id, 'author', 0
+  FROM default.books b JOIN default.authors a ON a.name = TRIM(b.author);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS default.book_tags;
+DROP TABLE IF EXISTS default.book_genres;
+DROP TABLE IF EXISTS default.genres;
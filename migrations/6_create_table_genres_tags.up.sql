@@ -0,0 +1,48 @@
+CREATE TABLE IF NOT EXISTS default.genres (
+  id SMALLINT NOT NULL AUTO_INCREMENT,
+  name VARCHAR(64) NOT NULL,
+  PRIMARY KEY (id),
+  UNIQUE KEY genres_name (name)
+);
+
+-- The vocabulary of defaultGenres, in its order.
+INSERT IGNORE INTO default.genres (name) VALUES
+  ('Fiction'),
+  ('Fantasy'),
+  ('Science fiction'),
+  ('Mystery'),
+  ('Thriller'),
+  ('Romance'),
+  ('Horror'),
+  ('Historical fiction'),
+  ('Poetry'),
+  ('Drama'),
+  ('Comics'),
+  ('Children''s'),
+  ('Young adult'),
+  ('Biography'),
+  ('History'),
+  ('Science'),
+  ('Philosophy'),
+  ('Religion'),
+  ('Travel'),
+  ('Cooking'),
+  ('Art'),
+  ('Reference');
+
+CREATE TABLE IF NOT EXISTS default.book_genres (
+  book_id MEDIUMINT NOT NULL,
+  genre_id SMALLINT NOT NULL,
+  PRIMARY KEY (book_id, genre_id),
+  KEY book_genres_genre (genre_id),
+  CONSTRAINT book_genres_book FOREIGN KEY (book_id) REFERENCES default.books (id) ON DELETE CASCADE,
+  CONSTRAINT book_genres_genre FOREIGN KEY (genre_id) REFERENCES default.genres (id)
+);
+
+CREATE TABLE IF NOT EXISTS default.book_tags (
+  book_id MEDIUMINT NOT NULL,
+  tag VARCHAR(64) NOT NULL,
+  PRIMARY KEY (book_id, tag),
+  KEY book_tags_tag (tag),
+  CONSTRAINT book_tags_book FOREIGN KEY (book_id) REFERENCES default.books (id) ON DELETE CASCADE
+);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS default.book_series;
+DROP TABLE IF EXISTS default.series;
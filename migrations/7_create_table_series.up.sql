@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS default.series (
+  id MEDIUMINT NOT NULL AUTO_INCREMENT,
+  name VARCHAR(255) NOT NULL,
+  PRIMARY KEY (id),
+  UNIQUE KEY series_name (name)
+);
+
+-- A book is in one series at most. number is 0 for unnumbered volumes.
+CREATE TABLE IF NOT EXISTS default.book_series (
+  book_id MEDIUMINT NOT NULL,
+  series_id MEDIUMINT NOT NULL,
+  number DECIMAL(8,3) NOT NULL DEFAULT 0,
+  PRIMARY KEY (book_id),
+  KEY book_series_series (series_id, number),
+  CONSTRAINT book_series_book FOREIGN KEY (book_id) REFERENCES default.books (id) ON DELETE CASCADE,
+  CONSTRAINT book_series_series FOREIGN KEY (series_id) REFERENCES default.series (id)
+);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS default.collection_books;
+DROP TABLE IF EXISTS default.collections;
@@ -0,0 +1,22 @@
+-- owner_id is the ID of a user, or 0 for the collections of a bookshelf
+-- without sign-in.
+CREATE TABLE IF NOT EXISTS default.collections (
+  id MEDIUMINT NOT NULL AUTO_INCREMENT,
+  owner_id MEDIUMINT NOT NULL DEFAULT 0,
+  name VARCHAR(100) NOT NULL,
+  share_token VARCHAR(64) NOT NULL DEFAULT '',
+  created_at DATETIME NOT NULL,
+  PRIMARY KEY (id),
+  UNIQUE KEY collections_owner_name (owner_id, name),
+  KEY collections_share_token (share_token)
+);
+
+CREATE TABLE IF NOT EXISTS default.collection_books (
+  collection_id MEDIUMINT NOT NULL,
+  book_id MEDIUMINT NOT NULL,
+  position INT NOT NULL DEFAULT 0,
+  PRIMARY KEY (collection_id, book_id),
+  KEY collection_books_book (book_id),
+  CONSTRAINT collection_books_collection FOREIGN KEY (collection_id) REFERENCES default.collections (id) ON DELETE CASCADE,
+  CONSTRAINT collection_books_book FOREIGN KEY (book_id) REFERENCES default.books (id) ON DELETE CASCADE
+);
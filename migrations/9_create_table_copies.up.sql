@@ -0,0 +1,17 @@
+-- price is in cents, 0 when unknown. The acquired_ columns hold a partial
+-- date like the published_ columns of books.
+CREATE TABLE IF NOT EXISTS default.copies (
+  id MEDIUMINT NOT NULL AUTO_INCREMENT,
+  book_id MEDIUMINT NOT NULL,
+  barcode VARCHAR(64) NOT NULL,
+  location VARCHAR(100) NOT NULL DEFAULT '',
+  book_condition VARCHAR(16) NOT NULL DEFAULT 'good',
+  acquired_year SMALLINT NOT NULL DEFAULT 0,
+  acquired_month TINYINT NOT NULL DEFAULT 0,
+  acquired_day TINYINT NOT NULL DEFAULT 0,
+  price INT NOT NULL DEFAULT 0,
+  PRIMARY KEY (id),
+  UNIQUE KEY copies_barcode (barcode),
+  KEY copies_book (book_id),
+  CONSTRAINT copies_book FOREIGN KEY (book_id) REFERENCES default.books (id) ON DELETE CASCADE
+);
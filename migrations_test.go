@@ -0,0 +1,215 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+)
+
+// fakeMigrationStore records the statements it runs.
+type fakeMigrationStore struct {
+	lockMu sync.Mutex
+
+	mu       sync.Mutex
+	current  int
+	dirty    bool
+	executed []string
+	// fail makes exec fail for statements containing it.
+	fail string
+}
+
+func (s *fakeMigrationStore) lock(ctx context.Context) (func() error, error) {
+	s.lockMu.Lock()
+	return func() error { s.lockMu.Unlock(); return nil }, nil
+}
+
+func (s *fakeMigrationStore) version(ctx context.Context) (int, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.current, s.dirty, nil
+}
+
+func (s *fakeMigrationStore) setVersion(ctx context.Context, version int, dirty bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.current, s.dirty = version, dirty
+	return nil
+}
+
+func (s *fakeMigrationStore) exec(ctx context.Context, stmt string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail != "" && strings.Contains(stmt, s.fail) {
+		return errors.New("syntax error")
+	}
+	s.executed = append(s.executed, stmt)
+	return nil
+}
+
+var testMigrations = fstest.MapFS{
+	"m/1_books.up.sql":    {Data: []byte("CREATE books;")},
+	"m/1_books.down.sql":  {Data: []byte("DROP books;")},
+	"m/2_users.up.sql":    {Data: []byte("CREATE users;\nCREATE INDEX users_email;\n-- trailing comment\n")},
+	"m/2_users.down.sql":  {Data: []byte("DROP users;")},
+	"m/10_audit.up.sql":   {Data: []byte("CREATE audit;")},
+	"m/10_audit.down.sql": {Data: []byte("DROP audit;")},
+	"m/README.md":         {Data: []byte("not a migration")},
+}
+
+func newTestMigrator(t *testing.T) (*migrator, *fakeMigrationStore) {
+	t.Helper()
+	migrations, err := loadMigrations(testMigrations, "m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &fakeMigrationStore{}
+	return &migrator{store: store, migrations: migrations, logf: t.Logf}, store
+}
+
+func TestMigrator(t *testing.T) {
+	ctx := context.Background()
+	m, store := newTestMigrator(t)
+
+	if err := m.up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"CREATE books", "CREATE users", "CREATE INDEX users_email", "CREATE audit"}
+	if !reflect.DeepEqual(store.executed, want) {
+		t.Errorf("up: executed %q, want %q", store.executed, want)
+	}
+	if s, _ := m.status(ctx); s.Version != 10 || s.Dirty || len(s.Pending) != 0 {
+		t.Errorf("after up: got status %+v", s)
+	}
+	// Nothing left to do.
+	if err := m.up(ctx); err != nil || len(store.executed) != 4 {
+		t.Errorf("second up: executed %q, %v", store.executed, err)
+	}
+
+	store.executed = nil
+	if err := m.down(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"DROP audit", "DROP users"}; !reflect.DeepEqual(store.executed, want) {
+		t.Errorf("down 2: executed %q, want %q", store.executed, want)
+	}
+	if s, _ := m.status(ctx); s.Version != 1 || len(s.Pending) != 2 {
+		t.Errorf("after down 2: got status %+v", s)
+	}
+
+	if err := m.gotoVersion(ctx, 2); err != nil || store.current != 2 {
+		t.Errorf("goto 2: at version %d, %v", store.current, err)
+	}
+	if err := m.gotoVersion(ctx, 3); err == nil {
+		t.Error("goto unknown version: want non-nil err")
+	}
+	if err := m.down(ctx, 5); err != nil || store.current != 0 {
+		t.Errorf("down past the first version: at version %d, %v", store.current, err)
+	}
+}
+
+func TestMigratorDirty(t *testing.T) {
+	ctx := context.Background()
+	m, store := newTestMigrator(t)
+
+	store.fail = "INDEX"
+	if err := m.up(ctx); err == nil || !strings.Contains(err.Error(), "2_users up") {
+		t.Fatalf("got %v, want the failing migration", err)
+	}
+	if store.current != 2 || !store.dirty {
+		t.Errorf("got version %d dirty %v, want 2 dirty", store.current, store.dirty)
+	}
+
+	store.fail = ""
+	if err := m.up(ctx); err == nil || !strings.Contains(err.Error(), "dirty") {
+		t.Errorf("up while dirty: got %v", err)
+	}
+	if err := m.force(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.up(ctx); err != nil || store.current != 10 {
+		t.Errorf("up after force: at version %d, %v", store.current, err)
+	}
+}
+
+func TestMigratorConcurrent(t *testing.T) {
+	ctx := context.Background()
+	m, store := newTestMigrator(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := m.up(ctx); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if len(store.executed) != 4 {
+		t.Errorf("migrations ran more than once: %q", store.executed)
+	}
+}
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations(migrationFiles, "migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, mig := range migrations {
+		if mig.Version != i+1 {
+			t.Errorf("migration %s has version %d, want %d", mig.Name, mig.Version, i+1)
+		}
+	}
+
+	for name, files := range map[string]fstest.MapFS{
+		"missing down": {"m/1_a.up.sql": {Data: []byte("x;")}},
+		"two names": {
+			"m/1_a.up.sql": {Data: []byte("x;")}, "m/1_a.down.sql": {Data: []byte("x;")},
+			"m/1_b.up.sql": {Data: []byte("x;")}, "m/1_b.down.sql": {Data: []byte("x;")},
+		},
+	} {
+		if _, err := loadMigrations(files, "m"); err == nil {
+			t.Errorf("%s: want non-nil err", name)
+		}
+	}
+}
+
+func TestWriteMigrations(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "migrations")
+	written, err := writeMigrations(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(written) == 0 || len(written)%2 != 0 {
+		t.Fatalf("got %d migrations, want pairs of up and down", len(written))
+	}
+	for _, name := range written {
+		if !strings.HasSuffix(name, ".up.sql") {
+			continue
+		}
+		down := strings.TrimSuffix(name, ".up.sql") + ".down.sql"
+		if _, err := os.Stat(down); err != nil {
+			t.Errorf("%s has no down migration: %v", filepath.Base(name), err)
+		}
+	}
+}
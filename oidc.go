@@ -0,0 +1,554 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OIDCConfig configures sign-in through an OpenID Connect provider.
+type OIDCConfig struct {
+	// IssuerURL is used for discovery and must match the "iss" claim.
+	IssuerURL    string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL must point at /auth/callback of this bookshelf.
+	RedirectURL string
+	// Scopes requested in addition to "openid".
+	Scopes []string
+
+	// RoleClaim names the ID token claim used to assign a role,
+	// e.g. "groups". Its value may be a string or a list of strings.
+	RoleClaim string
+	// RoleMapping maps claim values to roles. The most privileged match wins.
+	RoleMapping map[string]Role
+	// DefaultRole is assigned when no claim value matches.
+	DefaultRole Role
+
+	// HTTPClient is used to talk to the provider. Defaults to
+	// http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+// parseRoleMapping parses "value:role,value:role" into a role mapping.
+func parseRoleMapping(s string) (map[string]Role, error) {
+	m := make(map[string]Role)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		i := strings.LastIndex(pair, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("oidc: bad role mapping %q, want value:role", pair)
+		}
+		role, err := parseRole(pair[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("oidc: %v", err)
+		}
+		m[pair[:i]] = role
+	}
+	return m, nil
+}
+
+// oidcProvider talks to an OpenID Connect provider found through discovery.
+type oidcProvider struct {
+	cfg    OIDCConfig
+	client *http.Client
+
+	issuer        string
+	authEndpoint  string
+	tokenEndpoint string
+	jwksURI       string
+
+	mu   sync.Mutex
+	keys map[string]*rsa.PublicKey // maps from key ID to key.
+}
+
+// newOIDCProvider fetches the discovery document of cfg.IssuerURL.
+func newOIDCProvider(ctx context.Context, cfg OIDCConfig) (*oidcProvider, error) {
+	if cfg.IssuerURL == "" || cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, errors.New("oidc: issuer URL, client ID and redirect URL are required")
+	}
+	if cfg.DefaultRole == "" {
+		cfg.DefaultRole = RoleViewer
+	}
+	p := &oidcProvider{
+		cfg:    cfg,
+		client: cfg.HTTPClient,
+	}
+	if p.client == nil {
+		p.client = http.DefaultClient
+	}
+
+	var doc struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	wellKnown := strings.TrimSuffix(cfg.IssuerURL, "/") + "/.well-known/openid-configuration"
+	if err := p.getJSON(ctx, wellKnown, &doc); err != nil {
+		return nil, fmt.Errorf("oidc: discovery: %v", err)
+	}
+	if doc.Issuer != cfg.IssuerURL {
+		return nil, fmt.Errorf("oidc: discovery: issuer %q does not match %q", doc.Issuer, cfg.IssuerURL)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		return nil, errors.New("oidc: discovery: incomplete provider metadata")
+	}
+	p.issuer = doc.Issuer
+	p.authEndpoint = doc.AuthorizationEndpoint
+	p.tokenEndpoint = doc.TokenEndpoint
+	p.jwksURI = doc.JWKSURI
+	return p, nil
+}
+
+func (p *oidcProvider) getJSON(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// authCodeURL returns the URL of the provider's consent page.
+func (p *oidcProvider) authCodeURL(state, nonce, verifier string) string {
+	scopes := append([]string{"openid"}, p.cfg.Scopes...)
+	v := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.cfg.ClientID},
+		"redirect_uri":          {p.cfg.RedirectURL},
+		"scope":                 {strings.Join(scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {pkceChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(p.authEndpoint, "?") {
+		sep = "&"
+	}
+	return p.authEndpoint + sep + v.Encode()
+}
+
+// exchange trades an authorization code for a raw ID token.
+func (p *oidcProvider) exchange(ctx context.Context, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.cfg.RedirectURL},
+		"client_id":     {p.cfg.ClientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest(http.MethodPost, p.tokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if p.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	}
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", fmt.Errorf("oidc: token: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("oidc: token: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("oidc: token: %s: %s", resp.Status, body)
+	}
+	var tok struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &tok); err != nil {
+		return "", fmt.Errorf("oidc: token: %v", err)
+	}
+	if tok.IDToken == "" {
+		return "", errors.New("oidc: token: response has no id_token")
+	}
+	return tok.IDToken, nil
+}
+
+// idClaims holds the verified claims of an ID token.
+type idClaims struct {
+	Issuer  string
+	Subject string
+	Email   string
+	Name    string
+	all     map[string]interface{}
+}
+
+// clockSkew is the tolerance applied to time based claims.
+const clockSkew = time.Minute
+
+// verify checks the signature and claims of a raw ID token.
+func (p *oidcProvider) verify(ctx context.Context, raw, nonce string) (*idClaims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("oidc: malformed ID token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("oidc: ID token header: %v", err)
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("oidc: unsupported signing algorithm %q", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("oidc: ID token signature: %v", err)
+	}
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, h[:], sig); err != nil {
+		return nil, errors.New("oidc: invalid ID token signature")
+	}
+
+	var all map[string]interface{}
+	if err := decodeSegment(parts[1], &all); err != nil {
+		return nil, fmt.Errorf("oidc: ID token claims: %v", err)
+	}
+	c := &idClaims{all: all}
+	c.Issuer, _ = all["iss"].(string)
+	c.Subject, _ = all["sub"].(string)
+	c.Email, _ = all["email"].(string)
+	c.Name, _ = all["name"].(string)
+
+	if c.Issuer != p.issuer {
+		return nil, fmt.Errorf("oidc: unexpected issuer %q", c.Issuer)
+	}
+	if c.Subject == "" {
+		return nil, errors.New("oidc: ID token has no subject")
+	}
+	if !hasAudience(all["aud"], p.cfg.ClientID) {
+		return nil, errors.New("oidc: ID token was not issued for this client")
+	}
+	if azp, ok := all["azp"].(string); ok && azp != p.cfg.ClientID {
+		return nil, fmt.Errorf("oidc: unexpected authorized party %q", azp)
+	}
+	now := time.Now()
+	exp, ok := all["exp"].(float64)
+	if !ok {
+		return nil, errors.New("oidc: ID token has no expiry")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(clockSkew)) {
+		return nil, errors.New("oidc: ID token expired")
+	}
+	if iat, ok := all["iat"].(float64); ok && time.Unix(int64(iat), 0).After(now.Add(clockSkew)) {
+		return nil, errors.New("oidc: ID token issued in the future")
+	}
+	if got, _ := all["nonce"].(string); got != nonce {
+		return nil, errors.New("oidc: nonce mismatch")
+	}
+	return c, nil
+}
+
+// key returns the signing key with the given ID, refreshing the key set
+// once when the ID is unknown so that provider key rotation is picked up.
+func (p *oidcProvider) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if k := p.lookupKey(kid); k != nil {
+		return k, nil
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(ctx, p.jwksURI, &set); err != nil {
+		return nil, fmt.Errorf("oidc: fetch keys: %v", err)
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	p.keys = keys
+	if k := p.lookupKey(kid); k != nil {
+		return k, nil
+	}
+	return nil, fmt.Errorf("oidc: no signing key with ID %q", kid)
+}
+
+// lookupKey finds a cached key. A token without key ID matches the only
+// key of a single-key set. p.mu must be held.
+func (p *oidcProvider) lookupKey(kid string) *rsa.PublicKey {
+	if k, ok := p.keys[kid]; ok {
+		return k
+	}
+	if kid == "" && len(p.keys) == 1 {
+		for _, k := range p.keys {
+			return k
+		}
+	}
+	return nil
+}
+
+// roleFor maps the configured role claim to a Role.
+func (p *oidcProvider) roleFor(c *idClaims) Role {
+	var values []string
+	switch v := c.all[p.cfg.RoleClaim].(type) {
+	case string:
+		values = []string{v}
+	case []interface{}:
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+	role := p.cfg.DefaultRole
+	for _, v := range values {
+		if r, ok := p.cfg.RoleMapping[v]; ok && roleRank[r] > roleRank[role] {
+			role = r
+		}
+	}
+	return role
+}
+
+func hasAudience(aud interface{}, clientID string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == clientID
+	case []interface{}:
+		for _, a := range v {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// randomToken returns a URL safe random string.
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// pkceChallenge derives the S256 code challenge of a PKCE verifier.
+func pkceChallenge(verifier string) string {
+	h := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
+
+const (
+	oidcCookieName = "bookshelf_oidc"
+	oidcLoginTTL   = 10 * time.Minute
+)
+
+// oidcLogin is the signed state of a login in progress.
+type oidcLogin struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Next     string `json:"next"`
+	Expires  int64  `json:"exp"`
+}
+
+// configureOIDC enables sign-in through the provider described by cfg. The
+// database must store users, whom sign-in records.
+func (b *Bookshelf) configureOIDC(ctx context.Context, cfg OIDCConfig) error {
+	if b.Users == nil {
+		return errNoUsers
+	}
+	p, err := newOIDCProvider(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	b.oidc = p
+	return nil
+}
+
+// loginHandler redirects the user to the identity provider.
+func (b *Bookshelf) loginHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if !b.authEnabled() {
+		http.Redirect(w, r, "/books", http.StatusFound)
+		return nil
+	}
+	login := oidcLogin{
+		Next:    localRedirect(r.FormValue("next")),
+		Expires: time.Now().Add(oidcLoginTTL).Unix(),
+	}
+	for _, s := range []*string{&login.State, &login.Nonce, &login.Verifier} {
+		v, err := randomToken()
+		if err != nil {
+			return b.appErrorf(r, err, "could not start login: %v", err)
+		}
+		*s = v
+	}
+	v, err := b.sessions.encode(login)
+	if err != nil {
+		return b.appErrorf(r, err, "could not start login: %v", err)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookieName,
+		Value:    v,
+		Path:     "/auth",
+		MaxAge:   int(oidcLoginTTL / time.Second),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, b.oidc.authCodeURL(login.State, login.Nonce, login.Verifier), http.StatusFound)
+	return nil
+}
+
+// callbackHandler completes a login started by loginHandler.
+func (b *Bookshelf) callbackHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if !b.authEnabled() {
+		http.Redirect(w, r, "/books", http.StatusFound)
+		return nil
+	}
+	if e := r.FormValue("error"); e != "" {
+		err := fmt.Errorf("identity provider: %s: %s", e, r.FormValue("error_description"))
+		return b.appErrorf(r, err, "login failed: %v", err)
+	}
+	c, err := r.Cookie(oidcCookieName)
+	if err != nil {
+		return b.appErrorf(r, err, "login failed: no login in progress")
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcCookieName, Path: "/auth", MaxAge: -1})
+
+	var login oidcLogin
+	if err := b.sessions.decode(c.Value, &login); err != nil {
+		return b.appErrorf(r, err, "login failed: %v", err)
+	}
+	if time.Now().Unix() > login.Expires {
+		return b.appErrorf(r, errors.New("login expired"), "login failed: login expired")
+	}
+	if r.FormValue("state") != login.State {
+		return b.appErrorf(r, errors.New("state mismatch"), "login failed: state mismatch")
+	}
+
+	ctx := r.Context()
+	raw, err := b.oidc.exchange(ctx, r.FormValue("code"), login.Verifier)
+	if err != nil {
+		return b.appErrorf(r, err, "login failed: %v", err)
+	}
+	claims, err := b.oidc.verify(ctx, raw, login.Nonce)
+	if err != nil {
+		return b.appErrorf(r, err, "login failed: %v", err)
+	}
+
+	u := &User{
+		Issuer:      claims.Issuer,
+		Subject:     claims.Subject,
+		Email:       claims.Email,
+		Name:        claims.Name,
+		Role:        b.oidc.roleFor(claims),
+		LastLoginAt: time.Now(),
+	}
+	// Without a role mapping roles are managed with "bookshelf users", and
+	// logging in must not reset them.
+	if len(b.oidc.cfg.RoleMapping) == 0 {
+		old, err := b.Users.FindUser(u.Issuer, u.Subject)
+		switch {
+		case err == nil:
+			u.Role = old.Role
+		case !errors.Is(err, errNotFound):
+			return b.appErrorf(r, err, "could not load user: %v", err)
+		}
+	}
+	// The callback is a GET, which holdWrites lets through during a backup.
+	b.writes.RLock()
+	u.ID, err = b.Users.UpsertUser(u)
+	b.writes.RUnlock()
+	if err != nil {
+		return b.appErrorf(r, err, "could not save user: %v", err)
+	}
+	if err := b.setSession(w, r, u); err != nil {
+		return b.appErrorf(r, err, "could not start session: %v", err)
+	}
+	http.Redirect(w, r, login.Next, http.StatusFound)
+	return nil
+}
+
+// logoutHandler ends the current session.
+func (b *Bookshelf) logoutHandler(w http.ResponseWriter, r *http.Request) *appError {
+	b.clearSession(w)
+	http.Redirect(w, r, "/books", http.StatusFound)
+	return nil
+}
+
+// localRedirect only allows redirects to paths of this site.
+func localRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/books"
+	}
+	return next
+}
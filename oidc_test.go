@@ -0,0 +1,404 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockIssuer is a minimal OpenID Connect provider which signs in whoever
+// asks, as the user described by claims.
+type mockIssuer struct {
+	t            *testing.T
+	srv          *httptest.Server
+	key          *rsa.PrivateKey
+	clientID     string
+	clientSecret string
+
+	mu     sync.Mutex
+	claims map[string]interface{}
+	grants map[string]url.Values // maps from code to the authorize request.
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockIssuer{
+		t:            t,
+		key:          key,
+		clientID:     "bookshelf",
+		clientSecret: "s3cret",
+		grants:       make(map[string]url.Values),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", m.discovery)
+	mux.HandleFunc("/authorize", m.authorize)
+	mux.HandleFunc("/token", m.token)
+	mux.HandleFunc("/jwks", m.jwks)
+	m.srv = httptest.NewServer(mux)
+	t.Cleanup(m.srv.Close)
+	return m
+}
+
+func (m *mockIssuer) setClaims(c map[string]interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.claims = c
+}
+
+func (m *mockIssuer) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]string{
+		"issuer":                 m.srv.URL,
+		"authorization_endpoint": m.srv.URL + "/authorize",
+		"token_endpoint":         m.srv.URL + "/token",
+		"jwks_uri":               m.srv.URL + "/jwks",
+	})
+}
+
+func (m *mockIssuer) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != m.clientID || q.Get("response_type") != "code" ||
+		q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		http.Error(w, "bad authorize request", http.StatusBadRequest)
+		return
+	}
+	code, _ := randomToken()
+	m.mu.Lock()
+	m.grants[code] = q
+	m.mu.Unlock()
+
+	u, _ := url.Parse(q.Get("redirect_uri"))
+	v := url.Values{"code": {code}, "state": {q.Get("state")}}
+	u.RawQuery = v.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+func (m *mockIssuer) token(w http.ResponseWriter, r *http.Request) {
+	id, secret, ok := r.BasicAuth()
+	if !ok || id != m.clientID || secret != m.clientSecret {
+		http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+		return
+	}
+	m.mu.Lock()
+	grant, ok := m.grants[r.FormValue("code")]
+	delete(m.grants, r.FormValue("code"))
+	claims := m.claims
+	m.mu.Unlock()
+	if !ok || r.FormValue("grant_type") != "authorization_code" ||
+		r.FormValue("redirect_uri") != grant.Get("redirect_uri") ||
+		pkceChallenge(r.FormValue("code_verifier")) != grant.Get("code_challenge") {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+
+	c := map[string]interface{}{
+		"iss":   m.srv.URL,
+		"aud":   m.clientID,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": grant.Get("nonce"),
+	}
+	for k, v := range claims {
+		c[k] = v
+	}
+	json.NewEncoder(w).Encode(map[string]string{
+		"access_token": "at",
+		"token_type":   "Bearer",
+		"id_token":     m.sign(c),
+	})
+}
+
+func (m *mockIssuer) jwks(w http.ResponseWriter, r *http.Request) {
+	enc := base64.RawURLEncoding
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "k1",
+			"use": "sig",
+			"alg": "RS256",
+			"n":   enc.EncodeToString(m.key.N.Bytes()),
+			"e":   enc.EncodeToString(big.NewInt(int64(m.key.E)).Bytes()),
+		}},
+	})
+}
+
+// sign returns an RS256 JWT holding claims.
+func (m *mockIssuer) sign(claims map[string]interface{}) string {
+	enc := base64.RawURLEncoding
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "k1", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := enc.EncodeToString(header) + "." + enc.EncodeToString(payload)
+	h := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, h[:])
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	return signed + "." + enc.EncodeToString(sig)
+}
+
+// newOIDCBookshelf starts a bookshelf which signs in through m.
+func newOIDCBookshelf(t *testing.T, m *mockIssuer) (*Bookshelf, *httptest.Server) {
+	t.Helper()
+
+	bs, srv := newTestBookshelf(t)
+	err := bs.configureOIDC(context.Background(), OIDCConfig{
+		IssuerURL:    m.srv.URL,
+		ClientID:     m.clientID,
+		ClientSecret: m.clientSecret,
+		RedirectURL:  srv.URL + "/auth/callback",
+		RoleClaim:    "groups",
+		RoleMapping: map[string]Role{
+			"library-staff":  RoleStaff,
+			"library-admins": RoleAdmin,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bs, srv
+}
+
+func newBrowser(t *testing.T) *http.Client {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{Jar: jar}
+}
+
+func TestOIDCLogin(t *testing.T) {
+	m := newMockIssuer(t)
+	bs, srv := newOIDCBookshelf(t, m)
+
+	tests := []struct {
+		name   string
+		groups []interface{}
+		want   Role
+		status int
+	}{
+		{"viewer", nil, RoleViewer, http.StatusForbidden},
+		{"staff", []interface{}{"everyone", "library-staff"}, RoleStaff, http.StatusOK},
+		{"admin", []interface{}{"library-staff", "library-admins"}, RoleAdmin, http.StatusOK},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			m.setClaims(map[string]interface{}{
+				"sub":    "user-" + tc.name,
+				"email":  tc.name + "@example.com",
+				"name":   "Test " + tc.name,
+				"groups": tc.groups,
+			})
+			c := newBrowser(t)
+
+			// Adding a book requires staff, so this goes through the login flow.
+			resp, err := c.Get(srv.URL + "/books/add")
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != tc.status {
+				t.Fatalf("GET /books/add: got status %d, want %d: %s", resp.StatusCode, tc.status, body)
+			}
+			if got, want := resp.Request.URL.Path, "/books/add"; got != want {
+				t.Errorf("redirected to %q, want %q", got, want)
+			}
+
+			users, err := bs.Users.ListUsers()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var u *User
+			for _, x := range users {
+				if x.Subject == "user-"+tc.name {
+					u = x
+				}
+			}
+			if u == nil {
+				t.Fatalf("user %q was not stored", tc.name)
+			}
+			if u.Role != tc.want || u.Issuer != m.srv.URL || u.Email != tc.name+"@example.com" {
+				t.Errorf("got user %+v, want role %q", u, tc.want)
+			}
+
+			resp, err = c.Get(srv.URL + "/books")
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if !strings.Contains(string(body), "Test "+tc.name) {
+				t.Errorf("list page does not show the signed-in user:\n%s", body)
+			}
+
+			resp, err = c.Post(srv.URL+"/logout", "", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if !strings.Contains(string(body), "Log in") {
+				t.Errorf("still signed in after logout:\n%s", body)
+			}
+		})
+	}
+}
+
+func TestOIDCRequiresLogin(t *testing.T) {
+	m := newMockIssuer(t)
+	_, srv := newOIDCBookshelf(t, m)
+
+	c := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := c.PostForm(srv.URL+"/books", url.Values{"title": {"nope"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusUnauthorized; got != want {
+		t.Errorf("POST /books: got status %d, want %d", got, want)
+	}
+
+	resp, err = c.Get(srv.URL + "/books")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Errorf("GET /books: got status %d, want %d", got, want)
+	}
+}
+
+func TestOIDCRequiresUserDatabase(t *testing.T) {
+	m := newMockIssuer(t)
+	// Only the BookDatabase methods of the memory database are visible.
+	bs, err := NewBookshelf(struct{ BookDatabase }{newMemoryDB()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bs.configureOIDC(context.Background(), OIDCConfig{
+		IssuerURL:    m.srv.URL,
+		ClientID:     m.clientID,
+		ClientSecret: m.clientSecret,
+	})
+	if !errors.Is(err, errNoUsers) {
+		t.Errorf("configureOIDC without a UserDatabase: got %v, want errNoUsers", err)
+	}
+	if bs.authEnabled() {
+		t.Error("sign-in was enabled without a UserDatabase")
+	}
+}
+
+func TestOIDCVerify(t *testing.T) {
+	m := newMockIssuer(t)
+	p, err := newOIDCProvider(context.Background(), OIDCConfig{
+		IssuerURL:   m.srv.URL,
+		ClientID:    m.clientID,
+		RedirectURL: "http://localhost/auth/callback",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss":   m.srv.URL,
+			"sub":   "alice",
+			"aud":   []interface{}{"other", m.clientID},
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"iat":   time.Now().Unix(),
+			"nonce": "n1",
+		}
+	}
+	tests := []struct {
+		name   string
+		mutate func(c map[string]interface{})
+		token  func(s string) string
+		ok     bool
+	}{
+		{name: "valid", ok: true},
+		{name: "wrong issuer", mutate: func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" }},
+		{name: "wrong audience", mutate: func(c map[string]interface{}) { c["aud"] = "other" }},
+		{name: "expired", mutate: func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() }},
+		{name: "wrong nonce", mutate: func(c map[string]interface{}) { c["nonce"] = "n2" }},
+		{name: "no subject", mutate: func(c map[string]interface{}) { delete(c, "sub") }},
+		{name: "tampered", token: func(s string) string {
+			parts := strings.Split(s, ".")
+			claims, _ := json.Marshal(map[string]interface{}{"iss": m.srv.URL, "sub": "mallory"})
+			parts[1] = base64.RawURLEncoding.EncodeToString(claims)
+			return strings.Join(parts, ".")
+		}},
+		{name: "alg none", token: func(s string) string {
+			parts := strings.Split(s, ".")
+			parts[0] = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+			return parts[0] + "." + parts[1] + "."
+		}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := valid()
+			if tc.mutate != nil {
+				tc.mutate(c)
+			}
+			raw := m.sign(c)
+			if tc.token != nil {
+				raw = tc.token(raw)
+			}
+			_, err := p.verify(context.Background(), raw, "n1")
+			if tc.ok && err != nil {
+				t.Errorf("got err %v, want nil", err)
+			}
+			if !tc.ok && err == nil {
+				t.Error("want non-nil err")
+			}
+		})
+	}
+}
+
+func TestParseRoleMapping(t *testing.T) {
+	got, err := parseRoleMapping("library-admins:admin, staff:Staff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]Role{"library-admins": RoleAdmin, "staff": RoleStaff}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, err := parseRoleMapping("staff:owner"); err == nil {
+		t.Error("want non-nil err for unknown role")
+	}
+}
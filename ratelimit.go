@@ -0,0 +1,233 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Route groups sharing a rate limit.
+const (
+	groupRead  = "read"  // browsing the catalog.
+	groupWrite = "write" // changing the catalog.
+	groupAuth  = "auth"  // signing in.
+	groupAdmin = "admin" // managing the bookshelf.
+)
+
+// RateLimit allows Burst requests at once, refilled at Rate per second.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// defaultRateLimits are used by main unless overridden by RATE_LIMIT_<GROUP>.
+var defaultRateLimits = map[string]RateLimit{
+	groupRead:  {Rate: 20, Burst: 50},
+	groupWrite: {Rate: 1, Burst: 10},
+	groupAuth:  {Rate: 0.5, Burst: 10},
+	groupAdmin: {Rate: 5, Burst: 20},
+}
+
+// parseRateLimit parses "rate:burst", e.g. "0.5:10". "off" disables the
+// limit and returns a zero RateLimit.
+func parseRateLimit(s string) (RateLimit, error) {
+	if s == "off" {
+		return RateLimit{}, nil
+	}
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return RateLimit{}, fmt.Errorf("bad rate limit %q, want rate:burst", s)
+	}
+	rate, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || rate <= 0 {
+		return RateLimit{}, fmt.Errorf("bad rate in %q", s)
+	}
+	burst, err := strconv.Atoi(parts[1])
+	if err != nil || burst < 1 {
+		return RateLimit{}, fmt.Errorf("bad burst in %q", s)
+	}
+	return RateLimit{Rate: rate, Burst: burst}, nil
+}
+
+// rateLimiter is a set of token buckets, one per client key.
+type rateLimiter struct {
+	limit RateLimit
+	now   func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	return &rateLimiter{
+		limit:   limit,
+		now:     time.Now,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow takes a token from the bucket of key. When none is left, it returns
+// how long the client has to wait for the next one.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(l.limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(l.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*l.limit.Rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.limit.Rate * float64(time.Second))
+	return false, wait
+}
+
+// sweep forgets buckets which have refilled completely, so that the set
+// does not grow with every client ever seen. l.mu must be held.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	full := time.Duration(float64(l.limit.Burst) / l.limit.Rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// setRateLimit limits the requests of each client to the routes of group.
+// A zero limit removes the limit.
+func (b *Bookshelf) setRateLimit(group string, limit RateLimit) {
+	if b.limiters == nil {
+		b.limiters = make(map[string]*rateLimiter)
+	}
+	if limit.Rate <= 0 {
+		delete(b.limiters, group)
+		return
+	}
+	b.limiters[group] = newRateLimiter(limit)
+}
+
+// rateLimitKey identifies the client of r. Signed-in users, whose session
+// withUser has verified, are limited per user, everyone else per IP
+// address: unverified credentials would let clients pick their own bucket.
+func (b *Bookshelf) rateLimitKey(r *http.Request) string {
+	if u := currentUser(r); u != nil {
+		return fmt.Sprintf("user:%d", u.ID)
+	}
+	return "ip:" + b.clientIP(r)
+}
+
+// rateLimit applies the limit of group to next.
+func (b *Bookshelf) rateLimit(group string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l := b.limiters[group]
+		if l == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ok, wait := l.allow(b.rateLimitKey(r))
+		if !ok {
+			secs := int(math.Ceil(wait.Seconds()))
+			if secs < 1 {
+				secs = 1
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(secs))
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Request size limits.
+const (
+	// defaultMaxRequestBytes caps the body of any request.
+	defaultMaxRequestBytes = 10 << 20
+	// maxFormMemory is the part of a multipart form held in memory,
+	// the rest is spooled to temporary files.
+	maxFormMemory = 1 << 20
+)
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// limitBody rejects requests whose body is larger than b.maxRequestBytes,
+// before anything parses them.
+func (b *Bookshelf) limitBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if b.maxRequestBytes <= 0 || r.Body == nil || r.Body == http.NoBody {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.ContentLength > b.maxRequestBytes {
+			w.Header().Set("Connection", "close")
+			http.Error(w, errBodyTooLarge.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = &limitedBody{rc: r.Body, n: b.maxRequestBytes}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitedBody fails with errBodyTooLarge once more than n bytes are read,
+// for clients which do not send a Content-Length or lie about it.
+type limitedBody struct {
+	rc io.ReadCloser
+	n  int64
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, errBodyTooLarge
+	}
+	// Read one byte more than allowed to tell EOF from an oversized body.
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.rc.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n + int(l.n), errBodyTooLarge
+	}
+	return n, err
+}
+
+func (l *limitedBody) Close() error {
+	return l.rc.Close()
+}
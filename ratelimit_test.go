@@ -0,0 +1,182 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := newRateLimiter(RateLimit{Rate: 2, Burst: 3})
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.allow("a"); !ok {
+			t.Fatalf("request %d within burst was limited", i)
+		}
+	}
+	ok, wait := l.allow("a")
+	if ok {
+		t.Fatal("request over burst was allowed")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("got wait %v, want 500ms", wait)
+	}
+	if ok, _ := l.allow("b"); !ok {
+		t.Error("other client was limited")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if ok, _ := l.allow("a"); !ok {
+		t.Error("request after refill was limited")
+	}
+
+	// Idle clients are forgotten.
+	now = now.Add(time.Hour)
+	l.allow("c")
+	if _, ok := l.buckets["a"]; ok {
+		t.Error("idle bucket was not swept")
+	}
+}
+
+func TestParseRateLimit(t *testing.T) {
+	got, err := parseRateLimit("0.5:10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (RateLimit{Rate: 0.5, Burst: 10}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if got, err := parseRateLimit("off"); err != nil || got.Rate != 0 {
+		t.Errorf("off: got %+v, %v", got, err)
+	}
+	for _, s := range []string{"", "5", "x:1", "1:0", "-1:5"} {
+		if _, err := parseRateLimit(s); err == nil {
+			t.Errorf("parseRateLimit(%q): want non-nil err", s)
+		}
+	}
+}
+
+func newLimitedBookshelf(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	bs, srv := newTestBookshelf(t)
+	bs.setRateLimit(groupRead, RateLimit{Rate: 1, Burst: 2})
+	bs.maxRequestBytes = 1024
+	return srv
+}
+
+func TestRateLimitHandler(t *testing.T) {
+	srv := newLimitedBookshelf(t)
+
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(srv.URL + "/books")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d: got status %d, want 200", i, resp.StatusCode)
+		}
+	}
+	resp, err := http.Get(srv.URL + "/books")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusTooManyRequests; got != want {
+		t.Fatalf("got status %d, want %d", got, want)
+	}
+	if got := resp.Header.Get("Retry-After"); got != "1" {
+		t.Errorf("got Retry-After %q, want 1", got)
+	}
+
+	// Unverified credentials do not get a bucket of their own.
+	req, _ := http.NewRequest("GET", srv.URL+"/books", nil)
+	req.Header.Set("Authorization", "Bearer t0k3n")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusTooManyRequests; got != want {
+		t.Errorf("client with a made-up token: got status %d, want %d", got, want)
+	}
+}
+
+func TestRateLimitKey(t *testing.T) {
+	bs, _ := newTestBookshelf(t)
+	r := httptest.NewRequest("GET", "/books", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("Authorization", "Bearer t0k3n")
+	if got, want := bs.rateLimitKey(r), "ip:192.0.2.1"; got != want {
+		t.Errorf("with a bearer token: got key %q, want %q", got, want)
+	}
+	r = r.WithContext(context.WithValue(r.Context(), userContextKey{}, &User{ID: 7}))
+	if got, want := bs.rateLimitKey(r), "user:7"; got != want {
+		t.Errorf("signed in: got key %q, want %q", got, want)
+	}
+}
+
+func TestRequestSizeLimit(t *testing.T) {
+	srv := newLimitedBookshelf(t)
+
+	form := func() (io.Reader, string) {
+		var body bytes.Buffer
+		m := multipart.NewWriter(&body)
+		m.WriteField("title", "big")
+		fw, _ := m.CreateFormFile("image", "big.png")
+		fw.Write(bytes.Repeat([]byte("x"), 4096))
+		m.Close()
+		return &body, m.FormDataContentType()
+	}
+
+	body, ct := form()
+	resp, err := http.Post(srv.URL+"/books", ct, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusRequestEntityTooLarge; got != want {
+		t.Errorf("with Content-Length: got status %d, want %d", got, want)
+	}
+
+	// Without a Content-Length the limit is enforced while parsing.
+	body, ct = form()
+	req, _ := http.NewRequest("POST", srv.URL+"/books", ioutil.NopCloser(body))
+	req.Header.Set("Content-Type", ct)
+	req.ContentLength = -1
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusRequestEntityTooLarge; got != want {
+		t.Errorf("chunked: got status %d, want %d", got, want)
+	}
+	if !strings.Contains(string(msg), "too large") {
+		t.Errorf("got body %q, want it to mention the size", msg)
+	}
+}
@@ -0,0 +1,601 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kinds of reminders. A loan gets one of each kind at most.
+const (
+	reminderDueSoon = "due-soon"
+	reminderOverdue = "overdue"
+)
+
+// Statuses of reminders.
+const (
+	reminderPending = "pending" // waiting for the next attempt.
+	reminderSent    = "sent"
+	reminderFailed  = "failed"  // given up after reminderMaxAttempts.
+	reminderSkipped = "skipped" // not needed any more, see LastError.
+)
+
+const (
+	// defaultReminderLead is how long before the due date borrowers are
+	// reminded.
+	defaultReminderLead = 2 * 24 * time.Hour
+	// defaultReminderInterval is how often the scheduler looks for loans
+	// to remind of and reminders to send.
+	defaultReminderInterval = 5 * time.Minute
+	// reminderRetryDelay is the wait after the first failed attempt. It
+	// doubles with each further attempt, up to reminderMaxRetryDelay.
+	reminderRetryDelay    = 5 * time.Minute
+	reminderMaxRetryDelay = 6 * time.Hour
+	reminderMaxAttempts   = 8
+	// reminderSendTimeout bounds a conversation with the SMTP server.
+	reminderSendTimeout = 30 * time.Second
+	// reminderClaimTimeout is how long a claimed reminder is left to its
+	// sender, before others take it to be lost and try again.
+	reminderClaimTimeout = 10 * time.Minute
+	// reminderRunTimeout bounds a run of sendReminders, so that the
+	// claims it made stay its own until it is done.
+	reminderRunTimeout = reminderClaimTimeout - 2*reminderSendTimeout
+)
+
+// Reminder is an entry of the delivery log of reminder emails.
+type Reminder struct {
+	ID     uint   `gorm:"column:id;primary_key" json:"id"`
+	LoanID uint   `gorm:"column:loan_id" json:"loan_id"`
+	UserID uint   `gorm:"column:user_id" json:"user_id"`
+	Kind   string `gorm:"column:kind" json:"kind"`
+	Status string `gorm:"column:status" json:"status"`
+	// To is the address of the last attempt.
+	To          string     `gorm:"column:recipient" json:"to,omitempty"`
+	Queued      time.Time  `gorm:"column:queued_at" json:"queued"`
+	Attempts    int        `gorm:"column:attempts" json:"attempts"`
+	NextAttempt time.Time  `gorm:"column:next_attempt_at" json:"next_attempt"`
+	LastError   string     `gorm:"column:last_error" json:"last_error,omitempty"`
+	Sent        *time.Time `gorm:"column:sent_at" json:"sent,omitempty"`
+}
+
+// TableName tells gorm where reminders live.
+func (Reminder) TableName() string {
+	return "reminders"
+}
+
+// ReminderFilter selects reminders. Zero fields match all reminders.
+type ReminderFilter struct {
+	UserID uint
+	Status string
+	// AttemptBy only selects pending reminders whose next attempt is due
+	// by then.
+	AttemptBy time.Time
+	// Limit caps the number of reminders returned, unless 0.
+	Limit int
+}
+
+func (f ReminderFilter) match(r *Reminder) bool {
+	return (f.UserID == 0 || r.UserID == f.UserID) &&
+		(f.Status == "" || r.Status == f.Status) &&
+		(f.AttemptBy.IsZero() || (r.Status == reminderPending && !r.NextAttempt.After(f.AttemptBy)))
+}
+
+// ReminderDatabase keeps the delivery log of reminder emails and who
+// declines them.
+type ReminderDatabase interface {
+	// QueueReminder adds a pending reminder, setting its ID, unless one
+	// of its kind was queued for its loan before. It reports whether it
+	// did.
+	QueueReminder(r *Reminder) (bool, error)
+
+	// ClaimReminder takes a pending reminder whose next attempt is due by
+	// now for an attempt to send it, by moving its next attempt to until.
+	// It reports false when the reminder was taken or changed meanwhile.
+	ClaimReminder(id uint, now, until time.Time) (bool, error)
+
+	// UpdateReminder saves the outcome of an attempt to send a reminder.
+	UpdateReminder(r *Reminder) error
+
+	// ListReminders returns the reminders selected by f, newest first.
+	ListReminders(f ReminderFilter) ([]*Reminder, error)
+
+	// SetOptOut records whether a user declines reminders.
+	SetOptOut(userID uint, out bool) error
+
+	// OptedOut reports whether a user declines reminders.
+	OptedOut(userID uint) (bool, error)
+
+	// ListOptOuts returns the IDs of the users declining reminders.
+	ListOptOuts() ([]uint, error)
+}
+
+var errNoReminders = errors.New("the configured database does not keep reminders")
+
+// reminderRetryAfter returns how long to wait after the given number of
+// failed attempts.
+func reminderRetryAfter(attempts int) time.Duration {
+	d := reminderRetryDelay
+	for i := 1; i < attempts && d < reminderMaxRetryDelay; i++ {
+		d *= 2
+	}
+	if d > reminderMaxRetryDelay {
+		d = reminderMaxRetryDelay
+	}
+	return d
+}
+
+// email is a message to a single recipient.
+type email struct {
+	To      string
+	Subject string
+	HTML    string
+}
+
+// mailer sends emails.
+type mailer interface {
+	Send(ctx context.Context, m *email) error
+}
+
+// smtpMailer sends emails through an SMTP server, upgrading to TLS when
+// the server offers it.
+type smtpMailer struct {
+	Addr     string // host:port of the server.
+	From     string
+	Username string // authenticates with PLAIN unless empty.
+	Password string
+}
+
+// mailerFromEnv returns the mailer configured by SMTP_ADDR, SMTP_FROM,
+// SMTP_USERNAME and SMTP_PASSWORD, or nil without SMTP_ADDR.
+func mailerFromEnv() (*smtpMailer, error) {
+	m := &smtpMailer{
+		Addr:     os.Getenv("SMTP_ADDR"),
+		From:     os.Getenv("SMTP_FROM"),
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+	}
+	if m.Addr == "" {
+		return nil, nil
+	}
+	if _, _, err := net.SplitHostPort(m.Addr); err != nil {
+		return nil, fmt.Errorf("bad SMTP_ADDR %q: %v", m.Addr, err)
+	}
+	if _, err := mail.ParseAddress(m.From); err != nil {
+		return nil, fmt.Errorf("bad SMTP_FROM %q: %v", m.From, err)
+	}
+	return m, nil
+}
+
+// Send delivers m.
+func (s *smtpMailer) Send(ctx context.Context, m *email) error {
+	from, err := mail.ParseAddress(s.From)
+	if err != nil {
+		return fmt.Errorf("bad sender %q: %v", s.From, err)
+	}
+	to, err := mail.ParseAddress(m.To)
+	if err != nil {
+		return fmt.Errorf("bad recipient %q: %v", m.To, err)
+	}
+	msg, err := s.message(from, to, m)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, reminderSendTimeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	host, _, _ := net.SplitHostPort(s.Addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if s.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.Username, s.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from.Address); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to.Address); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// message formats m as an HTML email.
+func (s *smtpMailer) message(from, to *mail.Address, m *email) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, h := range [][2]string{
+		{"From", from.String()},
+		{"To", to.String()},
+		{"Subject", mime.QEncoding.Encode("utf-8", m.Subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", `text/html; charset="utf-8"`},
+		{"Content-Transfer-Encoding", "quoted-printable"},
+	} {
+		fmt.Fprintf(&buf, "%s: %s\r\n", h[0], h[1])
+	}
+	buf.WriteString("\r\n")
+	qp := quotedprintable.NewWriter(&buf)
+	if _, err := qp.Write([]byte(m.HTML)); err != nil {
+		return nil, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// configureRemindersFromEnv sets up reminder emails when SMTP_ADDR is set.
+// PUBLIC_URL is where the links of the emails lead, REMINDER_LEAD how
+// long before the due date borrowers are reminded.
+func configureRemindersFromEnv(b *Bookshelf) error {
+	m, err := mailerFromEnv()
+	if err != nil || m == nil {
+		return err
+	}
+	b.mailer = m
+	b.publicURL = strings.TrimSuffix(os.Getenv("PUBLIC_URL"), "/")
+	if s := os.Getenv("REMINDER_LEAD"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			return fmt.Errorf("bad REMINDER_LEAD %q", s)
+		}
+		b.reminderLead = d
+	}
+	return nil
+}
+
+// reminderReport counts what a run of sendReminders did.
+type reminderReport struct {
+	Queued  int `json:"queued"`
+	Sent    int `json:"sent"`
+	Retried int `json:"retried"`
+	Failed  int `json:"failed"`
+	Skipped int `json:"skipped"`
+}
+
+// sendReminders queues reminders for the loans due soon or overdue by
+// now, then attempts to send the pending ones. A reminder which cannot be
+// sent is retried later, only failures of the database stop the run. The
+// reminders left when reminderRunTimeout passes are left to the next run.
+// Backups wait for the writes to the database, but not for the emails.
+func (b *Bookshelf) sendReminders(ctx context.Context, now time.Time) (*reminderReport, error) {
+	if b.Reminders == nil {
+		return nil, errNoReminders
+	}
+	if b.Loans == nil {
+		return nil, errNoLoans
+	}
+	if b.mailer == nil {
+		return nil, errors.New("no SMTP server is configured")
+	}
+	report := &reminderReport{}
+	err := b.holdingWrites(func() error { return b.queueReminders(now, report) })
+	if err != nil {
+		return report, err
+	}
+	pending, err := b.Reminders.ListReminders(ReminderFilter{AttemptBy: now})
+	if err != nil {
+		return report, fmt.Errorf("could not list reminders: %v", err)
+	}
+	run, cancel := context.WithTimeout(ctx, reminderRunTimeout)
+	defer cancel()
+	for _, r := range pending {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		if run.Err() != nil {
+			break
+		}
+		if err := b.deliverReminder(run, r, now, report); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// queueReminders queues the reminders of the active loans due within
+// the reminder lead of now, for the users who have not opted out.
+func (b *Bookshelf) queueReminders(now time.Time, report *reminderReport) error {
+	loans, err := b.Loans.ListLoans(LoanFilter{Active: true, DueBefore: now.Add(b.reminderLead)})
+	if err != nil {
+		return fmt.Errorf("could not list loans: %v", err)
+	}
+	for _, l := range loans {
+		out, err := b.Reminders.OptedOut(l.UserID)
+		if err != nil {
+			return err
+		}
+		if out {
+			continue
+		}
+		kind := reminderDueSoon
+		if l.Overdue(now) {
+			kind = reminderOverdue
+		}
+		r := &Reminder{LoanID: l.ID, UserID: l.UserID, Kind: kind, Status: reminderPending, Queued: now, NextAttempt: now}
+		queued, err := b.Reminders.QueueReminder(r)
+		if err != nil {
+			return fmt.Errorf("could not queue reminder: %v", err)
+		}
+		if queued {
+			report.Queued++
+		}
+	}
+	return nil
+}
+
+// deliverReminder attempts to send r, recording the outcome. It claims r
+// first, so that schedulers running at once, in this process or others,
+// do not send it twice.
+func (b *Bookshelf) deliverReminder(ctx context.Context, r *Reminder, now time.Time, report *reminderReport) error {
+	until := now.Add(reminderClaimTimeout)
+	var claimed bool
+	err := b.holdingWrites(func() (err error) {
+		claimed, err = b.Reminders.ClaimReminder(r.ID, now, until)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("could not claim reminder: %v", err)
+	}
+	if !claimed {
+		return nil
+	}
+	r.NextAttempt = until
+
+	m, skip, err := b.reminderEmail(r, now)
+	if err != nil {
+		b.retryReminder(r, now, report, err)
+		return b.saveReminder(r)
+	}
+	if skip != "" {
+		r.Status, r.LastError = reminderSkipped, skip
+		report.Skipped++
+		return b.saveReminder(r)
+	}
+
+	r.To = m.To
+	if err := b.mailer.Send(ctx, m); err != nil {
+		b.retryReminder(r, now, report, err)
+		return b.saveReminder(r)
+	}
+	r.Status, r.LastError, r.Sent = reminderSent, "", &now
+	r.Attempts++
+	report.Sent++
+	return b.saveReminder(r)
+}
+
+// saveReminder records the outcome of an attempt to send r.
+func (b *Bookshelf) saveReminder(r *Reminder) error {
+	return b.holdingWrites(func() error { return b.Reminders.UpdateReminder(r) })
+}
+
+// retryReminder records a failed attempt to send r, giving up after
+// reminderMaxAttempts.
+func (b *Bookshelf) retryReminder(r *Reminder, now time.Time, report *reminderReport, err error) {
+	r.Attempts++
+	r.LastError = err.Error()
+	if r.Attempts >= reminderMaxAttempts {
+		r.Status = reminderFailed
+		report.Failed++
+	} else {
+		r.NextAttempt = now.Add(reminderRetryAfter(r.Attempts))
+		report.Retried++
+	}
+	log.Printf("reminders: reminder %d to user %d, attempt %d: %v", r.ID, r.UserID, r.Attempts, err)
+}
+
+// reminderView is the data of templates/email/reminder.html.
+type reminderView struct {
+	User    *User
+	Book    *Book
+	Loan    *Loan
+	Overdue bool
+	// BookURL and LoansURL are empty without PUBLIC_URL.
+	BookURL  string
+	LoansURL string
+}
+
+// reminderEmail renders the email of r, or returns why it is not needed
+// any more.
+func (b *Bookshelf) reminderEmail(r *Reminder, now time.Time) (m *email, skip string, err error) {
+	l, err := b.Loans.GetLoan(r.LoanID)
+	if errors.Is(err, errNotFound) {
+		return nil, "the loan was deleted", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if !l.Active() {
+		return nil, "the copy was returned", nil
+	}
+	out, err := b.Reminders.OptedOut(r.UserID)
+	if err != nil {
+		return nil, "", err
+	}
+	if out {
+		return nil, "the user opted out", nil
+	}
+	if b.Users == nil {
+		return nil, "", errNoUsers
+	}
+	u, err := b.Users.GetUser(r.UserID)
+	if errors.Is(err, errNotFound) {
+		return nil, "the user was deleted", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if u.Email == "" {
+		return nil, "the user has no email address", nil
+	}
+	book, err := b.DB.GetBook(l.BookID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	v := reminderView{User: u, Book: book, Loan: l, Overdue: r.Kind == reminderOverdue}
+	if b.publicURL != "" {
+		v.BookURL = fmt.Sprintf("%s/books/%d", b.publicURL, book.ID)
+		v.LoansURL = b.publicURL + "/loans"
+	}
+	t, err := b.emailTemplate("reminder.html")
+	if err != nil {
+		return nil, "", err
+	}
+	var body bytes.Buffer
+	if err := t.Execute(&body, v); err != nil {
+		return nil, "", fmt.Errorf("could not write reminder: %v", err)
+	}
+	subject := "Due soon: " + book.Title
+	if v.Overdue {
+		subject = "Overdue: " + book.Title
+	}
+	return &email{To: u.Email, Subject: subject, HTML: body.String()}, "", nil
+}
+
+// emailTemplate parses a file of templates/email, honoring templateDir
+// like the pages do.
+func (b *Bookshelf) emailTemplate(filename string) (*template.Template, error) {
+	var files fs.FS
+	if b.templateDir != "" {
+		files = os.DirFS(b.templateDir)
+	} else {
+		var err error
+		if files, err = fs.Sub(templateFiles, "templates"); err != nil {
+			return nil, err
+		}
+	}
+	t, err := template.New(filename).Funcs(templateFuncs).ParseFS(files, "email/"+filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse email/%s: %v", filename, err)
+	}
+	return t, nil
+}
+
+// remindEvery runs sendReminders every interval until ctx is done.
+func (b *Bookshelf) remindEvery(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			report, err := b.sendReminders(ctx, now.UTC())
+			if err != nil {
+				log.Printf("reminders: %v", err)
+				continue
+			}
+			if *report != (reminderReport{}) {
+				log.Printf("reminders: %+v", *report)
+			}
+		}
+	}
+}
+
+// optOutHandler records whether the signed-in user wants reminders.
+func (b *Bookshelf) optOutHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if b.Reminders == nil {
+		return b.appErrorf(r, errNoReminders, "%v", errNoReminders)
+	}
+	u := currentUser(r)
+	if u == nil {
+		return b.appErrorf(r, errNoUsers, "sign in to choose reminders")
+	}
+	out, err := strconv.ParseBool(r.FormValue("off"))
+	if err != nil {
+		e := b.appErrorf(r, err, "bad value %q of off", r.FormValue("off"))
+		e.code = http.StatusBadRequest
+		return e
+	}
+	if err := b.Reminders.SetOptOut(u.ID, out); err != nil {
+		return b.appErrorf(r, err, "could not save the choice: %v", err)
+	}
+	http.Redirect(w, r, "/loans", http.StatusFound)
+	return nil
+}
+
+// remindersHandler shows the delivery log of reminders.
+func (b *Bookshelf) remindersHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if b.Reminders == nil {
+		return b.appErrorf(r, errNoReminders, "%v", errNoReminders)
+	}
+	f := ReminderFilter{Status: r.FormValue("status"), Limit: 200}
+	if s := r.FormValue("user"); s != "" {
+		id, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			e := b.appErrorf(r, err, "bad user ID %q", s)
+			e.code = http.StatusBadRequest
+			return e
+		}
+		f.UserID = uint(id)
+	}
+	reminders, err := b.Reminders.ListReminders(f)
+	if err != nil {
+		return b.appErrorf(r, err, "could not list reminders: %v", err)
+	}
+	return remindersTmpl.Execute(b, w, r, struct {
+		Reminders []*Reminder
+		Status    string
+		User      string
+		Statuses  []string
+		// Enabled is set when an SMTP server is configured.
+		Enabled bool
+	}{reminders, f.Status, r.FormValue("user"),
+		[]string{reminderPending, reminderSent, reminderFailed, reminderSkipped}, b.mailer != nil})
+}
@@ -0,0 +1,508 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSMTP is an SMTP server keeping the messages it receives.
+type fakeSMTP struct {
+	addr string
+
+	mu sync.Mutex
+	// fail rejects that many recipients with a temporary error.
+	fail     int
+	messages []*mail.Message
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	s := &fakeSMTP{addr: l.Addr().String()}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	c := textproto.NewConn(conn)
+	c.PrintfLine("220 fake ESMTP")
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		switch verb := strings.ToUpper(strings.Fields(line + " ")[0]); verb {
+		case "EHLO", "HELO", "MAIL", "RSET", "NOOP":
+			c.PrintfLine("250 OK")
+		case "RCPT":
+			s.mu.Lock()
+			failing := s.fail > 0
+			if failing {
+				s.fail--
+			}
+			s.mu.Unlock()
+			if failing {
+				c.PrintfLine("451 try again later")
+			} else {
+				c.PrintfLine("250 OK")
+			}
+		case "DATA":
+			c.PrintfLine("354 go ahead")
+			data, err := c.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			m, err := mail.ReadMessage(strings.NewReader(string(data)))
+			if err != nil {
+				c.PrintfLine("554 %v", err)
+				continue
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, m)
+			s.mu.Unlock()
+			c.PrintfLine("250 OK")
+		case "QUIT":
+			c.PrintfLine("221 bye")
+			return
+		default:
+			c.PrintfLine("502 %s not implemented", verb)
+		}
+	}
+}
+
+// received returns the messages received so far and forgets them.
+func (s *fakeSMTP) received() []*mail.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.messages
+	s.messages = nil
+	return m
+}
+
+func (s *fakeSMTP) failNext(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fail = n
+}
+
+// decodeEmail returns the subject and body of m.
+func decodeEmail(t *testing.T, m *mail.Message) (subject, body string) {
+	t.Helper()
+	subject, err := new(mime.WordDecoder).DecodeHeader(m.Header.Get("Subject"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(quotedprintable.NewReader(m.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return subject, string(b)
+}
+
+func TestReminderRetryAfter(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{
+		1:  5 * time.Minute,
+		2:  10 * time.Minute,
+		4:  40 * time.Minute,
+		7:  320 * time.Minute,
+		8:  6 * time.Hour,
+		50: 6 * time.Hour,
+	} {
+		if got := reminderRetryAfter(attempts); got != want {
+			t.Errorf("reminderRetryAfter(%d) = %v, want %v", attempts, got, want)
+		}
+	}
+}
+
+func TestSendReminders(t *testing.T) {
+	ctx := context.Background()
+	bs, _ := newTestBookshelf(t)
+	smtpd := newFakeSMTP(t)
+	bs.mailer = &smtpMailer{Addr: smtpd.addr, From: "Library <library@example.com>"}
+	bs.publicURL = "https://books.example.com"
+
+	bookID, err := bs.DB.AddBook(&Book{Title: "Pride & Prejudice", Author: "Jane Austen"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2020, 3, 10, 9, 0, 0, 0, time.UTC)
+	day := func(d int) time.Time { return time.Date(2020, 3, d, 0, 0, 0, 0, time.UTC) }
+	borrow := func(name, email string, due time.Time) uint {
+		t.Helper()
+		uid, err := bs.Users.UpsertUser(&User{Issuer: "https://issuer", Subject: name, Name: name, Email: email, Role: RoleViewer})
+		if err != nil {
+			t.Fatal(err)
+		}
+		copyID, err := bs.Copies.AddCopy(&Copy{BookID: bookID, Barcode: name, Condition: conditionGood})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bs.Loans.CheckOut(&Loan{CopyID: copyID, UserID: uid, CheckedOut: now.Add(-loanPeriod), Due: due}); err != nil {
+			t.Fatal(err)
+		}
+		return uid
+	}
+	alice := borrow("alice", "alice@example.com", day(11))
+	bob := borrow("bob", "bob@example.com", day(11))
+	borrow("carol", "", day(5))
+	borrow("dave", "dave@example.com", day(30))
+	if err := bs.Reminders.SetOptOut(bob, true); err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(at time.Time, want reminderReport) {
+		t.Helper()
+		report, err := bs.sendReminders(ctx, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *report != want {
+			t.Errorf("sendReminders at %v: got %+v, want %+v", at, *report, want)
+		}
+	}
+
+	// Alice is reminded before the due date; bob opted out, carol has no
+	// address to send to and dave's loan is not due soon.
+	run(now, reminderReport{Queued: 2, Sent: 1, Skipped: 1})
+	messages := smtpd.received()
+	if len(messages) != 1 {
+		t.Fatalf("got %d messages, want 1", len(messages))
+	}
+	subject, body := decodeEmail(t, messages[0])
+	if to := messages[0].Header.Get("To"); to != "<alice@example.com>" {
+		t.Errorf("sent to %q, want alice", to)
+	}
+	if subject != "Due soon: Pride & Prejudice" {
+		t.Errorf("got subject %q", subject)
+	}
+	for _, want := range []string{"Hello alice,", "Pride &amp; Prejudice", "Wednesday, March 11", `href="https://books.example.com/books/1"`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("body does not contain %q:\n%s", want, body)
+		}
+	}
+	// Each reminder is sent once.
+	run(now.Add(time.Hour), reminderReport{})
+
+	// Failed attempts are retried later and later.
+	overdue := day(12)
+	smtpd.failNext(2)
+	run(overdue, reminderReport{Queued: 1, Retried: 1})
+	run(overdue.Add(4*time.Minute), reminderReport{})
+	run(overdue.Add(5*time.Minute), reminderReport{Retried: 1})
+	run(overdue.Add(14*time.Minute), reminderReport{})
+	run(overdue.Add(15*time.Minute), reminderReport{Sent: 1})
+	if messages := smtpd.received(); len(messages) != 1 {
+		t.Errorf("got %d messages, want 1", len(messages))
+	} else if subject, _ := decodeEmail(t, messages[0]); subject != "Overdue: Pride & Prejudice" {
+		t.Errorf("got subject %q", subject)
+	}
+	log, err := bs.Reminders.ListReminders(ReminderFilter{UserID: alice})
+	if err != nil || len(log) != 2 {
+		t.Fatalf("ListReminders: got %+v, %v", log, err)
+	}
+	if r := log[0]; r.Kind != reminderOverdue || r.Status != reminderSent || r.Attempts != 3 || r.To != "alice@example.com" || r.LastError != "" {
+		t.Errorf("got reminder %+v, want it sent on the third attempt", r)
+	}
+
+	// After too many attempts, reminders are given up.
+	smtpd.failNext(reminderMaxAttempts)
+	dave := day(30).Add(24 * time.Hour)
+	for i := 0; i < reminderMaxAttempts; i++ {
+		report, err := bs.sendReminders(ctx, dave)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Sent != 0 {
+			t.Fatalf("sent despite failing: %+v", report)
+		}
+		dave = dave.Add(reminderMaxRetryDelay)
+	}
+	failed, err := bs.Reminders.ListReminders(ReminderFilter{Status: reminderFailed})
+	if err != nil || len(failed) != 1 || failed[0].Attempts != reminderMaxAttempts || !strings.Contains(failed[0].LastError, "451") {
+		t.Errorf("ListReminders of failed reminders: got %+v, %v", failed, err)
+	}
+}
+
+func TestSendRemindersOnce(t *testing.T) {
+	ctx := context.Background()
+	bs, _ := newTestBookshelf(t)
+	smtpd := newFakeSMTP(t)
+	bs.mailer = &smtpMailer{Addr: smtpd.addr, From: "library@example.com"}
+
+	bookID, err := bs.DB.AddBook(&Book{Title: "Emma"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2020, 3, 10, 9, 0, 0, 0, time.UTC)
+	for _, name := range []string{"alice", "bob", "carol"} {
+		uid, err := bs.Users.UpsertUser(&User{Issuer: "https://issuer", Subject: name, Name: name, Email: name + "@example.com", Role: RoleViewer})
+		if err != nil {
+			t.Fatal(err)
+		}
+		copyID, err := bs.Copies.AddCopy(&Copy{BookID: bookID, Barcode: name, Condition: conditionGood})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bs.Loans.CheckOut(&Loan{CopyID: copyID, UserID: uid, CheckedOut: now.Add(-loanPeriod), Due: now}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A reminder which cannot be written is retried, without holding up
+	// the others.
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "email"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "email", "reminder.html"), []byte("{{.Missing}}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	bs.templateDir = dir
+	report, err := bs.sendReminders(ctx, now)
+	if err != nil {
+		t.Fatalf("sendReminders with a broken template: %v", err)
+	}
+	if want := (reminderReport{Queued: 3, Retried: 3}); *report != want {
+		t.Errorf("sendReminders with a broken template: got %+v, want %+v", *report, want)
+	}
+	pending, err := bs.Reminders.ListReminders(ReminderFilter{Status: reminderPending})
+	if err != nil || len(pending) != 3 || pending[0].Attempts != 1 || !strings.Contains(pending[0].LastError, "Missing") {
+		t.Errorf("ListReminders after a broken template: got %+v, %v", pending, err)
+	}
+	bs.templateDir = ""
+
+	// Schedulers running at once send each reminder once.
+	retry := now.Add(reminderRetryDelay)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := bs.sendReminders(ctx, retry); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if messages := smtpd.received(); len(messages) != 3 {
+		t.Errorf("got %d messages, want one to each borrower", len(messages))
+	}
+}
+
+// blockingMailer sends nothing, blocking each send until released.
+type blockingMailer struct {
+	sending chan *email
+	release chan struct{}
+}
+
+func (m *blockingMailer) Send(ctx context.Context, e *email) error {
+	m.sending <- e
+	select {
+	case <-m.release:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestSendRemindersDoesNotHoldBackups(t *testing.T) {
+	ctx := context.Background()
+	bs, _ := newTestBookshelf(t)
+	m := &blockingMailer{sending: make(chan *email), release: make(chan struct{})}
+	bs.mailer = m
+
+	bookID, err := bs.DB.AddBook(&Book{Title: "Emma"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid, err := bs.Users.UpsertUser(&User{Issuer: "https://issuer", Subject: "alice", Name: "alice", Email: "alice@example.com", Role: RoleViewer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyID, err := bs.Copies.AddCopy(&Copy{BookID: bookID, Barcode: "emma-1", Condition: conditionGood})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2020, 3, 10, 9, 0, 0, 0, time.UTC)
+	if _, err := bs.Loans.CheckOut(&Loan{CopyID: copyID, UserID: uid, CheckedOut: now.Add(-loanPeriod), Due: now}); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := bs.sendReminders(ctx, now)
+		done <- err
+	}()
+	<-m.sending
+
+	// A backup goes ahead while the email is being sent.
+	snapshotDone := make(chan error, 1)
+	go func() {
+		_, err := bs.snapshot(ctx)
+		snapshotDone <- err
+	}()
+	select {
+	case err := <-snapshotDone:
+		if err != nil {
+			t.Errorf("snapshot: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("snapshot waited for the email to be sent")
+	}
+
+	close(m.release)
+	if err := <-done; err != nil {
+		t.Fatalf("sendReminders: %v", err)
+	}
+	sent, err := bs.Reminders.ListReminders(ReminderFilter{Status: reminderSent})
+	if err != nil || len(sent) != 1 {
+		t.Errorf("ListReminders(sent): got %+v, %v", sent, err)
+	}
+}
+
+func TestReminderOptOut(t *testing.T) {
+	m := newMockIssuer(t)
+	bs, srv := newOIDCBookshelf(t, m)
+
+	m.setClaims(map[string]interface{}{"sub": "alice", "name": "Alice", "email": "alice@example.com"})
+	c := newBrowser(t)
+	get := func(path string) (int, string) {
+		t.Helper()
+		resp, err := c.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	post := func(form url.Values) int {
+		t.Helper()
+		resp, err := c.PostForm(srv.URL+"/loans/reminders", form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if _, body := get("/loans"); !strings.Contains(body, "Turn reminders off") {
+		t.Errorf("my loans do not offer to turn reminders off:\n%s", body)
+	}
+	if code := post(url.Values{"off": {"true"}}); code != http.StatusOK {
+		t.Fatalf("turning reminders off: got status %d", code)
+	}
+	users, _ := bs.Users.ListUsers()
+	if out, err := bs.Reminders.OptedOut(users[0].ID); err != nil || !out {
+		t.Errorf("OptedOut: got %v, %v, want true", out, err)
+	}
+	if _, body := get("/loans"); !strings.Contains(body, "Turn reminders on") {
+		t.Errorf("my loans do not offer to turn reminders on:\n%s", body)
+	}
+	if code := post(url.Values{"off": {"maybe"}}); code != http.StatusBadRequest {
+		t.Errorf("bad choice: got status %d, want 400", code)
+	}
+	if code, _ := get("/admin/reminders"); code != http.StatusForbidden {
+		t.Errorf("delivery log for a viewer: got status %d, want 403", code)
+	}
+}
+
+func TestRemindersPage(t *testing.T) {
+	bs, srv := newTestBookshelf(t)
+	uid, err := bs.Users.UpsertUser(&User{Issuer: "https://issuer", Subject: "alice", Role: RoleViewer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	for _, r := range []*Reminder{
+		{LoanID: 1, UserID: uid, Kind: reminderDueSoon, Status: reminderPending, Queued: now, NextAttempt: now},
+		{LoanID: 2, UserID: uid, Kind: reminderOverdue, Status: reminderFailed, Queued: now, NextAttempt: now, LastError: "451 try again later"},
+	} {
+		if _, err := bs.Reminders.QueueReminder(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func(path string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	code, body := get("/admin/reminders")
+	if code != http.StatusOK || !strings.Contains(body, "No SMTP server is configured") || !strings.Contains(body, "451 try again later") {
+		t.Errorf("delivery log: got status %d:\n%s", code, body)
+	}
+	if _, body := get("/admin/reminders?status=pending"); strings.Contains(body, "451 try again later") {
+		t.Errorf("delivery log of pending reminders shows a failed one:\n%s", body)
+	}
+	if code, _ := get(fmt.Sprintf("/admin/reminders?user=%s", "x")); code != http.StatusBadRequest {
+		t.Errorf("bad user ID: got status %d, want 400", code)
+	}
+}
+
+func TestCLIReminders(t *testing.T) {
+	c := newCLI(t)
+	c.mustRun("users", "create", "-subject", "alice", "-role", "viewer")
+
+	if code, _, _ := c.run("reminders", "send"); code != exitError {
+		t.Errorf("reminders send without SMTP server: got exit code %d, want %d", code, exitError)
+	}
+	if code, _, _ := c.run("reminders", "opt-out", "2"); code != exitNotFound {
+		t.Errorf("reminders opt-out of a missing user: got exit code %d, want %d", code, exitNotFound)
+	}
+	c.mustRun("reminders", "opt-out", "1")
+	if out, err := c.bs.Reminders.OptedOut(1); err != nil || !out {
+		t.Errorf("OptedOut after opt-out: got %v, %v", out, err)
+	}
+	c.mustRun("reminders", "opt-out", "-undo", "1")
+	if out, _ := c.bs.Reminders.OptedOut(1); out {
+		t.Error("still opted out after opt-out -undo")
+	}
+	if out := c.mustRun("reminders", "log"); out != "" {
+		t.Errorf("reminders log: got %q", out)
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultCoverFetchTimeout = 10 * time.Second
+	maxCoverRedirects        = 5
+)
+
+// errCoverFetch is returned when a cover cannot be imported from a URL.
+var errCoverFetch = errors.New("could not fetch cover")
+
+// blockedNets are the address ranges covers are never fetched from, so that
+// the import cannot be used to reach the internal network of the server.
+var blockedNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8",      // "this" network
+		"10.0.0.0/8",     // private
+		"100.64.0.0/10",  // carrier-grade NAT
+		"127.0.0.0/8",    // loopback
+		"169.254.0.0/16", // link-local, cloud metadata servers
+		"172.16.0.0/12",  // private
+		"192.0.0.0/24",   // IETF protocol assignments
+		"192.168.0.0/16", // private
+		"198.18.0.0/15",  // benchmarking
+		"224.0.0.0/4",    // multicast
+		"240.0.0.0/4",    // reserved, broadcast
+		"::/128",         // unspecified
+		"::1/128",        // loopback
+		"64:ff9b::/96",   // NAT64
+		"fc00::/7",       // unique local
+		"fe80::/10",      // link-local
+		"ff00::/8",       // multicast
+	} {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+// publicIP reports whether ip is outside of blockedNets.
+func publicIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, n := range blockedNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// coverFetcher downloads covers from remote URLs.
+type coverFetcher struct {
+	client *http.Client
+}
+
+// newCoverFetcher creates a coverFetcher giving up after timeout. Unless
+// allowPrivate is set, which is meant for tests, it refuses to connect to
+// addresses in blockedNets.
+func newCoverFetcher(timeout time.Duration, allowPrivate bool) *coverFetcher {
+	dialer := &net.Dialer{Timeout: timeout}
+	if !allowPrivate {
+		// The address is checked after name resolution, right before
+		// connecting, so that DNS cannot return another address than was
+		// checked, and redirects are covered as well.
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+				return fmt.Errorf("address %s is not public", host)
+			}
+			return nil
+		}
+	}
+	return &coverFetcher{
+		client: &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				// Never go through a proxy, which would dial for us.
+				Proxy:                 nil,
+				DialContext:           dialer.DialContext,
+				TLSHandshakeTimeout:   timeout,
+				ResponseHeaderTimeout: timeout,
+				MaxIdleConns:          10,
+				IdleConnTimeout:       time.Minute,
+			},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= maxCoverRedirects {
+					return errors.New("too many redirects")
+				}
+				return checkCoverURL(req.URL)
+			},
+		},
+	}
+}
+
+// checkCoverURL returns an error unless covers may be fetched from u.
+func checkCoverURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return errors.New("missing host")
+	}
+	if u.User != nil {
+		return errors.New("credentials in URL")
+	}
+	return nil
+}
+
+// fetch downloads the cover at rawURL, reading at most maxBytes.
+func (f *coverFetcher) fetch(ctx context.Context, rawURL string, maxBytes int64) ([]byte, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errCoverFetch, err)
+	}
+	if err := checkCoverURL(u); err != nil {
+		return nil, fmt.Errorf("%w: %v", errCoverFetch, err)
+	}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errCoverFetch, err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "image/*")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errCoverFetch, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s returned %s", errCoverFetch, u.Host, resp.Status)
+	}
+	if resp.ContentLength > maxBytes {
+		return nil, fmt.Errorf("%w: more than %d bytes", errImageTooLarge, maxBytes)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errCoverFetch, err)
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, fmt.Errorf("%w: more than %d bytes", errImageTooLarge, maxBytes)
+	}
+	return data, nil
+}
+
+// importCover downloads the cover at rawURL and stores it like an upload.
+func (b *Bookshelf) importCover(ctx context.Context, rawURL string) (string, error) {
+	if b.Images == nil {
+		return "", errNoImageStore
+	}
+	data, err := b.fetcher.fetch(ctx, rawURL, b.imageLimits.MaxBytes)
+	if err != nil {
+		return "", err
+	}
+	return b.storeCover(ctx, bytes.NewReader(data))
+}
@@ -0,0 +1,133 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestPublicIP(t *testing.T) {
+	for _, tc := range []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1::", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.31.255.255", false},
+		{"192.168.0.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+	} {
+		if got := publicIP(net.ParseIP(tc.ip)); got != tc.want {
+			t.Errorf("publicIP(%s) = %v, want %v", tc.ip, got, tc.want)
+		}
+	}
+}
+
+// newCoverServer serves a cover at /cover.png, a non-image at /text and
+// redirects /redirect to the cover.
+func newCoverServer(t *testing.T, cover []byte) *httptest.Server {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cover.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(cover)
+	})
+	mux.HandleFunc("/text", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html>not a cover</html>"))
+	})
+	mux.Handle("/redirect", http.RedirectHandler("/cover.png", http.StatusFound))
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func postCoverURL(t *testing.T, srvURL, coverURL string) int {
+	t.Helper()
+	resp, err := http.PostForm(srvURL+"/books", url.Values{
+		"title":    {"imported"},
+		"coverURL": {coverURL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestImportCover(t *testing.T) {
+	bs, srv := newTestBookshelf(t)
+	bs.fetcher = newCoverFetcher(time.Second, true)
+	covers := newCoverServer(t, encodePNG(t, 300, 200))
+
+	for _, path := range []string{"/cover.png", "/redirect"} {
+		if got := postCoverURL(t, srv.URL, covers.URL+path); got != http.StatusOK {
+			t.Fatalf("%s: got status %d, want 200", path, got)
+		}
+	}
+	books, err := bs.DB.ListBooks()
+	if err != nil || len(books) != 2 {
+		t.Fatalf("ListBooks: got %d books, %v", len(books), err)
+	}
+	name, ok := bs.Images.Name(books[0].ImageURL)
+	if !ok {
+		t.Fatalf("cover %q is not in the image store", books[0].ImageURL)
+	}
+	if got := imageWidth(t, bs.Images, name); got != 300 {
+		t.Errorf("got width %d, want 300", got)
+	}
+
+	for _, tc := range []struct {
+		url  string
+		want int
+	}{
+		{covers.URL + "/text", http.StatusBadRequest},
+		{covers.URL + "/missing", http.StatusBadRequest},
+		{"file:///etc/passwd", http.StatusBadRequest},
+	} {
+		if got := postCoverURL(t, srv.URL, tc.url); got != tc.want {
+			t.Errorf("%s: got status %d, want %d", tc.url, got, tc.want)
+		}
+	}
+
+	bs.imageLimits.MaxBytes = 100
+	if got, want := postCoverURL(t, srv.URL, covers.URL+"/cover.png"), http.StatusRequestEntityTooLarge; got != want {
+		t.Errorf("oversized: got status %d, want %d", got, want)
+	}
+}
+
+func TestImportCoverBlocksPrivateAddresses(t *testing.T) {
+	bs, srv := newTestBookshelf(t)
+	covers := newCoverServer(t, encodePNG(t, 300, 200))
+
+	if got := postCoverURL(t, srv.URL, covers.URL+"/cover.png"); got != http.StatusBadRequest {
+		t.Errorf("got status %d, want 400", got)
+	}
+	if objects, _ := bs.Images.List(context.Background()); len(objects) != 0 {
+		t.Errorf("cover from a private address was stored: %+v", objects)
+	}
+}
@@ -0,0 +1,363 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	minRating = 1
+	maxRating = 5
+	// maxReviewBody bounds the text of reviews, in characters.
+	maxReviewBody = 5000
+)
+
+// Review is the rating of a book by a user, with an optional text.
+type Review struct {
+	ID      uint      `gorm:"column:id;primary_key" json:"id"`
+	BookID  uint      `gorm:"column:book_id" json:"book_id"`
+	UserID  uint      `gorm:"column:user_id" json:"user_id"`
+	Rating  int       `gorm:"column:rating" json:"rating"`
+	Body    string    `gorm:"column:body" json:"body,omitempty"`
+	Created time.Time `gorm:"column:created_at" json:"created"`
+	Updated time.Time `gorm:"column:updated_at" json:"updated"`
+	// Hidden reviews were taken down by a moderator. They are only shown
+	// to admins and their authors, and do not count towards ratings.
+	Hidden bool `gorm:"column:hidden" json:"hidden,omitempty"`
+}
+
+// TableName tells gorm where reviews live.
+func (Review) TableName() string {
+	return "reviews"
+}
+
+// Edited reports whether the review was changed after it was written.
+func (r *Review) Edited() bool {
+	return r.Updated.After(r.Created)
+}
+
+// RatingSummary sums up the visible reviews of a book.
+type RatingSummary struct {
+	Count   int
+	Average float64
+}
+
+// String formats the average rating, e.g. 4.5.
+func (s RatingSummary) String() string {
+	return strconv.FormatFloat(s.Average, 'f', 1, 64)
+}
+
+// better reports whether s comes before t when sorting by rating: by
+// average, then by count, unrated books last.
+func (s RatingSummary) better(t RatingSummary) bool {
+	if (s.Count == 0) != (t.Count == 0) {
+		return t.Count == 0
+	}
+	if s.Average != t.Average {
+		return s.Average > t.Average
+	}
+	return s.Count > t.Count
+}
+
+// ReviewFilter selects reviews. Zero fields match all reviews.
+type ReviewFilter struct {
+	BookID uint
+	UserID uint
+	// Visible leaves out hidden reviews.
+	Visible bool
+	// Limit caps the number of reviews returned, unless 0.
+	Limit int
+}
+
+func (f ReviewFilter) match(r *Review) bool {
+	return (f.BookID == 0 || r.BookID == f.BookID) &&
+		(f.UserID == 0 || r.UserID == f.UserID) &&
+		(!f.Visible || !r.Hidden)
+}
+
+// ReviewDatabase provides thread-safe access to the reviews of books. A
+// user reviews a book once at most.
+type ReviewDatabase interface {
+	// GetReview retrieves a review by its ID.
+	GetReview(id uint) (*Review, error)
+
+	// FindReview retrieves the review of a book by a user.
+	FindReview(bookID, userID uint) (*Review, error)
+
+	// SaveReview adds the review of r.UserID on r.BookID, which must
+	// exist, or replaces the rating, body and update time of the existing
+	// one, setting the ID, Created and Hidden of r from it.
+	SaveReview(r *Review) (id uint, err error)
+
+	// DeleteReview removes a review by its ID.
+	DeleteReview(id uint) error
+
+	// HideReview takes a review down or puts it back up.
+	HideReview(id uint, hidden bool) error
+
+	// ListReviews returns the reviews selected by f, newest first.
+	ListReviews(f ReviewFilter) ([]*Review, error)
+
+	// Ratings sums up the visible reviews of the given books. Books
+	// without any are left out.
+	Ratings(bookIDs []uint) (map[uint]RatingSummary, error)
+}
+
+var errNoReviews = errors.New("the configured database does not keep reviews")
+
+// errBadReview is wrapped by the errors of invalid reviews.
+var errBadReview = errors.New("bad review")
+
+// normalizeReview trims the body of r and checks its rating and length.
+func normalizeReview(r *Review) error {
+	if r.Rating < minRating || r.Rating > maxRating {
+		return fmt.Errorf("%w: rating %d is not between %d and %d", errBadReview, r.Rating, minRating, maxRating)
+	}
+	r.Body = strings.TrimSpace(strings.ReplaceAll(r.Body, "\r\n", "\n"))
+	if n := utf8.RuneCountInString(r.Body); n > maxReviewBody {
+		return fmt.Errorf("%w: review of %d characters, at most %d allowed", errBadReview, n, maxReviewBody)
+	}
+	if !utf8.ValidString(r.Body) {
+		return fmt.Errorf("%w: review is not valid UTF-8", errBadReview)
+	}
+	return nil
+}
+
+// ratingsOf sums up the reviews of books, or returns nil when the
+// database does not keep reviews.
+func (b *Bookshelf) ratingsOf(books []*Book) (map[uint]RatingSummary, error) {
+	if b.Reviews == nil {
+		return nil, nil
+	}
+	ids := make([]uint, len(books))
+	for i, book := range books {
+		ids[i] = book.ID
+	}
+	ratings, err := b.Reviews.Ratings(ids)
+	if err != nil {
+		return nil, fmt.Errorf("could not sum up ratings: %v", err)
+	}
+	return ratings, nil
+}
+
+// reviewView is a review with its author, for templates.
+type reviewView struct {
+	*Review
+	User *User
+	// Mine is set for the review of the signed-in user.
+	Mine bool
+}
+
+// bookReviews is what the page of a book shows about its reviews.
+type bookReviews struct {
+	Rating  RatingSummary
+	Reviews []reviewView
+	// Mine is the review of the signed-in user, if any.
+	Mine *Review
+	// CanReview is set for signed-in users, Moderate for admins.
+	CanReview bool
+	Moderate  bool
+	// Ratings are the choices of the rating form.
+	Ratings []int
+}
+
+// reviewsOf returns the reviews of a book for its page, or nil when the
+// database does not keep reviews. Hidden reviews are shown to admins and
+// their authors only.
+func (b *Bookshelf) reviewsOf(r *http.Request, book *Book) (*bookReviews, error) {
+	if b.Reviews == nil {
+		return nil, nil
+	}
+	u := currentUser(r)
+	br := &bookReviews{
+		CanReview: u != nil,
+		Moderate:  b.hasRole(r, RoleAdmin),
+		Ratings:   []int{5, 4, 3, 2, 1},
+	}
+	ratings, err := b.Reviews.Ratings([]uint{book.ID})
+	if err != nil {
+		return nil, fmt.Errorf("could not sum up ratings: %v", err)
+	}
+	br.Rating = ratings[book.ID]
+	reviews, err := b.Reviews.ListReviews(ReviewFilter{BookID: book.ID})
+	if err != nil {
+		return nil, fmt.Errorf("could not list reviews: %v", err)
+	}
+	for _, rev := range reviews {
+		mine := u != nil && rev.UserID == u.ID
+		if mine {
+			br.Mine = rev
+		}
+		if rev.Hidden && !mine && !br.Moderate {
+			continue
+		}
+		v := reviewView{Review: rev, Mine: mine}
+		if b.Users != nil {
+			if v.User, err = b.Users.GetUser(rev.UserID); err != nil && !errors.Is(err, errNotFound) {
+				return nil, err
+			}
+		}
+		br.Reviews = append(br.Reviews, v)
+	}
+	return br, nil
+}
+
+// reviewErrorf reports err, telling clients asking for missing books and
+// reviews and sending invalid ones.
+func (b *Bookshelf) reviewErrorf(r *http.Request, err error) *appError {
+	e := b.appErrorf(r, err, "%v", err)
+	switch {
+	case errors.Is(err, errNotFound):
+		e.code = http.StatusNotFound
+	case errors.Is(err, errBadReview):
+		e.code = http.StatusBadRequest
+	}
+	return e
+}
+
+// reviewFromRequest returns the review in the URL's path. Only its author
+// and admins may change it; others are told it does not exist.
+func (b *Bookshelf) reviewFromRequest(r *http.Request) (*Review, error) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil || id == 0 {
+		return nil, fmt.Errorf("%w: bad review ID %q", errBadReview, mux.Vars(r)["id"])
+	}
+	rev, err := b.Reviews.GetReview(uint(id))
+	if err != nil {
+		return nil, err
+	}
+	if u := currentUser(r); (u == nil || u.ID != rev.UserID) && !b.hasRole(r, RoleAdmin) {
+		return nil, fmt.Errorf("review with ID %d %w", id, errNotFound)
+	}
+	return rev, nil
+}
+
+// saveReviewHandler rates and reviews the book in the URL's path for the
+// signed-in user, replacing their earlier review.
+func (b *Bookshelf) saveReviewHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if b.Reviews == nil {
+		return b.appErrorf(r, errNoReviews, "%v", errNoReviews)
+	}
+	u := currentUser(r)
+	if u == nil {
+		e := b.appErrorf(r, errors.New("not signed in"), "sign in to review books")
+		e.code = http.StatusUnauthorized
+		return e
+	}
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil || id == 0 {
+		return b.reviewErrorf(r, fmt.Errorf("%w: bad book ID %q", errBadReview, mux.Vars(r)["id"]))
+	}
+	rating, err := strconv.Atoi(r.FormValue("rating"))
+	if err != nil {
+		return b.reviewErrorf(r, fmt.Errorf("%w: bad rating %q", errBadReview, r.FormValue("rating")))
+	}
+	now := time.Now().UTC()
+	rev := &Review{BookID: uint(id), UserID: u.ID, Rating: rating, Body: r.FormValue("body"), Created: now, Updated: now}
+	if err := normalizeReview(rev); err != nil {
+		return b.reviewErrorf(r, err)
+	}
+	if _, err := b.Reviews.SaveReview(rev); err != nil {
+		return b.reviewErrorf(r, err)
+	}
+	http.Redirect(w, r, fmt.Sprintf("/books/%d#reviews", rev.BookID), http.StatusFound)
+	return nil
+}
+
+// deleteReviewHandler removes the review in the URL's path. Users delete
+// their own reviews, admins any.
+func (b *Bookshelf) deleteReviewHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if b.Reviews == nil {
+		return b.appErrorf(r, errNoReviews, "%v", errNoReviews)
+	}
+	rev, err := b.reviewFromRequest(r)
+	if err != nil {
+		return b.reviewErrorf(r, err)
+	}
+	if err := b.Reviews.DeleteReview(rev.ID); err != nil {
+		return b.reviewErrorf(r, err)
+	}
+	b.redirectAfterModeration(w, r, rev)
+	return nil
+}
+
+// moderateReviewHandler hides the review in the URL's path, or shows it
+// again with hidden=false.
+func (b *Bookshelf) moderateReviewHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if b.Reviews == nil {
+		return b.appErrorf(r, errNoReviews, "%v", errNoReviews)
+	}
+	rev, err := b.reviewFromRequest(r)
+	if err != nil {
+		return b.reviewErrorf(r, err)
+	}
+	hidden, err := strconv.ParseBool(r.FormValue("hidden"))
+	if err != nil {
+		return b.reviewErrorf(r, fmt.Errorf("%w: bad value %q of hidden", errBadReview, r.FormValue("hidden")))
+	}
+	if err := b.Reviews.HideReview(rev.ID, hidden); err != nil {
+		return b.reviewErrorf(r, err)
+	}
+	b.redirectAfterModeration(w, r, rev)
+	return nil
+}
+
+// redirectAfterModeration returns to the moderation page when the form
+// came from there, and to the page of the book otherwise.
+func (b *Bookshelf) redirectAfterModeration(w http.ResponseWriter, r *http.Request, rev *Review) {
+	next := fmt.Sprintf("/books/%d#reviews", rev.BookID)
+	if r.FormValue("next") == "moderation" {
+		next = "/admin/reviews"
+	}
+	http.Redirect(w, r, next, http.StatusFound)
+}
+
+// reviewsModerationHandler lists the latest reviews of all books for
+// admins, hidden ones included.
+func (b *Bookshelf) reviewsModerationHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if b.Reviews == nil {
+		return b.appErrorf(r, errNoReviews, "%v", errNoReviews)
+	}
+	reviews, err := b.Reviews.ListReviews(ReviewFilter{Limit: 200})
+	if err != nil {
+		return b.appErrorf(r, err, "could not list reviews: %v", err)
+	}
+	type moderatedReview struct {
+		reviewView
+		Book *Book
+	}
+	views := make([]moderatedReview, len(reviews))
+	for i, rev := range reviews {
+		v := moderatedReview{reviewView: reviewView{Review: rev}}
+		if v.Book, err = b.DB.GetBook(rev.BookID); err != nil && !errors.Is(err, errNotFound) {
+			return b.appErrorf(r, err, "%v", err)
+		}
+		if b.Users != nil {
+			if v.User, err = b.Users.GetUser(rev.UserID); err != nil && !errors.Is(err, errNotFound) {
+				return b.appErrorf(r, err, "%v", err)
+			}
+		}
+		views[i] = v
+	}
+	return reviewsTmpl.Execute(b, w, r, views)
+}
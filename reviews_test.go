@@ -0,0 +1,200 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestReviews(t *testing.T) {
+	m := newMockIssuer(t)
+	bs, srv := newOIDCBookshelf(t, m)
+
+	dune, err := bs.DB.AddBook(&Book{Title: "Dune"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bs.DB.AddBook(&Book{Title: "Anathem"}); err != nil {
+		t.Fatal(err)
+	}
+	page := fmt.Sprintf("%s/books/%d", srv.URL, dune)
+
+	signIn := func(sub string, groups ...interface{}) *http.Client {
+		t.Helper()
+		m.setClaims(map[string]interface{}{"sub": sub, "name": sub, "groups": groups})
+		c := newBrowser(t)
+		resp, err := c.Get(srv.URL + "/loans")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: GET /loans: got status %d", sub, resp.StatusCode)
+		}
+		return c
+	}
+	get := func(c *http.Client, url string) string {
+		t.Helper()
+		resp, err := c.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body)
+	}
+	post := func(c *http.Client, url string, form url.Values) int {
+		t.Helper()
+		resp, err := c.PostForm(url, form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	alice, bob := signIn("alice"), signIn("bob")
+	admin := signIn("carol", "library-admins")
+
+	// Visitors see reviews, but need to sign in to write one.
+	if code := post(http.DefaultClient, page+"/review", url.Values{"rating": {"5"}}); code == http.StatusOK {
+		t.Error("anonymous review: got status 200")
+	}
+	if body := get(http.DefaultClient, page); strings.Contains(body, fmt.Sprintf(`action="/books/%d/review"`, dune)) {
+		t.Error("anonymous visitors are offered the review form")
+	}
+
+	for _, tc := range []struct {
+		rating, body string
+		want         int
+	}{
+		{"0", "", http.StatusBadRequest},
+		{"6", "", http.StatusBadRequest},
+		{"five", "", http.StatusBadRequest},
+		{"3", strings.Repeat("x", maxReviewBody+1), http.StatusBadRequest},
+		{"3", "Slow start.", http.StatusOK},
+	} {
+		if code := post(alice, page+"/review", url.Values{"rating": {tc.rating}, "body": {tc.body}}); code != tc.want {
+			t.Errorf("review with rating %q: got status %d, want %d", tc.rating, code, tc.want)
+		}
+	}
+	if code := post(alice, srv.URL+"/books/99/review", url.Values{"rating": {"3"}}); code != http.StatusNotFound {
+		t.Errorf("review of a missing book: got status %d, want 404", code)
+	}
+	// Writing again edits the review.
+	if code := post(alice, page+"/review", url.Values{"rating": {"4"}, "body": {"A <classic>."}}); code != http.StatusOK {
+		t.Fatalf("editing the review: got status %d", code)
+	}
+	if code := post(bob, page+"/review", url.Values{"rating": {"5"}}); code != http.StatusOK {
+		t.Fatalf("bob's review: got status %d", code)
+	}
+	reviews, err := bs.Reviews.ListReviews(ReviewFilter{BookID: dune})
+	if err != nil || len(reviews) != 2 {
+		t.Fatalf("ListReviews: got %+v, %v", reviews, err)
+	}
+	bobs, alices := reviews[0], reviews[1]
+	if alices.Rating != 4 || alices.Body != "A <classic>." {
+		t.Errorf("alice's review: got %+v", alices)
+	}
+
+	body := get(alice, page)
+	for _, want := range []string{"&#9733; 4.5", "from 2 reviews", "A &lt;classic&gt;.", "Update review", `<option value="4" selected>`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("book page does not show %q", want)
+		}
+	}
+	if body := get(alice, srv.URL+"/books"); !strings.Contains(body, "&#9733; 4.5 <small>(2)</small>") {
+		t.Error("book list does not show the rating")
+	}
+	if body := get(alice, srv.URL+"/books?sort=-rating"); strings.Index(body, ">Dune<") > strings.Index(body, ">Anathem<") {
+		t.Error("sorting by rating does not list the rated book first")
+	}
+
+	// Users delete their own reviews only; others are told there is none.
+	if code := post(alice, fmt.Sprintf("%s/reviews/%d:delete", srv.URL, bobs.ID), nil); code != http.StatusNotFound {
+		t.Errorf("alice deleting bob's review: got status %d, want 404", code)
+	}
+	if code := post(alice, fmt.Sprintf("%s/reviews/%d:hide", srv.URL, bobs.ID), url.Values{"hidden": {"true"}}); code != http.StatusForbidden {
+		t.Errorf("alice hiding bob's review: got status %d, want 403", code)
+	}
+
+	// Admins hide reviews, which then count no more and are shown to
+	// their authors and admins only.
+	if body := get(admin, srv.URL+"/admin/reviews"); !strings.Contains(body, "A &lt;classic&gt;.") || strings.Contains(body, "Slow start.") {
+		t.Error("moderation page does not list the reviews")
+	}
+	if code := post(admin, fmt.Sprintf("%s/reviews/%d:hide", srv.URL, alices.ID), url.Values{"hidden": {"true"}}); code != http.StatusOK {
+		t.Fatalf("hiding alice's review: got status %d", code)
+	}
+	if body := get(bob, page); strings.Contains(body, "A &lt;classic&gt;.") || !strings.Contains(body, "&#9733; 5.0") {
+		t.Error("hidden review is shown to others or still counted")
+	}
+	if body := get(alice, page); !strings.Contains(body, "hidden by a moderator") {
+		t.Error("hidden review is not shown to its author")
+	}
+	if body := get(admin, page); !strings.Contains(body, "A &lt;classic&gt;.") {
+		t.Error("hidden review is not shown to admins")
+	}
+	if code := post(admin, fmt.Sprintf("%s/reviews/%d:hide", srv.URL, alices.ID), url.Values{"hidden": {"maybe"}}); code != http.StatusBadRequest {
+		t.Errorf("hiding with a bad value: got status %d, want 400", code)
+	}
+	if code := post(admin, fmt.Sprintf("%s/reviews/%d:delete", srv.URL, bobs.ID), url.Values{"next": {"moderation"}}); code != http.StatusOK {
+		t.Errorf("admin deleting bob's review: got status %d", code)
+	}
+	if code := post(alice, fmt.Sprintf("%s/reviews/%d:delete", srv.URL, alices.ID), nil); code != http.StatusOK {
+		t.Errorf("alice deleting her review: got status %d", code)
+	}
+	if reviews, err := bs.Reviews.ListReviews(ReviewFilter{}); err != nil || len(reviews) != 0 {
+		t.Errorf("ListReviews after deleting: got %+v, %v", reviews, err)
+	}
+	if body := get(bob, page); !strings.Contains(body, "No reviews yet.") {
+		t.Error("book page still shows reviews")
+	}
+}
+
+func TestCLIReviews(t *testing.T) {
+	c := newCLI(t)
+	c.mustRun("books", "add", "-title", "Dune")
+	c.mustRun("users", "create", "-subject", "alice", "-role", "viewer")
+	r := &Review{BookID: 1, UserID: 1, Rating: 2, Body: "Too much sand."}
+	if _, err := c.bs.Reviews.SaveReview(r); err != nil {
+		t.Fatal(err)
+	}
+
+	if code, _, _ := c.run("reviews", "hide"); code != exitUsage {
+		t.Errorf("reviews hide without IDs: got exit code %d, want %d", code, exitUsage)
+	}
+	c.mustRun("reviews", "hide", "1")
+	if out := c.mustRun("reviews", "list", "-book", "1"); !strings.Contains(out, `"hidden":true`) {
+		t.Errorf("reviews list after hide: got %q", out)
+	}
+	c.mustRun("reviews", "hide", "-undo", "1")
+	if out := c.mustRun("reviews", "list", "-user", "1"); strings.Contains(out, `"hidden"`) || !strings.Contains(out, "Too much sand.") {
+		t.Errorf("reviews list after hide -undo: got %q", out)
+	}
+	c.mustRun("reviews", "delete", "1")
+	if code, _, _ := c.run("reviews", "delete", "1"); code != exitNotFound {
+		t.Errorf("reviews delete twice: got exit code %d, want %d", code, exitNotFound)
+	}
+	if out := c.mustRun("reviews", "list"); out != "" {
+		t.Errorf("reviews list after delete: got %q", out)
+	}
+	if code, _, _ := c.run("books", "list", "-sort", "-rating"); code != exitOK {
+		t.Errorf("books list -sort -rating: got exit code %d", code)
+	}
+}
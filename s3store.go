@@ -0,0 +1,418 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Config configures an S3-compatible image store, such as MinIO.
+type S3Config struct {
+	// Endpoint is the base URL of the service, e.g. https://minio.local:9000.
+	Endpoint string
+	Region   string
+	Bucket   string
+
+	AccessKeyID     string
+	SecretAccessKey string
+
+	// PathStyle addresses objects as Endpoint/Bucket/name rather than
+	// through the bucket.host virtual host. MinIO needs it.
+	PathStyle bool
+
+	// PublicURL is the base URL objects are served at in public mode.
+	// It defaults to the URL of the bucket, which must then allow
+	// anonymous reads.
+	PublicURL string
+
+	// PresignExpiry switches to presigned mode when non-zero: the bucket
+	// stays private and /images/ redirects browsers to URLs signed for
+	// that long.
+	PresignExpiry time.Duration
+}
+
+// s3ImageStore keeps images in a bucket of an S3-compatible service.
+type s3ImageStore struct {
+	cfg      S3Config
+	endpoint *url.URL
+	client   *http.Client
+	// now can be overridden for tests.
+	now func() time.Time
+}
+
+var _ ImageStore = &s3ImageStore{}
+
+// newS3ImageStore creates an ImageStore backed by the bucket of cfg.
+func newS3ImageStore(cfg S3Config) (*s3ImageStore, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, errors.New("s3: endpoint and bucket are required")
+	}
+	if cfg.AccessKeyID == "" || cfg.SecretAccessKey == "" {
+		return nil, errors.New("s3: access key and secret are required")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	endpoint, err := url.Parse(strings.TrimSuffix(cfg.Endpoint, "/"))
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("s3: bad endpoint %q", cfg.Endpoint)
+	}
+	if cfg.PublicURL == "" {
+		cfg.PublicURL = strings.TrimSuffix(bucketURL(endpoint, cfg.Bucket, cfg.PathStyle).String(), "/")
+	}
+	return &s3ImageStore{
+		cfg:      cfg,
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: time.Minute},
+		now:      time.Now,
+	}, nil
+}
+
+// bucketURL returns the URL of bucket, under which objects are addressed.
+func bucketURL(endpoint *url.URL, bucket string, pathStyle bool) *url.URL {
+	u := *endpoint
+	if pathStyle {
+		u.Path += "/" + bucket + "/"
+	} else {
+		u.Host = bucket + "." + u.Host
+		u.Path += "/"
+	}
+	return &u
+}
+
+// objectURL returns the URL of the object name, for the API.
+func (s *s3ImageStore) objectURL(name string) *url.URL {
+	u := bucketURL(s.endpoint, s.cfg.Bucket, s.cfg.PathStyle)
+	u.Path += name
+	return u
+}
+
+// do signs and sends a request to the API. Responses with a status of 300
+// and above are turned into errors, 404 into errImageNotFound.
+func (s *s3ImageStore) do(ctx context.Context, method string, u *url.URL, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("s3: %v", err)
+	}
+	req = req.WithContext(ctx)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.ContentLength = int64(len(body))
+	signV4(req, sha256Hex(body), s.cfg.AccessKeyID, s.cfg.SecretAccessKey, s.cfg.Region, s.now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("s3: %v", err)
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errImageNotFound
+	}
+	var e struct {
+		Code    string
+		Message string
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	if xml.Unmarshal(msg, &e) == nil && e.Code != "" {
+		return nil, fmt.Errorf("s3: %s %s: %s: %s", method, u.Path, e.Code, e.Message)
+	}
+	return nil, fmt.Errorf("s3: %s %s: %s", method, u.Path, resp.Status)
+}
+
+// Put stores data under name and returns its public URL.
+func (s *s3ImageStore) Put(ctx context.Context, name, contentType string, data []byte) (string, error) {
+	header := http.Header{}
+	header.Set("Content-Type", contentType)
+	header.Set("Cache-Control", immutableCacheControl)
+	resp, err := s.do(ctx, "PUT", s.objectURL(name), header, data)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return s.URL(name), nil
+}
+
+// Get returns the content of the object with the given name.
+func (s *s3ImageStore) Get(ctx context.Context, name string) ([]byte, error) {
+	resp, err := s.do(ctx, "GET", s.objectURL(name), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Delete removes the object with the given name. S3 does not tell whether
+// the object existed.
+func (s *s3ImageStore) Delete(ctx context.Context, name string) error {
+	resp, err := s.do(ctx, "DELETE", s.objectURL(name), nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Stat describes the object with the given name. S3 does not keep the
+// creation time, the time of the last write is reported instead.
+func (s *s3ImageStore) Stat(ctx context.Context, name string) (ImageObject, error) {
+	resp, err := s.do(ctx, "HEAD", s.objectURL(name), nil, nil)
+	if err != nil {
+		return ImageObject{}, err
+	}
+	resp.Body.Close()
+	modified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return ImageObject{}, fmt.Errorf("s3: bad Last-Modified of %s: %v", name, err)
+	}
+	return ImageObject{Name: name, Size: resp.ContentLength, Created: modified}, nil
+}
+
+// listBucketResult is the response to ListObjectsV2.
+type listBucketResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// List returns all objects of the bucket.
+func (s *s3ImageStore) List(ctx context.Context) ([]ImageObject, error) {
+	var objects []ImageObject
+	token := ""
+	for {
+		u := bucketURL(s.endpoint, s.cfg.Bucket, s.cfg.PathStyle)
+		q := url.Values{"list-type": {"2"}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		u.RawQuery = q.Encode()
+
+		resp, err := s.do(ctx, "GET", u, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3: could not decode listing: %v", err)
+		}
+		for _, c := range result.Contents {
+			objects = append(objects, ImageObject{Name: c.Key, Size: c.Size, Created: c.LastModified})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// URL returns the URL of the object with the given name. In presigned mode
+// that is a URL of /images/, see ServeHTTP.
+func (s *s3ImageStore) URL(name string) string {
+	if s.cfg.PresignExpiry > 0 {
+		return memoryImagePrefix + name
+	}
+	return s.cfg.PublicURL + "/" + name
+}
+
+// Name returns the name of the object served at url.
+func (s *s3ImageStore) Name(url string) (string, bool) {
+	prefix := s.URL("")
+	if !strings.HasPrefix(url, prefix) || url == prefix {
+		return "", false
+	}
+	return strings.TrimPrefix(url, prefix), true
+}
+
+// ServeHTTP redirects to a presigned URL of the object in presigned mode.
+func (s *s3ImageStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name, ok := s.Name(r.URL.Path)
+	if !ok || s.cfg.PresignExpiry <= 0 {
+		http.NotFound(w, r)
+		return
+	}
+	u := presignV4(s.objectURL(name), s.cfg.AccessKeyID, s.cfg.SecretAccessKey, s.cfg.Region, s.now(), s.cfg.PresignExpiry)
+	// The redirect may be cached for a while, but not for longer than the
+	// signature is valid.
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(s.cfg.PresignExpiry.Seconds()/2)))
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+// Signature Version 4, see
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-authenticating-requests.html.
+
+const (
+	sigV4Algorithm  = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat = "20060102T150405Z"
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// sigV4Key derives the signing key of a day, region and service.
+func sigV4Key(secret, date, region string) []byte {
+	k := hmacSHA256([]byte("AWS4"+secret), date)
+	k = hmacSHA256(k, region)
+	k = hmacSHA256(k, "s3")
+	return hmacSHA256(k, "aws4_request")
+}
+
+// uriEncode escapes s as S3 expects: everything but the unreserved
+// characters, and the slash unless it is encoding a query component.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// canonicalQuery returns q sorted and escaped for signing.
+func canonicalQuery(q url.Values) string {
+	var pairs []string
+	for k, vs := range q {
+		for _, v := range vs {
+			pairs = append(pairs, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// canonicalHeaders returns the headers to sign, which are host and all
+// headers set on req, and their names.
+func canonicalHeaders(req *http.Request) (canonical, signed string) {
+	headers := map[string]string{"host": req.URL.Host}
+	for k, vs := range req.Header {
+		k = strings.ToLower(k)
+		if k == "authorization" || k == "user-agent" {
+			continue
+		}
+		var values []string
+		for _, v := range vs {
+			values = append(values, strings.Join(strings.Fields(v), " "))
+		}
+		headers[k] = strings.Join(values, ",")
+	}
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, k := range names {
+		b.WriteString(k + ":" + headers[k] + "\n")
+	}
+	return b.String(), strings.Join(names, ";")
+}
+
+// stringToSign returns the string the signature of a request is computed
+// over, and the scope of its credentials.
+func stringToSign(method string, u *url.URL, headers, signedHeaders, payloadHash, region string, t time.Time) (string, string) {
+	path := u.EscapedPath()
+	if p, err := url.PathUnescape(path); err == nil {
+		path = p
+	}
+	if path == "" {
+		path = "/"
+	}
+	canonical := strings.Join([]string{
+		method,
+		uriEncode(path, false),
+		canonicalQuery(u.Query()),
+		headers,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := t.Format("20060102") + "/" + region + "/s3/aws4_request"
+	return strings.Join([]string{
+		sigV4Algorithm,
+		t.Format(sigV4TimeFormat),
+		scope,
+		sha256Hex([]byte(canonical)),
+	}, "\n"), scope
+}
+
+// signV4 adds the Authorization header to req, which sends a payload with
+// the given SHA-256.
+func signV4(req *http.Request, payloadHash, accessKey, secret, region string, t time.Time) {
+	t = t.UTC()
+	req.Header.Set("X-Amz-Date", t.Format(sigV4TimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	headers, signed := canonicalHeaders(req)
+	sts, scope := stringToSign(req.Method, req.URL, headers, signed, payloadHash, region, t)
+	sig := hex.EncodeToString(hmacSHA256(sigV4Key(secret, t.Format("20060102"), region), sts))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, accessKey, scope, signed, sig))
+}
+
+// presignV4 returns u with a query string authorizing a GET for expiry.
+func presignV4(u *url.URL, accessKey, secret, region string, t time.Time, expiry time.Duration) *url.URL {
+	t = t.UTC()
+	signed := *u
+	q := signed.Query()
+	q.Set("X-Amz-Algorithm", sigV4Algorithm)
+	q.Set("X-Amz-Credential", accessKey+"/"+t.Format("20060102")+"/"+region+"/s3/aws4_request")
+	q.Set("X-Amz-Date", t.Format(sigV4TimeFormat))
+	q.Set("X-Amz-Expires", strconv.Itoa(int(expiry.Seconds())))
+	q.Set("X-Amz-SignedHeaders", "host")
+	signed.RawQuery = canonicalQuery(q)
+
+	sts, _ := stringToSign("GET", &signed, "host:"+u.Host+"\n", "host", unsignedPayload, region, t)
+	sig := hex.EncodeToString(hmacSHA256(sigV4Key(secret, t.Format("20060102"), region), sts))
+	signed.RawQuery += "&X-Amz-Signature=" + sig
+	return &signed
+}
@@ -0,0 +1,367 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// maxSeriesName is the size of the name column.
+const maxSeriesName = 255
+
+// maxSeriesNumber bounds the numbers of volumes, which the number column
+// stores with 3 decimals.
+const maxSeriesNumber = 99999
+
+// Series is a sequence of books meant to be read in order.
+type Series struct {
+	ID   uint   `gorm:"column:id;primary_key" json:"id"`
+	Name string `gorm:"column:name" json:"name"`
+}
+
+// TableName tells gorm where series live.
+func (Series) TableName() string {
+	return "series"
+}
+
+// SeriesEntry places a book in a series.
+type SeriesEntry struct {
+	SeriesID uint   `json:"series_id,omitempty"`
+	Name     string `json:"name"`
+	// Number is the place of the book in the series, e.g. 3 or 2.5 for a
+	// novella between the second and third volumes; 0 when unnumbered.
+	Number float64 `json:"number,omitempty"`
+}
+
+// NumberString formats Number without trailing zeros, and 0 as "".
+func (e *SeriesEntry) NumberString() string {
+	return formatSeriesNumber(e.Number)
+}
+
+func formatSeriesNumber(n float64) string {
+	if n == 0 {
+		return ""
+	}
+	return strconv.FormatFloat(n, 'f', -1, 64)
+}
+
+// bookSeries places a book in a series, see SeriesEntry.
+type bookSeries struct {
+	BookID   uint    `gorm:"column:book_id;primary_key"`
+	SeriesID uint    `gorm:"column:series_id"`
+	Number   float64 `gorm:"column:number"`
+}
+
+// TableName tells gorm where the series of books live.
+func (bookSeries) TableName() string {
+	return "book_series"
+}
+
+// Volume is a book of a series.
+type Volume struct {
+	Book   *Book
+	Number float64
+}
+
+// NumberString formats Number, see SeriesEntry.NumberString.
+func (v Volume) NumberString() string {
+	return formatSeriesNumber(v.Number)
+}
+
+// sortVolumes puts volumes in reading order: by number, the unnumbered
+// last, then by title and ID.
+func sortVolumes(volumes []Volume) {
+	sort.Slice(volumes, func(i, j int) bool {
+		a, b := volumes[i], volumes[j]
+		if (a.Number == 0) != (b.Number == 0) {
+			return b.Number == 0
+		}
+		if a.Number != b.Number {
+			return a.Number < b.Number
+		}
+		if a.Book.Title != b.Book.Title {
+			return a.Book.Title < b.Book.Title
+		}
+		return a.Book.ID < b.Book.ID
+	})
+}
+
+// SeriesDatabase provides thread-safe access to series and the books in
+// them.
+type SeriesDatabase interface {
+	// GetSeries retrieves a series by its ID.
+	GetSeries(id uint) (*Series, error)
+
+	// ListSeries returns all series, ordered by name.
+	ListSeries() ([]*Series, error)
+
+	// SetSeries places a book in a series, or takes it out of its series if
+	// e is nil. Series are matched by name, ignoring case, and added when not
+	// known yet; series left without books are removed. The SeriesID and
+	// Name of e are set to those of the matched series.
+	SetSeries(bookID uint, e *SeriesEntry) error
+
+	// BookSeries returns the series of a book, or nil.
+	BookSeries(bookID uint) (*SeriesEntry, error)
+
+	// Volumes returns the books of a series, in reading order.
+	Volumes(seriesID uint) ([]Volume, error)
+
+	// RenameSeries changes the name of a series.
+	RenameSeries(id uint, name string) error
+}
+
+var errNoSeries = errors.New("the configured database does not keep series")
+
+// errBadSeries is wrapped by the errors of normalizeSeries.
+var errBadSeries = errors.New("bad series")
+
+// normalizeSeries trims the name of e, returning nil for a blank one, and
+// checks its number. Numbers are kept to 3 decimals.
+func normalizeSeries(e *SeriesEntry) (*SeriesEntry, error) {
+	if e == nil {
+		return nil, nil
+	}
+	n := *e
+	n.Name = strings.Join(strings.Fields(n.Name), " ")
+	if n.Name == "" {
+		if n.Number != 0 {
+			return nil, fmt.Errorf("%w: number without series", errBadSeries)
+		}
+		return nil, nil
+	}
+	if len(n.Name) > maxSeriesName {
+		return nil, fmt.Errorf("%w: name longer than %d bytes", errBadSeries, maxSeriesName)
+	}
+	if math.IsNaN(n.Number) || n.Number < 0 || n.Number > maxSeriesNumber {
+		return nil, fmt.Errorf("%w: number %v out of range", errBadSeries, n.Number)
+	}
+	n.Number = math.Round(n.Number*1000) / 1000
+	return &n, nil
+}
+
+// seriesFromForm reads the seriesName and seriesNumber fields of the edit
+// form.
+func seriesFromForm(r *http.Request) (*SeriesEntry, error) {
+	e := &SeriesEntry{Name: r.FormValue("seriesName")}
+	if s := strings.TrimSpace(r.FormValue("seriesNumber")); s != "" {
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: number %q", errBadSeries, s)
+		}
+		e.Number = n
+	}
+	return normalizeSeries(e)
+}
+
+// seriesTitle matches titles with the series at their end, as in
+// "Dust (Silo, #3)", "The Hedge Knight (Dunk and Egg, Book 1)" and
+// "Elantris (Cosmere #2.5)".
+var seriesTitle = regexp.MustCompile(`^(.*\S)\s*\(\s*(.*?\S)\s*,?\s+(?:#|(?i:book|vol\.?|volume|no\.?)\s*#?)\s*(\d+(?:\.\d+)?)\s*\)$`)
+
+// parseSeriesTitle splits the series off a title, see seriesTitle.
+func parseSeriesTitle(title string) (string, *SeriesEntry, bool) {
+	m := seriesTitle.FindStringSubmatch(strings.TrimSpace(title))
+	if m == nil {
+		return title, nil, false
+	}
+	n, err := strconv.ParseFloat(m[3], 64)
+	if err != nil {
+		return title, nil, false
+	}
+	e, err := normalizeSeries(&SeriesEntry{Name: m[2], Number: n})
+	if err != nil || e == nil {
+		return title, nil, false
+	}
+	return m[1], e, true
+}
+
+// seriesNumberOnly matches titles numbering a volume without naming the
+// series, e.g. "Dust (Book 3)", which convertSeriesTitles cannot convert.
+var seriesNumberOnly = regexp.MustCompile(`\(\s*(?:#|(?i:book|vol\.?|volume|no\.?)\s*#?)\s*\d+(?:\.\d+)?\s*\)\s*$`)
+
+// convertedTitle is a title convertSeriesTitles split.
+type convertedTitle struct {
+	ID     uint    `json:"id"`
+	Title  string  `json:"title"`
+	Series string  `json:"series"`
+	Number float64 `json:"number,omitempty"`
+}
+
+// unconvertedTitle is a title numbering a volume without naming its series.
+type unconvertedTitle struct {
+	ID    uint   `json:"id"`
+	Title string `json:"title"`
+}
+
+// titleConversion reports the result of convertSeriesTitles.
+type titleConversion struct {
+	Converted   []convertedTitle   `json:"converted"`
+	Unconverted []unconvertedTitle `json:"unconverted"`
+}
+
+// convertSeriesTitles moves the series written at the end of the titles of
+// books in no series yet, e.g. "Dust (Silo, #3)", into series. Unless dryRun
+// is set, the books are updated and the changes audited.
+func (b *Bookshelf) convertSeriesTitles(dryRun bool) (*titleConversion, error) {
+	books, err := b.DB.ListBooks()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(books, func(i, j int) bool {
+		return books[i].ID < books[j].ID
+	})
+	report := &titleConversion{}
+	for _, book := range books {
+		if err := b.loadSeries(book); err != nil {
+			return report, err
+		}
+		if book.Series != nil {
+			continue
+		}
+		title, e, ok := parseSeriesTitle(book.Title)
+		if !ok {
+			if seriesNumberOnly.MatchString(book.Title) {
+				report.Unconverted = append(report.Unconverted, unconvertedTitle{book.ID, book.Title})
+			}
+			continue
+		}
+		if !dryRun {
+			if err := b.loadCredits(book); err != nil {
+				return report, err
+			}
+			before := *book
+			book.Title, book.Series = title, e
+			if err := b.DB.UpdateBook(book); err != nil {
+				return report, err
+			}
+			if err := b.saveSeries(book); err != nil {
+				return report, err
+			}
+			if err := b.auditCLI(AuditUpdate, book.ID, &before, book); err != nil {
+				return report, err
+			}
+		}
+		report.Converted = append(report.Converted, convertedTitle{book.ID, title, e.Name, e.Number})
+	}
+	return report, nil
+}
+
+// saveSeries stores the series of book, which must have an ID. It is a
+// no-op when the database does not keep series.
+func (b *Bookshelf) saveSeries(book *Book) error {
+	if b.Series == nil {
+		return nil
+	}
+	defer invalidateCache(b.DB, book.ID)
+	if err := b.Series.SetSeries(book.ID, book.Series); err != nil {
+		return fmt.Errorf("could not save series: %v", err)
+	}
+	return nil
+}
+
+// loadSeries sets the series of books from the database.
+func (b *Bookshelf) loadSeries(books ...*Book) error {
+	if b.Series == nil {
+		return nil
+	}
+	for _, book := range books {
+		e, err := b.Series.BookSeries(book.ID)
+		if err != nil {
+			return fmt.Errorf("could not load series: %v", err)
+		}
+		book.Series = e
+	}
+	return nil
+}
+
+// seriesNeighbors returns the books before and after book in its series,
+// either of which may be nil.
+func (b *Bookshelf) seriesNeighbors(book *Book) (prev, next *Book, err error) {
+	if b.Series == nil || book.Series == nil {
+		return nil, nil, nil
+	}
+	volumes, err := b.Series.Volumes(book.Series.SeriesID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not list series: %v", err)
+	}
+	for i, v := range volumes {
+		if v.Book.ID != book.ID {
+			continue
+		}
+		if i > 0 {
+			prev = volumes[i-1].Book
+		}
+		if i+1 < len(volumes) {
+			next = volumes[i+1].Book
+		}
+	}
+	return prev, next, nil
+}
+
+// seriesListHandler lists all series.
+func (b *Bookshelf) seriesListHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if b.Series == nil {
+		return b.appErrorf(r, errNoSeries, "%v", errNoSeries)
+	}
+	series, err := b.Series.ListSeries()
+	if err != nil {
+		return b.appErrorf(r, err, "could not list series: %v", err)
+	}
+	return seriesListTmpl.Execute(b, w, r, series)
+}
+
+// seriesHandler shows a series and its books in reading order.
+func (b *Bookshelf) seriesHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if b.Series == nil {
+		return b.appErrorf(r, errNoSeries, "%v", errNoSeries)
+	}
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil || id == 0 {
+		return b.appErrorf(r, err, "bad series ID %q", mux.Vars(r)["id"])
+	}
+	s, err := b.Series.GetSeries(uint(id))
+	if err != nil {
+		e := b.appErrorf(r, err, "%v", err)
+		if errors.Is(err, errNotFound) {
+			e.code = http.StatusNotFound
+		}
+		return e
+	}
+	volumes, err := b.Series.Volumes(s.ID)
+	if err != nil {
+		return b.appErrorf(r, err, "could not list books: %v", err)
+	}
+	type volumeView struct {
+		bookView
+		Number string
+	}
+	views := make([]volumeView, len(volumes))
+	for i, v := range volumes {
+		views[i] = volumeView{b.viewOf(v.Book), v.NumberString()}
+	}
+	return seriesTmpl.Execute(b, w, r, struct {
+		Series  *Series
+		Volumes []volumeView
+	}{s, views})
+}
@@ -0,0 +1,205 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseSeriesTitle(t *testing.T) {
+	for _, tc := range []struct {
+		in, title, series string
+		number            float64
+	}{
+		{"Dust (Silo, #3)", "Dust", "Silo", 3},
+		{"Elantris (Cosmere #2.5)", "Elantris", "Cosmere", 2.5},
+		{"The Hedge Knight (Dunk and Egg, Book 1)", "The Hedge Knight", "Dunk and Egg", 1},
+		{"Mort (Discworld, vol. 4)", "Mort", "Discworld", 4},
+		{"Dune  ( Dune Chronicles  #1 )", "Dune", "Dune Chronicles", 1},
+	} {
+		title, e, ok := parseSeriesTitle(tc.in)
+		if !ok || title != tc.title || e.Name != tc.series || e.Number != tc.number {
+			t.Errorf("parseSeriesTitle(%q): got %q, %+v, %v", tc.in, title, e, ok)
+		}
+	}
+	for _, in := range []string{"Dust (Book 3)", "Catch-22", "Dune (1965)", "Volume 3 (Revised)"} {
+		if title, e, ok := parseSeriesTitle(in); ok {
+			t.Errorf("parseSeriesTitle(%q): got %q, %+v, want no series", in, title, e)
+		}
+	}
+}
+
+func TestNormalizeSeries(t *testing.T) {
+	if e, err := normalizeSeries(&SeriesEntry{Name: "  The   Expanse ", Number: 2.50001}); err != nil || e.Name != "The Expanse" || e.NumberString() != "2.5" {
+		t.Errorf("normalizeSeries: got %+v, %v", e, err)
+	}
+	if e, err := normalizeSeries(&SeriesEntry{Name: " "}); err != nil || e != nil {
+		t.Errorf("normalizeSeries of a blank name: got %+v, %v, want nil", e, err)
+	}
+	for _, e := range []*SeriesEntry{{Number: 1}, {Name: "X", Number: -1}, {Name: "X", Number: maxSeriesNumber + 1}} {
+		if _, err := normalizeSeries(e); !errors.Is(err, errBadSeries) {
+			t.Errorf("normalizeSeries(%+v): got %v, want errBadSeries", e, err)
+		}
+	}
+}
+
+func TestSeriesPages(t *testing.T) {
+	bs, srv := newTestBookshelf(t)
+
+	get := func(path string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	post := func(form url.Values) int {
+		t.Helper()
+		resp, err := http.PostForm(srv.URL+"/books", form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for _, v := range []struct{ title, number string }{
+		{"Leviathan Wakes", "1"},
+		{"Caliban's War", "2"},
+		{"Gods of Risk", "2.5"},
+		{"Abaddon's Gate", "3"},
+	} {
+		code := post(url.Values{"title": {v.title}, "seriesName": {"The Expanse"}, "seriesNumber": {v.number}})
+		if code != http.StatusOK {
+			t.Fatalf("adding %s: got status %d", v.title, code)
+		}
+	}
+	for _, form := range []url.Values{
+		{"title": {"Bad"}, "seriesName": {"The Expanse"}, "seriesNumber": {"two"}},
+		{"title": {"Bad"}, "seriesNumber": {"2"}},
+	} {
+		if code := post(form); code != http.StatusBadRequest {
+			t.Errorf("%v: got status %d, want 400", form, code)
+		}
+	}
+
+	series, _ := bs.Series.ListSeries()
+	if len(series) != 1 {
+		t.Fatalf("got series %+v, want The Expanse", series)
+	}
+	code, body := get(fmt.Sprintf("/series/%d", series[0].ID))
+	if code != http.StatusOK {
+		t.Fatalf("series page: got status %d", code)
+	}
+	last := -1
+	for _, v := range []string{"#1", "#2", "#2.5", "#3"} {
+		i := strings.Index(body, `<span class="series-number">`+v+`</span>`)
+		if i < last {
+			t.Errorf("series page: volume %s missing or out of order", v)
+		}
+		last = i
+	}
+	if code, _ := get("/series/999"); code != http.StatusNotFound {
+		t.Errorf("unknown series: got status %d, want 404", code)
+	}
+	if _, body := get("/series"); !strings.Contains(body, "The Expanse") {
+		t.Errorf("series list:\n%s", body)
+	}
+
+	// Gods of Risk is book 3, between books 2 and 4.
+	_, body = get("/books/3")
+	for _, want := range []string{
+		fmt.Sprintf(`Book 2.5 of <a href="/series/%d">The Expanse</a>`, series[0].ID),
+		`<a href="/books/2" rel="prev">`,
+		`<a href="/books/4" rel="next">`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("detail page: want %s", want)
+		}
+	}
+	if _, body := get("/books/1"); strings.Contains(body, `rel="prev"`) || !strings.Contains(body, `<a href="/books/2" rel="next">`) {
+		t.Error("detail page of the first volume: want a link to the next one only")
+	}
+	if _, body := get("/books/3/edit"); !strings.Contains(body, `value="The Expanse"`) || !strings.Contains(body, `value="2.5"`) {
+		t.Error("edit form does not show the series")
+	}
+
+	// Taking the book out of the series.
+	resp, err := http.PostForm(srv.URL+"/books/3", url.Values{"title": {"Gods of Risk"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if e, _ := bs.Series.BookSeries(3); e != nil {
+		t.Errorf("after clearing the series: got %+v", e)
+	}
+}
+
+func TestCLISeries(t *testing.T) {
+	c := newCLI(t)
+	c.mustRun("books", "add", "-title", "Wool", "-series", "Silo", "-series-number", "1")
+	c.mustRun("books", "add", "-title", "Dust (Silo, #3)")
+	c.mustRun("books", "add", "-title", "Shift (Book 2)")
+	if code, _, _ := c.run("books", "add", "-title", "Bad", "-series-number", "2"); code != exitUsage {
+		t.Errorf("books add -series-number without -series: got exit code %d, want %d", code, exitUsage)
+	}
+
+	var report titleConversion
+	out := c.mustRun("series", "convert-titles", "-dry-run")
+	if err := json.Unmarshal([]byte(out), &report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Converted) != 1 || report.Converted[0].Title != "Dust" || len(report.Unconverted) != 1 {
+		t.Errorf("convert-titles -dry-run: got %s", out)
+	}
+	if book, _ := c.bs.DB.GetBook(2); book.Title != "Dust (Silo, #3)" {
+		t.Errorf("convert-titles -dry-run changed the title to %q", book.Title)
+	}
+	c.mustRun("series", "convert-titles")
+	if book, _ := c.bs.DB.GetBook(2); book.Title != "Dust" {
+		t.Errorf("convert-titles: got title %q", book.Title)
+	}
+
+	out = c.mustRun("series", "get", "1")
+	if strings.Count(out, "\n") != 2 || !strings.HasPrefix(out, `{"number":1,"id":1,"title":"Wool"}`) {
+		t.Errorf("series get: got %q", out)
+	}
+
+	// Series survive an export and import.
+	file := filepath.Join(t.TempDir(), "books.jsonl")
+	if err := ioutil.WriteFile(file, []byte(c.mustRun("export")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	other := newCLI(t)
+	other.mustRun("import", file)
+	if e, _ := other.bs.Series.BookSeries(2); e == nil || e.Name != "Silo" || e.Number != 3 {
+		t.Errorf("after import: got series %+v", e)
+	}
+
+	c.mustRun("series", "rename", "1", "Silo Saga")
+	if out := c.mustRun("series", "list"); !strings.Contains(out, "Silo Saga") {
+		t.Errorf("series list after rename: got %q", out)
+	}
+}
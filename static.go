@@ -0,0 +1,137 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// staticFiles are the stylesheets and images of the UI, served under
+// /static/ so that it works without access to the internet.
+//
+//go:embed static
+var staticFiles embed.FS
+
+const staticPrefix = "/static/"
+
+// staticAssets serves files under fingerprinted names, which contain a hash
+// of their content and can thus be cached forever.
+type staticAssets struct {
+	files fs.FS
+	// paths maps from the name of a file, e.g. css/bookshelf.css, to its
+	// fingerprinted name, e.g. css/bookshelf.0123456789.css.
+	paths map[string]string
+	// names maps back from fingerprinted names.
+	names map[string]string
+}
+
+// assets are the embedded static files.
+var assets = mustStaticAssets(staticFiles, "static")
+
+// newStaticAssets fingerprints the files below dir of files.
+func newStaticAssets(files fs.FS, dir string) (*staticAssets, error) {
+	sub, err := fs.Sub(files, dir)
+	if err != nil {
+		return nil, err
+	}
+	a := &staticAssets{
+		files: sub,
+		paths: make(map[string]string),
+		names: make(map[string]string),
+	}
+	err = fs.WalkDir(sub, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(sub, name)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		ext := path.Ext(name)
+		fingerprinted := strings.TrimSuffix(name, ext) + "." + hex.EncodeToString(sum[:5]) + ext
+		a.paths[name] = fingerprinted
+		a.names[fingerprinted] = name
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("static: %v", err)
+	}
+	return a, nil
+}
+
+func mustStaticAssets(files fs.FS, dir string) *staticAssets {
+	a, err := newStaticAssets(files, dir)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+// URL returns the fingerprinted URL of the named file.
+func (a *staticAssets) URL(name string) (string, error) {
+	p, ok := a.paths[name]
+	if !ok {
+		return "", fmt.Errorf("static: no file %q", name)
+	}
+	return staticPrefix + p, nil
+}
+
+var iconName = regexp.MustCompile(`^[a-z-]+$`)
+
+// icon returns an inline <svg> showing the named symbol of img/icons.svg.
+func (a *staticAssets) icon(name string) (template.HTML, error) {
+	if !iconName.MatchString(name) {
+		return "", fmt.Errorf("static: bad icon name %q", name)
+	}
+	sprite, err := a.URL("img/icons.svg")
+	if err != nil {
+		return "", err
+	}
+	return template.HTML(fmt.Sprintf(`<svg class="icon" aria-hidden="true"><use href="%s#%s"></use></svg>`, sprite, name)), nil
+}
+
+// ServeHTTP serves the files. Fingerprinted names are cached for a year,
+// plain names are revalidated on every use.
+func (a *staticAssets) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, staticPrefix)
+	cacheControl := immutableCacheControl
+	if n, ok := a.names[name]; ok {
+		name = n
+	} else if _, ok := a.paths[name]; ok {
+		cacheControl = "no-cache"
+	} else {
+		http.NotFound(w, r)
+		return
+	}
+	data, err := fs.ReadFile(a.files, name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Cache-Control", cacheControl)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(data))
+}
@@ -0,0 +1,65 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The author picker of templates/edit.html: suggests known authors while
+// typing names, from /authors.json, and adds rows for more authors. The
+// form works without it, with a few blank rows.
+(function () {
+  'use strict';
+
+  var fieldset = document.getElementById('authors');
+  var list = document.getElementById('author-suggestions');
+  if (!fieldset || !list) {
+    return;
+  }
+
+  var timer, last;
+  function suggest(input) {
+    var q = input.value.trim();
+    if (q === '' || q === last) {
+      return;
+    }
+    last = q;
+    fetch('/authors.json?q=' + encodeURIComponent(q), {headers: {'Accept': 'application/json'}})
+      .then(function (resp) { return resp.ok ? resp.json() : []; })
+      .then(function (authors) {
+        list.textContent = '';
+        authors.forEach(function (a) {
+          var option = document.createElement('option');
+          option.value = a.name;
+          list.appendChild(option);
+        });
+      })
+      .catch(function () {});
+  }
+
+  fieldset.addEventListener('input', function (e) {
+    if (!e.target.hasAttribute('data-author-suggest')) {
+      return;
+    }
+    clearTimeout(timer);
+    timer = setTimeout(suggest, 200, e.target);
+  });
+
+  var add = fieldset.querySelector('[data-add-author]');
+  add.hidden = false;
+  add.addEventListener('click', function () {
+    var rows = fieldset.querySelectorAll('.author-row');
+    var row = rows[rows.length - 1].cloneNode(true);
+    row.querySelector('input').value = '';
+    row.querySelector('select').selectedIndex = 0;
+    add.parentNode.insertBefore(row, add);
+    row.querySelector('input').focus();
+  });
+})();
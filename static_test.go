@@ -0,0 +1,99 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestStaticAssets(t *testing.T) {
+	a, err := newStaticAssets(fstest.MapFS{
+		"static/css/site.css": {Data: []byte("body {}")},
+		"static/logo.svg":     {Data: []byte("<svg/>")},
+	}, "static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := a.URL("css/site.css")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^/static/css/site\.[0-9a-f]{10}\.css$`).MatchString(u) {
+		t.Errorf("got URL %s, want a fingerprinted one", u)
+	}
+	if _, err := a.URL("missing.css"); err == nil {
+		t.Error("URL of missing file: want non-nil err")
+	}
+
+	// The fingerprint changes with the content.
+	b, _ := newStaticAssets(fstest.MapFS{
+		"static/css/site.css": {Data: []byte("body { color: red }")},
+	}, "static")
+	if u2, _ := b.URL("css/site.css"); u2 == u {
+		t.Errorf("fingerprint did not change with the content: %s", u2)
+	}
+}
+
+func TestServeStatic(t *testing.T) {
+	_, srv := newTestBookshelf(t)
+
+	get := func(path string) (*http.Response, string) {
+		t.Helper()
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(body)
+	}
+
+	_, page := get("/books")
+	for _, host := range []string{"maxcdn", "placekitten", "https://"} {
+		if strings.Contains(page, host) {
+			t.Errorf("page refers to %s:\n%s", host, page)
+		}
+	}
+	css, err := assets.URL("css/bookshelf.css")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(page, css) {
+		t.Errorf("page does not use %s:\n%s", css, page)
+	}
+
+	resp, body := get(css)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, ".navbar") {
+		t.Fatalf("%s: got status %d", css, resp.StatusCode)
+	}
+	if got := resp.Header.Get("Content-Type"); !strings.HasPrefix(got, "text/css") {
+		t.Errorf("got Content-Type %q, want text/css", got)
+	}
+	if got := resp.Header.Get("Cache-Control"); got != immutableCacheControl {
+		t.Errorf("fingerprinted: got Cache-Control %q", got)
+	}
+
+	resp, _ = get("/static/css/bookshelf.css")
+	if got := resp.Header.Get("Cache-Control"); resp.StatusCode != http.StatusOK || got != "no-cache" {
+		t.Errorf("plain name: got status %d and Cache-Control %q", resp.StatusCode, got)
+	}
+	if resp, _ := get("/static/css/bookshelf.0000000000.css"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("stale fingerprint: got status %d, want 404", resp.StatusCode)
+	}
+}
@@ -15,42 +15,87 @@
 package main
 
 import (
+	"embed"
 	"fmt"
 	"html/template"
-	"io/ioutil"
+	"io/fs"
 	"net/http"
-	"path/filepath"
+	"os"
 )
 
-// parseTemplate applies a given file to the body of the base template.
+// templateFuncs are available to all templates.
+var templateFuncs = template.FuncMap{
+	// static returns the URL of a file of the static directory.
+	"static": assets.URL,
+	// icon shows an icon of static/img/icons.svg.
+	"icon": assets.icon,
+}
+
+// templateFiles are the templates built into the binary.
+//
+//go:embed templates
+var templateFiles embed.FS
+
+// parseTemplate applies a given file of the embedded templates to the body
+// of the base template.
 func parseTemplate(filename string) *appTemplate {
-	tmpl := template.Must(template.ParseFiles("templates/base.html"))
+	files, err := fs.Sub(templateFiles, "templates")
+	if err != nil {
+		panic(err)
+	}
+	t, err := parseTemplateFS(files, filename)
+	if err != nil {
+		panic(err)
+	}
+	return &appTemplate{t: t, filename: filename}
+}
 
-	// Put the named file into a template called "body"
-	path := filepath.Join("templates", filename)
-	b, err := ioutil.ReadFile(path)
+// parseTemplateFS applies filename of files to the body of base.html.
+func parseTemplateFS(files fs.FS, filename string) (*template.Template, error) {
+	tmpl, err := template.New("base.html").Funcs(templateFuncs).ParseFS(files, "base.html")
 	if err != nil {
-		panic(fmt.Errorf("could not read template: %v", err))
+		return nil, fmt.Errorf("could not parse base template: %v", err)
 	}
-	template.Must(tmpl.New("body").Parse(string(b)))
 
-	return &appTemplate{tmpl.Lookup("base.html")}
+	// Put the named file into a template called "body"
+	b, err := fs.ReadFile(files, filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not read template: %v", err)
+	}
+	if _, err := tmpl.New("body").Parse(string(b)); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %v", filename, err)
+	}
+	return tmpl.Lookup("base.html"), nil
 }
 
 // appTemplate is an appError-aware wrapper for a html/template.
 type appTemplate struct {
-	t *template.Template
+	t        *template.Template
+	filename string
 }
 
 // Execute writes the template using the provided data.
 func (tmpl *appTemplate) Execute(b *Bookshelf, w http.ResponseWriter, r *http.Request, data interface{}) *appError {
 	d := struct {
-		Data interface{}
+		Data        interface{}
+		User        *User
+		AuthEnabled bool
 	}{
-		Data: data,
+		Data:        data,
+		User:        currentUser(r),
+		AuthEnabled: b.authEnabled(),
 	}
 
-	if err := tmpl.t.Execute(w, d); err != nil {
+	t := tmpl.t
+	if b.templateDir != "" {
+		// Read the template again on every request, to see changes made
+		// during development without a restart.
+		var err error
+		if t, err = parseTemplateFS(os.DirFS(b.templateDir), tmpl.filename); err != nil {
+			return b.appErrorf(r, err, "%v", err)
+		}
+	}
+	if err := t.Execute(w, d); err != nil {
 		return b.appErrorf(r, err, "could not write template: %v", err)
 	}
 	return nil
@@ -0,0 +1,59 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTemplateDir(t *testing.T) {
+	bs, srv := newTestBookshelf(t)
+	dir := t.TempDir()
+	bs.templateDir = dir
+
+	write := func(name, content string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func() (int, string) {
+		resp, err := http.Get(srv.URL + "/books")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode, string(body)
+	}
+
+	write("base.html", `<main>{{template "body" .Data}}</main>`)
+	write("list.html", `first`)
+	if code, body := get(); code != http.StatusOK || body != "<main>first</main>" {
+		t.Errorf("got %d %q", code, body)
+	}
+	// Changes show up without a restart.
+	write("list.html", `second {{static "css/bookshelf.css"}}`)
+	if _, body := get(); !strings.HasPrefix(body, "<main>second /static/css/bookshelf.") {
+		t.Errorf("got %q after editing the template", body)
+	}
+
+	write("list.html", `{{.Broken`)
+	if code, _ := get(); code != http.StatusInternalServerError {
+		t.Errorf("broken template: got status %d, want 500", code)
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// imageSize is a width covers are resized to, in addition to the original.
+type imageSize struct {
+	Name  string
+	Width int
+}
+
+// defaultImageSizes are the sizes generated for every cover.
+var defaultImageSizes = []imageSize{
+	{Name: "thumb", Width: 160},
+	{Name: "detail", Width: 400},
+}
+
+// parseImageSizes parses "name:width,name:width", e.g. "thumb:160,detail:400".
+func parseImageSizes(s string) ([]imageSize, error) {
+	var sizes []imageSize
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.Split(strings.TrimSpace(pair), ":")
+		if len(parts) != 2 || parts[0] == "" || parts[0] == "original" {
+			return nil, fmt.Errorf("bad image size %q, want name:width", pair)
+		}
+		w, err := strconv.Atoi(parts[1])
+		if err != nil || w <= 0 {
+			return nil, fmt.Errorf("bad width in image size %q", pair)
+		}
+		sizes = append(sizes, imageSize{Name: parts[0], Width: w})
+	}
+	sort.Slice(sizes, func(i, j int) bool {
+		return sizes[i].Width < sizes[j].Width
+	})
+	return sizes, nil
+}
+
+// variantName returns the object name of a resized variant of the original
+// stored as name. Variants of images which may be transparent are PNG, all
+// others are JPEG.
+func variantName(name, size string) string {
+	ext := path.Ext(name)
+	v := strings.TrimSuffix(name, ext) + "_" + size
+	switch ext {
+	case ".png", ".gif", ".webp":
+		return v + ".png"
+	}
+	return v + ".jpg"
+}
+
+// resize scales img down to width, keeping its aspect ratio. Images which
+// are narrow enough already are returned as is.
+func resize(img image.Image, width int) image.Image {
+	b := img.Bounds()
+	if b.Dx() <= width {
+		return img
+	}
+	height := b.Dy() * width / b.Dx()
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+	return dst
+}
+
+// encodeVariant encodes a resized image for the object name.
+func encodeVariant(img image.Image, name string) (data []byte, contentType string, err error) {
+	var buf bytes.Buffer
+	if path.Ext(name) == ".png" {
+		err = png.Encode(&buf, img)
+		contentType = "image/png"
+	} else {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85})
+		contentType = "image/jpeg"
+	}
+	return buf.Bytes(), contentType, err
+}
+
+// putVariants stores the resized variants of the original stored as name.
+func (b *Bookshelf) putVariants(ctx context.Context, name string, img image.Image) error {
+	for _, size := range b.imageSizes {
+		vname := variantName(name, size.Name)
+		data, contentType, err := encodeVariant(resize(img, size.Width), vname)
+		if err != nil {
+			return fmt.Errorf("could not encode %s: %v", vname, err)
+		}
+		if _, err := b.Images.Put(ctx, vname, contentType, data); err != nil {
+			return fmt.Errorf("could not store %s: %v", vname, err)
+		}
+	}
+	return nil
+}
+
+// cover holds the URLs a book cover is available at.
+type cover struct {
+	Original string
+	sizes    map[string]string // maps from size name to URL.
+	srcset   string
+}
+
+// URL returns the URL of the cover in the named size, falling back to the
+// original for covers which are not kept in the image store.
+func (c cover) URL(size string) string {
+	if u, ok := c.sizes[size]; ok {
+		return u
+	}
+	return c.Original
+}
+
+// SrcSet returns the resized variants for the srcset attribute of <img>.
+func (c cover) SrcSet() string {
+	return c.srcset
+}
+
+// coverOf returns the cover URLs of book.
+func (b *Bookshelf) coverOf(book *Book) cover {
+	c := cover{Original: book.ImageURL}
+	if book.ImageURL == "" || b.Images == nil {
+		return c
+	}
+	name, ok := b.Images.Name(book.ImageURL)
+	if !ok {
+		return c
+	}
+	c.sizes = make(map[string]string)
+	var srcset []string
+	for _, size := range b.imageSizes {
+		u := b.Images.URL(variantName(name, size.Name))
+		c.sizes[size.Name] = u
+		srcset = append(srcset, fmt.Sprintf("%s %dw", u, size.Width))
+	}
+	c.srcset = strings.Join(srcset, ", ")
+	return c
+}
+
+// bookView is a Book as shown by the list and detail pages.
+type bookView struct {
+	*Book
+	Cover cover
+}
+
+func (b *Bookshelf) viewOf(book *Book) bookView {
+	return bookView{Book: book, Cover: b.coverOf(book)}
+}
+
+// backfillThumbnails generates the resized variants of every cover in the
+// image store, for books uploaded before the current sizes were configured.
+func (b *Bookshelf) backfillThumbnails(ctx context.Context, logf func(format string, v ...interface{})) error {
+	if b.Images == nil {
+		return errNoImageStore
+	}
+	books, err := b.DB.ListBooks()
+	if err != nil {
+		return err
+	}
+	var failed int
+	for _, book := range books {
+		name, ok := b.Images.Name(book.ImageURL)
+		if !ok {
+			continue
+		}
+		data, err := b.Images.Get(ctx, name)
+		if err != nil {
+			logf("book %d: %v", book.ID, err)
+			failed++
+			continue
+		}
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			logf("book %d: could not decode %s: %v", book.ID, name, err)
+			failed++
+			continue
+		}
+		if err := b.putVariants(ctx, name, img); err != nil {
+			logf("book %d: %v", book.ID, err)
+			failed++
+			continue
+		}
+		logf("book %d: resized %s", book.ID, name)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d covers could not be resized", failed)
+	}
+	return nil
+}
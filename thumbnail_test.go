@@ -0,0 +1,190 @@
+// Copyright 2019 Toshiki kawai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"image"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// postBook adds a book with a cover through the form of srvURL.
+func postBook(t *testing.T, srvURL, title, filename string, cover []byte) *http.Response {
+	t.Helper()
+
+	var body bytes.Buffer
+	m := multipart.NewWriter(&body)
+	m.WriteField("title", title)
+	if cover != nil {
+		fw, _ := m.CreateFormFile("image", filename)
+		fw.Write(cover)
+	}
+	m.Close()
+
+	resp, err := http.Post(srvURL+"/books", m.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func imageWidth(t *testing.T, store ImageStore, name string) int {
+	t.Helper()
+	data, err := store.Get(context.Background(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg.Width
+}
+
+func TestUploadStoresVariants(t *testing.T) {
+	bs, srv := newTestBookshelf(t)
+
+	resp := postBook(t, srv.URL, "covered", "cover.png", encodePNG(t, 800, 600))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want 200", resp.StatusCode)
+	}
+
+	books, err := bs.DB.ListBooks()
+	if err != nil || len(books) != 1 {
+		t.Fatalf("ListBooks: got %d books, %v", len(books), err)
+	}
+	name, ok := bs.Images.Name(books[0].ImageURL)
+	if !ok || !strings.HasSuffix(name, ".png") {
+		t.Fatalf("cover %q is not in the image store", books[0].ImageURL)
+	}
+
+	if got := imageWidth(t, bs.Images, name); got != 800 {
+		t.Errorf("original: got width %d, want 800", got)
+	}
+	for _, size := range defaultImageSizes {
+		if got := imageWidth(t, bs.Images, variantName(name, size.Name)); got != size.Width {
+			t.Errorf("%s: got width %d, want %d", size.Name, got, size.Width)
+		}
+	}
+
+	resp, err = http.Get(srv.URL + "/books")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	thumb := bs.Images.URL(variantName(name, "thumb"))
+	if !strings.Contains(string(body), `src="`+thumb+`"`) || !strings.Contains(string(body), "srcset=") {
+		t.Errorf("list page does not use the thumbnail %s:\n%s", thumb, body)
+	}
+
+	resp, err = http.Get(srv.URL + thumb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get("Content-Type"); got != "image/png" {
+		t.Errorf("thumbnail served as %q, want image/png", got)
+	}
+}
+
+func TestTransparentWebPVariants(t *testing.T) {
+	bs, srv := newTestBookshelf(t)
+
+	// tinyWebP is a single transparent pixel.
+	webp, err := base64.StdEncoding.DecodeString(tinyWebP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := postBook(t, srv.URL, "transparent", "cover.webp", webp)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want 200", resp.StatusCode)
+	}
+	books, err := bs.DB.ListBooks()
+	if err != nil || len(books) != 1 {
+		t.Fatalf("ListBooks: got %d books, %v", len(books), err)
+	}
+	name, ok := bs.Images.Name(books[0].ImageURL)
+	if !ok || !strings.HasSuffix(name, ".webp") {
+		t.Fatalf("cover %q is not a WebP in the image store", books[0].ImageURL)
+	}
+	for _, size := range defaultImageSizes {
+		vname := variantName(name, size.Name)
+		data, err := bs.Images.Get(context.Background(), vname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, format, err := image.Decode(bytes.NewReader(data))
+		if err != nil || format != "png" {
+			t.Fatalf("%s: got format %q, %v, want png", vname, format, err)
+		}
+		if _, _, _, a := img.At(0, 0).RGBA(); a != 0 {
+			t.Errorf("%s: got alpha %d, want the pixel transparent", vname, a)
+		}
+	}
+}
+
+func TestBackfillThumbnails(t *testing.T) {
+	bs, _ := newTestBookshelf(t)
+	ctx := context.Background()
+
+	url, err := bs.Images.Put(ctx, "old.jpg", "image/jpeg", encodeJPEG(t, 500, 700))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bs.DB.AddBook(&Book{Title: "old", ImageURL: url}); err != nil {
+		t.Fatal(err)
+	}
+	// Covers hosted elsewhere are left alone.
+	if _, err := bs.DB.AddBook(&Book{Title: "hotlinked", ImageURL: "https://example.com/a.jpg"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var log bytes.Buffer
+	err = bs.backfillThumbnails(ctx, func(format string, v ...interface{}) {
+		log.WriteString(format + "\n")
+	})
+	if err != nil {
+		t.Fatalf("backfillThumbnails: %v\n%s", err, log.String())
+	}
+	if got := imageWidth(t, bs.Images, "old_thumb.jpg"); got != 160 {
+		t.Errorf("thumb: got width %d, want 160", got)
+	}
+	if got := imageWidth(t, bs.Images, "old_detail.jpg"); got != 400 {
+		t.Errorf("detail: got width %d, want 400", got)
+	}
+}
+
+func TestParseImageSizes(t *testing.T) {
+	sizes, err := parseImageSizes("detail:400, thumb:160")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sizes) != 2 || sizes[0] != (imageSize{"thumb", 160}) || sizes[1] != (imageSize{"detail", 400}) {
+		t.Errorf("got %+v", sizes)
+	}
+	for _, s := range []string{"thumb", "thumb:0", "original:100", ":100"} {
+		if _, err := parseImageSizes(s); err == nil {
+			t.Errorf("parseImageSizes(%q): want non-nil err", s)
+		}
+	}
+}